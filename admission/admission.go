@@ -0,0 +1,265 @@
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bbs"
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/runtimeschema/metric"
+	"code.cloudfoundry.org/stager/prometheus_metrics"
+)
+
+const (
+	// Staging error id reported to CC when a request is turned away
+	STAGING_LIMIT_EXCEEDED = "StagingLimitExceeded"
+
+	DefaultRetryAfterSeconds = 30
+	DefaultRebuildInterval   = 30 * time.Second
+
+	// Metrics
+	inFlightMetric = metric.Metric("StagingTasksInFlight")
+)
+
+// Limits caps the number of in-flight staging tasks. A zero limit is
+// unlimited.
+type Limits struct {
+	MaxInFlight                    int `json:"max_in_flight"`
+	MaxInFlightPerIsolationSegment int `json:"max_in_flight_per_isolation_segment"`
+	MaxInFlightPerApp              int `json:"max_in_flight_per_app"`
+	RetryAfterSeconds              int `json:"retry_after_in_seconds"`
+	RebuildIntervalSeconds         int `json:"rebuild_interval_in_seconds"`
+}
+
+func (l Limits) Enabled() bool {
+	return l.MaxInFlight > 0 || l.MaxInFlightPerIsolationSegment > 0 || l.MaxInFlightPerApp > 0
+}
+
+// RebuildInterval is how often the in-flight accounting is rebuilt from the
+// BBS.
+func (l Limits) RebuildInterval() time.Duration {
+	if l.RebuildIntervalSeconds <= 0 {
+		return DefaultRebuildInterval
+	}
+	return time.Duration(l.RebuildIntervalSeconds) * time.Second
+}
+
+type LimitExceededError struct {
+	Scope string
+	Limit int
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("too many staging tasks in flight: %s limit of %d reached", e.Scope, e.Limit)
+}
+
+//go:generate counterfeiter -o fakes/fake_controller.go . Controller
+type Controller interface {
+	// Admit records a staging task as in flight, or returns a
+	// *LimitExceededError if doing so would exceed a limit. Admitting a guid
+	// that is already in flight always succeeds.
+	Admit(stagingGuid, appId, isolationSegment string) error
+	Release(stagingGuid string)
+	RetryAfterSeconds() int
+	InFlight() int
+	// Rebuild replaces the in-flight accounting with the staging tasks the
+	// BBS has not yet completed. Tasks admitted or released while the BBS is
+	// being queried are carried over.
+	Rebuild(logger lager.Logger, bbsClient bbs.Client) error
+}
+
+type task struct {
+	appId            string
+	isolationSegment string
+}
+
+type controller struct {
+	logger lager.Logger
+	limits Limits
+
+	lock       sync.Mutex
+	inFlight   map[string]task
+	perSegment map[string]int
+	perApp     map[string]int
+
+	// admitted and released record the changes made while a rebuild is
+	// fetching tasks from the BBS, so that the rebuild does not discard them.
+	rebuildLock sync.Mutex
+	admitted    map[string]task
+	released    map[string]struct{}
+}
+
+func New(logger lager.Logger, limits Limits) Controller {
+	if limits.RetryAfterSeconds <= 0 {
+		limits.RetryAfterSeconds = DefaultRetryAfterSeconds
+	}
+
+	return &controller{
+		logger:     logger.Session("admission"),
+		limits:     limits,
+		inFlight:   map[string]task{},
+		perSegment: map[string]int{},
+		perApp:     map[string]int{},
+	}
+}
+
+func (c *controller) Admit(stagingGuid, appId, isolationSegment string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.inFlight[stagingGuid]; ok {
+		return nil
+	}
+
+	if c.limits.MaxInFlight > 0 && len(c.inFlight) >= c.limits.MaxInFlight {
+		return &LimitExceededError{Scope: "global", Limit: c.limits.MaxInFlight}
+	}
+
+	if c.limits.MaxInFlightPerIsolationSegment > 0 && c.perSegment[isolationSegment] >= c.limits.MaxInFlightPerIsolationSegment {
+		return &LimitExceededError{Scope: "isolation segment", Limit: c.limits.MaxInFlightPerIsolationSegment}
+	}
+
+	if c.limits.MaxInFlightPerApp > 0 && c.perApp[appId] >= c.limits.MaxInFlightPerApp {
+		return &LimitExceededError{Scope: "app", Limit: c.limits.MaxInFlightPerApp}
+	}
+
+	t := task{appId: appId, isolationSegment: isolationSegment}
+	c.add(stagingGuid, t)
+	if c.admitted != nil {
+		c.admitted[stagingGuid] = t
+	}
+	c.emitInFlight(len(c.inFlight))
+
+	return nil
+}
+
+func (c *controller) Release(stagingGuid string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.released != nil {
+		delete(c.admitted, stagingGuid)
+		c.released[stagingGuid] = struct{}{}
+	}
+
+	t, ok := c.inFlight[stagingGuid]
+	if !ok {
+		return
+	}
+
+	delete(c.inFlight, stagingGuid)
+	decrement(c.perSegment, t.isolationSegment)
+	decrement(c.perApp, t.appId)
+	c.emitInFlight(len(c.inFlight))
+}
+
+func (c *controller) RetryAfterSeconds() int {
+	return c.limits.RetryAfterSeconds
+}
+
+func (c *controller) InFlight() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.inFlight)
+}
+
+func (c *controller) Rebuild(logger lager.Logger, bbsClient bbs.Client) error {
+	logger = logger.Session("rebuild-admission")
+
+	c.rebuildLock.Lock()
+	defer c.rebuildLock.Unlock()
+
+	c.lock.Lock()
+	c.admitted = map[string]task{}
+	c.released = map[string]struct{}{}
+	c.lock.Unlock()
+
+	tasks, err := bbsClient.TasksByDomain(logger, cc_messages.StagingTaskDomain)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	admitted, released := c.admitted, c.released
+	c.admitted = nil
+	c.released = nil
+
+	if err != nil {
+		logger.Error("failed-to-fetch-tasks", err)
+		return err
+	}
+
+	c.inFlight = map[string]task{}
+	c.perSegment = map[string]int{}
+	c.perApp = map[string]int{}
+
+	for _, bbsTask := range tasks {
+		if bbsTask.State == models.Task_Completed || bbsTask.State == models.Task_Resolving {
+			continue
+		}
+		if _, ok := released[bbsTask.TaskGuid]; ok {
+			continue
+		}
+		c.add(bbsTask.TaskGuid, taskFromDefinition(bbsTask.TaskDefinition))
+	}
+
+	for stagingGuid, t := range admitted {
+		if _, ok := c.inFlight[stagingGuid]; !ok {
+			c.add(stagingGuid, t)
+		}
+	}
+
+	logger.Info("rebuilt", lager.Data{"in-flight": len(c.inFlight)})
+	c.emitInFlight(len(c.inFlight))
+
+	return nil
+}
+
+func (c *controller) add(stagingGuid string, t task) {
+	c.inFlight[stagingGuid] = t
+	c.perSegment[t.isolationSegment]++
+	c.perApp[t.appId]++
+}
+
+func (c *controller) emitInFlight(inFlight int) {
+	prometheus_metrics.StagingTasksInFlight.Set(float64(inFlight))
+	err := inFlightMetric.Send(inFlight)
+	if err != nil {
+		c.logger.Error("failed-to-send-in-flight-metric", err)
+	}
+}
+
+// taskFromDefinition recovers the accounting keys of a task desired by the
+// backends, which use the app guid as log guid and record the isolation
+// segment in the annotation. Tasks desired before the annotation carried it
+// have the isolation segment as their only placement tag.
+func taskFromDefinition(definition *models.TaskDefinition) task {
+	if definition == nil {
+		return task{}
+	}
+
+	t := task{appId: definition.LogGuid}
+
+	var annotation struct {
+		IsolationSegment *string `json:"isolation_segment"`
+	}
+	err := json.Unmarshal([]byte(definition.Annotation), &annotation)
+	if err == nil && annotation.IsolationSegment != nil {
+		t.isolationSegment = *annotation.IsolationSegment
+	} else if len(definition.PlacementTags) > 0 {
+		t.isolationSegment = definition.PlacementTags[0]
+	}
+
+	return t
+}
+
+func decrement(counts map[string]int, key string) {
+	counts[key]--
+	if counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
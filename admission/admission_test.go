@@ -0,0 +1,193 @@
+package admission_test
+
+import (
+	"errors"
+
+	"code.cloudfoundry.org/bbs/fake_bbs"
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/admission"
+	"github.com/cloudfoundry/dropsonde/metric_sender/fake"
+	"github.com/cloudfoundry/dropsonde/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Controller", func() {
+	var (
+		logger       *lagertest.TestLogger
+		metricSender *fake.FakeMetricSender
+		limits       admission.Limits
+		controller   admission.Controller
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		metricSender = fake.NewFakeMetricSender()
+		metrics.Initialize(metricSender, nil)
+
+		limits = admission.Limits{}
+	})
+
+	JustBeforeEach(func() {
+		controller = admission.New(logger, limits)
+	})
+
+	Context("without limits", func() {
+		It("admits everything", func() {
+			for _, guid := range []string{"a", "b", "c"} {
+				Expect(controller.Admit(guid, "app", "")).To(Succeed())
+			}
+			Expect(controller.InFlight()).To(Equal(3))
+		})
+
+		It("defaults the retry after", func() {
+			Expect(controller.RetryAfterSeconds()).To(Equal(admission.DefaultRetryAfterSeconds))
+		})
+	})
+
+	Context("with a global limit", func() {
+		BeforeEach(func() {
+			limits.MaxInFlight = 2
+			limits.RetryAfterSeconds = 5
+		})
+
+		It("turns away requests above the limit until a task is released", func() {
+			Expect(controller.Admit("a", "app-1", "")).To(Succeed())
+			Expect(controller.Admit("b", "app-2", "")).To(Succeed())
+
+			err := controller.Admit("c", "app-3", "")
+			Expect(err).To(Equal(&admission.LimitExceededError{Scope: "global", Limit: 2}))
+
+			controller.Release("a")
+			Expect(controller.Admit("c", "app-3", "")).To(Succeed())
+			Expect(controller.RetryAfterSeconds()).To(Equal(5))
+		})
+
+		It("always admits a guid that is already in flight", func() {
+			Expect(controller.Admit("a", "app-1", "")).To(Succeed())
+			Expect(controller.Admit("b", "app-2", "")).To(Succeed())
+			Expect(controller.Admit("a", "app-1", "")).To(Succeed())
+			Expect(controller.InFlight()).To(Equal(2))
+		})
+
+		It("emits the number of tasks in flight", func() {
+			Expect(controller.Admit("a", "app-1", "")).To(Succeed())
+			Expect(metricSender.GetValue("StagingTasksInFlight").Value).To(BeEquivalentTo(1))
+
+			controller.Release("a")
+			Expect(metricSender.GetValue("StagingTasksInFlight").Value).To(BeEquivalentTo(0))
+		})
+	})
+
+	Context("with an isolation segment limit", func() {
+		BeforeEach(func() {
+			limits.MaxInFlightPerIsolationSegment = 1
+		})
+
+		It("limits each segment separately", func() {
+			Expect(controller.Admit("a", "app-1", "segment-1")).To(Succeed())
+			Expect(controller.Admit("b", "app-2", "segment-2")).To(Succeed())
+
+			err := controller.Admit("c", "app-3", "segment-1")
+			Expect(err).To(Equal(&admission.LimitExceededError{Scope: "isolation segment", Limit: 1}))
+		})
+	})
+
+	Context("with a per app limit", func() {
+		BeforeEach(func() {
+			limits.MaxInFlightPerApp = 1
+		})
+
+		It("limits each app separately", func() {
+			Expect(controller.Admit("a", "app-1", "")).To(Succeed())
+			Expect(controller.Admit("b", "app-2", "")).To(Succeed())
+
+			err := controller.Admit("c", "app-1", "")
+			Expect(err).To(MatchError("too many staging tasks in flight: app limit of 1 reached"))
+		})
+	})
+
+	Describe("Rebuild", func() {
+		var fakeBBSClient *fake_bbs.FakeClient
+
+		BeforeEach(func() {
+			limits.MaxInFlightPerApp = 1
+			limits.MaxInFlightPerIsolationSegment = 1
+			fakeBBSClient = &fake_bbs.FakeClient{}
+			fakeBBSClient.TasksByDomainReturns([]*models.Task{
+				{
+					TaskGuid:       "running",
+					State:          models.Task_Running,
+					TaskDefinition: &models.TaskDefinition{LogGuid: "app-1", PlacementTags: []string{"segment-1"}},
+				},
+				{
+					TaskGuid: "tagged",
+					State:    models.Task_Pending,
+					TaskDefinition: &models.TaskDefinition{
+						LogGuid:       "app-4",
+						PlacementTags: []string{"staging-docker"},
+						Annotation:    `{"lifecycle":"docker","isolation_segment":""}`,
+					},
+				},
+				{
+					TaskGuid:       "completed",
+					State:          models.Task_Completed,
+					TaskDefinition: &models.TaskDefinition{LogGuid: "app-2"},
+				},
+			}, nil)
+		})
+
+		It("accounts for the staging tasks the BBS has not completed", func() {
+			Expect(controller.Admit("stale", "app-3", "")).To(Succeed())
+
+			Expect(controller.Rebuild(logger, fakeBBSClient)).To(Succeed())
+			Expect(fakeBBSClient.TasksByDomainCallCount()).To(Equal(1))
+			_, domain := fakeBBSClient.TasksByDomainArgsForCall(0)
+			Expect(domain).To(Equal(cc_messages.StagingTaskDomain))
+
+			Expect(controller.InFlight()).To(Equal(2))
+			Expect(controller.Admit("new", "app-1", "")).To(HaveOccurred())
+			Expect(controller.Admit("new", "app-2", "segment-1")).To(HaveOccurred())
+			Expect(controller.Admit("new", "app-2", "staging-docker")).To(Succeed())
+		})
+
+		It("keeps the tasks admitted while the BBS is queried", func() {
+			fakeBBSClient.TasksByDomainStub = func(lager.Logger, string) ([]*models.Task, error) {
+				Expect(controller.Admit("during", "app-3", "")).To(Succeed())
+				return nil, nil
+			}
+
+			Expect(controller.Rebuild(logger, fakeBBSClient)).To(Succeed())
+			Expect(controller.InFlight()).To(Equal(1))
+
+			controller.Release("during")
+			Expect(controller.InFlight()).To(Equal(0))
+		})
+
+		It("drops the tasks released while the BBS is queried", func() {
+			fakeBBSClient.TasksByDomainStub = func(lager.Logger, string) ([]*models.Task, error) {
+				controller.Release("running")
+				return []*models.Task{
+					{TaskGuid: "running", State: models.Task_Running, TaskDefinition: &models.TaskDefinition{LogGuid: "app-1"}},
+				}, nil
+			}
+
+			Expect(controller.Rebuild(logger, fakeBBSClient)).To(Succeed())
+			Expect(controller.InFlight()).To(Equal(0))
+		})
+
+		Context("when the BBS fails", func() {
+			BeforeEach(func() {
+				fakeBBSClient.TasksByDomainReturns(nil, errors.New("boom"))
+			})
+
+			It("returns the error", func() {
+				Expect(controller.Rebuild(logger, fakeBBSClient)).To(MatchError("boom"))
+			})
+		})
+	})
+})
@@ -0,0 +1,189 @@
+// This file was generated by counterfeiter
+package fakes
+
+import (
+	"sync"
+
+	"code.cloudfoundry.org/bbs"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/stager/admission"
+)
+
+type FakeController struct {
+	AdmitStub        func(stagingGuid, appId, isolationSegment string) error
+	admitMutex       sync.RWMutex
+	admitArgsForCall []struct {
+		stagingGuid      string
+		appId            string
+		isolationSegment string
+	}
+	admitReturns struct {
+		result1 error
+	}
+	ReleaseStub        func(stagingGuid string)
+	releaseMutex       sync.RWMutex
+	releaseArgsForCall []struct {
+		stagingGuid string
+	}
+	RetryAfterSecondsStub        func() int
+	retryAfterSecondsMutex       sync.RWMutex
+	retryAfterSecondsArgsForCall []struct{}
+	retryAfterSecondsReturns     struct {
+		result1 int
+	}
+	InFlightStub        func() int
+	inFlightMutex       sync.RWMutex
+	inFlightArgsForCall []struct{}
+	inFlightReturns     struct {
+		result1 int
+	}
+	RebuildStub        func(logger lager.Logger, bbsClient bbs.Client) error
+	rebuildMutex       sync.RWMutex
+	rebuildArgsForCall []struct {
+		logger    lager.Logger
+		bbsClient bbs.Client
+	}
+	rebuildReturns struct {
+		result1 error
+	}
+}
+
+func (fake *FakeController) Admit(stagingGuid string, appId string, isolationSegment string) error {
+	fake.admitMutex.Lock()
+	fake.admitArgsForCall = append(fake.admitArgsForCall, struct {
+		stagingGuid      string
+		appId            string
+		isolationSegment string
+	}{stagingGuid, appId, isolationSegment})
+	fake.admitMutex.Unlock()
+	if fake.AdmitStub != nil {
+		return fake.AdmitStub(stagingGuid, appId, isolationSegment)
+	} else {
+		return fake.admitReturns.result1
+	}
+}
+
+func (fake *FakeController) AdmitCallCount() int {
+	fake.admitMutex.RLock()
+	defer fake.admitMutex.RUnlock()
+	return len(fake.admitArgsForCall)
+}
+
+func (fake *FakeController) AdmitArgsForCall(i int) (string, string, string) {
+	fake.admitMutex.RLock()
+	defer fake.admitMutex.RUnlock()
+	return fake.admitArgsForCall[i].stagingGuid, fake.admitArgsForCall[i].appId, fake.admitArgsForCall[i].isolationSegment
+}
+
+func (fake *FakeController) AdmitReturns(result1 error) {
+	fake.AdmitStub = nil
+	fake.admitReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeController) Release(stagingGuid string) {
+	fake.releaseMutex.Lock()
+	fake.releaseArgsForCall = append(fake.releaseArgsForCall, struct {
+		stagingGuid string
+	}{stagingGuid})
+	fake.releaseMutex.Unlock()
+	if fake.ReleaseStub != nil {
+		fake.ReleaseStub(stagingGuid)
+	}
+}
+
+func (fake *FakeController) ReleaseCallCount() int {
+	fake.releaseMutex.RLock()
+	defer fake.releaseMutex.RUnlock()
+	return len(fake.releaseArgsForCall)
+}
+
+func (fake *FakeController) ReleaseArgsForCall(i int) string {
+	fake.releaseMutex.RLock()
+	defer fake.releaseMutex.RUnlock()
+	return fake.releaseArgsForCall[i].stagingGuid
+}
+
+func (fake *FakeController) RetryAfterSeconds() int {
+	fake.retryAfterSecondsMutex.Lock()
+	fake.retryAfterSecondsArgsForCall = append(fake.retryAfterSecondsArgsForCall, struct{}{})
+	fake.retryAfterSecondsMutex.Unlock()
+	if fake.RetryAfterSecondsStub != nil {
+		return fake.RetryAfterSecondsStub()
+	} else {
+		return fake.retryAfterSecondsReturns.result1
+	}
+}
+
+func (fake *FakeController) RetryAfterSecondsCallCount() int {
+	fake.retryAfterSecondsMutex.RLock()
+	defer fake.retryAfterSecondsMutex.RUnlock()
+	return len(fake.retryAfterSecondsArgsForCall)
+}
+
+func (fake *FakeController) RetryAfterSecondsReturns(result1 int) {
+	fake.RetryAfterSecondsStub = nil
+	fake.retryAfterSecondsReturns = struct {
+		result1 int
+	}{result1}
+}
+
+func (fake *FakeController) InFlight() int {
+	fake.inFlightMutex.Lock()
+	fake.inFlightArgsForCall = append(fake.inFlightArgsForCall, struct{}{})
+	fake.inFlightMutex.Unlock()
+	if fake.InFlightStub != nil {
+		return fake.InFlightStub()
+	} else {
+		return fake.inFlightReturns.result1
+	}
+}
+
+func (fake *FakeController) InFlightCallCount() int {
+	fake.inFlightMutex.RLock()
+	defer fake.inFlightMutex.RUnlock()
+	return len(fake.inFlightArgsForCall)
+}
+
+func (fake *FakeController) InFlightReturns(result1 int) {
+	fake.InFlightStub = nil
+	fake.inFlightReturns = struct {
+		result1 int
+	}{result1}
+}
+
+func (fake *FakeController) Rebuild(logger lager.Logger, bbsClient bbs.Client) error {
+	fake.rebuildMutex.Lock()
+	fake.rebuildArgsForCall = append(fake.rebuildArgsForCall, struct {
+		logger    lager.Logger
+		bbsClient bbs.Client
+	}{logger, bbsClient})
+	fake.rebuildMutex.Unlock()
+	if fake.RebuildStub != nil {
+		return fake.RebuildStub(logger, bbsClient)
+	} else {
+		return fake.rebuildReturns.result1
+	}
+}
+
+func (fake *FakeController) RebuildCallCount() int {
+	fake.rebuildMutex.RLock()
+	defer fake.rebuildMutex.RUnlock()
+	return len(fake.rebuildArgsForCall)
+}
+
+func (fake *FakeController) RebuildArgsForCall(i int) (lager.Logger, bbs.Client) {
+	fake.rebuildMutex.RLock()
+	defer fake.rebuildMutex.RUnlock()
+	return fake.rebuildArgsForCall[i].logger, fake.rebuildArgsForCall[i].bbsClient
+}
+
+func (fake *FakeController) RebuildReturns(result1 error) {
+	fake.RebuildStub = nil
+	fake.rebuildReturns = struct {
+		result1 error
+	}{result1}
+}
+
+var _ admission.Controller = new(FakeController)
@@ -0,0 +1,60 @@
+package admission
+
+import (
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/bbs"
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"github.com/tedsuo/ifrit"
+)
+
+type rebuilder struct {
+	logger     lager.Logger
+	controller Controller
+	bbsClient  bbs.Client
+	clock      clock.Clock
+	interval   time.Duration
+}
+
+// NewRebuilder returns a runner that periodically rebuilds the controller's
+// in-flight accounting from the BBS. A task admitted by one stager usually
+// completes through another, so without it the counts of every stager drift
+// from the tasks actually running.
+func NewRebuilder(
+	logger lager.Logger,
+	controller Controller,
+	bbsClient bbs.Client,
+	clock clock.Clock,
+	interval time.Duration,
+) ifrit.Runner {
+	return &rebuilder{
+		logger:     logger.Session("admission-rebuilder"),
+		controller: controller,
+		bbsClient:  bbsClient,
+		clock:      clock,
+		interval:   interval,
+	}
+}
+
+func (r *rebuilder) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	logger := r.logger.Session("run", lager.Data{"interval": r.interval.String()})
+	logger.Info("starting")
+
+	ticker := r.clock.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	close(ready)
+
+	for {
+		select {
+		case <-signals:
+			logger.Info("stopped")
+			return nil
+		case <-ticker.C():
+			// Rebuild logs its own failures; the next tick tries again.
+			_ = r.controller.Rebuild(logger, r.bbsClient)
+		}
+	}
+}
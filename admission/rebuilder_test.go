@@ -0,0 +1,64 @@
+package admission_test
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/bbs/fake_bbs"
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/stager/admission"
+	"code.cloudfoundry.org/stager/admission/fakes"
+	"github.com/tedsuo/ifrit"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rebuilder", func() {
+	const interval = 10 * time.Second
+
+	var (
+		fakeController *fakes.FakeController
+		fakeBBSClient  *fake_bbs.FakeClient
+		fakeClock      *fakeclock.FakeClock
+		process        ifrit.Process
+	)
+
+	BeforeEach(func() {
+		fakeController = &fakes.FakeController{}
+		fakeBBSClient = &fake_bbs.FakeClient{}
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+
+		runner := admission.NewRebuilder(lagertest.NewTestLogger("test"), fakeController, fakeBBSClient, fakeClock, interval)
+		process = ifrit.Invoke(runner)
+	})
+
+	AfterEach(func() {
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive(BeNil()))
+	})
+
+	It("rebuilds the accounting from the BBS on every tick", func() {
+		Consistently(fakeController.RebuildCallCount).Should(Equal(0))
+
+		fakeClock.WaitForWatcherAndIncrement(interval)
+		Eventually(fakeController.RebuildCallCount).Should(Equal(1))
+		_, bbsClient := fakeController.RebuildArgsForCall(0)
+		Expect(bbsClient).To(Equal(fakeBBSClient))
+
+		fakeClock.WaitForWatcherAndIncrement(interval)
+		Eventually(fakeController.RebuildCallCount).Should(Equal(2))
+	})
+
+	It("keeps running when a rebuild fails", func() {
+		fakeController.RebuildReturns(errors.New("boom"))
+
+		fakeClock.WaitForWatcherAndIncrement(interval)
+		Eventually(fakeController.RebuildCallCount).Should(Equal(1))
+
+		fakeClock.WaitForWatcherAndIncrement(interval)
+		Eventually(fakeController.RebuildCallCount).Should(Equal(2))
+	})
+})
@@ -0,0 +1,153 @@
+package api_auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"code.cloudfoundry.org/stager"
+	"code.cloudfoundry.org/stager/backend"
+	"code.cloudfoundry.org/stager/handlers"
+)
+
+// Config holds the credentials callers of the stager API must present. The
+// CC routes accept the basic auth username and password or any of the bearer
+// tokens, and are open when neither is configured. The completion callback
+// must carry a signature made with one of the callback signing keys; the
+// first key signs the callback URLs of new staging tasks, the others are
+// only accepted so that keys can be rotated while tasks are running. The
+// callback is open when there are no keys.
+type Config struct {
+	Username            string   `json:"basic_auth_username"`
+	Password            string   `json:"basic_auth_password"`
+	BearerTokens        []string `json:"bearer_tokens"`
+	CallbackSigningKeys []string `json:"callback_signing_keys"`
+}
+
+func (c Config) Validate() error {
+	if (c.Username == "") != (c.Password == "") {
+		return errors.New("basic_auth_username and basic_auth_password must be set together")
+	}
+
+	for _, token := range c.BearerTokens {
+		if token == "" {
+			return errors.New("bearer_tokens cannot contain a blank token")
+		}
+	}
+
+	for _, key := range c.CallbackSigningKeys {
+		if key == "" {
+			return errors.New("callback_signing_keys cannot contain a blank key")
+		}
+	}
+
+	return nil
+}
+
+// SigningKey returns the key that signs the callback URLs of new staging
+// tasks, or "" when callbacks are not signed.
+func (c Config) SigningKey() string {
+	if len(c.CallbackSigningKeys) == 0 {
+		return ""
+	}
+	return c.CallbackSigningKeys[0]
+}
+
+// Authenticator checks the credentials of each request against the route it
+// calls. Its Config can be replaced while the stager is serving.
+type Authenticator struct {
+	config atomic.Value
+}
+
+var _ handlers.Authorizer = (*Authenticator)(nil)
+
+func New(config Config) *Authenticator {
+	a := &Authenticator{}
+	a.Update(config)
+	return a
+}
+
+func (a *Authenticator) Update(config Config) {
+	a.config.Store(config)
+}
+
+func (a *Authenticator) Authorize(route string, request *http.Request) error {
+	config := a.config.Load().(Config)
+	if route == stager.StagingCompletedRoute {
+		return authorizeCallback(config, request)
+	}
+	return authorizeCaller(config, request)
+}
+
+func authorizeCaller(config Config, request *http.Request) error {
+	if config.Username == "" && len(config.BearerTokens) == 0 {
+		return nil
+	}
+
+	if username, password, ok := request.BasicAuth(); ok && config.Username != "" {
+		if equal(username, config.Username) && equal(password, config.Password) {
+			return nil
+		}
+		return unauthorized(config, "invalid basic auth credentials")
+	}
+
+	if token, ok := bearerToken(request); ok && len(config.BearerTokens) > 0 {
+		for _, allowed := range config.BearerTokens {
+			if equal(token, allowed) {
+				return nil
+			}
+		}
+		return unauthorized(config, "invalid bearer token")
+	}
+
+	return unauthorized(config, "no credentials")
+}
+
+func authorizeCallback(config Config, request *http.Request) error {
+	if len(config.CallbackSigningKeys) == 0 {
+		return nil
+	}
+
+	query := request.URL.Query()
+	signature := query.Get(backend.CallbackSignatureParam)
+	if signature == "" {
+		return handlers.NewUnauthorizedError("no callback signature")
+	}
+
+	if !backend.VerifyCallbackSignature(config.CallbackSigningKeys, query.Get(":staging_guid"), signature) {
+		return handlers.NewForbiddenError("invalid callback signature")
+	}
+
+	return nil
+}
+
+func unauthorized(config Config, message string) error {
+	challenges := []string{}
+	if config.Username != "" {
+		challenges = append(challenges, `Basic realm="stager"`)
+	}
+	if len(config.BearerTokens) > 0 {
+		challenges = append(challenges, `Bearer realm="stager"`)
+	}
+
+	return &handlers.AuthorizationError{
+		StatusCode: http.StatusUnauthorized,
+		Message:    message,
+		Challenge:  strings.Join(challenges, ", "),
+	}
+}
+
+func bearerToken(request *http.Request) (string, bool) {
+	const prefix = "bearer "
+	header := request.Header.Get("Authorization")
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return header[len(prefix):], true
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,13 @@
+package api_auth_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestAPIAuth(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "API Auth Suite")
+}
@@ -0,0 +1,239 @@
+package api_auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bbs/fake_bbs"
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/stager"
+	admission_fakes "code.cloudfoundry.org/stager/admission/fakes"
+	"code.cloudfoundry.org/stager/api_auth"
+	"code.cloudfoundry.org/stager/backend"
+	"code.cloudfoundry.org/stager/cc_client/fakes"
+	"code.cloudfoundry.org/stager/handlers"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("APIAuth", func() {
+	var (
+		config        api_auth.Config
+		authenticator *api_auth.Authenticator
+	)
+
+	authorizationError := func(err error) *handlers.AuthorizationError {
+		authErr, ok := err.(*handlers.AuthorizationError)
+		Expect(ok).To(BeTrue())
+		return authErr
+	}
+
+	newRequest := func(method, target string) *http.Request {
+		request, err := http.NewRequest(method, target, nil)
+		Expect(err).NotTo(HaveOccurred())
+		return request
+	}
+
+	BeforeEach(func() {
+		config = api_auth.Config{
+			Username:            "cc",
+			Password:            "secret",
+			BearerTokens:        []string{"token-1", "token-2"},
+			CallbackSigningKeys: []string{"new-key", "old-key"},
+		}
+	})
+
+	JustBeforeEach(func() {
+		authenticator = api_auth.New(config)
+	})
+
+	Describe("Config", func() {
+		It("accepts a complete config", func() {
+			Expect(config.Validate()).To(Succeed())
+			Expect(api_auth.Config{}.Validate()).To(Succeed())
+		})
+
+		It("requires the basic auth username and password together", func() {
+			config.Password = ""
+			Expect(config.Validate()).To(MatchError("basic_auth_username and basic_auth_password must be set together"))
+		})
+
+		It("rejects blank tokens and keys", func() {
+			config.BearerTokens = []string{""}
+			Expect(config.Validate()).To(MatchError("bearer_tokens cannot contain a blank token"))
+
+			config.BearerTokens = nil
+			config.CallbackSigningKeys = []string{"key", ""}
+			Expect(config.Validate()).To(MatchError("callback_signing_keys cannot contain a blank key"))
+		})
+
+		It("signs with the first key", func() {
+			Expect(config.SigningKey()).To(Equal("new-key"))
+			Expect(api_auth.Config{}.SigningKey()).To(BeEmpty())
+		})
+	})
+
+	Describe("CC routes", func() {
+		var request *http.Request
+
+		BeforeEach(func() {
+			request = newRequest("PUT", "/v1/staging/staging-guid")
+		})
+
+		It("accepts the basic auth credentials", func() {
+			request.SetBasicAuth("cc", "secret")
+			Expect(authenticator.Authorize(stager.StageRoute, request)).To(Succeed())
+		})
+
+		It("accepts any of the bearer tokens", func() {
+			request.Header.Set("Authorization", "Bearer token-2")
+			Expect(authenticator.Authorize(stager.StopStagingRoute, request)).To(Succeed())
+		})
+
+		It("rejects a wrong password", func() {
+			request.SetBasicAuth("cc", "guess")
+			err := authenticator.Authorize(stager.StageRoute, request)
+			Expect(authorizationError(err).StatusCode).To(Equal(http.StatusUnauthorized))
+			Expect(err).To(MatchError("invalid basic auth credentials"))
+		})
+
+		It("rejects an unknown bearer token", func() {
+			request.Header.Set("Authorization", "Bearer token-3")
+			err := authenticator.Authorize(stager.StagingStatusRoute, request)
+			Expect(err).To(MatchError("invalid bearer token"))
+		})
+
+		It("challenges requests without credentials", func() {
+			err := authenticator.Authorize(stager.StageRoute, request)
+			Expect(authorizationError(err).StatusCode).To(Equal(http.StatusUnauthorized))
+			Expect(authorizationError(err).Challenge).To(Equal(`Basic realm="stager", Bearer realm="stager"`))
+		})
+
+		It("does not accept the callback signature", func() {
+			request = newRequest("PUT", "/v1/staging/staging-guid?signature="+backend.SignCallback("new-key", "staging-guid"))
+			Expect(authenticator.Authorize(stager.StageRoute, request)).NotTo(Succeed())
+		})
+
+		Context("when only bearer tokens are configured", func() {
+			BeforeEach(func() {
+				config.Username = ""
+				config.Password = ""
+			})
+
+			It("does not accept basic auth", func() {
+				request.SetBasicAuth("", "")
+				err := authenticator.Authorize(stager.StageRoute, request)
+				Expect(err).To(MatchError("no credentials"))
+				Expect(authorizationError(err).Challenge).To(Equal(`Bearer realm="stager"`))
+			})
+		})
+
+		Context("when no credentials are configured", func() {
+			BeforeEach(func() {
+				config = api_auth.Config{}
+			})
+
+			It("allows every request", func() {
+				Expect(authenticator.Authorize(stager.StageRoute, request)).To(Succeed())
+			})
+		})
+
+		It("uses the credentials of an updated config", func() {
+			request.SetBasicAuth("cc", "rotated")
+			Expect(authenticator.Authorize(stager.StageRoute, request)).NotTo(Succeed())
+
+			config.Password = "rotated"
+			authenticator.Update(config)
+
+			Expect(authenticator.Authorize(stager.StageRoute, request)).To(Succeed())
+		})
+	})
+
+	Describe("the completion route", func() {
+		callback := func(stagingGuid, signature string) *http.Request {
+			target := "/v1/staging/" + stagingGuid + "/completed?:staging_guid=" + stagingGuid
+			if signature != "" {
+				target += "&signature=" + signature
+			}
+			return newRequest("POST", target)
+		}
+
+		It("accepts a signature made with any of the keys", func() {
+			Expect(authenticator.Authorize(stager.StagingCompletedRoute, callback("staging-guid", backend.SignCallback("new-key", "staging-guid")))).To(Succeed())
+			Expect(authenticator.Authorize(stager.StagingCompletedRoute, callback("staging-guid", backend.SignCallback("old-key", "staging-guid")))).To(Succeed())
+		})
+
+		It("rejects a callback without a signature", func() {
+			err := authenticator.Authorize(stager.StagingCompletedRoute, callback("staging-guid", ""))
+			Expect(authorizationError(err).StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("rejects a signature made for another task", func() {
+			err := authenticator.Authorize(stager.StagingCompletedRoute, callback("staging-guid", backend.SignCallback("new-key", "other-guid")))
+			Expect(authorizationError(err).StatusCode).To(Equal(http.StatusForbidden))
+		})
+
+		It("does not accept the CC credentials", func() {
+			request := callback("staging-guid", "")
+			request.SetBasicAuth("cc", "secret")
+			Expect(authenticator.Authorize(stager.StagingCompletedRoute, request)).NotTo(Succeed())
+		})
+
+		Context("when there are no signing keys", func() {
+			BeforeEach(func() {
+				config.CallbackSigningKeys = nil
+			})
+
+			It("allows every callback", func() {
+				Expect(authenticator.Authorize(stager.StagingCompletedRoute, callback("staging-guid", ""))).To(Succeed())
+			})
+		})
+	})
+
+	Describe("through the stager's router", func() {
+		var (
+			fakeCCClient *fakes.FakeCcClient
+			handler      http.Handler
+		)
+
+		post := func(target string) int {
+			request, err := http.NewRequest("POST", target, strings.NewReader(`{"task_guid": "staging-guid", "failed": true, "failure_reason": "forged"}`))
+			Expect(err).NotTo(HaveOccurred())
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			return recorder.Code
+		}
+
+		JustBeforeEach(func() {
+			fakeCCClient = &fakes.FakeCcClient{}
+			handler = handlers.New(
+				lagertest.NewTestLogger("test"),
+				fakeCCClient,
+				nil,
+				&admission_fakes.FakeController{},
+				&fake_bbs.FakeClient{},
+				map[string]backend.Backend{},
+				authenticator,
+				fakeclock.NewFakeClock(time.Now()),
+			)
+		})
+
+		It("rejects a forged completion before it reaches CC", func() {
+			Expect(post("/v1/staging/staging-guid/completed")).To(Equal(http.StatusUnauthorized))
+			Expect(post("/v1/staging/staging-guid/completed?signature=forged")).To(Equal(http.StatusForbidden))
+			Expect(fakeCCClient.StagingCompleteCallCount()).To(Equal(0))
+		})
+
+		It("lets a completion at the task's callback URL through", func() {
+			callbackURL := backend.Config{CallbackSigningKey: config.SigningKey()}.CallbackURL("staging-guid")
+
+			code := post(callbackURL)
+			Expect(code).NotTo(Equal(http.StatusUnauthorized))
+			Expect(code).NotTo(Equal(http.StatusForbidden))
+		})
+	})
+})
@@ -0,0 +1,143 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+)
+
+// Staging error id reported to CC when a staging guid is reused for a
+// different request
+const STAGING_REQUEST_CONFLICT = "StagingRequestConflict"
+
+// StagingTaskAnnotation extends the annotation CC knows about with data the
+// stager keeps for itself. It decodes as a cc_messages.StagingTaskAnnotation.
+// OriginalDockerImage is the image the user asked for when it was staged from
+// a registry mirror. IsolationSegment is recorded as it can no longer be told
+// apart from the other placement tags.
+type StagingTaskAnnotation struct {
+	cc_messages.StagingTaskAnnotation
+	Stack               string              `json:"stack,omitempty"`
+	IsolationSegment    string              `json:"isolation_segment"`
+	RequestFingerprint  *RequestFingerprint `json:"request_fingerprint,omitempty"`
+	TraceContext        map[string]string   `json:"trace_context,omitempty"`
+	OriginalDockerImage string              `json:"original_docker_image,omitempty"`
+}
+
+// RequestFingerprint identifies a staging request without storing it. Fields
+// holds a digest of every top-level field so that conflicting requests can be
+// told apart by field name. Docker registry passwords are left out, as an
+// unkeyed digest of one could be guessed by anyone who can read the task.
+type RequestFingerprint struct {
+	Digest string            `json:"digest"`
+	Fields map[string]string `json:"fields"`
+}
+
+func NewRequestFingerprint(request cc_messages.StagingRequestFromCC) (*RequestFingerprint, error) {
+	requestJson, err := json.Marshal(RedactCredentials(request))
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(requestJson, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := &RequestFingerprint{
+		Digest: digest(requestJson),
+		Fields: map[string]string{},
+	}
+	for name, value := range fields {
+		fingerprint.Fields[name] = digest(value)[:16]
+	}
+
+	return fingerprint, nil
+}
+
+// Diff returns the sorted names of the fields that differ between the two
+// fingerprints.
+func (f *RequestFingerprint) Diff(other *RequestFingerprint) []string {
+	differing := []string{}
+	for name, value := range f.Fields {
+		if other.Fields[name] != value {
+			differing = append(differing, name)
+		}
+	}
+	for name := range other.Fields {
+		if _, ok := f.Fields[name]; !ok {
+			differing = append(differing, name)
+		}
+	}
+
+	sort.Strings(differing)
+	return differing
+}
+
+func stagingAnnotation(lifecycle, stack string, request cc_messages.StagingRequestFromCC) (string, error) {
+	annotation, err := newStagingTaskAnnotation(lifecycle, stack, request)
+	if err != nil {
+		return "", err
+	}
+
+	annotationJson, err := json.Marshal(annotation)
+	if err != nil {
+		return "", err
+	}
+
+	return string(annotationJson), nil
+}
+
+func newStagingTaskAnnotation(lifecycle, stack string, request cc_messages.StagingRequestFromCC) (StagingTaskAnnotation, error) {
+	fingerprint, err := NewRequestFingerprint(request)
+	if err != nil {
+		return StagingTaskAnnotation{}, err
+	}
+
+	return StagingTaskAnnotation{
+		StagingTaskAnnotation: cc_messages.StagingTaskAnnotation{
+			Lifecycle:          lifecycle,
+			CompletionCallback: request.CompletionCallback,
+		},
+		Stack:              stack,
+		IsolationSegment:   request.IsolationSegment,
+		RequestFingerprint: fingerprint,
+	}, nil
+}
+
+// WithTraceContext adds the serialized trace context of the staging request to
+// an annotation built by stagingAnnotation, keeping any fields a backend added
+// of its own. Anything else is returned as is.
+func WithTraceContext(annotationJson string, traceContext map[string]string) string {
+	if len(traceContext) == 0 {
+		return annotationJson
+	}
+
+	var annotation map[string]json.RawMessage
+	err := json.Unmarshal([]byte(annotationJson), &annotation)
+	if err != nil || annotation == nil {
+		return annotationJson
+	}
+
+	traceContextJson, err := json.Marshal(traceContext)
+	if err != nil {
+		return annotationJson
+	}
+
+	annotation["trace_context"] = traceContextJson
+	updated, err := json.Marshal(annotation)
+	if err != nil {
+		return annotationJson
+	}
+
+	return string(updated)
+}
+
+func digest(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:])
+}
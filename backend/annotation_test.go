@@ -0,0 +1,107 @@
+package backend_test
+
+import (
+	"encoding/json"
+
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/backend"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RequestFingerprint", func() {
+	var request cc_messages.StagingRequestFromCC
+
+	BeforeEach(func() {
+		lifecycleData := json.RawMessage(`{"stack": "cflinuxfs2"}`)
+		request = cc_messages.StagingRequestFromCC{
+			AppId:         "app-id",
+			LogGuid:       "log-guid",
+			MemoryMB:      1024,
+			Lifecycle:     "buildpack",
+			LifecycleData: &lifecycleData,
+			Environment:   []*models.EnvironmentVariable{{Name: "FOO", Value: "bar"}},
+		}
+	})
+
+	It("is stable for identical requests", func() {
+		first, err := backend.NewRequestFingerprint(request)
+		Expect(err).NotTo(HaveOccurred())
+
+		second, err := backend.NewRequestFingerprint(request)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(first).To(Equal(second))
+		Expect(first.Diff(second)).To(BeEmpty())
+	})
+
+	It("names the fields that differ", func() {
+		first, err := backend.NewRequestFingerprint(request)
+		Expect(err).NotTo(HaveOccurred())
+
+		request.MemoryMB = 2048
+		request.Environment = []*models.EnvironmentVariable{{Name: "FOO", Value: "baz"}}
+
+		second, err := backend.NewRequestFingerprint(request)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(first.Digest).NotTo(Equal(second.Digest))
+		Expect(first.Diff(second)).To(Equal([]string{"environment", "memory_mb"}))
+	})
+
+	It("does not store field values", func() {
+		fingerprint, err := backend.NewRequestFingerprint(request)
+		Expect(err).NotTo(HaveOccurred())
+
+		fingerprintJson, err := json.Marshal(fingerprint)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(fingerprintJson)).NotTo(ContainSubstring("bar"))
+		Expect(string(fingerprintJson)).NotTo(ContainSubstring("app-id"))
+	})
+
+	It("does not depend on the docker registry password", func() {
+		dockerData := json.RawMessage(`{"docker_image": "some/image", "docker_user": "user", "docker_password": "first-password"}`)
+		request.LifecycleData = &dockerData
+		first, err := backend.NewRequestFingerprint(request)
+		Expect(err).NotTo(HaveOccurred())
+
+		dockerData = json.RawMessage(`{"docker_image": "some/image", "docker_user": "user", "docker_password": "second-password"}`)
+		request.LifecycleData = &dockerData
+		second, err := backend.NewRequestFingerprint(request)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(first).To(Equal(second))
+	})
+})
+
+var _ = Describe("WithTraceContext", func() {
+	traceContext := map[string]string{"traceparent": "00-trace-span-01"}
+
+	It("adds the trace context", func() {
+		annotation := backend.WithTraceContext(`{"lifecycle":"buildpack","isolation_segment":""}`, traceContext)
+		Expect(annotation).To(MatchJSON(`{
+			"lifecycle": "buildpack",
+			"isolation_segment": "",
+			"trace_context": {"traceparent": "00-trace-span-01"}
+		}`))
+	})
+
+	It("keeps fields it does not know about", func() {
+		annotation := backend.WithTraceContext(`{"lifecycle":"plugin","plugin_data":{"builder":"kpack"}}`, traceContext)
+		Expect(annotation).To(MatchJSON(`{
+			"lifecycle": "plugin",
+			"plugin_data": {"builder": "kpack"},
+			"trace_context": {"traceparent": "00-trace-span-01"}
+		}`))
+	})
+
+	It("returns anything that is not a JSON object as is", func() {
+		Expect(backend.WithTraceContext("not json", traceContext)).To(Equal("not json"))
+		Expect(backend.WithTraceContext("null", traceContext)).To(Equal("null"))
+	})
+
+	It("returns the annotation as is without a trace context", func() {
+		Expect(backend.WithTraceContext(`{"lifecycle":"buildpack"}`, nil)).To(Equal(`{"lifecycle":"buildpack"}`))
+	})
+})
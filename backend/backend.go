@@ -1,15 +1,12 @@
 package backend
 
 import (
-	"errors"
 	"fmt"
 	"net/url"
-	"strconv"
-	"strings"
 	"time"
 
 	"code.cloudfoundry.org/bbs/models"
-	"code.cloudfoundry.org/buildpackapplifecycle"
+	"code.cloudfoundry.org/clock"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
 	"code.cloudfoundry.org/stager/diego_errors"
 )
@@ -20,7 +17,9 @@ const (
 	TrustedSystemCertificatesPath = "/etc/cf-system-certificates"
 )
 
-type FailureReasonSanitizer func(string) *cc_messages.StagingError
+// FailureReasonSanitizer turns the failure reason of a task of the given
+// lifecycle into the error reported to CC.
+type FailureReasonSanitizer func(lifecycle, reason string) *cc_messages.StagingError
 
 //go:generate counterfeiter -o fake_backend/fake_backend.go . Backend
 type Backend interface {
@@ -28,10 +27,10 @@ type Backend interface {
 	BuildStagingResponse(*models.TaskCallbackResponse) (cc_messages.StagingResponseForCC, error)
 }
 
-var ErrNoCompilerDefined = errors.New(diego_errors.NO_COMPILER_DEFINED_MESSAGE)
-var ErrMissingAppId = errors.New(diego_errors.MISSING_APP_ID_MESSAGE)
-var ErrMissingAppBitsDownloadUri = errors.New(diego_errors.MISSING_APP_BITS_DOWNLOAD_URI_MESSAGE)
-var ErrMissingLifecycleData = errors.New(diego_errors.MISSING_LIFECYCLE_DATA_MESSAGE)
+var ErrNoCompilerDefined = newInvalidRequestError(diego_errors.NO_COMPILER_DEFINED_MESSAGE)
+var ErrMissingAppId = newInvalidRequestError(diego_errors.MISSING_APP_ID_MESSAGE)
+var ErrMissingAppBitsDownloadUri = newInvalidRequestError(diego_errors.MISSING_APP_BITS_DOWNLOAD_URI_MESSAGE)
+var ErrMissingLifecycleData = newInvalidRequestError(diego_errors.MISSING_LIFECYCLE_DATA_MESSAGE)
 
 type Config struct {
 	TaskDomain               string
@@ -45,10 +44,47 @@ type Config struct {
 	Sanitizer                FailureReasonSanitizer
 	DockerStagingStack       string
 	PrivilegedContainers     bool
+	ResourcePolicies         ResourcePolicies
+	DockerRegistries         DockerRegistries
+	DockerImagePolicy        DockerImagePolicy
+	PlacementRules           PlacementRules
+	StackRootFSes            StackRootFSes
+	CallbackSigningKey       string
+	// DockerCredentialsBaseURL is where staging tasks download their docker
+	// credentials from, when not from StagerURL.
+	DockerCredentialsBaseURL string
+	// DockerCredentialsKeys open the docker credentials sealed into staging
+	// tasks; the first one seals them.
+	DockerCredentialsKeys []string
+	Clock                 clock.Clock
 }
 
+// CallbackURL returns the URL the BBS reports the completion of the staging
+// task to. When CallbackSigningKey is set the URL carries the task's
+// signature.
 func (c Config) CallbackURL(stagingGuid string) string {
-	return fmt.Sprintf("%s/v1/staging/%s/completed", c.StagerURL, stagingGuid)
+	callbackURL := fmt.Sprintf("%s/v1/staging/%s/completed", c.StagerURL, stagingGuid)
+	if c.CallbackSigningKey == "" {
+		return callbackURL
+	}
+
+	return fmt.Sprintf("%s?%s=%s", callbackURL, CallbackSignatureParam, SignCallback(c.CallbackSigningKey, stagingGuid))
+}
+
+func (c Config) now() time.Time {
+	if c.Clock == nil {
+		return time.Now()
+	}
+	return c.Clock.Now()
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
 func max(x, y uint64) uint64 {
@@ -65,36 +101,3 @@ func addTimeoutParamToURL(u url.URL, timeout time.Duration) *url.URL {
 	u.RawQuery = query.Encode()
 	return &u
 }
-
-func SanitizeErrorMessage(message string) *cc_messages.StagingError {
-	const staging_failed = "staging failed"
-	id := cc_messages.STAGING_ERROR
-	switch {
-	case strings.HasSuffix(message, strconv.Itoa(buildpackapplifecycle.DETECT_FAIL_CODE)):
-		id = cc_messages.BUILDPACK_DETECT_FAILED
-		message = staging_failed
-	case strings.HasSuffix(message, strconv.Itoa(buildpackapplifecycle.COMPILE_FAIL_CODE)):
-		id = cc_messages.BUILDPACK_COMPILE_FAILED
-		message = staging_failed
-	case strings.HasSuffix(message, strconv.Itoa(buildpackapplifecycle.RELEASE_FAIL_CODE)):
-		id = cc_messages.BUILDPACK_RELEASE_FAILED
-		message = staging_failed
-	case strings.HasPrefix(message, diego_errors.INSUFFICIENT_RESOURCES_MESSAGE):
-		id = cc_messages.INSUFFICIENT_RESOURCES
-	case strings.HasPrefix(message, diego_errors.CELL_MISMATCH_MESSAGE):
-		id = cc_messages.NO_COMPATIBLE_CELL
-	case message == diego_errors.CELL_COMMUNICATION_ERROR:
-		id = cc_messages.CELL_COMMUNICATION_ERROR
-	case message == diego_errors.MISSING_DOCKER_IMAGE_URL:
-	case message == diego_errors.MISSING_DOCKER_REGISTRY:
-	case message == diego_errors.MISSING_DOCKER_CREDENTIALS:
-	case message == diego_errors.INVALID_DOCKER_REGISTRY_ADDRESS:
-	default:
-		message = "staging failed"
-	}
-
-	return &cc_messages.StagingError{
-		Id:      id,
-		Message: message,
-	}
-}
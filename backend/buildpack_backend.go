@@ -26,11 +26,17 @@ const (
 )
 
 type traditionalBackend struct {
-	config Config
+	config *SharedConfig
 	logger lager.Logger
 }
 
 func NewTraditionalBackend(config Config, logger lager.Logger) Backend {
+	return NewTraditionalBackendWithSharedConfig(NewSharedConfig(config), logger)
+}
+
+// NewTraditionalBackendWithSharedConfig builds a backend that picks up every Config
+// stored in config.
+func NewTraditionalBackendWithSharedConfig(config *SharedConfig, logger lager.Logger) Backend {
 	return &traditionalBackend{
 		config: config,
 		logger: logger.Session("traditional"),
@@ -38,6 +44,7 @@ func NewTraditionalBackend(config Config, logger lager.Logger) Backend {
 }
 
 func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_messages.StagingRequestFromCC) (*models.TaskDefinition, string, string, error) {
+	config := backend.config.Load()
 	logger := backend.logger.Session("build-recipe", lager.Data{"app-id": request.AppId, "staging-guid": stagingGuid})
 	logger.Info("staging-request")
 
@@ -56,7 +63,17 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 		return &models.TaskDefinition{}, "", "", err
 	}
 
-	compilerURL, err := backend.compilerDownloadURL(request, lifecycleData)
+	resources, err := config.ResourcePolicies.Resolve(request.Lifecycle, lifecycleData.Stack, StagingTaskCpuWeight, request)
+	if err != nil {
+		return &models.TaskDefinition{}, "", "", err
+	}
+
+	rootFS, err := config.StackRootFSes.RootFS(lifecycleData.Stack)
+	if err != nil {
+		return &models.TaskDefinition{}, "", "", err
+	}
+
+	compilerURL, err := compilerDownloadURL(config, request.Lifecycle+"/"+lifecycleData.Stack)
 	if err != nil {
 		return &models.TaskDefinition{}, "", "", err
 	}
@@ -67,7 +84,7 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 	}
 
 	skipDetect := len(lifecycleData.Buildpacks) == 1 && lifecycleData.Buildpacks[0].SkipDetect
-	builderConfig := buildpackapplifecycle.NewLifecycleBuilderConfig(buildpacksOrder, skipDetect, backend.config.SkipCertVerify)
+	builderConfig := buildpackapplifecycle.NewLifecycleBuilderConfig(buildpacksOrder, skipDetect, config.SkipCertVerify)
 
 	timeout := traditionalTimeout(request, backend.logger)
 
@@ -110,7 +127,7 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 	}
 
 	//Download buildpack artifacts cache
-	downloadURL, err := backend.buildArtifactsDownloadURL(lifecycleData)
+	downloadURL, err := buildArtifactsDownloadURL(lifecycleData)
 	if err != nil {
 		return &models.TaskDefinition{}, "", "", err
 	}
@@ -127,7 +144,7 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 		actions = append(actions, downloadAction)
 	}
 
-	fileDescriptorLimit := uint64(request.FileDescriptors)
+	fileDescriptorLimit := uint64(resources.FileDescriptors)
 
 	//Run Builder
 	runEnv := append(request.Environment, &models.EnvironmentVariable{"CF_STACK", lifecycleData.Stack})
@@ -152,7 +169,7 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 	//Upload Droplet
 	uploadActions := []models.ActionInterface{}
 	uploadNames := []string{}
-	uploadURL, err := backend.dropletUploadURL(request, lifecycleData)
+	uploadURL, err := dropletUploadURL(config, request, lifecycleData)
 	if err != nil {
 		return &models.TaskDefinition{}, "", "", err
 	}
@@ -169,7 +186,7 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 	uploadNames = append(uploadNames, "droplet")
 
 	//Upload Buildpack Artifacts Cache
-	uploadURL, err = backend.buildArtifactsUploadURL(request, lifecycleData)
+	uploadURL, err = buildArtifactsUploadURL(config, request, lifecycleData)
 	if err != nil {
 		return &models.TaskDefinition{}, "", "", err
 	}
@@ -189,43 +206,41 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 	uploadMsg := fmt.Sprintf("Uploading %s...", strings.Join(uploadNames, ", "))
 	actions = append(actions, models.EmitProgressFor(models.Parallel(uploadActions...), uploadMsg, "Uploading complete", "Uploading failed"))
 
-	annotationJson, _ := json.Marshal(cc_messages.StagingTaskAnnotation{
-		Lifecycle:          TraditionalLifecycleName,
-		CompletionCallback: request.CompletionCallback,
-	})
+	annotation, err := stagingAnnotation(TraditionalLifecycleName, lifecycleData.Stack, request)
+	if err != nil {
+		return &models.TaskDefinition{}, "", "", err
+	}
 
 	taskDefinition := &models.TaskDefinition{
-		RootFs:                        models.PreloadedRootFS(lifecycleData.Stack),
+		RootFs:                        rootFS,
 		ResultFile:                    builderConfig.OutputMetadata(),
-		MemoryMb:                      int32(request.MemoryMB),
-		DiskMb:                        int32(request.DiskMB),
-		CpuWeight:                     uint32(StagingTaskCpuWeight),
+		MemoryMb:                      int32(resources.MemoryMB),
+		DiskMb:                        int32(resources.DiskMB),
+		CpuWeight:                     resources.CpuWeight,
 		CachedDependencies:            cachedDependencies,
 		Action:                        models.WrapAction(models.Timeout(models.Serial(actions...), timeout)),
 		LogGuid:                       request.LogGuid,
 		LogSource:                     TaskLogSource,
-		CompletionCallbackUrl:         backend.config.CallbackURL(stagingGuid),
+		CompletionCallbackUrl:         config.CallbackURL(stagingGuid),
 		EgressRules:                   request.EgressRules,
-		Annotation:                    string(annotationJson),
-		Privileged:                    backend.config.PrivilegedContainers,
+		Annotation:                    annotation,
+		Privileged:                    config.PrivilegedContainers,
 		EnvironmentVariables:          []*models.EnvironmentVariable{{"LANG", DefaultLANG}},
 		TrustedSystemCertificatesPath: TrustedSystemCertificatesPath,
-	}
-
-	if request.IsolationSegment != "" {
-		taskDefinition.PlacementTags = []string{request.IsolationSegment}
+		PlacementTags:                 config.PlacementRules.PlacementTags(TraditionalLifecycleName, lifecycleData.Stack, request.IsolationSegment),
 	}
 
 	logger.Debug("staging-task-request")
 
-	return taskDefinition, stagingGuid, backend.config.TaskDomain, nil
+	return taskDefinition, stagingGuid, config.TaskDomain, nil
 }
 
 func (backend *traditionalBackend) BuildStagingResponse(taskResponse *models.TaskCallbackResponse) (cc_messages.StagingResponseForCC, error) {
+	config := backend.config.Load()
 	var response cc_messages.StagingResponseForCC
 
 	if taskResponse.Failed {
-		response.Error = backend.config.Sanitizer(taskResponse.FailureReason)
+		response.Error = config.Sanitizer(TraditionalLifecycleName, taskResponse.FailureReason)
 	} else {
 		result := json.RawMessage([]byte(taskResponse.Result))
 		response.Result = &result
@@ -234,8 +249,8 @@ func (backend *traditionalBackend) BuildStagingResponse(taskResponse *models.Tas
 	return response, nil
 }
 
-func (backend *traditionalBackend) compilerDownloadURL(request cc_messages.StagingRequestFromCC, buildpackData cc_messages.BuildpackStagingData) (*url.URL, error) {
-	compilerPath, ok := backend.config.Lifecycles[request.Lifecycle+"/"+buildpackData.Stack]
+func compilerDownloadURL(config Config, lifecycleKey string) (*url.URL, error) {
+	compilerPath, ok := config.Lifecycles[lifecycleKey]
 	if !ok {
 		return nil, ErrNoCompilerDefined
 	}
@@ -254,7 +269,7 @@ func (backend *traditionalBackend) compilerDownloadURL(request cc_messages.Stagi
 		return nil, errors.New("Unknown Scheme")
 	}
 
-	urlString := urljoiner.Join(backend.config.FileServerURL, "/v1/static/", compilerPath)
+	urlString := urljoiner.Join(config.FileServerURL, "/v1/static/", compilerPath)
 
 	url, err := url.ParseRequestURI(urlString)
 	if err != nil {
@@ -264,7 +279,7 @@ func (backend *traditionalBackend) compilerDownloadURL(request cc_messages.Stagi
 	return url, nil
 }
 
-func (backend *traditionalBackend) dropletUploadURL(request cc_messages.StagingRequestFromCC, buildpackData cc_messages.BuildpackStagingData) (*url.URL, error) {
+func dropletUploadURL(config Config, request cc_messages.StagingRequestFromCC, buildpackData cc_messages.BuildpackStagingData) (*url.URL, error) {
 	path, err := ccuploader.Routes.CreatePathForRoute(ccuploader.UploadDropletRoute, rata.Params{
 		"guid": request.AppId,
 	})
@@ -272,7 +287,7 @@ func (backend *traditionalBackend) dropletUploadURL(request cc_messages.StagingR
 		return nil, fmt.Errorf("couldn't generate droplet upload URL: %s", err)
 	}
 
-	urlString := urljoiner.Join(backend.config.CCUploaderURL, path)
+	urlString := urljoiner.Join(config.CCUploaderURL, path)
 
 	u, err := url.ParseRequestURI(urlString)
 	if err != nil {
@@ -286,7 +301,7 @@ func (backend *traditionalBackend) dropletUploadURL(request cc_messages.StagingR
 	return u, nil
 }
 
-func (backend *traditionalBackend) buildArtifactsUploadURL(request cc_messages.StagingRequestFromCC, buildpackData cc_messages.BuildpackStagingData) (*url.URL, error) {
+func buildArtifactsUploadURL(config Config, request cc_messages.StagingRequestFromCC, buildpackData cc_messages.BuildpackStagingData) (*url.URL, error) {
 	path, err := ccuploader.Routes.CreatePathForRoute(ccuploader.UploadBuildArtifactsRoute, rata.Params{
 		"app_guid": request.AppId,
 	})
@@ -294,7 +309,7 @@ func (backend *traditionalBackend) buildArtifactsUploadURL(request cc_messages.S
 		return nil, fmt.Errorf("couldn't generate build artifacts cache upload URL: %s", err)
 	}
 
-	urlString := urljoiner.Join(backend.config.CCUploaderURL, path)
+	urlString := urljoiner.Join(config.CCUploaderURL, path)
 
 	u, err := url.ParseRequestURI(urlString)
 	if err != nil {
@@ -308,7 +323,7 @@ func (backend *traditionalBackend) buildArtifactsUploadURL(request cc_messages.S
 	return u, nil
 }
 
-func (backend *traditionalBackend) buildArtifactsDownloadURL(buildpackData cc_messages.BuildpackStagingData) (*url.URL, error) {
+func buildArtifactsDownloadURL(buildpackData cc_messages.BuildpackStagingData) (*url.URL, error) {
 	urlString := buildpackData.BuildArtifactsCacheDownloadUri
 	if urlString == "" {
 		return nil, nil
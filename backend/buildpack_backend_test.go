@@ -59,7 +59,7 @@ var _ = Describe("TraditionalBackend", func() {
 				"buildpack/compiler_with_full_url": "http://the-full-compiler-url",
 				"buildpack/compiler_with_bad_url":  "ftp://the-bad-compiler-url",
 			},
-			Sanitizer: func(msg string) *cc_messages.StagingError {
+			Sanitizer: func(lifecycle, msg string) *cc_messages.StagingError {
 				return &cc_messages.StagingError{Message: msg + " was totally sanitized"}
 			},
 		}
@@ -255,6 +255,14 @@ var _ = Describe("TraditionalBackend", func() {
 			CompletionCallback: "https://api.cc.com/v1/staging/some-staging-guid/droplet_completed",
 		}))
 
+		var stagerAnnotation backend.StagingTaskAnnotation
+		err = json.Unmarshal([]byte(taskDef.Annotation), &stagerAnnotation)
+		Expect(err).NotTo(HaveOccurred())
+
+		expectedFingerprint, err := backend.NewRequestFingerprint(stagingRequest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stagerAnnotation.RequestFingerprint).To(Equal(expectedFingerprint))
+
 		actions := actionsFromTaskDef(taskDef)
 		Expect(actions).To(Equal(models.Serial(
 			downloadAppAction,
@@ -293,6 +301,33 @@ var _ = Describe("TraditionalBackend", func() {
 			Expect(err).NotTo(HaveOccurred())
 			Expect(taskDef.PlacementTags).To(ContainElement("foo"))
 		})
+
+		Context("with placement rules for the lifecycle and stack", func() {
+			BeforeEach(func() {
+				config.PlacementRules = backend.PlacementRules{
+					"buildpack":             {"staging"},
+					"buildpack/rabbit_hole": {"rabbit"},
+					"*/rabbit_hole":         {"burrow", "foo"},
+					"docker":                {"staging-docker"},
+				}
+				traditional = backend.NewTraditionalBackend(config, logger)
+			})
+
+			It("merges the rules' tags after the isolation segment", func() {
+				taskDef, _, _, err := traditional.BuildRecipe(stagingGuid, stagingRequest)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(taskDef.PlacementTags).To(Equal([]string{"foo", "staging", "rabbit", "burrow"}))
+			})
+
+			It("records the isolation segment in the annotation", func() {
+				taskDef, _, _, err := traditional.BuildRecipe(stagingGuid, stagingRequest)
+				Expect(err).NotTo(HaveOccurred())
+
+				var annotation backend.StagingTaskAnnotation
+				Expect(json.Unmarshal([]byte(taskDef.Annotation), &annotation)).To(Succeed())
+				Expect(annotation.IsolationSegment).To(Equal("foo"))
+			})
+		})
 	})
 
 	Context("with a specified buildpack", func() {
@@ -472,6 +507,34 @@ var _ = Describe("TraditionalBackend", func() {
 		})
 	})
 
+	Context("when rootfses are configured per stack", func() {
+		BeforeEach(func() {
+			config.StackRootFSes = backend.StackRootFSes{"rabbit_hole": "docker:///cloudfoundry/rabbit-hole"}
+			traditional = backend.NewTraditionalBackend(config, logger)
+		})
+
+		It("stages on the stack's rootfs", func() {
+			taskDef, _, _, err := traditional.BuildRecipe(stagingGuid, stagingRequest)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(taskDef.RootFs).To(Equal("docker:///cloudfoundry/rabbit-hole"))
+		})
+
+		Context("when the requested stack is not configured", func() {
+			BeforeEach(func() {
+				stack = "penguin"
+			})
+
+			It("returns an unknown stack error", func() {
+				_, _, _, err := traditional.BuildRecipe(stagingGuid, stagingRequest)
+				Expect(err).To(HaveOccurred())
+				Expect(backend.AsStagingError(err).ToCC()).To(Equal(&cc_messages.StagingError{
+					Id:      backend.UNKNOWN_STACK,
+					Message: "unknown stack 'penguin'",
+				}))
+			})
+		})
+	})
+
 	Context("when no compiler is defined for the requested stack in backend configuration", func() {
 		BeforeEach(func() {
 			stack = "no_such_stack"
@@ -628,13 +691,13 @@ var _ = Describe("TraditionalBackend", func() {
 	Describe("SanitizeErrorMessage", func() {
 		Context("when the message is InsufficientResources", func() {
 			It("returns an InsufficientResources memory error", func() {
-				stagingErr := backend.SanitizeErrorMessage("insufficient resources: memory")
+				stagingErr := backend.SanitizeErrorMessage(backend.TraditionalLifecycleName, "insufficient resources: memory")
 				Expect(stagingErr.Id).To(Equal(cc_messages.INSUFFICIENT_RESOURCES))
 				Expect(stagingErr.Message).To(Equal("insufficient resources: memory"))
 			})
 
 			It("returns an InsufficientResources disk error", func() {
-				stagingErr := backend.SanitizeErrorMessage("insufficient resources: disk")
+				stagingErr := backend.SanitizeErrorMessage(backend.TraditionalLifecycleName, "insufficient resources: disk")
 				Expect(stagingErr.Id).To(Equal(cc_messages.INSUFFICIENT_RESOURCES))
 				Expect(stagingErr.Message).To(Equal("insufficient resources: disk"))
 			})
@@ -642,7 +705,7 @@ var _ = Describe("TraditionalBackend", func() {
 
 		Context("when the message is NoCompatibleCell", func() {
 			It("returns a NoCompatibleCell", func() {
-				stagingErr := backend.SanitizeErrorMessage(diego_errors.CELL_MISMATCH_MESSAGE)
+				stagingErr := backend.SanitizeErrorMessage(backend.TraditionalLifecycleName, diego_errors.CELL_MISMATCH_MESSAGE)
 				Expect(stagingErr.Id).To(Equal(cc_messages.NO_COMPATIBLE_CELL))
 				Expect(stagingErr.Message).To(Equal(diego_errors.CELL_MISMATCH_MESSAGE))
 			})
@@ -650,7 +713,7 @@ var _ = Describe("TraditionalBackend", func() {
 
 		Context("when the message is NoCompatibleCell Volume Drivers", func() {
 			It("returns a NoCompatibleCell", func() {
-				stagingErr := backend.SanitizeErrorMessage("found no compatible cell with volume drivers: [driver1]")
+				stagingErr := backend.SanitizeErrorMessage(backend.TraditionalLifecycleName, "found no compatible cell with volume drivers: [driver1]")
 				Expect(stagingErr.Id).To(Equal(cc_messages.NO_COMPATIBLE_CELL))
 				Expect(stagingErr.Message).To(ContainSubstring(diego_errors.CELL_MISMATCH_MESSAGE))
 			})
@@ -658,7 +721,7 @@ var _ = Describe("TraditionalBackend", func() {
 
 		Context("when the message is NoCompatibleCell Placement tags", func() {
 			It("returns a NoCompatibleCell", func() {
-				stagingErr := backend.SanitizeErrorMessage("found no compatible cell with placement tags: [tag1, tag2]")
+				stagingErr := backend.SanitizeErrorMessage(backend.TraditionalLifecycleName, "found no compatible cell with placement tags: [tag1, tag2]")
 				Expect(stagingErr.Id).To(Equal(cc_messages.NO_COMPATIBLE_CELL))
 				Expect(stagingErr.Message).To(ContainSubstring(diego_errors.CELL_MISMATCH_MESSAGE))
 			})
@@ -666,7 +729,7 @@ var _ = Describe("TraditionalBackend", func() {
 
 		Context("when the message is CellCommunicationError", func() {
 			It("returns a CellCommunicationError", func() {
-				stagingErr := backend.SanitizeErrorMessage(diego_errors.CELL_COMMUNICATION_ERROR)
+				stagingErr := backend.SanitizeErrorMessage(backend.TraditionalLifecycleName, diego_errors.CELL_COMMUNICATION_ERROR)
 				Expect(stagingErr.Id).To(Equal(cc_messages.CELL_COMMUNICATION_ERROR))
 				Expect(stagingErr.Message).To(Equal(diego_errors.CELL_COMMUNICATION_ERROR))
 			})
@@ -674,7 +737,7 @@ var _ = Describe("TraditionalBackend", func() {
 
 		Context("when the message is missing docker image URL", func() {
 			It("returns a StagingError", func() {
-				stagingErr := backend.SanitizeErrorMessage(diego_errors.MISSING_DOCKER_IMAGE_URL)
+				stagingErr := backend.SanitizeErrorMessage(backend.TraditionalLifecycleName, diego_errors.MISSING_DOCKER_IMAGE_URL)
 				Expect(stagingErr.Id).To(Equal(cc_messages.STAGING_ERROR))
 				Expect(stagingErr.Message).To(Equal(diego_errors.MISSING_DOCKER_IMAGE_URL))
 			})
@@ -682,15 +745,23 @@ var _ = Describe("TraditionalBackend", func() {
 
 		Context("when the message is missing docker registry", func() {
 			It("returns a StagingError", func() {
-				stagingErr := backend.SanitizeErrorMessage(diego_errors.MISSING_DOCKER_REGISTRY)
+				stagingErr := backend.SanitizeErrorMessage(backend.TraditionalLifecycleName, diego_errors.MISSING_DOCKER_REGISTRY)
 				Expect(stagingErr.Id).To(Equal(cc_messages.STAGING_ERROR))
 				Expect(stagingErr.Message).To(Equal(diego_errors.MISSING_DOCKER_REGISTRY))
 			})
 		})
 
+		Context("when the task exited with a cnb lifecycle exit code", func() {
+			It("returns a StagingError", func() {
+				stagingErr := backend.SanitizeErrorMessage(backend.TraditionalLifecycleName, "Exited with status 100")
+				Expect(stagingErr.Id).To(Equal(cc_messages.STAGING_ERROR))
+				Expect(stagingErr.Message).To(Equal("staging failed"))
+			})
+		})
+
 		Context("any other message", func() {
 			It("returns a StagingError", func() {
-				stagingErr := backend.SanitizeErrorMessage("some-error")
+				stagingErr := backend.SanitizeErrorMessage(backend.TraditionalLifecycleName, "some-error")
 				Expect(stagingErr.Id).To(Equal(cc_messages.STAGING_ERROR))
 				Expect(stagingErr.Message).To(Equal("staging failed"))
 			})
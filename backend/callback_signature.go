@@ -0,0 +1,32 @@
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// CallbackSignatureParam is the query parameter of the completion callback
+// URL that carries the signature of the staging task.
+const CallbackSignatureParam = "signature"
+
+// SignCallback returns the signature of the completion callback of the
+// staging task stagingGuid: the hex encoded HMAC-SHA256 of the guid, keyed
+// with the callback key derived from key.
+func SignCallback(key, stagingGuid string) string {
+	mac := hmac.New(sha256.New, deriveKey(key, callbackKeyInfo))
+	mac.Write([]byte(stagingGuid))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyCallbackSignature reports whether signature was made for stagingGuid
+// with any of keys, so that callbacks of tasks signed before a key was
+// rotated are still accepted.
+func VerifyCallbackSignature(keys []string, stagingGuid, signature string) bool {
+	for _, key := range keys {
+		if hmac.Equal([]byte(SignCallback(key, stagingGuid)), []byte(signature)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package backend_test
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"code.cloudfoundry.org/stager/backend"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Callback signatures", func() {
+	Describe("CallbackURL", func() {
+		It("is unsigned without a signing key", func() {
+			config := backend.Config{StagerURL: "http://stager.example.com"}
+			Expect(config.CallbackURL("staging-guid")).To(Equal("http://stager.example.com/v1/staging/staging-guid/completed"))
+		})
+
+		It("carries the task's signature with a signing key", func() {
+			config := backend.Config{StagerURL: "http://stager.example.com", CallbackSigningKey: "key"}
+			Expect(config.CallbackURL("staging-guid")).To(Equal(
+				"http://stager.example.com/v1/staging/staging-guid/completed?signature=" + backend.SignCallback("key", "staging-guid"),
+			))
+		})
+	})
+
+	Describe("SignCallback", func() {
+		It("is the hex encoded HMAC-SHA256 of the staging guid with the derived callback key", func() {
+			Expect(backend.SignCallback("key", "The quick brown fox jumps over the lazy dog")).To(
+				Equal("82c6c237447985d28fd40c8906ed8678f1ad7c39b61a4cba597b02b5c96bcd7b"),
+			)
+		})
+
+		It("reveals nothing about the docker credentials key", func() {
+			sealed, err := backend.SealDockerCredentials("key", "staging-guid", "secret", time.Now().Add(time.Minute))
+			Expect(err).NotTo(HaveOccurred())
+
+			signature, err := hex.DecodeString(backend.SignCallback("key", "stager/docker-credentials/v1"))
+			Expect(err).NotTo(HaveOccurred())
+			ciphertext, err := base64.RawURLEncoding.DecodeString(sealed)
+			Expect(err).NotTo(HaveOccurred())
+
+			block, err := aes.NewCipher(signature)
+			Expect(err).NotTo(HaveOccurred())
+			aead, err := cipher.NewGCM(block)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], []byte("staging-guid"))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("differs between tasks", func() {
+			Expect(backend.SignCallback("key", "staging-guid")).NotTo(Equal(backend.SignCallback("key", "other-guid")))
+		})
+	})
+
+	Describe("VerifyCallbackSignature", func() {
+		var signature string
+
+		BeforeEach(func() {
+			signature = backend.SignCallback("old-key", "staging-guid")
+		})
+
+		It("accepts a signature made with any of the keys", func() {
+			Expect(backend.VerifyCallbackSignature([]string{"new-key", "old-key"}, "staging-guid", signature)).To(BeTrue())
+		})
+
+		It("rejects a signature made with another key", func() {
+			Expect(backend.VerifyCallbackSignature([]string{"new-key"}, "staging-guid", signature)).To(BeFalse())
+		})
+
+		It("rejects a signature made for another task", func() {
+			Expect(backend.VerifyCallbackSignature([]string{"old-key"}, "other-guid", signature)).To(BeFalse())
+		})
+
+		It("rejects a missing signature", func() {
+			Expect(backend.VerifyCallbackSignature([]string{"old-key"}, "staging-guid", "")).To(BeFalse())
+		})
+	})
+})
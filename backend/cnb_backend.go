@@ -0,0 +1,514 @@
+package backend
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	CNBLifecycleName = "cnb"
+
+	// CNBPlatformAPI is the version of the CNB platform API the lifecycle
+	// phases are run with. It determines their flags, their exit codes and
+	// the format of the metadata the builder writes.
+	CNBPlatformAPI = "0.5"
+
+	CNBHomeDir               = "/home/vcap"
+	CNBLifecycleDir          = "/tmp/lifecycle"
+	CNBBuildpackDownloadsDir = "/tmp/buildpack-downloads"
+	CNBBuildpacksDir         = "/tmp/buildpacks"
+	CNBOrderPath             = "/tmp/order.toml"
+	CNBCacheDir              = "/tmp/cache"
+	CNBAnalyzedPath          = "/tmp/analyzed"
+	CNBResolvedPath          = "/tmp/resolved-buildpacks.toml"
+	CNBResultPath            = "/tmp/result.toml"
+	CNBWorkspaceDir          = CNBHomeDir + "/workspace"
+	CNBLayersDir             = CNBHomeDir + "/layers"
+	CNBPlatformDir           = CNBHomeDir + "/platform"
+	CNBGroupPath             = CNBLayersDir + "/group.toml"
+	CNBPlanPath              = CNBLayersDir + "/plan.toml"
+	CNBMetadataPath          = CNBLayersDir + "/config/metadata.toml"
+	CNBOutputDroplet         = "/tmp/droplet"
+	CNBOutputCache           = "/tmp/output-cache"
+
+	// Exit codes of the CNB lifecycle phases
+	CNBDetectFailCode = 100
+	CNBBuildFailCode  = 401
+)
+
+// Staging error ids reported to CC for CNB failures
+const (
+	CNB_DETECT_FAILED = "CNBDetectFailed"
+	CNB_BUILD_FAILED  = "CNBBuildFailed"
+)
+
+// CNBStagingMetadata is the staging result: the metadata the builder phase
+// writes to CNBMetadataPath, followed by the buildpacks of the staging
+// request as they were resolved.
+type CNBStagingMetadata struct {
+	Buildpacks         []CNBBuildpackMetadata `toml:"buildpacks"`
+	Processes          []CNBProcess           `toml:"processes"`
+	ResolvedBuildpacks []CNBResolvedBuildpack `toml:"resolved_buildpacks"`
+}
+
+type CNBBuildpackMetadata struct {
+	ID      string `toml:"id"`
+	Version string `toml:"version"`
+}
+
+type CNBProcess struct {
+	Type    string   `toml:"type"`
+	Command string   `toml:"command"`
+	Args    []string `toml:"args"`
+}
+
+// CNBResolvedBuildpack ties a buildpack of the staging request, which CC
+// knows by its key and name, to the id and version in its buildpack.toml.
+type CNBResolvedBuildpack struct {
+	Key     string `toml:"key"`
+	Name    string `toml:"name"`
+	ID      string `toml:"id"`
+	Version string `toml:"version"`
+}
+
+type cnbStagingResult struct {
+	LifecycleType     string               `json:"lifecycle_type"`
+	LifecycleMetadata cnbLifecycleMetadata `json:"lifecycle_metadata"`
+	ProcessTypes      map[string]string    `json:"process_types"`
+	ExecutionMetadata string               `json:"execution_metadata"`
+}
+
+type cnbLifecycleMetadata struct {
+	DetectedBuildpack string              `json:"detected_buildpack"`
+	Buildpacks        []cnbBuildpackForCC `json:"buildpacks"`
+}
+
+type cnbBuildpackForCC struct {
+	Key     string `json:"key"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type cnbBackend struct {
+	config *SharedConfig
+	logger lager.Logger
+}
+
+func NewCNBBackend(config Config, logger lager.Logger) Backend {
+	return NewCNBBackendWithSharedConfig(NewSharedConfig(config), logger)
+}
+
+// NewCNBBackendWithSharedConfig builds a backend that picks up every Config
+// stored in config.
+func NewCNBBackendWithSharedConfig(config *SharedConfig, logger lager.Logger) Backend {
+	return &cnbBackend{
+		config: config,
+		logger: logger.Session("cnb"),
+	}
+}
+
+func (backend *cnbBackend) BuildRecipe(stagingGuid string, request cc_messages.StagingRequestFromCC) (*models.TaskDefinition, string, string, error) {
+	config := backend.config.Load()
+	logger := backend.logger.Session("build-recipe", lager.Data{"app-id": request.AppId, "staging-guid": stagingGuid})
+	logger.Info("staging-request")
+
+	if request.LifecycleData == nil {
+		return &models.TaskDefinition{}, "", "", ErrMissingLifecycleData
+	}
+
+	var lifecycleData cc_messages.BuildpackStagingData
+	err := json.Unmarshal(*request.LifecycleData, &lifecycleData)
+	if err != nil {
+		return &models.TaskDefinition{}, "", "", err
+	}
+
+	if len(request.AppId) == 0 {
+		return &models.TaskDefinition{}, "", "", ErrMissingAppId
+	}
+
+	if len(lifecycleData.AppBitsDownloadUri) == 0 {
+		return &models.TaskDefinition{}, "", "", ErrMissingAppBitsDownloadUri
+	}
+
+	resources, err := config.ResourcePolicies.Resolve(CNBLifecycleName, lifecycleData.Stack, StagingTaskCpuWeight, request)
+	if err != nil {
+		return &models.TaskDefinition{}, "", "", err
+	}
+
+	rootFS, err := config.StackRootFSes.RootFS(lifecycleData.Stack)
+	if err != nil {
+		return &models.TaskDefinition{}, "", "", err
+	}
+
+	compilerURL, err := compilerDownloadURL(config, CNBLifecycleName+"/"+lifecycleData.Stack)
+	if err != nil {
+		return &models.TaskDefinition{}, "", "", err
+	}
+
+	timeout := traditionalTimeout(request, backend.logger)
+
+	cachedDependencies := []*models.CachedDependency{
+		{
+			From:     compilerURL.String(),
+			To:       CNBLifecycleDir,
+			CacheKey: fmt.Sprintf("cnb-%s-lifecycle", lifecycleData.Stack),
+		},
+	}
+
+	err = validateCNBBuildpacks(lifecycleData.Buildpacks)
+	if err != nil {
+		return &models.TaskDefinition{}, "", "", err
+	}
+
+	actions := []models.ActionInterface{
+		&models.DownloadAction{
+			Artifact: "app package",
+			From:     lifecycleData.AppBitsDownloadUri,
+			To:       CNBWorkspaceDir,
+			User:     "vcap",
+		},
+	}
+
+	// buildpacks are downloaded under their key, as only their
+	// buildpack.toml tells their id and version
+	for _, buildpack := range lifecycleData.Buildpacks {
+		if buildpack.Name == cc_messages.CUSTOM_BUILDPACK {
+			actions = append(actions, &models.DownloadAction{
+				Artifact: "custom buildpack",
+				From:     buildpack.Url,
+				To:       cnbBuildpackDownloadPath(buildpack),
+				User:     "vcap",
+			})
+			continue
+		}
+
+		cachedDependencies = append(cachedDependencies, &models.CachedDependency{
+			Name:     buildpack.Name,
+			From:     buildpack.Url,
+			To:       cnbBuildpackDownloadPath(buildpack),
+			CacheKey: buildpack.Key,
+		})
+	}
+
+	downloadURL, err := buildArtifactsDownloadURL(lifecycleData)
+	if err != nil {
+		return &models.TaskDefinition{}, "", "", err
+	}
+
+	if downloadURL != nil {
+		actions = append(actions, models.Try(
+			&models.DownloadAction{
+				Artifact: "build artifacts cache",
+				From:     downloadURL.String(),
+				To:       CNBCacheDir,
+				User:     "vcap",
+			},
+		))
+	}
+
+	fileDescriptorLimit := uint64(resources.FileDescriptors)
+	runEnv := append(request.Environment,
+		&models.EnvironmentVariable{Name: "CF_STACK", Value: lifecycleData.Stack},
+		&models.EnvironmentVariable{Name: "CNB_STACK_ID", Value: lifecycleData.Stack},
+		&models.EnvironmentVariable{Name: "CNB_PLATFORM_API", Value: CNBPlatformAPI},
+	)
+
+	run := func(path string, args ...string) models.ActionInterface {
+		return &models.RunAction{
+			User: "vcap",
+			Path: path,
+			Args: args,
+			Env:  runEnv,
+			ResourceLimits: &models.ResourceLimits{
+				Nofile: &fileDescriptorLimit,
+			},
+		}
+	}
+
+	// The lifecycle's analyzer, restorer and exporter read and write OCI
+	// images, which CC cannot run, so the task runs those phases itself
+	// against the build artifacts cache and the droplet.
+	actions = append(actions, models.EmitProgressFor(
+		models.Serial(
+			run("/bin/sh", "-c", cnbResolveScript(lifecycleData.Buildpacks)),
+			run(path.Join(CNBLifecycleDir, "detector"),
+				"-app", CNBWorkspaceDir,
+				"-buildpacks", CNBBuildpacksDir,
+				"-group", CNBGroupPath,
+				"-layers", CNBLayersDir,
+				"-order", CNBOrderPath,
+				"-plan", CNBPlanPath,
+				"-platform", CNBPlatformDir,
+			),
+			run("/bin/sh", "-c", cnbAnalyzeScript),
+			run("/bin/sh", "-c", cnbRestoreScript),
+			run(path.Join(CNBLifecycleDir, "builder"),
+				"-app", CNBWorkspaceDir,
+				"-buildpacks", CNBBuildpacksDir,
+				"-group", CNBGroupPath,
+				"-layers", CNBLayersDir,
+				"-plan", CNBPlanPath,
+				"-platform", CNBPlatformDir,
+			),
+			run("/bin/sh", "-c", cnbExportScript),
+		),
+		"Staging...",
+		"Staging complete",
+		"Staging failed",
+	))
+
+	dropletURL, err := dropletUploadURL(config, request, lifecycleData)
+	if err != nil {
+		return &models.TaskDefinition{}, "", "", err
+	}
+
+	cacheURL, err := buildArtifactsUploadURL(config, request, lifecycleData)
+	if err != nil {
+		return &models.TaskDefinition{}, "", "", err
+	}
+
+	actions = append(actions, models.EmitProgressFor(
+		models.Parallel(
+			&models.UploadAction{
+				Artifact: "droplet",
+				From:     CNBOutputDroplet,
+				To:       addTimeoutParamToURL(*dropletURL, timeout).String(),
+				User:     "vcap",
+			},
+			models.Try(
+				&models.UploadAction{
+					Artifact: "build artifacts cache",
+					From:     CNBOutputCache,
+					To:       addTimeoutParamToURL(*cacheURL, timeout).String(),
+					User:     "vcap",
+				},
+			),
+		),
+		"Uploading droplet, build artifacts cache...",
+		"Uploading complete",
+		"Uploading failed",
+	))
+
+	annotation, err := stagingAnnotation(CNBLifecycleName, lifecycleData.Stack, request)
+	if err != nil {
+		return &models.TaskDefinition{}, "", "", err
+	}
+
+	taskDefinition := &models.TaskDefinition{
+		RootFs:                        rootFS,
+		ResultFile:                    CNBResultPath,
+		MemoryMb:                      int32(resources.MemoryMB),
+		DiskMb:                        int32(resources.DiskMB),
+		CpuWeight:                     resources.CpuWeight,
+		CachedDependencies:            cachedDependencies,
+		Action:                        models.WrapAction(models.Timeout(models.Serial(actions...), timeout)),
+		LogGuid:                       request.LogGuid,
+		LogSource:                     TaskLogSource,
+		CompletionCallbackUrl:         config.CallbackURL(stagingGuid),
+		EgressRules:                   request.EgressRules,
+		Annotation:                    annotation,
+		Privileged:                    config.PrivilegedContainers,
+		EnvironmentVariables:          []*models.EnvironmentVariable{{"LANG", DefaultLANG}},
+		TrustedSystemCertificatesPath: TrustedSystemCertificatesPath,
+		PlacementTags:                 config.PlacementRules.PlacementTags(CNBLifecycleName, lifecycleData.Stack, request.IsolationSegment),
+	}
+
+	logger.Debug("staging-task-request")
+
+	return taskDefinition, stagingGuid, config.TaskDomain, nil
+}
+
+func (backend *cnbBackend) BuildStagingResponse(taskResponse *models.TaskCallbackResponse) (cc_messages.StagingResponseForCC, error) {
+	config := backend.config.Load()
+	var response cc_messages.StagingResponseForCC
+
+	if taskResponse.Failed {
+		response.Error = config.Sanitizer(CNBLifecycleName, taskResponse.FailureReason)
+		return response, nil
+	}
+
+	var metadata CNBStagingMetadata
+	_, err := toml.Decode(taskResponse.Result, &metadata)
+	if err != nil {
+		return response, fmt.Errorf("failed to parse cnb staging result: %s", err)
+	}
+
+	result := cnbStagingResult{
+		LifecycleType: CNBLifecycleName,
+		LifecycleMetadata: cnbLifecycleMetadata{
+			Buildpacks: []cnbBuildpackForCC{},
+		},
+		ProcessTypes: map[string]string{},
+	}
+
+	// CC knows the buildpacks of the request by their key; others, such as
+	// the buildpacks of a meta-buildpack, only by their id
+	keys := map[string]string{}
+	for _, resolved := range metadata.ResolvedBuildpacks {
+		keys[resolved.ID] = resolved.Key
+	}
+
+	detected := []string{}
+	for _, buildpack := range metadata.Buildpacks {
+		key, ok := keys[buildpack.ID]
+		if !ok {
+			key = buildpack.ID
+		}
+
+		result.LifecycleMetadata.Buildpacks = append(result.LifecycleMetadata.Buildpacks, cnbBuildpackForCC{
+			Key:     key,
+			Name:    buildpack.ID,
+			Version: buildpack.Version,
+		})
+		detected = append(detected, buildpack.ID)
+	}
+	result.LifecycleMetadata.DetectedBuildpack = strings.Join(detected, ", ")
+
+	for _, process := range metadata.Processes {
+		result.ProcessTypes[process.Type] = strings.Join(append([]string{process.Command}, process.Args...), " ")
+	}
+
+	resultJson, err := json.Marshal(result)
+	if err != nil {
+		return response, err
+	}
+
+	rawResult := json.RawMessage(resultJson)
+	response.Result = &rawResult
+
+	return response, nil
+}
+
+// validateCNBBuildpacks checks that the task can download every buildpack:
+// custom buildpacks must be archives it can fetch over http or https.
+func validateCNBBuildpacks(buildpacks []cc_messages.Buildpack) error {
+	for _, buildpack := range buildpacks {
+		if buildpack.Name != cc_messages.CUSTOM_BUILDPACK {
+			continue
+		}
+
+		parsed, err := url.Parse(buildpack.Url)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return newInvalidRequestError(fmt.Sprintf("cnb buildpack '%s' must be an http or https URL of a buildpack archive", buildpack.Url))
+		}
+	}
+	return nil
+}
+
+func cnbBuildpackDownloadPath(buildpack cc_messages.Buildpack) string {
+	return path.Join(CNBBuildpackDownloadsDir, fmt.Sprintf("%x", md5.Sum([]byte(buildpack.Key))))
+}
+
+// cnbAddBuildpack reads the id and version of a downloaded buildpack from
+// its buildpack.toml, links it where the lifecycle looks for it, adds it to
+// the current group of the order and records it in CNBResolvedPath. It is
+// called with the download directory and the TOML quoted name and key.
+var cnbAddBuildpack = fmt.Sprintf(`add_buildpack() {
+  set -- "$1" "$2" "$3" $(awk -F'"' '/^\[buildpack\]/ { b = 1; next } /^\[/ { b = 0 } b && $1 ~ /^[ \t]*id[ \t]*=/ { id = $2 } b && $1 ~ /^[ \t]*version[ \t]*=/ { version = $2 } END { print id, version }' "$1/buildpack.toml")
+  if [ -z "$5" ]; then
+    echo "buildpack $2 has no id and version in its buildpack.toml" >&2
+    exit 1
+  fi
+  mkdir -p "%[1]s/$(echo "$4" | tr / _)"
+  ln -sfn "$1" "%[1]s/$(echo "$4" | tr / _)/$5"
+  printf '\n  [[order.group]]\n    id = "%%s"\n    version = "%%s"\n' "$4" "$5" >> %[2]s
+  printf '[[resolved_buildpacks]]\n  key = %%s\n  name = %%s\n  id = "%%s"\n  version = "%%s"\n\n' "$3" "$2" "$4" "$5" >> %[3]s
+}
+`, CNBBuildpacksDir, CNBOrderPath, CNBResolvedPath)
+
+// cnbResolveScript lays the buildpacks out for the lifecycle and writes the
+// order.toml the detector picks them from. Buildpacks chosen for the app,
+// which CC marks to skip detection, all run as one group. Otherwise each is
+// a group of its own and the first to pass detection is used, as with the
+// buildpack lifecycle.
+func cnbResolveScript(buildpacks []cc_messages.Buildpack) string {
+	chosen := len(buildpacks) > 0
+	for _, buildpack := range buildpacks {
+		chosen = chosen && buildpack.SkipDetect
+	}
+
+	script := &strings.Builder{}
+	fmt.Fprintf(script, "set -e\n%s", cnbAddBuildpack)
+	fmt.Fprintf(script, ": > %s\n: > %s\n", CNBOrderPath, CNBResolvedPath)
+	for i, buildpack := range buildpacks {
+		if !chosen || i == 0 {
+			fmt.Fprintf(script, "echo '[[order]]' >> %s\n", CNBOrderPath)
+		}
+		fmt.Fprintf(script, "add_buildpack %s %s %s\n",
+			cnbBuildpackDownloadPath(buildpack),
+			shellQuote(strconv.Quote(buildpack.Name)),
+			shellQuote(strconv.Quote(buildpack.Key)),
+		)
+	}
+	return script.String()
+}
+
+// cnbAnalyzeScript lists the layers of the build artifacts cache that the
+// buildpacks of the detected group may reuse: those their buildpack asked
+// to cache, with the store.toml of each buildpack.
+var cnbAnalyzeScript = fmt.Sprintf(`set -e
+: > %[1]s
+for id in $(awk -F'"' '$1 ~ /^[ \t]*id[ \t]*=/ { print $2 }' %[2]s); do
+  for layer in %[3]s/$(echo "$id" | tr / _)/*.toml; do
+    if [ -f "$layer" ] && { [ "${layer##*/}" = store.toml ] || grep -Eq '^[[:space:]]*cache[[:space:]]*=[[:space:]]*true' "$layer"; }; then
+      echo "${layer#%[3]s/}" >> %[1]s
+    fi
+  done
+done
+`, CNBAnalyzedPath, CNBGroupPath, CNBCacheDir)
+
+// cnbRestoreScript restores the analyzed layers, with their metadata, for
+// the builder.
+var cnbRestoreScript = fmt.Sprintf(`set -e
+while read -r layer; do
+  mkdir -p "%[2]s/$(dirname "$layer")"
+  cp "%[3]s/$layer" "%[2]s/$layer"
+  if [ -d "%[3]s/${layer%%.toml}" ]; then
+    cp -a "%[3]s/${layer%%.toml}" "%[2]s/${layer%%.toml}"
+  fi
+done < %[1]s
+`, CNBAnalyzedPath, CNBLayersDir, CNBCacheDir)
+
+// cnbExportScript exports the droplet and the build artifacts cache. The
+// droplet holds the app and the layers the buildpacks marked for launch,
+// with the launch metadata the builder wrote, laid out as CNBHomeDir for
+// the lifecycle's launcher. The cache holds the layers marked for caching.
+// The staging result is the launch metadata followed by the resolved
+// buildpacks.
+var cnbExportScript = fmt.Sprintf(`set -e
+cd %[1]s
+printf '%%s\n' %[2]s %[3]s/config/metadata.toml > /tmp/droplet-contents
+: > /tmp/cache-contents
+for layer in */*.toml; do
+  case "$layer" in config/*) continue ;; esac
+  if grep -Eq '^[[:space:]]*launch[[:space:]]*=[[:space:]]*true' "$layer"; then
+    echo "%[3]s/$layer" >> /tmp/droplet-contents
+    if [ -d "${layer%%.toml}" ]; then
+      echo "%[3]s/${layer%%.toml}" >> /tmp/droplet-contents
+    fi
+  fi
+  if [ "${layer##*/}" = store.toml ] || grep -Eq '^[[:space:]]*cache[[:space:]]*=[[:space:]]*true' "$layer"; then
+    echo "$layer" >> /tmp/cache-contents
+    if [ -d "${layer%%.toml}" ]; then
+      echo "${layer%%.toml}" >> /tmp/cache-contents
+    fi
+  fi
+done
+tar -czf %[4]s -C %[5]s -T /tmp/droplet-contents
+tar -czf %[6]s -C %[1]s -T /tmp/cache-contents
+{ cat %[7]s; echo; cat %[8]s; } > %[9]s
+`, CNBLayersDir, path.Base(CNBWorkspaceDir), path.Base(CNBLayersDir), CNBOutputDroplet, CNBHomeDir, CNBOutputCache, CNBMetadataPath, CNBResolvedPath, CNBResultPath)
+
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
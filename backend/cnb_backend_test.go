@@ -0,0 +1,377 @@
+package backend_test
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/backend"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// cnbLifecycleFlags declares the flags of the lifecycle's detector and
+// builder for platform API 0.5, as defined by buildpacks/lifecycle.
+func cnbLifecycleFlags(phase string) *flag.FlagSet {
+	flags := flag.NewFlagSet(phase, flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	for _, name := range []string{"app", "buildpacks", "group", "layers", "log-level", "plan", "platform"} {
+		flags.String(name, "", "")
+	}
+	if phase == "detector" {
+		flags.String("order", "", "")
+	}
+	return flags
+}
+
+var _ = Describe("CNBBackend", func() {
+	var (
+		cnb            backend.Backend
+		config         backend.Config
+		stagingRequest cc_messages.StagingRequestFromCC
+		stack          string
+		appBitsUri     string
+		buildpacks     []cc_messages.Buildpack
+	)
+
+	stagingActions := func(taskDef *models.TaskDefinition) []*models.Action {
+		return actionsFromTaskDef(taskDef)[1].GetEmitProgressAction().Action.GetSerialAction().Actions
+	}
+
+	BeforeEach(func() {
+		config = backend.Config{
+			TaskDomain:    "config-task-domain",
+			StagerURL:     "http://the-stager.example.com",
+			FileServerURL: "http://file-server.com",
+			CCUploaderURL: "http://cc-uploader.com",
+			Lifecycles: map[string]string{
+				"cnb/cflinuxfs3": "cnb-lifecycle.tgz",
+			},
+			Sanitizer: func(lifecycle, msg string) *cc_messages.StagingError {
+				return &cc_messages.StagingError{Message: msg + " was totally sanitized"}
+			},
+		}
+
+		cnb = backend.NewCNBBackend(config, lagertest.NewTestLogger("test"))
+
+		stack = "cflinuxfs3"
+		appBitsUri = "http://example-uri.com/bunny"
+		buildpacks = []cc_messages.Buildpack{
+			{Name: "node_buildpack", Key: "node-cnb", Url: "http://example.com/node-cnb.zip"},
+			{Name: "npm_buildpack", Key: "npm-cnb", Url: "http://example.com/npm-cnb.zip"},
+		}
+	})
+
+	JustBeforeEach(func() {
+		rawJsonBytes, err := json.Marshal(cc_messages.BuildpackStagingData{
+			AppBitsDownloadUri:           appBitsUri,
+			Buildpacks:                   buildpacks,
+			DropletUploadUri:             "http://example-uri.com/droplet-upload",
+			BuildArtifactsCacheUploadUri: "http://example-uri.com/cache-upload",
+			Stack:                        stack,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		lifecycleData := json.RawMessage(rawJsonBytes)
+
+		stagingRequest = cc_messages.StagingRequestFromCC{
+			AppId:           "bunny",
+			LogGuid:         "log-guid",
+			FileDescriptors: 512,
+			MemoryMB:        2048,
+			DiskMB:          3072,
+			Timeout:         900,
+			Lifecycle:       "cnb",
+			LifecycleData:   &lifecycleData,
+		}
+	})
+
+	Describe("BuildRecipe", func() {
+		It("downloads the cnb lifecycle and the buildpacks", func() {
+			taskDef, guid, domain, err := cnb.BuildRecipe("staging-guid", stagingRequest)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(guid).To(Equal("staging-guid"))
+			Expect(domain).To(Equal("config-task-domain"))
+
+			Expect(taskDef.CachedDependencies).To(HaveLen(3))
+			Expect(taskDef.CachedDependencies[0].From).To(Equal("http://file-server.com/v1/static/cnb-lifecycle.tgz"))
+			Expect(taskDef.CachedDependencies[0].CacheKey).To(Equal("cnb-cflinuxfs3-lifecycle"))
+			Expect(taskDef.CachedDependencies[1]).To(Equal(&models.CachedDependency{
+				Name:     "node_buildpack",
+				From:     "http://example.com/node-cnb.zip",
+				To:       "/tmp/buildpack-downloads/" + fmt.Sprintf("%x", md5.Sum([]byte("node-cnb"))),
+				CacheKey: "node-cnb",
+			}))
+			Expect(taskDef.CachedDependencies[2].To).To(Equal("/tmp/buildpack-downloads/" + fmt.Sprintf("%x", md5.Sum([]byte("npm-cnb")))))
+		})
+
+		It("resolves the buildpacks from their buildpack.toml into an order.toml with a group per buildpack", func() {
+			taskDef, _, _, err := cnb.BuildRecipe("staging-guid", stagingRequest)
+			Expect(err).NotTo(HaveOccurred())
+
+			resolve := stagingActions(taskDef)[0].GetRunAction()
+			Expect(resolve.Path).To(Equal("/bin/sh"))
+			Expect(resolve.Args[0]).To(Equal("-c"))
+
+			script := resolve.Args[1]
+			Expect(script).To(ContainSubstring(`"$1/buildpack.toml"`))
+			Expect(script).To(ContainSubstring(`ln -sfn "$1" "/tmp/buildpacks/$(echo "$4" | tr / _)/$5"`))
+			Expect(script).To(HaveSuffix(
+				": > /tmp/order.toml\n" +
+					": > /tmp/resolved-buildpacks.toml\n" +
+					"echo '[[order]]' >> /tmp/order.toml\n" +
+					"add_buildpack /tmp/buildpack-downloads/" + fmt.Sprintf("%x", md5.Sum([]byte("node-cnb"))) + ` '"node_buildpack"' '"node-cnb"'` + "\n" +
+					"echo '[[order]]' >> /tmp/order.toml\n" +
+					"add_buildpack /tmp/buildpack-downloads/" + fmt.Sprintf("%x", md5.Sum([]byte("npm-cnb"))) + ` '"npm_buildpack"' '"npm-cnb"'` + "\n",
+			))
+		})
+
+		Context("when the buildpacks were chosen for the app", func() {
+			BeforeEach(func() {
+				for i := range buildpacks {
+					buildpacks[i].SkipDetect = true
+				}
+			})
+
+			It("runs them all as one group", func() {
+				taskDef, _, _, err := cnb.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).NotTo(HaveOccurred())
+
+				script := stagingActions(taskDef)[0].GetRunAction().Args[1]
+				Expect(strings.Count(script, "echo '[[order]]'")).To(Equal(1))
+				Expect(strings.Count(script, "\nadd_buildpack ")).To(Equal(2))
+			})
+		})
+
+		Context("with a custom buildpack", func() {
+			BeforeEach(func() {
+				buildpacks = []cc_messages.Buildpack{
+					{Name: cc_messages.CUSTOM_BUILDPACK, Key: "https://example.com/custom.tgz", Url: "https://example.com/custom.tgz"},
+				}
+			})
+
+			It("downloads it from its URL", func() {
+				taskDef, _, _, err := cnb.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(taskDef.CachedDependencies).To(HaveLen(1))
+				Expect(actionsFromTaskDef(taskDef)[1].GetDownloadAction()).To(Equal(&models.DownloadAction{
+					Artifact: "custom buildpack",
+					From:     "https://example.com/custom.tgz",
+					To:       "/tmp/buildpack-downloads/" + fmt.Sprintf("%x", md5.Sum([]byte("https://example.com/custom.tgz"))),
+					User:     "vcap",
+				}))
+			})
+
+			Context("when its URL is not http or https", func() {
+				BeforeEach(func() {
+					buildpacks[0].Url = "git://example.com/custom.git"
+				})
+
+				It("rejects the request", func() {
+					_, _, _, err := cnb.BuildRecipe("staging-guid", stagingRequest)
+					Expect(err).To(MatchError(ContainSubstring("must be an http or https URL")))
+				})
+			})
+		})
+
+		It("runs every phase of the lifecycle", func() {
+			taskDef, _, _, err := cnb.BuildRecipe("staging-guid", stagingRequest)
+			Expect(err).NotTo(HaveOccurred())
+
+			actions := stagingActions(taskDef)
+			Expect(actions).To(HaveLen(6))
+			Expect(actions[0].GetRunAction().Args[1]).To(ContainSubstring("add_buildpack "))
+			Expect(actions[1].GetRunAction().Path).To(Equal("/tmp/lifecycle/detector"))
+			Expect(actions[2].GetRunAction().Args[1]).To(ContainSubstring("> /tmp/analyzed"))
+			Expect(actions[3].GetRunAction().Args[1]).To(ContainSubstring("< /tmp/analyzed"))
+			Expect(actions[4].GetRunAction().Path).To(Equal("/tmp/lifecycle/builder"))
+			Expect(actions[5].GetRunAction().Args[1]).To(ContainSubstring("tar -czf /tmp/droplet"))
+		})
+
+		It("runs the detector and builder with the lifecycle's flags", func() {
+			taskDef, _, _, err := cnb.BuildRecipe("staging-guid", stagingRequest)
+			Expect(err).NotTo(HaveOccurred())
+
+			actions := stagingActions(taskDef)
+			for _, i := range []int{1, 4} {
+				runAction := actions[i].GetRunAction()
+				phase := path.Base(runAction.Path)
+
+				flags := cnbLifecycleFlags(phase)
+				Expect(flags.Parse(runAction.Args)).To(Succeed())
+				Expect(flags.Args()).To(BeEmpty())
+				Expect(flags.Lookup("buildpacks").Value.String()).To(Equal(backend.CNBBuildpacksDir))
+				Expect(flags.Lookup("layers").Value.String()).To(Equal(backend.CNBLayersDir))
+				Expect(runAction.Env).To(ContainElement(&models.EnvironmentVariable{Name: "CNB_PLATFORM_API", Value: backend.CNBPlatformAPI}))
+			}
+
+			detectorFlags := cnbLifecycleFlags("detector")
+			Expect(detectorFlags.Parse(actions[1].GetRunAction().Args)).To(Succeed())
+			Expect(detectorFlags.Lookup("order").Value.String()).To(Equal(backend.CNBOrderPath))
+		})
+
+		It("restores the cached layers of the detected buildpacks", func() {
+			taskDef, _, _, err := cnb.BuildRecipe("staging-guid", stagingRequest)
+			Expect(err).NotTo(HaveOccurred())
+
+			actions := stagingActions(taskDef)
+			Expect(actions[2].GetRunAction().Args[1]).To(ContainSubstring("/home/vcap/layers/group.toml"))
+			Expect(actions[2].GetRunAction().Args[1]).To(ContainSubstring("cache[[:space:]]*=[[:space:]]*true"))
+			Expect(actions[3].GetRunAction().Args[1]).To(ContainSubstring(`cp "/tmp/cache/$layer" "/home/vcap/layers/$layer"`))
+		})
+
+		It("exports the app and its launch layers as the droplet and its cache layers as the cache", func() {
+			taskDef, _, _, err := cnb.BuildRecipe("staging-guid", stagingRequest)
+			Expect(err).NotTo(HaveOccurred())
+
+			script := stagingActions(taskDef)[5].GetRunAction().Args[1]
+			Expect(script).To(ContainSubstring("printf '%s\\n' workspace layers/config/metadata.toml > /tmp/droplet-contents"))
+			Expect(script).To(ContainSubstring("launch[[:space:]]*=[[:space:]]*true"))
+			Expect(script).To(ContainSubstring("tar -czf /tmp/droplet -C /home/vcap -T /tmp/droplet-contents"))
+			Expect(script).To(ContainSubstring("tar -czf /tmp/output-cache -C /home/vcap/layers -T /tmp/cache-contents"))
+			Expect(script).To(HaveSuffix("{ cat /home/vcap/layers/config/metadata.toml; echo; cat /tmp/resolved-buildpacks.toml; } > /tmp/result.toml\n"))
+		})
+
+		It("uploads the droplet through the cc-uploader", func() {
+			taskDef, _, _, err := cnb.BuildRecipe("staging-guid", stagingRequest)
+			Expect(err).NotTo(HaveOccurred())
+
+			uploads := actionsFromTaskDef(taskDef)[2].GetEmitProgressAction().Action.GetParallelAction().Actions
+			dropletUpload := uploads[0].GetUploadAction()
+			Expect(dropletUpload.From).To(Equal(backend.CNBOutputDroplet))
+			Expect(dropletUpload.To).To(Equal("http://cc-uploader.com/v1/droplet/bunny?" +
+				cc_messages.CcDropletUploadUriKey + "=http%3A%2F%2Fexample-uri.com%2Fdroplet-upload&" +
+				cc_messages.CcTimeoutKey + "=900"))
+		})
+
+		It("annotates the task with the cnb lifecycle", func() {
+			taskDef, _, _, err := cnb.BuildRecipe("staging-guid", stagingRequest)
+			Expect(err).NotTo(HaveOccurred())
+
+			var annotation cc_messages.StagingTaskAnnotation
+			Expect(json.Unmarshal([]byte(taskDef.Annotation), &annotation)).To(Succeed())
+			Expect(annotation).To(Equal(cc_messages.StagingTaskAnnotation{Lifecycle: "cnb"}))
+			Expect(taskDef.ResultFile).To(Equal(backend.CNBResultPath))
+			Expect(taskDef.RootFs).To(Equal(models.PreloadedRootFS("cflinuxfs3")))
+		})
+
+		Context("when no lifecycle is defined for the stack", func() {
+			BeforeEach(func() {
+				stack = "no_such_stack"
+			})
+
+			It("returns an error", func() {
+				_, _, _, err := cnb.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).To(Equal(backend.ErrNoCompilerDefined))
+			})
+		})
+
+		Context("with a missing app bits download uri", func() {
+			BeforeEach(func() {
+				appBitsUri = ""
+			})
+
+			It("returns an error", func() {
+				_, _, _, err := cnb.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).To(Equal(backend.ErrMissingAppBitsDownloadUri))
+			})
+		})
+	})
+
+	Describe("BuildStagingResponse", func() {
+		It("reports the buildpacks of the request by their key", func() {
+			response, err := cnb.BuildStagingResponse(&models.TaskCallbackResponse{
+				Result: `
+[[buildpacks]]
+  id = "org.cloudfoundry.node"
+  version = "1.2.3"
+
+[[buildpacks]]
+  id = "org.cloudfoundry.npm"
+  version = "0.1.0"
+
+[[resolved_buildpacks]]
+  key = "node-cnb"
+  name = "node_buildpack"
+  id = "org.cloudfoundry.node"
+  version = "1.2.3"
+`,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			var result struct {
+				LifecycleMetadata struct {
+					Buildpacks []map[string]string `json:"buildpacks"`
+				} `json:"lifecycle_metadata"`
+			}
+			Expect(json.Unmarshal(*response.Result, &result)).To(Succeed())
+			Expect(result.LifecycleMetadata.Buildpacks).To(Equal([]map[string]string{
+				{"key": "node-cnb", "name": "org.cloudfoundry.node", "version": "1.2.3"},
+				{"key": "org.cloudfoundry.npm", "name": "org.cloudfoundry.npm", "version": "0.1.0"},
+			}))
+		})
+
+		It("translates the cnb metadata into the CC result format", func() {
+			response, err := cnb.BuildStagingResponse(&models.TaskCallbackResponse{
+				Result: `
+[[buildpacks]]
+  id = "org.cloudfoundry.node"
+  version = "1.2.3"
+
+[[processes]]
+  type = "web"
+  command = "node"
+  args = ["server.js"]
+  direct = false
+`,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.Error).To(BeNil())
+			Expect([]byte(*response.Result)).To(MatchJSON(`{
+				"lifecycle_type": "cnb",
+				"lifecycle_metadata": {
+					"detected_buildpack": "org.cloudfoundry.node",
+					"buildpacks": [{"key": "org.cloudfoundry.node", "name": "org.cloudfoundry.node", "version": "1.2.3"}]
+				},
+				"process_types": {"web": "node server.js"},
+				"execution_metadata": ""
+			}`))
+		})
+
+		It("returns an error for malformed metadata", func() {
+			_, err := cnb.BuildStagingResponse(&models.TaskCallbackResponse{Result: "[[buildpacks"})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("sanitizes failures", func() {
+			response, err := cnb.BuildStagingResponse(&models.TaskCallbackResponse{
+				Failed:        true,
+				FailureReason: "some-failure-reason",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.Error).To(Equal(&cc_messages.StagingError{Message: "some-failure-reason was totally sanitized"}))
+		})
+	})
+
+	Describe("SanitizeErrorMessage", func() {
+		It("reports detect failures with their own id", func() {
+			stagingErr := backend.SanitizeErrorMessage(backend.CNBLifecycleName, "Exited with status "+strconv.Itoa(backend.CNBDetectFailCode))
+			Expect(stagingErr.Id).To(Equal(backend.CNB_DETECT_FAILED))
+			Expect(stagingErr.Message).To(Equal("staging failed"))
+		})
+
+		It("reports build failures with their own id", func() {
+			stagingErr := backend.SanitizeErrorMessage(backend.CNBLifecycleName, "Exited with status "+strconv.Itoa(backend.CNBBuildFailCode))
+			Expect(stagingErr.Id).To(Equal(backend.CNB_BUILD_FAILED))
+			Expect(stagingErr.Message).To(Equal("staging failed"))
+		})
+	})
+})
@@ -21,13 +21,24 @@ const (
 	MountCgroupsPath            = "/tmp/docker_app_lifecycle/mount_cgroups"
 	DockerBuilderExecutablePath = "/tmp/docker_app_lifecycle/builder"
 	DockerBuilderOutputPath     = "/tmp/docker-result/result.json"
+
+	redactedCredential = "[REDACTED]"
 )
 
-var ErrMissingDockerImageUrl = errors.New(diego_errors.MISSING_DOCKER_IMAGE_URL)
-var ErrMissingDockerCredentials = errors.New(diego_errors.MISSING_DOCKER_CREDENTIALS)
+// dockerPasswordScript starts the builder with the password the task
+// downloaded, removing the file first. The builder is given as $0 and its
+// other arguments follow.
+const dockerPasswordScript = `password=$(cat ` + DockerCredentialsDir + `/` + DockerPasswordFile + `) && ` +
+	`rm -f ` + DockerCredentialsDir + `/` + DockerPasswordFile + ` && ` +
+	`exec "$0" "$@" -dockerPassword "$password"`
+
+var ErrMissingDockerImageUrl = newInvalidRequestError(diego_errors.MISSING_DOCKER_IMAGE_URL)
+var ErrMissingDockerCredentials = newInvalidRequestError(diego_errors.MISSING_DOCKER_CREDENTIALS)
+var ErrMissingDockerImageDigest = NewStagingError(KindDockerImageDigestMissing, errors.New("docker image digest missing from staging result"))
+var ErrDockerCredentialsUnavailable = NewStagingError(KindStagingFailed, errors.New("docker credentials cannot be delivered without a callback signing key"))
 
 type dockerBackend struct {
-	config Config
+	config *SharedConfig
 	logger lager.Logger
 }
 
@@ -36,6 +47,12 @@ type consulServiceInfo struct {
 }
 
 func NewDockerBackend(config Config, logger lager.Logger) Backend {
+	return NewDockerBackendWithSharedConfig(NewSharedConfig(config), logger)
+}
+
+// NewDockerBackendWithSharedConfig builds a backend that picks up every Config
+// stored in config.
+func NewDockerBackendWithSharedConfig(config *SharedConfig, logger lager.Logger) Backend {
 	return &dockerBackend{
 		config: config,
 		logger: logger.Session("docker"),
@@ -43,6 +60,7 @@ func NewDockerBackend(config Config, logger lager.Logger) Backend {
 }
 
 func (backend *dockerBackend) BuildRecipe(stagingGuid string, request cc_messages.StagingRequestFromCC) (*models.TaskDefinition, string, string, error) {
+	config := backend.config.Load()
 	logger := backend.logger.Session("build-recipe", lager.Data{"app-id": request.AppId, "staging-guid": stagingGuid})
 	logger.Info("staging-request")
 
@@ -57,7 +75,28 @@ func (backend *dockerBackend) BuildRecipe(stagingGuid string, request cc_message
 		return &models.TaskDefinition{}, "", "", err
 	}
 
-	compilerURL, err := backend.compilerDownloadURL()
+	imageRef, err := ParseDockerImageReference(lifecycleData.DockerImageUrl)
+	if err != nil {
+		return &models.TaskDefinition{}, "", "", err
+	}
+
+	err = config.DockerImagePolicy.Check(imageRef, request.IsolationSegment)
+	if err != nil {
+		logger.Info("docker-image-not-allowed", lager.Data{"reason": err.Error()})
+		return &models.TaskDefinition{}, "", "", err
+	}
+
+	resources, err := config.ResourcePolicies.Resolve(DockerLifecycleName, config.DockerStagingStack, 0, request)
+	if err != nil {
+		return &models.TaskDefinition{}, "", "", err
+	}
+
+	rootFS, err := config.StackRootFSes.RootFS(config.DockerStagingStack)
+	if err != nil {
+		return &models.TaskDefinition{}, "", "", err
+	}
+
+	compilerURL, err := backend.compilerDownloadURL(config)
 	if err != nil {
 		return &models.TaskDefinition{}, "", "", err
 	}
@@ -70,96 +109,228 @@ func (backend *dockerBackend) BuildRecipe(stagingGuid string, request cc_message
 		},
 	}
 
+	pullRef, registry := config.DockerRegistries.Resolve(imageRef)
+	if pullRef != imageRef {
+		logger.Info("using-registry-mirror", lager.Data{"registry": imageRef.Registry, "mirror": pullRef.Registry})
+	}
+
 	runActionArguments := []string{
 		"-outputMetadataJSONFilename", DockerBuilderOutputPath,
-		"-dockerRef", lifecycleData.DockerImageUrl,
+		"-dockerRef", pullRef.String(),
 	}
 
-	if len(backend.config.InsecureDockerRegistries) > 0 {
-		insecureDockerRegistries := strings.Join(backend.config.InsecureDockerRegistries, ",")
-		runActionArguments = append(runActionArguments, "-insecureDockerRegistries", insecureDockerRegistries)
+	insecureDockerRegistries := config.InsecureDockerRegistries
+	if registry.Insecure() && !containsString(insecureDockerRegistries, pullRef.Registry) {
+		insecureDockerRegistries = append(append([]string{}, insecureDockerRegistries...), pullRef.Registry)
 	}
 
-	if lifecycleData.DockerUser != "" {
-		runActionArguments = append(runActionArguments,
-			"-dockerUser", lifecycleData.DockerUser,
-			"-dockerPassword", lifecycleData.DockerPassword)
+	if len(insecureDockerRegistries) > 0 {
+		runActionArguments = append(runActionArguments, "-insecureDockerRegistries", strings.Join(insecureDockerRegistries, ","))
+	}
+
+	environment := request.Environment
+	if registry.CABundle != "" {
+		caBundleURL, err := backend.staticDownloadURL(config, registry.CABundle)
+		if err != nil {
+			return &models.TaskDefinition{}, "", "", err
+		}
+
+		cachedDependencies = append(cachedDependencies, &models.CachedDependency{
+			From:     caBundleURL.String(),
+			To:       DockerRegistryCACertsPath,
+			CacheKey: "docker-registry-ca-" + cacheKeySuffix(pullRef.Registry),
+		})
+
+		// the builder verifies registries against the system roots, which Go
+		// extends with the certificates in SSL_CERT_DIR
+		environment = make([]*models.EnvironmentVariable, 0, len(request.Environment)+1)
+		environment = append(environment, request.Environment...)
+		environment = append(environment, &models.EnvironmentVariable{
+			Name:  SSLCertDirEnvVar,
+			Value: DockerRegistryCACertsPath,
+		})
 	}
 
-	fileDescriptorLimit := uint64(request.FileDescriptors)
+	// credentials given with the request take precedence over the registry's
+	if lifecycleData.DockerUser == "" {
+		lifecycleData.DockerUser = registry.Username
+		lifecycleData.DockerPassword = registry.Password
+	}
+
+	fileDescriptorLimit := uint64(resources.FileDescriptors)
 	runAs := "vcap"
 
 	actions := []models.ActionInterface{}
 
+	runAction := &models.RunAction{
+		Path: DockerBuilderExecutablePath,
+		Args: runActionArguments,
+		Env:  environment,
+		ResourceLimits: &models.ResourceLimits{
+			Nofile: &fileDescriptorLimit,
+		},
+		User: runAs,
+	}
+
+	if lifecycleData.DockerUser != "" {
+		// the password is sealed into the URL the task downloads it from, so
+		// that it is never stored in the BBS
+		if len(config.DockerCredentialsKeys) == 0 {
+			logger.Error("failed-to-deliver-docker-credentials", ErrDockerCredentialsUnavailable)
+			return &models.TaskDefinition{}, "", "", ErrDockerCredentialsUnavailable
+		}
+
+		sealed, err := SealDockerCredentials(config.DockerCredentialsKeys[0], stagingGuid, lifecycleData.DockerPassword, config.now().Add(DockerCredentialsTTL))
+		if err != nil {
+			return &models.TaskDefinition{}, "", "", err
+		}
+
+		actions = append(actions, &models.DownloadAction{
+			From: config.DockerCredentialsURL(stagingGuid, sealed),
+			To:   DockerCredentialsDir,
+			User: runAs,
+		})
+
+		runAction.Path = "/bin/sh"
+		runAction.Args = append([]string{"-c", dockerPasswordScript, DockerBuilderExecutablePath}, runActionArguments...)
+		runAction.Args = append(runAction.Args, "-dockerUser", lifecycleData.DockerUser)
+	}
+
 	actions = append(
 		actions,
 		models.EmitProgressFor(
-			&models.RunAction{
-				Path: DockerBuilderExecutablePath,
-				Args: runActionArguments,
-				Env:  request.Environment,
-				ResourceLimits: &models.ResourceLimits{
-					Nofile: &fileDescriptorLimit,
-				},
-				User: runAs,
-			},
+			runAction,
 			"Staging...",
 			"Staging Complete",
 			"Staging Failed",
 		),
 	)
 
-	annotationJson, _ := json.Marshal(cc_messages.StagingTaskAnnotation{
-		Lifecycle:          DockerLifecycleName,
-		CompletionCallback: request.CompletionCallback,
-	})
+	annotation, err := newStagingTaskAnnotation(DockerLifecycleName, config.DockerStagingStack, request)
+	if err != nil {
+		return &models.TaskDefinition{}, "", "", err
+	}
+
+	if pullRef != imageRef {
+		annotation.OriginalDockerImage = lifecycleData.DockerImageUrl
+	}
+
+	annotationJson, err := json.Marshal(annotation)
+	if err != nil {
+		return &models.TaskDefinition{}, "", "", err
+	}
 
 	taskDefinition := &models.TaskDefinition{
-		RootFs:                        models.PreloadedRootFS(backend.config.DockerStagingStack),
+		RootFs:                        rootFS,
 		ResultFile:                    DockerBuilderOutputPath,
-		Privileged:                    backend.config.PrivilegedContainers,
-		MemoryMb:                      int32(request.MemoryMB),
+		Privileged:                    config.PrivilegedContainers,
+		MemoryMb:                      int32(resources.MemoryMB),
 		LogSource:                     TaskLogSource,
 		LogGuid:                       request.LogGuid,
 		EgressRules:                   request.EgressRules,
-		DiskMb:                        int32(request.DiskMB),
-		CompletionCallbackUrl:         backend.config.CallbackURL(stagingGuid),
+		DiskMb:                        int32(resources.DiskMB),
+		CpuWeight:                     resources.CpuWeight,
+		CompletionCallbackUrl:         config.CallbackURL(stagingGuid),
 		Annotation:                    string(annotationJson),
 		Action:                        models.WrapAction(models.Timeout(models.Serial(actions...), dockerTimeout(request, backend.logger))),
 		CachedDependencies:            cachedDependencies,
 		TrustedSystemCertificatesPath: TrustedSystemCertificatesPath,
+		PlacementTags:                 config.PlacementRules.PlacementTags(DockerLifecycleName, config.DockerStagingStack, request.IsolationSegment),
 	}
 	logger.Debug("staging-task-request")
 
-	if request.IsolationSegment != "" {
-		taskDefinition.PlacementTags = []string{request.IsolationSegment}
-	}
-
-	return taskDefinition, stagingGuid, backend.config.TaskDomain, nil
+	return taskDefinition, stagingGuid, config.TaskDomain, nil
 }
 
 func (backend *dockerBackend) BuildStagingResponse(taskResponse *models.TaskCallbackResponse) (cc_messages.StagingResponseForCC, error) {
+	config := backend.config.Load()
 	var response cc_messages.StagingResponseForCC
 
 	if taskResponse.Failed {
-		response.Error = backend.config.Sanitizer(taskResponse.FailureReason)
+		response.Error = config.Sanitizer(DockerLifecycleName, taskResponse.FailureReason)
 	} else {
-		result := json.RawMessage([]byte(taskResponse.Result))
-		response.Result = &result
+		result, err := pinnedStagingResult(taskResponse.Result, taskResponse.Annotation)
+		if err != nil {
+			backend.logger.Error("failed-to-pin-docker-image", err, lager.Data{"task-guid": taskResponse.TaskGuid})
+			response.Error = AsStagingError(err).ToCC()
+		} else {
+			response.Result = &result
+		}
 	}
 
 	return response, nil
 }
 
-func (backend *dockerBackend) compilerDownloadURL() (*url.URL, error) {
-	lifecycleFilename := backend.config.Lifecycles["docker"]
+// pinnedStagingResult rewrites the builder's result so that CC runs the exact
+// image that was staged: lifecycle_metadata.docker_image becomes a
+// repository@digest reference to the image the user asked for. The builder
+// reports the digest as docker_image_digest or within docker_image. Images
+// staged from a mirror keep the mirror's reference as mirrored_docker_image.
+func pinnedStagingResult(result string, annotationJson string) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal([]byte(result), &fields)
+	if err != nil {
+		return nil, NewStagingError(KindStagingFailed, fmt.Errorf("invalid docker staging result: %s", err))
+	}
+
+	var metadata map[string]interface{}
+	err = json.Unmarshal(fields["lifecycle_metadata"], &metadata)
+	if err != nil || metadata == nil {
+		return nil, NewStagingError(KindStagingFailed, errors.New("invalid docker staging result: missing lifecycle metadata"))
+	}
+
+	image, _ := metadata["docker_image"].(string)
+	digest, _ := metadata["docker_image_digest"].(string)
+	if digest == "" {
+		if reported, err := ParseDockerImageReference(image); err == nil {
+			digest = reported.Digest
+		}
+	}
+
+	if !strings.HasPrefix(digest, "sha256:") || !digestPattern.MatchString(digest) {
+		return nil, ErrMissingDockerImageDigest
+	}
+
+	var annotation StagingTaskAnnotation
+	err = json.Unmarshal([]byte(annotationJson), &annotation)
+	if err == nil && annotation.OriginalDockerImage != "" {
+		metadata["mirrored_docker_image"] = image
+		image = annotation.OriginalDockerImage
+	}
+
+	pinned, err := ParseDockerImageReference(image)
+	if err != nil {
+		return nil, NewStagingError(KindStagingFailed, fmt.Errorf("invalid docker staging result: %s", err))
+	}
+	pinned.Tag = ""
+	pinned.Digest = digest
+
+	metadata["docker_image"] = pinned.String()
+	metadata["docker_image_digest"] = digest
+
+	fields["lifecycle_metadata"], err = json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(fields)
+}
+
+func (backend *dockerBackend) compilerDownloadURL(config Config) (*url.URL, error) {
+	lifecycleFilename := config.Lifecycles["docker"]
 	if lifecycleFilename == "" {
 		return nil, ErrNoCompilerDefined
 	}
 
-	parsed, err := url.Parse(lifecycleFilename)
+	return backend.staticDownloadURL(config, lifecycleFilename)
+}
+
+// staticDownloadURL resolves filename against the file server unless it is
+// already an http(s) URL.
+func (backend *dockerBackend) staticDownloadURL(config Config, filename string) (*url.URL, error) {
+	parsed, err := url.Parse(filename)
 	if err != nil {
-		return nil, errors.New("couldn't parse compiler URL")
+		return nil, errors.New("couldn't parse download URL")
 	}
 
 	switch parsed.Scheme {
@@ -171,11 +342,11 @@ func (backend *dockerBackend) compilerDownloadURL() (*url.URL, error) {
 		return nil, fmt.Errorf("unknown scheme: '%s'", parsed.Scheme)
 	}
 
-	urlString := urljoiner.Join(backend.config.FileServerURL, "/v1/static", lifecycleFilename)
+	urlString := urljoiner.Join(config.FileServerURL, "/v1/static", filename)
 
 	url, err := url.ParseRequestURI(urlString)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse compiler download URL: %s", err)
+		return nil, fmt.Errorf("failed to parse download URL: %s", err)
 	}
 
 	return url, nil
@@ -198,6 +369,30 @@ func (backend *dockerBackend) validateRequest(stagingRequest cc_messages.Staging
 	return nil
 }
 
+// RedactCredentials returns a copy of request that is safe to log, with any
+// docker registry password in its lifecycle data replaced.
+func RedactCredentials(request cc_messages.StagingRequestFromCC) cc_messages.StagingRequestFromCC {
+	if request.LifecycleData == nil {
+		return request
+	}
+
+	var lifecycleData map[string]json.RawMessage
+	err := json.Unmarshal(*request.LifecycleData, &lifecycleData)
+	if err != nil || lifecycleData["docker_password"] == nil {
+		return request
+	}
+
+	lifecycleData["docker_password"] = json.RawMessage(`"` + redactedCredential + `"`)
+	redacted, err := json.Marshal(lifecycleData)
+	if err != nil {
+		return request
+	}
+
+	redactedData := json.RawMessage(redacted)
+	request.LifecycleData = &redactedData
+	return request
+}
+
 func dockerTimeout(request cc_messages.StagingRequestFromCC, logger lager.Logger) time.Duration {
 	if request.Timeout > 0 {
 		return time.Duration(request.Timeout) * time.Second
@@ -3,9 +3,11 @@ package backend_test
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"time"
 
 	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/clock/fakeclock"
 	"code.cloudfoundry.org/dockerapplifecycle"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagertest"
@@ -40,7 +42,7 @@ var _ = Describe("DockerBackend", func() {
 				"compiler_with_bad_url":  "ftp://the-bad-compiler-url",
 				"docker":                 "docker_lifecycle/docker_app_lifecycle.tgz",
 			},
-			Sanitizer: func(msg string) *cc_messages.StagingError {
+			Sanitizer: func(lifecycle, msg string) *cc_messages.StagingError {
 				return &cc_messages.StagingError{Message: msg + " was totally sanitized"}
 			},
 		}
@@ -117,6 +119,26 @@ var _ = Describe("DockerBackend", func() {
 			Expect(domain).To(Equal("config-task-domain"))
 		})
 
+		Context("when the backend uses a shared config", func() {
+			var sharedConfig *backend.SharedConfig
+
+			BeforeEach(func() {
+				sharedConfig = backend.NewSharedConfig(config)
+				docker = backend.NewDockerBackendWithSharedConfig(sharedConfig, logger)
+			})
+
+			It("uses the config stored most recently", func() {
+				config.TaskDomain = "reloaded-task-domain"
+				config.PrivilegedContainers = true
+				sharedConfig.Store(config)
+
+				taskDef, _, domain, err := docker.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(domain).To(Equal("reloaded-task-domain"))
+				Expect(taskDef.Privileged).To(BeTrue())
+			})
+		})
+
 		It("returns the task guid", func() {
 			_, guid, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
 			Expect(err).NotTo(HaveOccurred())
@@ -184,24 +206,258 @@ var _ = Describe("DockerBackend", func() {
 			BeforeEach(func() {
 				dockerUser = "dockerusername"
 				dockerPassword = "dockerpassword"
+				config.DockerCredentialsKeys = []string{"signing-key"}
+				docker = backend.NewDockerBackend(config, logger)
 			})
 
-			It("includes the docker credentials in the run action args", func() {
+			It("passes the user in the run action args and has the task download the password", func() {
 				taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
 				Expect(err).NotTo(HaveOccurred())
 
 				actions := actionsFromTaskDef(taskDef)
-				Expect(actions).To(HaveLen(1))
-				emitProgressAction := actions[0].GetEmitProgressAction()
+				Expect(actions).To(HaveLen(2))
+
+				downloadAction := actions[0].GetDownloadAction()
+				Expect(downloadAction).NotTo(BeNil())
+				Expect(downloadAction.To).To(Equal(backend.DockerCredentialsDir))
+				Expect(downloadAction.User).To(Equal("vcap"))
+				Expect(downloadAction.CacheKey).To(BeEmpty())
+
+				emitProgressAction := actions[1].GetEmitProgressAction()
 				Expect(emitProgressAction).NotTo(BeNil())
 				Expect(emitProgressAction.Action).NotTo(BeNil())
-				Expect(emitProgressAction.Action.RunAction).NotTo(BeNil())
-				Expect(emitProgressAction.Action.RunAction.Args).To(ConsistOf(
+				runAction := emitProgressAction.Action.RunAction
+				Expect(runAction).NotTo(BeNil())
+				Expect(runAction.Path).To(Equal("/bin/sh"))
+				Expect(runAction.Args[0]).To(Equal("-c"))
+				Expect(runAction.Args[1]).To(ContainSubstring(`-dockerPassword "$password"`))
+				Expect(runAction.Args[2:]).To(Equal([]string{
+					"/tmp/docker_app_lifecycle/builder",
 					"-outputMetadataJSONFilename", "/tmp/docker-result/result.json",
-					"-dockerRef", "busybox",
+					"-dockerRef", "docker.io/library/busybox:latest",
 					"-insecureDockerRegistries", "http://registry-1.com,http://registry-2.com",
 					"-dockerUser", "dockerusername",
-					"-dockerPassword", "dockerpassword"))
+				}))
+				Expect(runAction.Env).To(Equal(stagingRequest.Environment))
+			})
+
+			It("seals the password into the download URL", func() {
+				taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).NotTo(HaveOccurred())
+
+				downloadURL, err := url.Parse(actionsFromTaskDef(taskDef)[0].GetDownloadAction().From)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(downloadURL.Host).To(Equal("staging-url.com"))
+				Expect(downloadURL.Path).To(Equal("/v1/staging/staging-guid/docker_credentials"))
+
+				password, err := backend.OpenDockerCredentials([]string{"signing-key"}, "staging-guid", downloadURL.Query().Get(backend.DockerCredentialsParam), time.Now())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(password).To(Equal("dockerpassword"))
+			})
+
+			It("seals the password for DockerCredentialsTTL", func() {
+				now := time.Unix(1500000000, 0)
+				config.Clock = fakeclock.NewFakeClock(now)
+				docker = backend.NewDockerBackend(config, logger)
+
+				taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).NotTo(HaveOccurred())
+
+				downloadURL, err := url.Parse(actionsFromTaskDef(taskDef)[0].GetDownloadAction().From)
+				Expect(err).NotTo(HaveOccurred())
+				sealed := downloadURL.Query().Get(backend.DockerCredentialsParam)
+
+				_, err = backend.OpenDockerCredentials([]string{"signing-key"}, "staging-guid", sealed, now.Add(backend.DockerCredentialsTTL))
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = backend.OpenDockerCredentials([]string{"signing-key"}, "staging-guid", sealed, now.Add(backend.DockerCredentialsTTL+time.Second))
+				Expect(err).To(Equal(backend.ErrExpiredDockerCredentials))
+			})
+
+			It("never stores the password in the task definition", func() {
+				taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).NotTo(HaveOccurred())
+
+				taskDefJson, err := json.Marshal(taskDef)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(taskDefJson)).NotTo(ContainSubstring("dockerpassword"))
+			})
+
+			Context("when there is no callback signing key to seal the password with", func() {
+				BeforeEach(func() {
+					config.DockerCredentialsKeys = nil
+					docker = backend.NewDockerBackend(config, logger)
+				})
+
+				It("returns an error", func() {
+					_, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+					Expect(err).To(Equal(backend.ErrDockerCredentialsUnavailable))
+				})
+			})
+
+			It("does not add the password to the request environment", func() {
+				_, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stagingRequest.Environment).To(HaveLen(2))
+			})
+
+			It("redacts the password from the request for logging", func() {
+				redacted := backend.RedactCredentials(stagingRequest)
+				Expect(string(*redacted.LifecycleData)).NotTo(ContainSubstring("dockerpassword"))
+				Expect(string(*redacted.LifecycleData)).To(ContainSubstring("dockerusername"))
+				Expect(string(*stagingRequest.LifecycleData)).To(ContainSubstring("dockerpassword"))
+			})
+		})
+
+		Context("when the image's registry is configured", func() {
+			var registry backend.DockerRegistry
+
+			BeforeEach(func() {
+				dockerImageUrl = "registry.example.com:5000/team/app:v1"
+				registry = backend.DockerRegistry{}
+			})
+
+			JustBeforeEach(func() {
+				config.DockerCredentialsKeys = []string{"signing-key"}
+				config.DockerRegistries = backend.DockerRegistries{
+					"registry.example.com:5000": registry,
+					"other.example.com":         {TLSMode: backend.RegistryTLSInsecure},
+				}
+				docker = backend.NewDockerBackend(config, logger)
+			})
+
+			runActionFor := func(taskDef *models.TaskDefinition) *models.RunAction {
+				actions := actionsFromTaskDef(taskDef)
+				return actions[len(actions)-1].GetEmitProgressAction().Action.RunAction
+			}
+
+			It("passes no extra arguments for a default entry", func() {
+				taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(runActionFor(taskDef).Args).To(Equal([]string{
+					"-outputMetadataJSONFilename", "/tmp/docker-result/result.json",
+					"-dockerRef", "registry.example.com:5000/team/app:v1",
+					"-insecureDockerRegistries", "http://registry-1.com,http://registry-2.com",
+				}))
+				Expect(taskDef.CachedDependencies).To(HaveLen(1))
+			})
+
+			Context("when the registry is insecure", func() {
+				BeforeEach(func() {
+					registry.TLSMode = backend.RegistryTLSInsecure
+				})
+
+				It("adds it to the insecure registries", func() {
+					taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(runActionFor(taskDef).Args).To(ContainElement("http://registry-1.com,http://registry-2.com,registry.example.com:5000"))
+					Expect(config.InsecureDockerRegistries).To(HaveLen(2))
+				})
+			})
+
+			Context("when the registry has a CA bundle", func() {
+				BeforeEach(func() {
+					registry.CABundle = "registry_ca/example.tgz"
+				})
+
+				It("downloads the bundle and has the builder trust it", func() {
+					taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(taskDef.CachedDependencies).To(ContainElement(&models.CachedDependency{
+						From:     "http://file-server.com/v1/static/registry_ca/example.tgz",
+						To:       backend.DockerRegistryCACertsPath,
+						CacheKey: "docker-registry-ca-registry.example.com-5000",
+					}))
+					runAction := runActionFor(taskDef)
+					Expect(runAction.Env).To(ContainElement(&models.EnvironmentVariable{
+						Name:  "SSL_CERT_DIR",
+						Value: backend.DockerRegistryCACertsPath,
+					}))
+					Expect(runAction.Args).NotTo(ContainElement(ContainSubstring("CACerts")))
+					Expect(stagingRequest.Environment).To(HaveLen(2))
+				})
+			})
+
+			Context("when the registry has mirrors", func() {
+				BeforeEach(func() {
+					registry.Mirrors = []string{"other.example.com", "mirror-2.example.com"}
+					registry.Username = "registry-user"
+					registry.Password = "registry-password"
+				})
+
+				It("stages the image from the first mirror with the mirror's settings", func() {
+					taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+					Expect(err).NotTo(HaveOccurred())
+
+					runAction := runActionFor(taskDef)
+					Expect(runAction.Args).To(Equal([]string{
+						"-outputMetadataJSONFilename", "/tmp/docker-result/result.json",
+						"-dockerRef", "other.example.com/team/app:v1",
+						"-insecureDockerRegistries", "http://registry-1.com,http://registry-2.com,other.example.com",
+					}))
+					Expect(runAction.Env).To(HaveLen(2))
+				})
+
+				It("records the original reference in the annotation", func() {
+					taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+					Expect(err).NotTo(HaveOccurred())
+
+					var annotation backend.StagingTaskAnnotation
+					err = json.Unmarshal([]byte(taskDef.Annotation), &annotation)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(annotation.OriginalDockerImage).To(Equal("registry.example.com:5000/team/app:v1"))
+				})
+			})
+
+			Context("when the registry has default credentials", func() {
+				BeforeEach(func() {
+					registry.Username = "registry-user"
+					registry.Password = "registry-password"
+				})
+
+				It("uses them for requests without credentials", func() {
+					taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(runActionFor(taskDef).Args).To(ContainElement("registry-user"))
+
+					downloadURL, err := url.Parse(actionsFromTaskDef(taskDef)[0].GetDownloadAction().From)
+					Expect(err).NotTo(HaveOccurred())
+					password, err := backend.OpenDockerCredentials([]string{"signing-key"}, "staging-guid", downloadURL.Query().Get(backend.DockerCredentialsParam), time.Now())
+					Expect(err).NotTo(HaveOccurred())
+					Expect(password).To(Equal("registry-password"))
+				})
+
+				It("never stores the registry password in the task definition", func() {
+					taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+					Expect(err).NotTo(HaveOccurred())
+
+					taskDefJson, err := json.Marshal(taskDef)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(taskDefJson)).NotTo(ContainSubstring("registry-password"))
+					for _, env := range runActionFor(taskDef).Env {
+						Expect(env.Value).NotTo(Equal("registry-password"))
+					}
+				})
+
+				Context("when the request has its own credentials", func() {
+					BeforeEach(func() {
+						dockerUser = "dockerusername"
+						dockerPassword = "dockerpassword"
+					})
+
+					It("prefers them", func() {
+						taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+						Expect(err).NotTo(HaveOccurred())
+
+						Expect(runActionFor(taskDef).Args).To(ContainElement("dockerusername"))
+						Expect(runActionFor(taskDef).Args).NotTo(ContainElement("registry-user"))
+					})
+				})
 			})
 		})
 
@@ -215,7 +471,7 @@ var _ = Describe("DockerBackend", func() {
 					Path: "/tmp/docker_app_lifecycle/builder",
 					Args: []string{
 						"-outputMetadataJSONFilename", "/tmp/docker-result/result.json",
-						"-dockerRef", "busybox",
+						"-dockerRef", "docker.io/library/busybox:latest",
 						"-insecureDockerRegistries", "http://registry-1.com,http://registry-2.com",
 					},
 					Env: []*models.EnvironmentVariable{
@@ -278,6 +534,20 @@ var _ = Describe("DockerBackend", func() {
 			Expect(taskDef.RootFs).To(Equal(models.PreloadedRootFS("penguin")))
 		})
 
+		Context("when the Docker staging stack has a configured rootfs", func() {
+			BeforeEach(func() {
+				config.StackRootFSes = backend.StackRootFSes{"penguin": "preloaded:penguin-v2"}
+				docker = backend.NewDockerBackend(config, logger)
+			})
+
+			It("sets the task RootFS to it", func() {
+				taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(taskDef.RootFs).To(Equal("preloaded:penguin-v2"))
+			})
+		})
+
 		It("sets the task CompletionCallbackURL", func() {
 			taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
 			Expect(err).NotTo(HaveOccurred())
@@ -312,6 +582,25 @@ var _ = Describe("DockerBackend", func() {
 			})
 		})
 
+		Context("with placement rules for the docker lifecycle", func() {
+			BeforeEach(func() {
+				config.PlacementRules = backend.PlacementRules{
+					"docker":        {"staging-docker"},
+					"*/penguin":     {"penguin-cells"},
+					"buildpack":     {"staging"},
+					"*/rabbit_hole": {"rabbit"},
+				}
+				docker = backend.NewDockerBackend(config, logger)
+			})
+
+			It("tags the task for the docker lifecycle and staging stack", func() {
+				taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(taskDef.PlacementTags).To(Equal([]string{"staging-docker", "penguin-cells"}))
+			})
+		})
+
 		Context("with a missing app id", func() {
 			BeforeEach(func() {
 				appID = ""
@@ -334,6 +623,33 @@ var _ = Describe("DockerBackend", func() {
 			})
 		})
 
+		Context("with a malformed docker image reference", func() {
+			BeforeEach(func() {
+				dockerImageUrl = "Registry.example.com/Busybox:latest"
+			})
+
+			It("returns an invalid image reference error", func() {
+				_, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).To(HaveOccurred())
+				Expect(backend.AsStagingError(err).ToCC().Id).To(Equal(backend.INVALID_DOCKER_IMAGE_REFERENCE))
+			})
+		})
+
+		Context("when the image is not allowed by policy", func() {
+			BeforeEach(func() {
+				config.DockerImagePolicy = backend.DockerImagePolicy{
+					DockerImageRule: backend.DockerImageRule{AllowedRegistries: []string{"registry.internal"}},
+				}
+				docker = backend.NewDockerBackend(config, logger)
+			})
+
+			It("returns an image not allowed error", func() {
+				_, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).To(HaveOccurred())
+				Expect(backend.AsStagingError(err).ToCC().Id).To(Equal(backend.DOCKER_IMAGE_NOT_ALLOWED))
+			})
+		})
+
 		Context("with password but no user", func() {
 			BeforeEach(func() {
 				dockerPassword = "password"
@@ -425,64 +741,133 @@ var _ = Describe("DockerBackend", func() {
 	})
 
 	Describe("BuildStagingResponse", func() {
+		const digest = "sha256:3b1f2b7e4c0d9a6e5f8a7b6c5d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d6e"
+
 		var (
 			response          cc_messages.StagingResponseForCC
 			failureReason     string
 			buildError        error
 			stagingResultJson []byte
 			stagingResult     dockerapplifecycle.StagingResult
+			annotation        string
 		)
 
+		lifecycleMetadata := func() map[string]interface{} {
+			Expect(response.Error).To(BeNil())
+
+			var result map[string]interface{}
+			err := json.Unmarshal(*response.Result, &result)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result["process_types"]).To(Equal(map[string]interface{}{"a": "b"}))
+			Expect(result["execution_metadata"]).To(Equal("metadata"))
+
+			return result["lifecycle_metadata"].(map[string]interface{})
+		}
+
 		BeforeEach(func() {
+			annotation = `{"lifecycle":"docker"}`
+			stagingResultJson = nil
 			stagingResult = dockerapplifecycle.NewStagingResult(
 				dockerapplifecycle.ProcessTypes{"a": "b"},
 				dockerapplifecycle.LifecycleMetadata{
-					DockerImage: "cloudfoundry/diego-docker-app",
+					DockerImage: "cloudfoundry/diego-docker-app:latest@" + digest,
 				},
 				"metadata",
 			)
-			var err error
-			stagingResultJson, err = json.Marshal(stagingResult)
-			Expect(err).NotTo(HaveOccurred())
+		})
+
+		JustBeforeEach(func() {
+			if stagingResultJson == nil {
+				var err error
+				stagingResultJson, err = json.Marshal(stagingResult)
+				Expect(err).NotTo(HaveOccurred())
+			}
 		})
 
 		Context("with a successful task response", func() {
-			BeforeEach(func() {
+			JustBeforeEach(func() {
 				taskResponse := &models.TaskCallbackResponse{
 					Failed:        false,
 					FailureReason: failureReason,
 					Result:        string(stagingResultJson),
+					Annotation:    annotation,
 				}
 
 				response, buildError = docker.BuildStagingResponse(taskResponse)
 				Expect(buildError).NotTo(HaveOccurred())
 			})
 
-			It("populates a staging response correctly", func() {
-				result := json.RawMessage(stagingResultJson)
-				Expect(response).To(Equal(cc_messages.StagingResponseForCC{
-					Result: &result,
+			It("pins the image to its digest", func() {
+				Expect(lifecycleMetadata()).To(Equal(map[string]interface{}{
+					"docker_image":        "docker.io/cloudfoundry/diego-docker-app@" + digest,
+					"docker_image_digest": digest,
 				}))
 			})
 
-			Context("with a failed task response", func() {
+			Context("when the builder reports the digest separately", func() {
 				BeforeEach(func() {
-					taskResponse := &models.TaskCallbackResponse{
-						Failed:        true,
-						FailureReason: "some-failure-reason",
-						Result:        string(stagingResultJson),
-					}
+					var err error
+					stagingResultJson, err = json.Marshal(map[string]interface{}{
+						"process_types":      map[string]string{"a": "b"},
+						"execution_metadata": "metadata",
+						"lifecycle_metadata": map[string]string{
+							"docker_image":        "cloudfoundry/diego-docker-app:v1",
+							"docker_image_digest": digest,
+						},
+					})
+					Expect(err).NotTo(HaveOccurred())
+				})
 
-					response, buildError = docker.BuildStagingResponse(taskResponse)
-					Expect(buildError).NotTo(HaveOccurred())
+				It("pins the image to that digest", func() {
+					Expect(lifecycleMetadata()["docker_image"]).To(Equal("docker.io/cloudfoundry/diego-docker-app@" + digest))
 				})
+			})
 
-				It("populates a staging response correctly", func() {
-					Expect(response).To(Equal(cc_messages.StagingResponseForCC{
-						Error: &cc_messages.StagingError{Message: "some-failure-reason was totally sanitized"},
+			Context("when the image was staged from a mirror", func() {
+				BeforeEach(func() {
+					annotation = `{"lifecycle":"docker","original_docker_image":"cloudfoundry/diego-docker-app"}`
+					stagingResult.LifecycleMetadata.DockerImage = "registry-mirror.internal/cloudfoundry/diego-docker-app:latest@" + digest
+				})
+
+				It("pins the original image and keeps the mirrored one", func() {
+					Expect(lifecycleMetadata()).To(Equal(map[string]interface{}{
+						"docker_image":          "docker.io/cloudfoundry/diego-docker-app@" + digest,
+						"docker_image_digest":   digest,
+						"mirrored_docker_image": "registry-mirror.internal/cloudfoundry/diego-docker-app:latest@" + digest,
 					}))
 				})
 			})
+
+			Context("when the builder reports no digest", func() {
+				BeforeEach(func() {
+					stagingResult.LifecycleMetadata.DockerImage = "cloudfoundry/diego-docker-app:latest"
+				})
+
+				It("fails staging with a missing digest error", func() {
+					Expect(response.Result).To(BeNil())
+					Expect(response.Error).To(Equal(backend.ErrMissingDockerImageDigest.ToCC()))
+					Expect(response.Error.Id).To(Equal(backend.DOCKER_IMAGE_DIGEST_MISSING))
+				})
+			})
+		})
+
+		Context("with a failed task response", func() {
+			JustBeforeEach(func() {
+				taskResponse := &models.TaskCallbackResponse{
+					Failed:        true,
+					FailureReason: "some-failure-reason",
+					Result:        string(stagingResultJson),
+				}
+
+				response, buildError = docker.BuildStagingResponse(taskResponse)
+				Expect(buildError).NotTo(HaveOccurred())
+			})
+
+			It("populates a staging response correctly", func() {
+				Expect(response).To(Equal(cc_messages.StagingResponseForCC{
+					Error: &cc_messages.StagingError{Message: "some-failure-reason was totally sanitized"},
+				}))
+			})
 		})
 	})
 })
@@ -0,0 +1,167 @@
+package backend
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	// DockerCredentialsParam is the query parameter of the docker credentials
+	// URL that carries the sealed credentials.
+	DockerCredentialsParam = "credentials"
+
+	// The task downloads its credentials here and hands them to the builder
+	// when it starts, so that the password never shows up in the task
+	// definition
+	DockerCredentialsDir = "/tmp/docker-credentials"
+	DockerPasswordFile   = "password"
+
+	// DockerCredentialsTTL is how long a staging task can take to be placed
+	// on a cell and download its credentials.
+	DockerCredentialsTTL = 30 * time.Minute
+)
+
+var ErrInvalidDockerCredentials = errors.New("invalid docker credentials")
+var ErrExpiredDockerCredentials = errors.New("expired docker credentials")
+
+type sealedDockerCredentials struct {
+	Password  string `json:"password"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// DockerCredentialsURL returns the URL the staging task downloads its sealed
+// docker credentials from.
+func (c Config) DockerCredentialsURL(stagingGuid, sealed string) string {
+	baseURL := c.DockerCredentialsBaseURL
+	if baseURL == "" {
+		baseURL = c.StagerURL
+	}
+	return fmt.Sprintf("%s/v1/staging/%s/docker_credentials?%s=%s", baseURL, stagingGuid, DockerCredentialsParam, url.QueryEscape(sealed))
+}
+
+// SealDockerCredentials encrypts password for the staging task stagingGuid
+// with a key derived from key. Only a stager holding key can open it, and
+// only until expiresAt.
+func SealDockerCredentials(key, stagingGuid, password string, expiresAt time.Time) (string, error) {
+	aead, err := dockerCredentialsAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := json.Marshal(sealedDockerCredentials{Password: password, ExpiresAt: expiresAt.Unix()})
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(stagingGuid))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// OpenDockerCredentials returns the password sealed for stagingGuid with any
+// of keys, so that credentials sealed before a key was rotated can still be
+// opened.
+func OpenDockerCredentials(keys []string, stagingGuid, sealed string, now time.Time) (string, error) {
+	ciphertext, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", ErrInvalidDockerCredentials
+	}
+
+	for _, key := range keys {
+		aead, err := dockerCredentialsAEAD(key)
+		if err != nil {
+			return "", err
+		}
+
+		if len(ciphertext) < aead.NonceSize() {
+			return "", ErrInvalidDockerCredentials
+		}
+
+		nonce := ciphertext[:aead.NonceSize()]
+		plaintext, err := aead.Open(nil, nonce, ciphertext[aead.NonceSize():], []byte(stagingGuid))
+		if err != nil {
+			continue
+		}
+
+		var credentials sealedDockerCredentials
+		err = json.Unmarshal(plaintext, &credentials)
+		if err != nil {
+			return "", ErrInvalidDockerCredentials
+		}
+
+		if now.After(time.Unix(credentials.ExpiresAt, 0)) {
+			return "", ErrExpiredDockerCredentials
+		}
+
+		return credentials.Password, nil
+	}
+
+	return "", ErrInvalidDockerCredentials
+}
+
+// OpenDockerCredentials opens docker credentials sealed with any of the
+// DockerCredentialsKeys of the current Config.
+func (s *SharedConfig) OpenDockerCredentials(stagingGuid, sealed string, now time.Time) (string, error) {
+	return OpenDockerCredentials(s.Load().DockerCredentialsKeys, stagingGuid, sealed, now)
+}
+
+// DockerCredentialsArchive returns the tgz the staging task downloads into
+// DockerCredentialsDir.
+func DockerCredentialsArchive(password string) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	err := tarWriter.WriteHeader(&tar.Header{
+		Name:     DockerPasswordFile,
+		Mode:     0600,
+		Size:     int64(len(password)),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tarWriter.Write([]byte(password))
+	if err != nil {
+		return nil, err
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = gzipWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// dockerCredentialsAEAD derives the encryption key from key rather than
+// using it directly, as key also signs the completion callbacks.
+func dockerCredentialsAEAD(key string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(key, dockerCredentialsKeyInfo))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
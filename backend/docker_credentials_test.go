@@ -0,0 +1,107 @@
+package backend_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"time"
+
+	"code.cloudfoundry.org/stager/backend"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DockerCredentials", func() {
+	var (
+		now    time.Time
+		sealed string
+	)
+
+	BeforeEach(func() {
+		now = time.Now()
+
+		var err error
+		sealed, err = backend.SealDockerCredentials("old-key", "staging-guid", "secret", now.Add(time.Minute))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("does not contain the password", func() {
+		Expect(sealed).NotTo(ContainSubstring("secret"))
+	})
+
+	It("opens with any of the keys", func() {
+		password, err := backend.OpenDockerCredentials([]string{"new-key", "old-key"}, "staging-guid", sealed, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(password).To(Equal("secret"))
+	})
+
+	It("does not open with another key", func() {
+		_, err := backend.OpenDockerCredentials([]string{"new-key"}, "staging-guid", sealed, now)
+		Expect(err).To(Equal(backend.ErrInvalidDockerCredentials))
+	})
+
+	It("does not open for another staging task", func() {
+		_, err := backend.OpenDockerCredentials([]string{"old-key"}, "other-guid", sealed, now)
+		Expect(err).To(Equal(backend.ErrInvalidDockerCredentials))
+	})
+
+	It("does not open once expired", func() {
+		_, err := backend.OpenDockerCredentials([]string{"old-key"}, "staging-guid", sealed, now.Add(2*time.Minute))
+		Expect(err).To(Equal(backend.ErrExpiredDockerCredentials))
+	})
+
+	It("rejects malformed credentials", func() {
+		_, err := backend.OpenDockerCredentials([]string{"old-key"}, "staging-guid", "not base64!", now)
+		Expect(err).To(Equal(backend.ErrInvalidDockerCredentials))
+
+		_, err = backend.OpenDockerCredentials([]string{"old-key"}, "staging-guid", "c2hvcnQ", now)
+		Expect(err).To(Equal(backend.ErrInvalidDockerCredentials))
+	})
+
+	Describe("DockerCredentialsURL", func() {
+		It("is on the stager's listener by default", func() {
+			config := backend.Config{StagerURL: "http://stager.example.com"}
+			Expect(config.DockerCredentialsURL("staging-guid", "sealed")).To(Equal("http://stager.example.com/v1/staging/staging-guid/docker_credentials?credentials=sealed"))
+		})
+
+		It("is on the docker credentials listener when there is one", func() {
+			config := backend.Config{StagerURL: "https://stager.example.com", DockerCredentialsBaseURL: "https://stager.example.com:8891"}
+			Expect(config.DockerCredentialsURL("staging-guid", "sealed")).To(Equal("https://stager.example.com:8891/v1/staging/staging-guid/docker_credentials?credentials=sealed"))
+		})
+	})
+
+	Describe("SharedConfig", func() {
+		It("opens credentials sealed with any of the current keys", func() {
+			shared := backend.NewSharedConfig(backend.Config{DockerCredentialsKeys: []string{"new-key", "old-key"}})
+
+			password, err := shared.OpenDockerCredentials("staging-guid", sealed, now)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(password).To(Equal("secret"))
+
+			shared.Store(backend.Config{DockerCredentialsKeys: []string{"new-key"}})
+			_, err = shared.OpenDockerCredentials("staging-guid", sealed, now)
+			Expect(err).To(Equal(backend.ErrInvalidDockerCredentials))
+		})
+	})
+
+	Describe("DockerCredentialsArchive", func() {
+		It("holds the password file", func() {
+			archive, err := backend.DockerCredentialsArchive("secret")
+			Expect(err).NotTo(HaveOccurred())
+
+			gzipReader, err := gzip.NewReader(bytes.NewReader(archive))
+			Expect(err).NotTo(HaveOccurred())
+			tarReader := tar.NewReader(gzipReader)
+
+			header, err := tarReader.Next()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(header.Name).To(Equal(backend.DockerPasswordFile))
+			Expect(header.Mode).To(Equal(int64(0600)))
+
+			contents, err := ioutil.ReadAll(tarReader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("secret"))
+		})
+	})
+})
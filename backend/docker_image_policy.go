@@ -0,0 +1,116 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+)
+
+// Staging error id reported to CC when a docker image is rejected by policy
+const DOCKER_IMAGE_NOT_ALLOWED = "DockerImageNotAllowed"
+
+var KindDockerImageNotAllowed = ErrorKind{Id: DOCKER_IMAGE_NOT_ALLOWED}
+
+// DockerImageRule restricts the docker images that may be staged. Registries
+// and repositories are glob patterns, as understood by path.Match, matched
+// against the normalized reference: "docker.io" and
+// "docker.io/library/*" rather than "busybox". An empty list of allowed
+// registries allows any registry.
+type DockerImageRule struct {
+	AllowedRegistries  []string `json:"allowed_registries"`
+	DeniedRepositories []string `json:"denied_repositories"`
+	RequireDigest      bool     `json:"require_digest"`
+}
+
+// DockerImagePolicy applies its rule to every docker staging request and, in
+// addition, the rule of the request's isolation segment if it has one.
+type DockerImagePolicy struct {
+	DockerImageRule
+	IsolationSegments map[string]DockerImageRule `json:"isolation_segments"`
+}
+
+func (p DockerImagePolicy) Validate() error {
+	err := p.DockerImageRule.validate()
+	if err != nil {
+		return fmt.Errorf("invalid docker image policy: %s", err)
+	}
+
+	segments := []string{}
+	for segment := range p.IsolationSegments {
+		segments = append(segments, segment)
+	}
+	sort.Strings(segments)
+
+	for _, segment := range segments {
+		err := p.IsolationSegments[segment].validate()
+		if err != nil {
+			return fmt.Errorf("invalid docker image policy for isolation segment '%s': %s", segment, err)
+		}
+	}
+
+	return nil
+}
+
+// Check returns a *StagingError if ref may not be staged in the given
+// isolation segment.
+func (p DockerImagePolicy) Check(ref DockerImageReference, isolationSegment string) error {
+	reason := p.DockerImageRule.violation(ref)
+	if reason != "" {
+		return imageNotAllowed(reason)
+	}
+
+	rule, ok := p.IsolationSegments[isolationSegment]
+	if !ok {
+		return nil
+	}
+
+	reason = rule.violation(ref)
+	if reason != "" {
+		return imageNotAllowed(fmt.Sprintf("%s in isolation segment '%s'", reason, isolationSegment))
+	}
+
+	return nil
+}
+
+func (r DockerImageRule) validate() error {
+	for _, pattern := range append(append([]string{}, r.AllowedRegistries...), r.DeniedRepositories...) {
+		// older versions of path.Match only report bad patterns they get far
+		// enough into, hence matching the pattern against itself
+		_, err := path.Match(pattern, pattern)
+		if err != nil {
+			return fmt.Errorf("bad pattern '%s'", pattern)
+		}
+	}
+	return nil
+}
+
+// violation describes why the rule rejects ref, or is empty.
+func (r DockerImageRule) violation(ref DockerImageReference) string {
+	if len(r.AllowedRegistries) > 0 && !matchesAny(r.AllowedRegistries, ref.Registry) {
+		return fmt.Sprintf("registry '%s' is not allowed", ref.Registry)
+	}
+
+	if matchesAny(r.DeniedRepositories, ref.Name()) {
+		return fmt.Sprintf("repository '%s' is denied", ref.Name())
+	}
+
+	if r.RequireDigest && ref.Digest == "" {
+		return "images must be referenced by digest"
+	}
+
+	return ""
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func imageNotAllowed(reason string) error {
+	return NewStagingError(KindDockerImageNotAllowed, errors.New("docker image not allowed: "+reason))
+}
@@ -0,0 +1,73 @@
+package backend_test
+
+import (
+	"code.cloudfoundry.org/stager/backend"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DockerImagePolicy", func() {
+	const digest = "sha256:3b1f2b7e4c0d9a6e5f8a7b6c5d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d6e"
+
+	var policy backend.DockerImagePolicy
+
+	BeforeEach(func() {
+		policy = backend.DockerImagePolicy{
+			DockerImageRule: backend.DockerImageRule{
+				DeniedRepositories: []string{"docker.io/evil/*"},
+			},
+			IsolationSegments: map[string]backend.DockerImageRule{
+				"production": {
+					AllowedRegistries: []string{"registry.internal", "*.registry.internal"},
+					RequireDigest:     true,
+				},
+			},
+		}
+	})
+
+	check := func(image, isolationSegment string) error {
+		ref, err := backend.ParseDockerImageReference(image)
+		Expect(err).NotTo(HaveOccurred())
+		return policy.Check(ref, isolationSegment)
+	}
+
+	expectNotAllowed := func(err error, message string) {
+		Expect(err).To(HaveOccurred())
+		ccError := backend.AsStagingError(err).ToCC()
+		Expect(ccError.Id).To(Equal(backend.DOCKER_IMAGE_NOT_ALLOWED))
+		Expect(ccError.Message).To(Equal(message))
+	}
+
+	Describe("Check", func() {
+		It("allows images outside of any restriction", func() {
+			Expect(check("busybox", "")).To(Succeed())
+			Expect(check("registry.example.com/app:v1", "other-segment")).To(Succeed())
+		})
+
+		It("rejects denied repositories everywhere", func() {
+			expectNotAllowed(check("evil/miner", ""), "docker image not allowed: repository 'docker.io/evil/miner' is denied")
+		})
+
+		It("applies the rule of the request's isolation segment", func() {
+			expectNotAllowed(check("busybox@"+digest, "production"),
+				"docker image not allowed: registry 'docker.io' is not allowed in isolation segment 'production'")
+			expectNotAllowed(check("eu.registry.internal/app:v1", "production"),
+				"docker image not allowed: images must be referenced by digest in isolation segment 'production'")
+
+			Expect(check("registry.internal/app@"+digest, "production")).To(Succeed())
+			Expect(check("eu.registry.internal/app:v1@"+digest, "production")).To(Succeed())
+		})
+	})
+
+	Describe("Validate", func() {
+		It("accepts well-formed patterns", func() {
+			Expect(policy.Validate()).To(Succeed())
+		})
+
+		It("rejects malformed patterns", func() {
+			policy.IsolationSegments["staging"] = backend.DockerImageRule{DeniedRepositories: []string{"docker.io/[evil"}}
+			Expect(policy.Validate()).To(MatchError("invalid docker image policy for isolation segment 'staging': bad pattern 'docker.io/[evil'"))
+		})
+	})
+})
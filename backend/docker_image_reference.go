@@ -0,0 +1,163 @@
+package backend
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Staging error id reported to CC for docker image references that cannot
+	// be parsed
+	INVALID_DOCKER_IMAGE_REFERENCE = "InvalidDockerImageReference"
+
+	// Staging error id reported to CC when the staged image cannot be pinned
+	// to a content digest
+	DOCKER_IMAGE_DIGEST_MISSING = "DockerImageDigestMissing"
+
+	DockerHubRegistry = "docker.io"
+	DefaultDockerTag  = "latest"
+
+	dockerHubLibrary  = "library"
+	maxRepositoryName = 255
+)
+
+var (
+	KindInvalidDockerImageReference = ErrorKind{Id: INVALID_DOCKER_IMAGE_REFERENCE}
+	KindDockerImageDigestMissing    = ErrorKind{Id: DOCKER_IMAGE_DIGEST_MISSING, Message: "staging failed: the registry did not report a digest for the image"}
+)
+
+var (
+	domainComponentPattern = regexp.MustCompile(`^([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])$`)
+	portPattern            = regexp.MustCompile(`^[0-9]+$`)
+	pathComponentPattern   = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*$`)
+	tagPattern             = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestPattern          = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}$`)
+)
+
+// DockerImageReference is a parsed and normalized docker image reference.
+// Docker Hub shorthand such as "busybox" is expanded to
+// "docker.io/library/busybox", and references without a tag or digest are
+// given the "latest" tag.
+type DockerImageReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseDockerImageReference parses references of the form
+// [registry[:port]/]repository[:tag][@digest]. Malformed references are
+// reported as a *StagingError that names what is wrong without echoing the
+// reference.
+func ParseDockerImageReference(ref string) (DockerImageReference, error) {
+	var parsed DockerImageReference
+
+	if ref == "" {
+		return parsed, invalidImageReference("reference is empty")
+	}
+
+	if strings.Contains(ref, "://") {
+		return parsed, invalidImageReference("reference must not contain a scheme")
+	}
+
+	name := ref
+	if i := strings.Index(name, "@"); i >= 0 {
+		parsed.Digest = name[i+1:]
+		name = name[:i]
+		if !digestPattern.MatchString(parsed.Digest) {
+			return parsed, invalidImageReference("invalid digest")
+		}
+	}
+
+	// a colon after the last slash separates the tag; any other colon belongs
+	// to the registry port
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		parsed.Tag = name[i+1:]
+		name = name[:i]
+		if !tagPattern.MatchString(parsed.Tag) {
+			return parsed, invalidImageReference("invalid tag")
+		}
+	}
+
+	components := strings.Split(name, "/")
+	if len(components) > 1 && isRegistry(components[0]) {
+		parsed.Registry = components[0]
+		components = components[1:]
+		err := validateRegistry(parsed.Registry)
+		if err != nil {
+			return parsed, err
+		}
+	}
+
+	for _, component := range components {
+		if !pathComponentPattern.MatchString(component) {
+			return parsed, invalidImageReference("invalid repository name")
+		}
+	}
+
+	if parsed.Registry == "" || parsed.Registry == "index.docker.io" {
+		parsed.Registry = DockerHubRegistry
+	}
+
+	if parsed.Registry == DockerHubRegistry && len(components) == 1 {
+		components = append([]string{dockerHubLibrary}, components...)
+	}
+
+	parsed.Repository = strings.Join(components, "/")
+	if len(parsed.Repository) > maxRepositoryName {
+		return parsed, invalidImageReference("repository name is too long")
+	}
+
+	if parsed.Tag == "" && parsed.Digest == "" {
+		parsed.Tag = DefaultDockerTag
+	}
+
+	return parsed, nil
+}
+
+// Name returns the registry and repository, without tag or digest.
+func (r DockerImageReference) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+func (r DockerImageReference) String() string {
+	ref := r.Name()
+	if r.Tag != "" {
+		ref += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		ref += "@" + r.Digest
+	}
+	return ref
+}
+
+// isRegistry follows the docker convention that the first component of a
+// name is a registry host only if it looks like one.
+func isRegistry(component string) bool {
+	return strings.ContainsAny(component, ".:") ||
+		component == "localhost" ||
+		strings.ToLower(component) != component
+}
+
+func validateRegistry(registry string) error {
+	host := registry
+	if i := strings.LastIndex(registry, ":"); i >= 0 {
+		host = registry[:i]
+		if !portPattern.MatchString(registry[i+1:]) {
+			return invalidImageReference("invalid registry port")
+		}
+	}
+
+	for _, component := range strings.Split(host, ".") {
+		if !domainComponentPattern.MatchString(component) {
+			return invalidImageReference("invalid registry host")
+		}
+	}
+
+	return nil
+}
+
+func invalidImageReference(reason string) error {
+	return NewStagingError(KindInvalidDockerImageReference, errors.New("invalid docker image reference: "+reason))
+}
@@ -0,0 +1,67 @@
+package backend_test
+
+import (
+	"strings"
+
+	"code.cloudfoundry.org/stager/backend"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseDockerImageReference", func() {
+	const digest = "sha256:3b1f2b7e4c0d9a6e5f8a7b6c5d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d6e"
+
+	DescribeTable("normalizes valid references",
+		func(ref string, expected backend.DockerImageReference, normalized string) {
+			parsed, err := backend.ParseDockerImageReference(ref)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed).To(Equal(expected))
+			Expect(parsed.String()).To(Equal(normalized))
+		},
+		Entry("docker hub shorthand", "busybox",
+			backend.DockerImageReference{Registry: "docker.io", Repository: "library/busybox", Tag: "latest"},
+			"docker.io/library/busybox:latest"),
+		Entry("docker hub user repository", "cloudfoundry/diego-docker-app:v1",
+			backend.DockerImageReference{Registry: "docker.io", Repository: "cloudfoundry/diego-docker-app", Tag: "v1"},
+			"docker.io/cloudfoundry/diego-docker-app:v1"),
+		Entry("legacy docker hub host", "index.docker.io/busybox",
+			backend.DockerImageReference{Registry: "docker.io", Repository: "library/busybox", Tag: "latest"},
+			"docker.io/library/busybox:latest"),
+		Entry("registry with a port", "registry.example.com:5000/team/app",
+			backend.DockerImageReference{Registry: "registry.example.com:5000", Repository: "team/app", Tag: "latest"},
+			"registry.example.com:5000/team/app:latest"),
+		Entry("localhost registry", "localhost/app:1.0",
+			backend.DockerImageReference{Registry: "localhost", Repository: "app", Tag: "1.0"},
+			"localhost/app:1.0"),
+		Entry("digest only", "busybox@"+digest,
+			backend.DockerImageReference{Registry: "docker.io", Repository: "library/busybox", Digest: digest},
+			"docker.io/library/busybox@"+digest),
+		Entry("tag and digest", "registry.example.com/app:1.0@"+digest,
+			backend.DockerImageReference{Registry: "registry.example.com", Repository: "app", Tag: "1.0", Digest: digest},
+			"registry.example.com/app:1.0@"+digest),
+	)
+
+	DescribeTable("rejects malformed references",
+		func(ref string, reason string) {
+			_, err := backend.ParseDockerImageReference(ref)
+			Expect(err).To(HaveOccurred())
+
+			ccError := backend.AsStagingError(err).ToCC()
+			Expect(ccError.Id).To(Equal(backend.INVALID_DOCKER_IMAGE_REFERENCE))
+			Expect(ccError.Message).To(Equal("invalid docker image reference: " + reason))
+		},
+		Entry("empty", "", "reference is empty"),
+		Entry("with a scheme", "docker:///busybox", "reference must not contain a scheme"),
+		Entry("uppercase repository", "Busybox", "invalid repository name"),
+		Entry("empty path component", "team//app", "invalid repository name"),
+		Entry("trailing separator", "app-:latest", "invalid repository name"),
+		Entry("invalid tag", "busybox:-latest", "invalid tag"),
+		Entry("empty tag", "busybox:", "invalid tag"),
+		Entry("invalid digest", "busybox@sha256:xyz", "invalid digest"),
+		Entry("invalid port", "registry.example.com:http/app", "invalid registry port"),
+		Entry("invalid host", "-registry.example.com/app", "invalid registry host"),
+		Entry("name too long", "team/"+strings.Repeat("a", 256), "repository name is too long"),
+	)
+})
@@ -0,0 +1,112 @@
+package backend
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// Registry TLS modes. Insecure registries may be reached over plain HTTP
+	// or HTTPS with an unverified certificate.
+	RegistryTLSVerify   = "verify"
+	RegistryTLSInsecure = "insecure"
+
+	DockerRegistryCACertsPath = "/tmp/docker_registry_ca"
+
+	// SSLCertDirEnvVar names the directory of extra CA certificates. Setting
+	// it replaces Go's default certificate directories but not its default
+	// CA bundle file, so public registries are still trusted.
+	SSLCertDirEnvVar = "SSL_CERT_DIR"
+)
+
+// DockerRegistry holds the settings for staging images from one registry.
+// CABundle is a tgz of PEM certificates, given as a URL or as a path on the
+// file server like the lifecycle bundles.
+type DockerRegistry struct {
+	TLSMode  string   `json:"tls_mode"`
+	CABundle string   `json:"ca_bundle"`
+	Mirrors  []string `json:"mirrors"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+}
+
+// DockerRegistries is keyed by registry host, including the port if any.
+// Docker Hub images match "docker.io".
+type DockerRegistries map[string]DockerRegistry
+
+func (registries DockerRegistries) Validate() error {
+	hosts := []string{}
+	for host := range registries {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	for _, host := range hosts {
+		err := validateRegistry(host)
+		if err != nil {
+			return fmt.Errorf("invalid docker registry '%s': not a registry host", host)
+		}
+
+		err = registries[host].validate()
+		if err != nil {
+			return fmt.Errorf("invalid docker registry '%s': %s", host, err)
+		}
+	}
+
+	return nil
+}
+
+// Lookup returns the settings of the registry hosting ref, if any.
+func (registries DockerRegistries) Lookup(ref DockerImageReference) (DockerRegistry, bool) {
+	registry, ok := registries[ref.Registry]
+	return registry, ok
+}
+
+// Resolve returns the reference to pull in place of ref and the settings to
+// pull it with. Images from a registry with mirrors are pulled from its first
+// mirror, with the mirror's own settings if it has an entry: the origin's
+// credentials are never sent to a mirror.
+func (registries DockerRegistries) Resolve(ref DockerImageReference) (DockerImageReference, DockerRegistry) {
+	registry, _ := registries.Lookup(ref)
+	if len(registry.Mirrors) == 0 {
+		return ref, registry
+	}
+
+	ref.Registry = registry.Mirrors[0]
+	mirror, _ := registries.Lookup(ref)
+	return ref, mirror
+}
+
+func (r DockerRegistry) Insecure() bool {
+	return r.TLSMode == RegistryTLSInsecure
+}
+
+func (r DockerRegistry) validate() error {
+	switch r.TLSMode {
+	case "", RegistryTLSVerify:
+	case RegistryTLSInsecure:
+		if r.CABundle != "" {
+			return fmt.Errorf("ca_bundle cannot be used with tls_mode '%s'", RegistryTLSInsecure)
+		}
+	default:
+		return fmt.Errorf("unknown tls_mode '%s'", r.TLSMode)
+	}
+
+	if (r.Username == "") != (r.Password == "") {
+		return fmt.Errorf("username and password must be given together")
+	}
+
+	for _, mirror := range r.Mirrors {
+		if validateRegistry(mirror) != nil {
+			return fmt.Errorf("invalid mirror '%s'", mirror)
+		}
+	}
+
+	return nil
+}
+
+// cacheKeySuffix turns a registry host into something usable in a cache key.
+func cacheKeySuffix(host string) string {
+	return strings.Replace(host, ":", "-", -1)
+}
@@ -0,0 +1,99 @@
+package backend_test
+
+import (
+	"code.cloudfoundry.org/stager/backend"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DockerRegistries", func() {
+	Describe("Validate", func() {
+		It("accepts well-formed registries", func() {
+			registries := backend.DockerRegistries{
+				"docker.io": {Mirrors: []string{"registry-mirror.internal"}},
+				"registry.example.com:5000": {
+					TLSMode:  backend.RegistryTLSVerify,
+					CABundle: "https://blobs.example.com/ca.tgz",
+					Username: "user",
+					Password: "password",
+				},
+				"insecure.example.com": {TLSMode: backend.RegistryTLSInsecure},
+			}
+			Expect(registries.Validate()).To(Succeed())
+		})
+
+		It("rejects keys that are not registry hosts", func() {
+			registries := backend.DockerRegistries{"https://registry.example.com": {}}
+			Expect(registries.Validate()).To(MatchError("invalid docker registry 'https://registry.example.com': not a registry host"))
+		})
+
+		It("rejects unknown TLS modes", func() {
+			registries := backend.DockerRegistries{"registry.example.com": {TLSMode: "maybe"}}
+			Expect(registries.Validate()).To(MatchError("invalid docker registry 'registry.example.com': unknown tls_mode 'maybe'"))
+		})
+
+		It("rejects CA bundles for insecure registries", func() {
+			registries := backend.DockerRegistries{"registry.example.com": {TLSMode: backend.RegistryTLSInsecure, CABundle: "ca.tgz"}}
+			Expect(registries.Validate()).To(HaveOccurred())
+		})
+
+		It("rejects half-given credentials", func() {
+			registries := backend.DockerRegistries{"registry.example.com": {Username: "user"}}
+			Expect(registries.Validate()).To(MatchError("invalid docker registry 'registry.example.com': username and password must be given together"))
+		})
+
+		It("rejects malformed mirrors", func() {
+			registries := backend.DockerRegistries{"docker.io": {Mirrors: []string{"mirror.internal/path"}}}
+			Expect(registries.Validate()).To(MatchError("invalid docker registry 'docker.io': invalid mirror 'mirror.internal/path'"))
+		})
+	})
+
+	Describe("Lookup", func() {
+		It("matches the registry of the parsed reference", func() {
+			registries := backend.DockerRegistries{"docker.io": {Username: "hub-user", Password: "hub-password"}}
+
+			ref, err := backend.ParseDockerImageReference("busybox")
+			Expect(err).NotTo(HaveOccurred())
+
+			registry, ok := registries.Lookup(ref)
+			Expect(ok).To(BeTrue())
+			Expect(registry.Username).To(Equal("hub-user"))
+
+			ref, err = backend.ParseDockerImageReference("registry.example.com/app")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, ok = registries.Lookup(ref)
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("Resolve", func() {
+		var registries backend.DockerRegistries
+
+		BeforeEach(func() {
+			registries = backend.DockerRegistries{
+				"docker.io":                {Mirrors: []string{"registry-mirror.internal"}, Username: "hub-user", Password: "hub-password"},
+				"registry-mirror.internal": {TLSMode: backend.RegistryTLSInsecure},
+			}
+		})
+
+		It("rewrites references to the first mirror", func() {
+			ref, err := backend.ParseDockerImageReference("busybox")
+			Expect(err).NotTo(HaveOccurred())
+
+			pullRef, registry := registries.Resolve(ref)
+			Expect(pullRef.String()).To(Equal("registry-mirror.internal/library/busybox:latest"))
+			Expect(registry).To(Equal(backend.DockerRegistry{TLSMode: backend.RegistryTLSInsecure}))
+		})
+
+		It("leaves references to registries without mirrors alone", func() {
+			ref, err := backend.ParseDockerImageReference("registry.example.com/app")
+			Expect(err).NotTo(HaveOccurred())
+
+			pullRef, registry := registries.Resolve(ref)
+			Expect(pullRef).To(Equal(ref))
+			Expect(registry).To(Equal(backend.DockerRegistry{}))
+		})
+	})
+})
@@ -0,0 +1,164 @@
+package backend
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/buildpackapplifecycle"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/diego_errors"
+)
+
+const stagingFailedMessage = "staging failed"
+
+// ErrorKind classifies a staging failure. Id is the error id reported to CC
+// and Message is the text shown to the user. An empty Message means the
+// underlying cause is safe to show as is.
+type ErrorKind struct {
+	Id      string
+	Message string
+}
+
+var (
+	KindStagingFailed          = ErrorKind{Id: cc_messages.STAGING_ERROR, Message: stagingFailedMessage}
+	KindInvalidRequest         = ErrorKind{Id: cc_messages.STAGING_ERROR}
+	KindBuildpackDetectFailed  = ErrorKind{Id: cc_messages.BUILDPACK_DETECT_FAILED, Message: stagingFailedMessage}
+	KindBuildpackCompileFailed = ErrorKind{Id: cc_messages.BUILDPACK_COMPILE_FAILED, Message: stagingFailedMessage}
+	KindBuildpackReleaseFailed = ErrorKind{Id: cc_messages.BUILDPACK_RELEASE_FAILED, Message: stagingFailedMessage}
+	KindCNBDetectFailed        = ErrorKind{Id: CNB_DETECT_FAILED, Message: stagingFailedMessage}
+	KindCNBBuildFailed         = ErrorKind{Id: CNB_BUILD_FAILED, Message: stagingFailedMessage}
+	KindInsufficientResources  = ErrorKind{Id: cc_messages.INSUFFICIENT_RESOURCES}
+	KindNoCompatibleCell       = ErrorKind{Id: cc_messages.NO_COMPATIBLE_CELL}
+	KindCellCommunication      = ErrorKind{Id: cc_messages.CELL_COMMUNICATION_ERROR}
+)
+
+// StagingError is a classified staging failure. Error() returns the raw
+// cause for logging; ToCC returns what may be reported to CC.
+type StagingError struct {
+	Kind  ErrorKind
+	Cause error
+}
+
+func NewStagingError(kind ErrorKind, cause error) *StagingError {
+	return &StagingError{Kind: kind, Cause: cause}
+}
+
+func newInvalidRequestError(message string) *StagingError {
+	return NewStagingError(KindInvalidRequest, errors.New(message))
+}
+
+func (e *StagingError) Error() string {
+	if e.Cause != nil {
+		return e.Cause.Error()
+	}
+	return e.UserMessage()
+}
+
+func (e *StagingError) UserMessage() string {
+	if e.Kind.Message != "" {
+		return e.Kind.Message
+	}
+	if e.Cause != nil {
+		return e.Cause.Error()
+	}
+	return stagingFailedMessage
+}
+
+func (e *StagingError) ToCC() *cc_messages.StagingError {
+	return &cc_messages.StagingError{
+		Id:      e.Kind.Id,
+		Message: e.UserMessage(),
+	}
+}
+
+// exitCodeKinds are the exit codes of each lifecycle. An exit code only
+// means something for the lifecycle whose task exited with it: a buildpack
+// can exit with the code another lifecycle reserves.
+var exitCodeKinds = map[string]map[int]ErrorKind{
+	TraditionalLifecycleName: {
+		buildpackapplifecycle.DETECT_FAIL_CODE:  KindBuildpackDetectFailed,
+		buildpackapplifecycle.COMPILE_FAIL_CODE: KindBuildpackCompileFailed,
+		buildpackapplifecycle.RELEASE_FAIL_CODE: KindBuildpackReleaseFailed,
+	},
+	CNBLifecycleName: {
+		CNBDetectFailCode: KindCNBDetectFailed,
+		CNBBuildFailCode:  KindCNBBuildFailed,
+	},
+}
+
+// failureReasonKinds forward the failure reason to CC as is, so each only
+// matches a reason that starts with, or for exact ones is, the phrase Diego
+// reports. A reason that merely mentions a phrase, for example in app output,
+// is a generic staging failure.
+var failureReasonKinds = []struct {
+	phrase string
+	exact  bool
+	kind   ErrorKind
+}{
+	{diego_errors.INSUFFICIENT_RESOURCES_MESSAGE, false, KindInsufficientResources},
+	{diego_errors.CELL_MISMATCH_MESSAGE, false, KindNoCompatibleCell},
+	{diego_errors.CELL_COMMUNICATION_ERROR, true, KindCellCommunication},
+	{diego_errors.MISSING_DOCKER_IMAGE_URL, true, KindInvalidRequest},
+	{diego_errors.MISSING_DOCKER_REGISTRY, true, KindInvalidRequest},
+	{diego_errors.MISSING_DOCKER_CREDENTIALS, true, KindInvalidRequest},
+	{diego_errors.INVALID_DOCKER_REGISTRY_ADDRESS, true, KindInvalidRequest},
+	{diego_errors.NO_COMPILER_DEFINED_MESSAGE, true, KindInvalidRequest},
+	{diego_errors.MISSING_APP_ID_MESSAGE, true, KindInvalidRequest},
+	{diego_errors.MISSING_APP_BITS_DOWNLOAD_URI_MESSAGE, true, KindInvalidRequest},
+	{diego_errors.MISSING_LIFECYCLE_DATA_MESSAGE, true, KindInvalidRequest},
+}
+
+// ParseFailureReason classifies the failure reason Diego reported for a task
+// of the given lifecycle. Reasons ending in an exit code of that lifecycle
+// are matched first, then known Diego messages; anything else is a generic
+// staging failure.
+func ParseFailureReason(lifecycle, reason string) *StagingError {
+	cause := errors.New(reason)
+
+	if code, ok := trailingExitCode(reason); ok {
+		if kind, ok := exitCodeKinds[lifecycle][code]; ok {
+			return NewStagingError(kind, cause)
+		}
+	}
+
+	for _, candidate := range failureReasonKinds {
+		matches := strings.HasPrefix(reason, candidate.phrase)
+		if candidate.exact {
+			matches = reason == candidate.phrase
+		}
+
+		if matches {
+			return NewStagingError(candidate.kind, cause)
+		}
+	}
+
+	return NewStagingError(KindStagingFailed, cause)
+}
+
+// AsStagingError returns err as a *StagingError, classifying it from its
+// message when it was not produced by this package. Such errors do not come
+// from a task, so their message is never read as an exit code.
+func AsStagingError(err error) *StagingError {
+	if stagingErr, ok := err.(*StagingError); ok {
+		return stagingErr
+	}
+	return ParseFailureReason("", err.Error())
+}
+
+func SanitizeErrorMessage(lifecycle, message string) *cc_messages.StagingError {
+	return ParseFailureReason(lifecycle, message).ToCC()
+}
+
+func trailingExitCode(reason string) (int, bool) {
+	fields := strings.Fields(reason)
+	if len(fields) == 0 {
+		return 0, false
+	}
+
+	code, err := strconv.Atoi(strings.TrimRight(fields[len(fields)-1], ".)"))
+	if err != nil {
+		return 0, false
+	}
+	return code, true
+}
@@ -0,0 +1,86 @@
+package backend_test
+
+import (
+	"errors"
+
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/backend"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("StagingError", func() {
+	Describe("ParseFailureReason", func() {
+		It("classifies lifecycle exit codes", func() {
+			Expect(backend.ParseFailureReason(backend.TraditionalLifecycleName, "Exited with status 222").Kind).To(Equal(backend.KindBuildpackDetectFailed))
+			Expect(backend.ParseFailureReason(backend.TraditionalLifecycleName, "Exited with status 223").Kind).To(Equal(backend.KindBuildpackCompileFailed))
+			Expect(backend.ParseFailureReason(backend.TraditionalLifecycleName, "Exited with status 224").Kind).To(Equal(backend.KindBuildpackReleaseFailed))
+			Expect(backend.ParseFailureReason(backend.CNBLifecycleName, "exit status 100").Kind).To(Equal(backend.KindCNBDetectFailed))
+			Expect(backend.ParseFailureReason(backend.CNBLifecycleName, "exit status 401").Kind).To(Equal(backend.KindCNBBuildFailed))
+		})
+
+		It("only classifies the exit codes of the task's own lifecycle", func() {
+			stagingErr := backend.ParseFailureReason(backend.TraditionalLifecycleName, "Exited with status 100")
+			Expect(stagingErr.Kind).To(Equal(backend.KindStagingFailed))
+			Expect(stagingErr.ToCC().Id).To(Equal(cc_messages.STAGING_ERROR))
+
+			Expect(backend.ParseFailureReason(backend.CNBLifecycleName, "Exited with status 223").Kind).To(Equal(backend.KindStagingFailed))
+			Expect(backend.ParseFailureReason(backend.DockerLifecycleName, "Exited with status 222").Kind).To(Equal(backend.KindStagingFailed))
+		})
+
+		It("does not match exit codes that merely end in a known code", func() {
+			Expect(backend.ParseFailureReason(backend.TraditionalLifecycleName, "Exited with status 1222").Kind).To(Equal(backend.KindStagingFailed))
+		})
+
+		It("classifies Diego messages by their prefix", func() {
+			stagingErr := backend.ParseFailureReason(backend.TraditionalLifecycleName, "insufficient resources: memory")
+			Expect(stagingErr.Kind).To(Equal(backend.KindInsufficientResources))
+			Expect(stagingErr.ToCC().Message).To(Equal("insufficient resources: memory"))
+
+			Expect(backend.ParseFailureReason(backend.TraditionalLifecycleName, "found no compatible cell for stack").Kind).To(Equal(backend.KindNoCompatibleCell))
+			Expect(backend.ParseFailureReason(backend.TraditionalLifecycleName, "missing app id").Kind).To(Equal(backend.KindInvalidRequest))
+		})
+
+		It("does not forward reasons that merely mention a Diego message", func() {
+			stagingErr := backend.ParseFailureReason(backend.TraditionalLifecycleName, "npm ERR! insufficient resources: DATABASE_URL=postgres://admin:secret@db")
+			Expect(stagingErr.Kind).To(Equal(backend.KindStagingFailed))
+			Expect(stagingErr.ToCC().Message).To(Equal("staging failed"))
+
+			Expect(backend.ParseFailureReason(backend.TraditionalLifecycleName, "missing app id in request").Kind).To(Equal(backend.KindStagingFailed))
+		})
+
+		It("keeps the raw reason as the cause", func() {
+			stagingErr := backend.ParseFailureReason(backend.TraditionalLifecycleName, "Exited with status 223")
+			Expect(stagingErr.Error()).To(Equal("Exited with status 223"))
+			Expect(stagingErr.ToCC()).To(Equal(&cc_messages.StagingError{
+				Id:      cc_messages.BUILDPACK_COMPILE_FAILED,
+				Message: "staging failed",
+			}))
+		})
+	})
+
+	Describe("AsStagingError", func() {
+		It("returns typed errors unchanged", func() {
+			Expect(backend.AsStagingError(backend.ErrMissingAppId)).To(BeIdenticalTo(backend.ErrMissingAppId))
+		})
+
+		It("does not read untyped errors as exit codes", func() {
+			Expect(backend.AsStagingError(errors.New("exit status 401")).Kind).To(Equal(backend.KindStagingFailed))
+		})
+
+		It("classifies untyped errors from their message", func() {
+			stagingErr := backend.AsStagingError(errors.New("some-error"))
+			Expect(stagingErr.Kind).To(Equal(backend.KindStagingFailed))
+			Expect(stagingErr.Error()).To(Equal("some-error"))
+		})
+	})
+
+	Describe("validation errors", func() {
+		It("reports the validation message to CC", func() {
+			Expect(backend.ErrMissingAppId.ToCC()).To(Equal(&cc_messages.StagingError{
+				Id:      cc_messages.STAGING_ERROR,
+				Message: "missing app id",
+			}))
+		})
+	})
+})
@@ -0,0 +1,27 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// The callback signing keys both sign completion callbacks and seal docker
+// credentials. Each use derives its own key with HKDF, under an info string
+// that no other use shares, so that what one use reveals, such as a
+// signature over an arbitrary staging guid, tells nothing about the others.
+const (
+	callbackKeyInfo          = "stager/callback/v1"
+	dockerCredentialsKeyInfo = "stager/docker-credentials/v1"
+)
+
+func deriveKey(key, info string) []byte {
+	derived := make([]byte, sha256.Size)
+	_, err := io.ReadFull(hkdf.New(sha256.New, []byte(key), nil, []byte(info)), derived)
+	if err != nil {
+		// HKDF only runs out after 255 blocks
+		panic(err)
+	}
+	return derived
+}
@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const anyLifecycle = "*"
+
+// PlacementRules adds placement tags to staging tasks. Rules are keyed by
+// "<lifecycle>", "<lifecycle>/<stack>" or "*/<stack>", and every rule that
+// matches a task applies.
+type PlacementRules map[string][]string
+
+// Validate checks that every rule can apply to one of the given lifecycles
+// and that no task would be given the same tag by two rules.
+func (rules PlacementRules) Validate(lifecycles []string, dockerStagingStack string) error {
+	keys := []string{}
+	for key := range rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		lifecycle, stack := splitPlacementKey(key)
+		if lifecycle == "" || (strings.Contains(key, "/") && stack == "") || strings.Count(key, "/") > 1 {
+			return fmt.Errorf("invalid placement rule '%s': expected <lifecycle>, <lifecycle>/<stack> or */<stack>", key)
+		}
+
+		if lifecycle == anyLifecycle && stack == "" {
+			return fmt.Errorf("invalid placement rule '%s': a stack is required with '*'", key)
+		}
+
+		if lifecycle != anyLifecycle && !containsString(lifecycles, lifecycle) {
+			return fmt.Errorf("invalid placement rule '%s': lifecycle '%s' is not enabled", key, lifecycle)
+		}
+
+		if lifecycle == DockerLifecycleName && stack != "" && stack != dockerStagingStack {
+			return fmt.Errorf("invalid placement rule '%s': docker staging always uses stack '%s'", key, dockerStagingStack)
+		}
+
+		seen := map[string]bool{}
+		for _, tag := range rules[key] {
+			if tag == "" {
+				return fmt.Errorf("invalid placement rule '%s': tags cannot be blank", key)
+			}
+			if seen[tag] {
+				return fmt.Errorf("invalid placement rule '%s': duplicate tag '%s'", key, tag)
+			}
+			seen[tag] = true
+		}
+	}
+
+	for _, key := range keys {
+		for _, other := range keys {
+			if key >= other || !rules.overlap(key, other) {
+				continue
+			}
+
+			for _, tag := range rules[key] {
+				if containsString(rules[other], tag) {
+					return fmt.Errorf("placement rules '%s' and '%s' conflict: both add tag '%s'", key, other, tag)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// PlacementTags merges the isolation segment, which always comes first, with
+// the tags of the rules matching lifecycle and stack.
+func (rules PlacementRules) PlacementTags(lifecycle, stack, isolationSegment string) []string {
+	tags := []string{}
+	if isolationSegment != "" {
+		tags = append(tags, isolationSegment)
+	}
+
+	for _, key := range []string{lifecycle, lifecycle + "/" + stack, anyLifecycle + "/" + stack} {
+		for _, tag := range rules[key] {
+			if !containsString(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// overlap reports whether some task matches both rules.
+func (rules PlacementRules) overlap(key, other string) bool {
+	lifecycle, stack := splitPlacementKey(key)
+	otherLifecycle, otherStack := splitPlacementKey(other)
+
+	lifecyclesOverlap := lifecycle == otherLifecycle || lifecycle == anyLifecycle || otherLifecycle == anyLifecycle
+	stacksOverlap := stack == otherStack || stack == "" || otherStack == ""
+
+	return lifecyclesOverlap && stacksOverlap
+}
+
+func splitPlacementKey(key string) (string, string) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
@@ -0,0 +1,88 @@
+package backend_test
+
+import (
+	"code.cloudfoundry.org/stager/backend"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PlacementRules", func() {
+	var (
+		rules      backend.PlacementRules
+		lifecycles []string
+	)
+
+	BeforeEach(func() {
+		lifecycles = []string{"buildpack", "docker"}
+		rules = backend.PlacementRules{
+			"docker":               {"staging-docker"},
+			"buildpack":            {"staging"},
+			"*/windows2016":        {"windows"},
+			"buildpack/cflinuxfs3": {"linux"},
+		}
+	})
+
+	Describe("PlacementTags", func() {
+		It("puts the isolation segment first", func() {
+			Expect(rules.PlacementTags("buildpack", "windows2016", "segment")).To(Equal([]string{"segment", "staging", "windows"}))
+		})
+
+		It("adds the tags of every matching rule", func() {
+			Expect(rules.PlacementTags("buildpack", "cflinuxfs3", "")).To(Equal([]string{"staging", "linux"}))
+			Expect(rules.PlacementTags("docker", "cflinuxfs3", "")).To(Equal([]string{"staging-docker"}))
+		})
+
+		It("does not repeat the isolation segment", func() {
+			Expect(rules.PlacementTags("docker", "cflinuxfs3", "staging-docker")).To(Equal([]string{"staging-docker"}))
+		})
+
+		It("returns nil when there is nothing to place on", func() {
+			Expect(rules.PlacementTags("cnb", "cflinuxfs3", "")).To(BeNil())
+		})
+	})
+
+	Describe("Validate", func() {
+		It("accepts consistent rules", func() {
+			Expect(rules.Validate(lifecycles, "cflinuxfs3")).To(Succeed())
+		})
+
+		It("rejects malformed keys", func() {
+			rules["buildpack/"] = []string{"x"}
+			Expect(rules.Validate(lifecycles, "cflinuxfs3")).To(MatchError(ContainSubstring("invalid placement rule 'buildpack/'")))
+		})
+
+		It("rejects '*' without a stack", func() {
+			rules["*"] = []string{"x"}
+			Expect(rules.Validate(lifecycles, "cflinuxfs3")).To(MatchError("invalid placement rule '*': a stack is required with '*'"))
+		})
+
+		It("rejects rules for lifecycles that are not enabled", func() {
+			rules["cnb"] = []string{"x"}
+			Expect(rules.Validate(lifecycles, "cflinuxfs3")).To(MatchError("invalid placement rule 'cnb': lifecycle 'cnb' is not enabled"))
+		})
+
+		It("rejects docker rules for another stack", func() {
+			rules["docker/windows2016"] = []string{"x"}
+			Expect(rules.Validate(lifecycles, "cflinuxfs3")).To(MatchError("invalid placement rule 'docker/windows2016': docker staging always uses stack 'cflinuxfs3'"))
+		})
+
+		It("rejects blank and duplicate tags", func() {
+			rules["docker"] = []string{""}
+			Expect(rules.Validate(lifecycles, "cflinuxfs3")).To(MatchError("invalid placement rule 'docker': tags cannot be blank"))
+
+			rules["docker"] = []string{"a", "a"}
+			Expect(rules.Validate(lifecycles, "cflinuxfs3")).To(MatchError("invalid placement rule 'docker': duplicate tag 'a'"))
+		})
+
+		It("rejects rules that would add the same tag to a task", func() {
+			rules["buildpack/windows2016"] = []string{"windows"}
+			Expect(rules.Validate(lifecycles, "cflinuxfs3")).To(MatchError("placement rules '*/windows2016' and 'buildpack/windows2016' conflict: both add tag 'windows'"))
+		})
+
+		It("allows the same tag in rules that never apply together", func() {
+			rules["buildpack/windows2012"] = []string{"linux"}
+			Expect(rules.Validate(lifecycles, "cflinuxfs3")).To(Succeed())
+		})
+	})
+})
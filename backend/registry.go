@@ -0,0 +1,159 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// Factory builds a Backend from the configuration shared by all lifecycles and
+// the lifecycle's own section of the stager configuration, which may be nil.
+// The shared configuration may be replaced while the backend is in use.
+type Factory func(config *SharedConfig, lifecycleConfig json.RawMessage, logger lager.Logger) (Backend, error)
+
+type Registry struct {
+	lock      sync.RWMutex
+	factories map[string]Factory
+	optIn     map[string]bool
+}
+
+// DefaultRegistry holds the lifecycles compiled into the stager. Packages
+// providing additional lifecycles add themselves to it with Register.
+var DefaultRegistry = NewRegistry()
+
+func init() {
+	Register(TraditionalLifecycleName, func(config *SharedConfig, _ json.RawMessage, logger lager.Logger) (Backend, error) {
+		return NewTraditionalBackendWithSharedConfig(config, logger), nil
+	})
+	Register(DockerLifecycleName, func(config *SharedConfig, _ json.RawMessage, logger lager.Logger) (Backend, error) {
+		return NewDockerBackendWithSharedConfig(config, logger), nil
+	})
+	RegisterOptIn(CNBLifecycleName, func(config *SharedConfig, _ json.RawMessage, logger lager.Logger) (Backend, error) {
+		return NewCNBBackendWithSharedConfig(config, logger), nil
+	})
+}
+
+// Register adds a lifecycle to the DefaultRegistry. It panics if the name is
+// already taken, as that can only be a programming error.
+func Register(name string, factory Factory) {
+	err := DefaultRegistry.Register(name, factory)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// RegisterOptIn adds a lifecycle to the DefaultRegistry that is only built
+// when it is enabled by name.
+func RegisterOptIn(name string, factory Factory) {
+	err := DefaultRegistry.RegisterOptIn(name, factory)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		factories: map[string]Factory{},
+		optIn:     map[string]bool{},
+	}
+}
+
+func (r *Registry) Register(name string, factory Factory) error {
+	return r.register(name, factory, false)
+}
+
+func (r *Registry) RegisterOptIn(name string, factory Factory) error {
+	return r.register(name, factory, true)
+}
+
+func (r *Registry) register(name string, factory Factory, optIn bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if name == "" {
+		return fmt.Errorf("lifecycle name cannot be blank")
+	}
+
+	if factory == nil {
+		return fmt.Errorf("no factory given for lifecycle '%s'", name)
+	}
+
+	if _, ok := r.factories[name]; ok {
+		return fmt.Errorf("lifecycle '%s' is already registered", name)
+	}
+
+	r.factories[name] = factory
+	r.optIn[name] = optIn
+	return nil
+}
+
+func (r *Registry) Names() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	names := []string{}
+	for name := range r.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// DefaultNames returns the lifecycles that are enabled when none are named:
+// every registered lifecycle except the opt-in ones.
+func (r *Registry) DefaultNames() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	names := []string{}
+	for name := range r.factories {
+		if !r.optIn[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Build constructs the enabled backends, keyed by lifecycle name. When enabled
+// is empty the DefaultNames are built.
+func (r *Registry) Build(enabled []string, config *SharedConfig, lifecycleConfigs map[string]json.RawMessage, logger lager.Logger) (map[string]Backend, error) {
+	if len(enabled) == 0 {
+		enabled = r.DefaultNames()
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for name := range lifecycleConfigs {
+		if _, ok := r.factories[name]; !ok {
+			return nil, fmt.Errorf("configuration given for unknown lifecycle '%s'", name)
+		}
+	}
+
+	backends := map[string]Backend{}
+	for _, name := range enabled {
+		factory, ok := r.factories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown lifecycle '%s'", name)
+		}
+
+		if _, ok := backends[name]; ok {
+			continue
+		}
+
+		backend, err := factory(config, lifecycleConfigs[name], logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize lifecycle '%s': %s", name, err)
+		}
+
+		backends[name] = backend
+	}
+
+	return backends, nil
+}
@@ -0,0 +1,140 @@
+package backend_test
+
+import (
+	"encoding/json"
+	"errors"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/stager/backend"
+	"code.cloudfoundry.org/stager/backend/fake_backend"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registry", func() {
+	var (
+		registry *backend.Registry
+		logger   lager.Logger
+		config   *backend.SharedConfig
+
+		fakeBackend       *fake_backend.FakeBackend
+		receivedConfig    *backend.SharedConfig
+		receivedLifecycle json.RawMessage
+		factoryError      error
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		config = backend.NewSharedConfig(backend.Config{TaskDomain: "config-task-domain"})
+
+		fakeBackend = &fake_backend.FakeBackend{}
+		factoryError = nil
+		receivedLifecycle = nil
+
+		registry = backend.NewRegistry()
+		err := registry.Register("fake", func(config *backend.SharedConfig, lifecycleConfig json.RawMessage, logger lager.Logger) (backend.Backend, error) {
+			receivedConfig = config
+			receivedLifecycle = lifecycleConfig
+			return fakeBackend, factoryError
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Describe("Register", func() {
+		It("rejects duplicate names", func() {
+			err := registry.Register("fake", func(*backend.SharedConfig, json.RawMessage, lager.Logger) (backend.Backend, error) {
+				return nil, nil
+			})
+			Expect(err).To(MatchError("lifecycle 'fake' is already registered"))
+		})
+
+		It("rejects blank names", func() {
+			err := registry.Register("", func(*backend.SharedConfig, json.RawMessage, lager.Logger) (backend.Backend, error) {
+				return nil, nil
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("rejects a missing factory", func() {
+			Expect(registry.Register("other", nil)).NotTo(Succeed())
+		})
+	})
+
+	Describe("Build", func() {
+		It("builds the enabled lifecycles with their configuration section", func() {
+			backends, err := registry.Build([]string{"fake"}, config, map[string]json.RawMessage{
+				"fake": json.RawMessage(`{"some":"setting"}`),
+			}, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(backends).To(HaveLen(1))
+			Expect(backends["fake"]).To(Equal(fakeBackend))
+			Expect(receivedConfig).To(BeIdenticalTo(config))
+			Expect([]byte(receivedLifecycle)).To(MatchJSON(`{"some":"setting"}`))
+		})
+
+		It("builds every registered lifecycle when none are enabled explicitly", func() {
+			backends, err := registry.Build(nil, config, nil, logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backends).To(HaveKey("fake"))
+		})
+
+		Context("when a lifecycle is opt-in", func() {
+			BeforeEach(func() {
+				err := registry.RegisterOptIn("opt-in", func(*backend.SharedConfig, json.RawMessage, lager.Logger) (backend.Backend, error) {
+					return &fake_backend.FakeBackend{}, nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("is only built when enabled by name", func() {
+				Expect(registry.Names()).To(Equal([]string{"fake", "opt-in"}))
+				Expect(registry.DefaultNames()).To(Equal([]string{"fake"}))
+
+				backends, err := registry.Build(nil, config, nil, logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(backends).NotTo(HaveKey("opt-in"))
+
+				backends, err = registry.Build([]string{"opt-in"}, config, nil, logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(backends).To(HaveKey("opt-in"))
+			})
+		})
+
+		It("fails for an unknown lifecycle", func() {
+			_, err := registry.Build([]string{"fake", "missing"}, config, nil, logger)
+			Expect(err).To(MatchError("unknown lifecycle 'missing'"))
+		})
+
+		It("fails for configuration of an unknown lifecycle", func() {
+			_, err := registry.Build(nil, config, map[string]json.RawMessage{
+				"missing": json.RawMessage(`{}`),
+			}, logger)
+			Expect(err).To(HaveOccurred())
+		})
+
+		Context("when the factory fails", func() {
+			BeforeEach(func() {
+				factoryError = errors.New("bad config")
+			})
+
+			It("returns the error", func() {
+				_, err := registry.Build(nil, config, nil, logger)
+				Expect(err).To(MatchError("failed to initialize lifecycle 'fake': bad config"))
+			})
+		})
+	})
+
+	Describe("DefaultRegistry", func() {
+		It("has the buildpack and docker lifecycles registered", func() {
+			Expect(backend.DefaultRegistry.Names()).To(ContainElement(backend.TraditionalLifecycleName))
+			Expect(backend.DefaultRegistry.Names()).To(ContainElement(backend.DockerLifecycleName))
+		})
+
+		It("only enables the cnb lifecycle when it is named", func() {
+			Expect(backend.DefaultRegistry.Names()).To(ContainElement(backend.CNBLifecycleName))
+			Expect(backend.DefaultRegistry.DefaultNames()).NotTo(ContainElement(backend.CNBLifecycleName))
+		})
+	})
+})
@@ -0,0 +1,133 @@
+package backend
+
+import (
+	"fmt"
+	"sort"
+
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+)
+
+// Staging error id reported to CC when a request is rejected by policy
+const STAGING_RESOURCES_OUT_OF_POLICY = "StagingResourcesOutOfPolicy"
+
+var KindResourcesOutOfPolicy = ErrorKind{Id: STAGING_RESOURCES_OUT_OF_POLICY}
+
+// ResourceLimits bounds a single staging resource. A zero value leaves that
+// bound unset.
+type ResourceLimits struct {
+	Min     int `json:"min"`
+	Max     int `json:"max"`
+	Default int `json:"default"`
+}
+
+// ResourcePolicy bounds the resources of a staging task. Requests outside the
+// limits are clamped unless Reject is set.
+type ResourcePolicy struct {
+	MemoryMB        ResourceLimits `json:"memory_mb"`
+	DiskMB          ResourceLimits `json:"disk_mb"`
+	FileDescriptors ResourceLimits `json:"file_descriptors"`
+	CpuWeight       uint32         `json:"cpu_weight"`
+	Reject          bool           `json:"reject_out_of_policy"`
+}
+
+// ResourcePolicies is keyed by "<lifecycle>/<stack>" or "<lifecycle>".
+// The most specific key wins.
+type ResourcePolicies map[string]ResourcePolicy
+
+type StagingResources struct {
+	MemoryMB        int
+	DiskMB          int
+	FileDescriptors int
+	CpuWeight       uint32
+}
+
+func (policies ResourcePolicies) Validate() error {
+	keys := []string{}
+	for key := range policies {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		policy := policies[key]
+		for name, limits := range map[string]ResourceLimits{
+			"memory_mb":        policy.MemoryMB,
+			"disk_mb":          policy.DiskMB,
+			"file_descriptors": policy.FileDescriptors,
+		} {
+			err := limits.validate()
+			if err != nil {
+				return fmt.Errorf("invalid %s policy for '%s': %s", name, key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Resolve applies the policy for lifecycle and stack to the resources asked
+// for in request. defaultCpuWeight is used when the policy sets none.
+func (policies ResourcePolicies) Resolve(lifecycle, stack string, defaultCpuWeight uint32, request cc_messages.StagingRequestFromCC) (StagingResources, error) {
+	policy, ok := policies[lifecycle+"/"+stack]
+	if !ok {
+		policy = policies[lifecycle]
+	}
+
+	resources := StagingResources{CpuWeight: defaultCpuWeight}
+	if policy.CpuWeight > 0 {
+		resources.CpuWeight = policy.CpuWeight
+	}
+
+	var err error
+	resources.MemoryMB, err = policy.MemoryMB.apply("memory_mb", request.MemoryMB, policy.Reject)
+	if err != nil {
+		return StagingResources{}, err
+	}
+
+	resources.DiskMB, err = policy.DiskMB.apply("disk_mb", request.DiskMB, policy.Reject)
+	if err != nil {
+		return StagingResources{}, err
+	}
+
+	fileDescriptors, err := policy.FileDescriptors.apply("file_descriptors", int(request.FileDescriptors), policy.Reject)
+	if err != nil {
+		return StagingResources{}, err
+	}
+	resources.FileDescriptors = fileDescriptors
+
+	return resources, nil
+}
+
+func (limits ResourceLimits) validate() error {
+	if limits.Min < 0 || limits.Max < 0 || limits.Default < 0 {
+		return fmt.Errorf("limits cannot be negative")
+	}
+	if limits.Max > 0 && limits.Min > limits.Max {
+		return fmt.Errorf("min %d is greater than max %d", limits.Min, limits.Max)
+	}
+	if limits.Default > 0 && (limits.Default < limits.Min || (limits.Max > 0 && limits.Default > limits.Max)) {
+		return fmt.Errorf("default %d is outside of [%d, %d]", limits.Default, limits.Min, limits.Max)
+	}
+	return nil
+}
+
+func (limits ResourceLimits) apply(name string, requested int, reject bool) (int, error) {
+	if requested == 0 {
+		requested = limits.Default
+	}
+
+	switch {
+	case limits.Min > 0 && requested < limits.Min:
+		if reject {
+			return 0, NewStagingError(KindResourcesOutOfPolicy, fmt.Errorf("requested %s %d is below the minimum of %d", name, requested, limits.Min))
+		}
+		return limits.Min, nil
+	case limits.Max > 0 && requested > limits.Max:
+		if reject {
+			return 0, NewStagingError(KindResourcesOutOfPolicy, fmt.Errorf("requested %s %d exceeds the maximum of %d", name, requested, limits.Max))
+		}
+		return limits.Max, nil
+	}
+
+	return requested, nil
+}
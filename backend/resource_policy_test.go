@@ -0,0 +1,126 @@
+package backend_test
+
+import (
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/backend"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ResourcePolicies", func() {
+	var (
+		policies backend.ResourcePolicies
+		request  cc_messages.StagingRequestFromCC
+	)
+
+	BeforeEach(func() {
+		policies = backend.ResourcePolicies{
+			"buildpack": {
+				MemoryMB:        backend.ResourceLimits{Min: 256, Max: 2048, Default: 1024},
+				DiskMB:          backend.ResourceLimits{Max: 4096},
+				FileDescriptors: backend.ResourceLimits{Default: 1024},
+			},
+			"buildpack/windows2012R2": {
+				MemoryMB:  backend.ResourceLimits{Max: 8192},
+				CpuWeight: 80,
+				Reject:    true,
+			},
+		}
+
+		request = cc_messages.StagingRequestFromCC{
+			MemoryMB:        512,
+			DiskMB:          1024,
+			FileDescriptors: 256,
+		}
+	})
+
+	Describe("Resolve", func() {
+		It("passes requests within policy through", func() {
+			resources, err := policies.Resolve("buildpack", "cflinuxfs2", 50, request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resources).To(Equal(backend.StagingResources{
+				MemoryMB:        512,
+				DiskMB:          1024,
+				FileDescriptors: 256,
+				CpuWeight:       50,
+			}))
+		})
+
+		It("uses defaults for unset values", func() {
+			request.MemoryMB = 0
+			request.FileDescriptors = 0
+
+			resources, err := policies.Resolve("buildpack", "cflinuxfs2", 50, request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resources.MemoryMB).To(Equal(1024))
+			Expect(resources.FileDescriptors).To(Equal(1024))
+		})
+
+		It("clamps values outside of the policy", func() {
+			request.MemoryMB = 64
+			request.DiskMB = 100000
+
+			resources, err := policies.Resolve("buildpack", "cflinuxfs2", 50, request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resources.MemoryMB).To(Equal(256))
+			Expect(resources.DiskMB).To(Equal(4096))
+		})
+
+		It("prefers the stack specific policy", func() {
+			request.MemoryMB = 6144
+
+			resources, err := policies.Resolve("buildpack", "windows2012R2", 50, request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resources.MemoryMB).To(Equal(6144))
+			Expect(resources.CpuWeight).To(Equal(uint32(80)))
+		})
+
+		Context("when the policy rejects out of policy requests", func() {
+			It("returns a typed error", func() {
+				request.MemoryMB = 16384
+
+				_, err := policies.Resolve("buildpack", "windows2012R2", 50, request)
+				Expect(err).To(HaveOccurred())
+
+				stagingErr := backend.AsStagingError(err)
+				Expect(stagingErr.Kind).To(Equal(backend.KindResourcesOutOfPolicy))
+				Expect(stagingErr.ToCC()).To(Equal(&cc_messages.StagingError{
+					Id:      backend.STAGING_RESOURCES_OUT_OF_POLICY,
+					Message: "requested memory_mb 16384 exceeds the maximum of 8192",
+				}))
+			})
+		})
+
+		Context("when there is no policy", func() {
+			It("passes the request through", func() {
+				resources, err := backend.ResourcePolicies(nil).Resolve("docker", "cflinuxfs2", 0, request)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resources).To(Equal(backend.StagingResources{
+					MemoryMB:        512,
+					DiskMB:          1024,
+					FileDescriptors: 256,
+				}))
+			})
+		})
+	})
+
+	Describe("Validate", func() {
+		It("accepts consistent policies", func() {
+			Expect(policies.Validate()).To(Succeed())
+		})
+
+		It("rejects a minimum above the maximum", func() {
+			policies["docker"] = backend.ResourcePolicy{
+				DiskMB: backend.ResourceLimits{Min: 2048, Max: 1024},
+			}
+			Expect(policies.Validate()).To(MatchError("invalid disk_mb policy for 'docker': min 2048 is greater than max 1024"))
+		})
+
+		It("rejects a default outside of the limits", func() {
+			policies["docker"] = backend.ResourcePolicy{
+				MemoryMB: backend.ResourceLimits{Min: 256, Max: 1024, Default: 2048},
+			}
+			Expect(policies.Validate()).To(HaveOccurred())
+		})
+	})
+})
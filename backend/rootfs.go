@@ -0,0 +1,95 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"code.cloudfoundry.org/bbs/models"
+)
+
+// Staging error id reported to CC when a request names a stack the stager
+// has no rootfs for
+const UNKNOWN_STACK = "UnknownStack"
+
+var KindUnknownStack = ErrorKind{Id: UNKNOWN_STACK}
+
+var rootFSSchemes = []string{"preloaded", "preloaded+layer", "docker"}
+
+// StackRootFSes maps stack names to the rootfs their staging tasks run on.
+// A value is either a rootfs URI, such as "preloaded:cflinuxfs3-v2" or
+// "docker:///cloudfoundry/cflinuxfs3", or the name of a preloaded rootfs the
+// stack is an alias for. When the map is empty every stack is staged on the
+// preloaded rootfs of the same name; otherwise only the stacks it lists are
+// accepted.
+type StackRootFSes map[string]string
+
+func (rootFSes StackRootFSes) Validate() error {
+	stacks := []string{}
+	for stack := range rootFSes {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+
+	for _, stack := range stacks {
+		if stack == "" {
+			return errors.New("invalid stack rootfs: stack name cannot be blank")
+		}
+
+		err := validateRootFS(rootFSes[stack])
+		if err != nil {
+			return fmt.Errorf("invalid rootfs for stack '%s': %s", stack, err)
+		}
+	}
+
+	return nil
+}
+
+// RootFS returns the rootfs to stage stack on, or a *StagingError if the
+// stack is unknown.
+func (rootFSes StackRootFSes) RootFS(stack string) (string, error) {
+	if len(rootFSes) == 0 {
+		return models.PreloadedRootFS(stack), nil
+	}
+
+	rootFS, ok := rootFSes[stack]
+	if !ok {
+		return "", NewStagingError(KindUnknownStack, fmt.Errorf("unknown stack '%s'", stack))
+	}
+
+	if !strings.Contains(rootFS, ":") {
+		return models.PreloadedRootFS(rootFS), nil
+	}
+
+	return rootFS, nil
+}
+
+func validateRootFS(rootFS string) error {
+	if rootFS == "" {
+		return errors.New("rootfs cannot be blank")
+	}
+
+	if !strings.Contains(rootFS, ":") {
+		if strings.Contains(rootFS, "/") {
+			return fmt.Errorf("'%s' is neither a URI nor a stack name", rootFS)
+		}
+		return nil
+	}
+
+	parsed, err := url.Parse(rootFS)
+	if err != nil {
+		return err
+	}
+
+	if !containsString(rootFSSchemes, parsed.Scheme) {
+		return fmt.Errorf("unsupported scheme '%s'", parsed.Scheme)
+	}
+
+	if parsed.Opaque == "" && parsed.Path == "" {
+		return fmt.Errorf("'%s' names no rootfs", rootFS)
+	}
+
+	return nil
+}
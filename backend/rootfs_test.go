@@ -0,0 +1,72 @@
+package backend_test
+
+import (
+	"code.cloudfoundry.org/stager/backend"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("StackRootFSes", func() {
+	var rootFSes backend.StackRootFSes
+
+	BeforeEach(func() {
+		rootFSes = backend.StackRootFSes{
+			"cflinuxfs3":  "preloaded:cflinuxfs3-v2",
+			"cflinuxfs4":  "docker:///cloudfoundry/cflinuxfs4#v1",
+			"cflinuxfs":   "cflinuxfs3",
+			"windows2016": "preloaded+layer:windows2016?layer=https://blobs.example.com/layer.tgz",
+		}
+	})
+
+	Describe("RootFS", func() {
+		It("returns configured URIs as is", func() {
+			Expect(rootFSes.RootFS("cflinuxfs3")).To(Equal("preloaded:cflinuxfs3-v2"))
+			Expect(rootFSes.RootFS("cflinuxfs4")).To(Equal("docker:///cloudfoundry/cflinuxfs4#v1"))
+		})
+
+		It("resolves aliases to a preloaded rootfs", func() {
+			Expect(rootFSes.RootFS("cflinuxfs")).To(Equal("preloaded:cflinuxfs3"))
+		})
+
+		It("rejects unknown stacks", func() {
+			_, err := rootFSes.RootFS("cflinuxfs2")
+			Expect(err).To(HaveOccurred())
+
+			ccError := backend.AsStagingError(err).ToCC()
+			Expect(ccError.Id).To(Equal(backend.UNKNOWN_STACK))
+			Expect(ccError.Message).To(Equal("unknown stack 'cflinuxfs2'"))
+		})
+
+		Context("when no rootfs is configured", func() {
+			BeforeEach(func() {
+				rootFSes = nil
+			})
+
+			It("uses the preloaded rootfs named after the stack", func() {
+				Expect(rootFSes.RootFS("anything")).To(Equal("preloaded:anything"))
+			})
+		})
+	})
+
+	Describe("Validate", func() {
+		It("accepts URIs and aliases", func() {
+			Expect(rootFSes.Validate()).To(Succeed())
+		})
+
+		It("rejects unsupported schemes", func() {
+			rootFSes["cflinuxfs3"] = "http://example.com/rootfs.tgz"
+			Expect(rootFSes.Validate()).To(MatchError("invalid rootfs for stack 'cflinuxfs3': unsupported scheme 'http'"))
+		})
+
+		It("rejects blank rootfses", func() {
+			rootFSes["cflinuxfs3"] = ""
+			Expect(rootFSes.Validate()).To(MatchError("invalid rootfs for stack 'cflinuxfs3': rootfs cannot be blank"))
+		})
+
+		It("rejects values that are neither URIs nor stack names", func() {
+			rootFSes["cflinuxfs3"] = "some/path"
+			Expect(rootFSes.Validate()).To(MatchError("invalid rootfs for stack 'cflinuxfs3': 'some/path' is neither a URI nor a stack name"))
+		})
+	})
+})
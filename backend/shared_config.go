@@ -0,0 +1,25 @@
+package backend
+
+import "sync/atomic"
+
+// SharedConfig holds the Config used by every backend so that it can be
+// replaced while the stager is running. Backends Load it once per request,
+// so a request is built from a single configuration even if it is swapped
+// halfway through.
+type SharedConfig struct {
+	value atomic.Value
+}
+
+func NewSharedConfig(config Config) *SharedConfig {
+	shared := &SharedConfig{}
+	shared.Store(config)
+	return shared
+}
+
+func (s *SharedConfig) Load() Config {
+	return s.value.Load().(Config)
+}
+
+func (s *SharedConfig) Store(config Config) {
+	s.value.Store(config)
+}
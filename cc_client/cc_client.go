@@ -3,9 +3,11 @@ package cc_client
 import (
 	"bytes"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"code.cloudfoundry.org/lager"
@@ -18,13 +20,30 @@ const (
 //go:generate counterfeiter -o fakes/fake_cc_client.go . CcClient
 type CcClient interface {
 	StagingComplete(stagingGuid string, completionCallback string, payload []byte, logger lager.Logger) error
+	StagingProgress(stagingGuid string, progress StagingProgress, logger lager.Logger) error
+	SetCredentials(username string, password string)
+}
+
+const (
+	// The task is desired and waiting to be placed on a cell
+	StagingProgressPending = "PENDING"
+	// A cell has claimed the task and started running it
+	StagingProgressRunning = "RUNNING"
+)
+
+type StagingProgress struct {
+	State     string `json:"state"`
+	CellId    string `json:"cell_id,omitempty"`
+	UpdatedAt int64  `json:"updated_at"`
 }
 
 type ccClient struct {
 	baseURI    string
-	username   string
-	password   string
 	httpClient *http.Client
+
+	credentialsLock sync.RWMutex
+	username        string
+	password        string
 }
 
 type BadResponseError struct {
@@ -69,7 +88,7 @@ func (cc *ccClient) StagingComplete(stagingGuid string, completionCallback strin
 		return err
 	}
 
-	request.SetBasicAuth(cc.username, cc.password)
+	request.SetBasicAuth(cc.credentials())
 	request.Header.Set("content-type", "application/json")
 
 	response, err := cc.httpClient.Do(request)
@@ -88,6 +107,38 @@ func (cc *ccClient) StagingComplete(stagingGuid string, completionCallback strin
 	return nil
 }
 
+func (cc *ccClient) StagingProgress(stagingGuid string, progress StagingProgress, logger lager.Logger) error {
+	logger = logger.Session("cc-client")
+
+	payload, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", fmt.Sprintf("%s/internal/staging/%s/progress", cc.baseURI, stagingGuid), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	request.SetBasicAuth(cc.credentials())
+	request.Header.Set("content-type", "application/json")
+
+	response, err := cc.httpClient.Do(request)
+	if err != nil {
+		logger.Error("deliver-staging-progress-failed", err)
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return &BadResponseError{response.StatusCode}
+	}
+
+	logger.Debug("delivered-staging-progress", lager.Data{"state": progress.State})
+	return nil
+}
+
 func (cc *ccClient) stagingCompleteURI(stagingGuid string, completionCallback string) string {
 	if completionCallback == "" {
 		return fmt.Sprintf("%s/internal/staging/%s/completed", cc.baseURI, stagingGuid)
@@ -95,3 +146,20 @@ func (cc *ccClient) stagingCompleteURI(stagingGuid string, completionCallback st
 		return completionCallback
 	}
 }
+
+// SetCredentials replaces the basic auth credentials used for requests made
+// from now on.
+func (cc *ccClient) SetCredentials(username string, password string) {
+	cc.credentialsLock.Lock()
+	defer cc.credentialsLock.Unlock()
+
+	cc.username = username
+	cc.password = password
+}
+
+func (cc *ccClient) credentials() (string, string) {
+	cc.credentialsLock.RLock()
+	defer cc.credentialsLock.RUnlock()
+
+	return cc.username, cc.password
+}
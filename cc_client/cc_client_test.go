@@ -84,6 +84,50 @@ var _ = Describe("CC Client", func() {
 		})
 	})
 
+	Describe("SetCredentials", func() {
+		It("uses the new credentials for subsequent requests", func() {
+			fakeCC.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", fmt.Sprintf("/internal/staging/%s/completed", stagingGuid)),
+					ghttp.VerifyBasicAuth("new-username", "new-password"),
+					ghttp.RespondWith(200, `{}`),
+				),
+			)
+
+			ccClient.SetCredentials("new-username", "new-password")
+
+			err := ccClient.StagingComplete(stagingGuid, completionCallback, []byte(`{}`), logger)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("StagingProgress", func() {
+		It("posts the progress to the CC progress endpoint", func() {
+			fakeCC.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", fmt.Sprintf("/internal/staging/%s/progress", stagingGuid)),
+					ghttp.VerifyBasicAuth("username", "password"),
+					ghttp.VerifyJSON(`{"state": "RUNNING", "cell_id": "cell-1", "updated_at": 42}`),
+					ghttp.RespondWith(200, `{}`),
+				),
+			)
+
+			err := ccClient.StagingProgress(stagingGuid, cc_client.StagingProgress{
+				State:     cc_client.StagingProgressRunning,
+				CellId:    "cell-1",
+				UpdatedAt: 42,
+			}, logger)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("returns an error with the actual status code", func() {
+			fakeCC.AppendHandlers(ghttp.RespondWith(404, `{}`))
+
+			err := ccClient.StagingProgress(stagingGuid, cc_client.StagingProgress{State: cc_client.StagingProgressPending}, logger)
+			Expect(err).To(Equal(&cc_client.BadResponseError{StatusCode: 404}))
+		})
+	})
+
 	Describe("TLS certificate validation", func() {
 		BeforeEach(func() {
 			fakeCC = ghttp.NewTLSServer() // self-signed certificate
@@ -20,6 +20,22 @@ type FakeCcClient struct {
 	stagingCompleteReturns struct {
 		result1 error
 	}
+	StagingProgressStub        func(stagingGuid string, progress cc_client.StagingProgress, logger lager.Logger) error
+	stagingProgressMutex       sync.RWMutex
+	stagingProgressArgsForCall []struct {
+		stagingGuid string
+		progress    cc_client.StagingProgress
+		logger      lager.Logger
+	}
+	stagingProgressReturns struct {
+		result1 error
+	}
+	SetCredentialsStub        func(username string, password string)
+	setCredentialsMutex       sync.RWMutex
+	setCredentialsArgsForCall []struct {
+		username string
+		password string
+	}
 }
 
 func (fake *FakeCcClient) StagingComplete(stagingGuid string, completionCallback string, payload []byte, logger lager.Logger) error {
@@ -57,4 +73,62 @@ func (fake *FakeCcClient) StagingCompleteReturns(result1 error) {
 	}{result1}
 }
 
+func (fake *FakeCcClient) StagingProgress(stagingGuid string, progress cc_client.StagingProgress, logger lager.Logger) error {
+	fake.stagingProgressMutex.Lock()
+	fake.stagingProgressArgsForCall = append(fake.stagingProgressArgsForCall, struct {
+		stagingGuid string
+		progress    cc_client.StagingProgress
+		logger      lager.Logger
+	}{stagingGuid, progress, logger})
+	fake.stagingProgressMutex.Unlock()
+	if fake.StagingProgressStub != nil {
+		return fake.StagingProgressStub(stagingGuid, progress, logger)
+	} else {
+		return fake.stagingProgressReturns.result1
+	}
+}
+
+func (fake *FakeCcClient) StagingProgressCallCount() int {
+	fake.stagingProgressMutex.RLock()
+	defer fake.stagingProgressMutex.RUnlock()
+	return len(fake.stagingProgressArgsForCall)
+}
+
+func (fake *FakeCcClient) StagingProgressArgsForCall(i int) (string, cc_client.StagingProgress, lager.Logger) {
+	fake.stagingProgressMutex.RLock()
+	defer fake.stagingProgressMutex.RUnlock()
+	return fake.stagingProgressArgsForCall[i].stagingGuid, fake.stagingProgressArgsForCall[i].progress, fake.stagingProgressArgsForCall[i].logger
+}
+
+func (fake *FakeCcClient) StagingProgressReturns(result1 error) {
+	fake.StagingProgressStub = nil
+	fake.stagingProgressReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeCcClient) SetCredentials(username string, password string) {
+	fake.setCredentialsMutex.Lock()
+	fake.setCredentialsArgsForCall = append(fake.setCredentialsArgsForCall, struct {
+		username string
+		password string
+	}{username, password})
+	fake.setCredentialsMutex.Unlock()
+	if fake.SetCredentialsStub != nil {
+		fake.SetCredentialsStub(username, password)
+	}
+}
+
+func (fake *FakeCcClient) SetCredentialsCallCount() int {
+	fake.setCredentialsMutex.RLock()
+	defer fake.setCredentialsMutex.RUnlock()
+	return len(fake.setCredentialsArgsForCall)
+}
+
+func (fake *FakeCcClient) SetCredentialsArgsForCall(i int) (string, string) {
+	fake.setCredentialsMutex.RLock()
+	defer fake.setCredentialsMutex.RUnlock()
+	return fake.setCredentialsArgsForCall[i].username, fake.setCredentialsArgsForCall[i].password
+}
+
 var _ cc_client.CcClient = new(FakeCcClient)
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/cloudfoundry/dropsonde"
 	"github.com/hashicorp/consul/api"
@@ -23,11 +28,19 @@ import (
 	"code.cloudfoundry.org/lager/lagerflags"
 	"code.cloudfoundry.org/locket"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
-	"code.cloudfoundry.org/runtimeschema/cc_messages/flags"
+	"code.cloudfoundry.org/stager/admission"
+	"code.cloudfoundry.org/stager/api_auth"
 	"code.cloudfoundry.org/stager/backend"
 	"code.cloudfoundry.org/stager/cc_client"
+	"code.cloudfoundry.org/stager/completion_queue"
 	"code.cloudfoundry.org/stager/config"
+	"code.cloudfoundry.org/stager/config_reloader"
 	"code.cloudfoundry.org/stager/handlers"
+	"code.cloudfoundry.org/stager/mutual_tls"
+	"code.cloudfoundry.org/stager/prometheus_metrics"
+	"code.cloudfoundry.org/stager/reconciler"
+	"code.cloudfoundry.org/stager/staging_progress"
+	"code.cloudfoundry.org/stager/tracing"
 )
 
 var configPath = flag.String(
@@ -36,6 +49,24 @@ var configPath = flag.String(
 	"path to the stager configuration file",
 )
 
+var secretsPath = flag.String(
+	"secretsPath",
+	"",
+	"path to a file of settings, such as passwords, merged on top of the configuration file",
+)
+
+var printConfig = flag.Bool(
+	"printConfig",
+	false,
+	"print the effective configuration, with secrets redacted, and exit",
+)
+
+var validateConfig = flag.Bool(
+	"validateConfig",
+	false,
+	"validate the configuration file, report any problems and exit",
+)
+
 const (
 	dropsondeOrigin = "stager"
 )
@@ -43,27 +74,81 @@ const (
 func main() {
 	flag.Parse()
 
-	stagerConfig, err := config.NewStagerConfig(*configPath)
+	sources := config.Sources{
+		ConfigPath:  *configPath,
+		SecretsPath: *secretsPath,
+		Environment: os.Environ(),
+	}
+
+	if *validateConfig {
+		os.Exit(validateConfigSources(sources))
+	}
+
+	if *printConfig {
+		os.Exit(printConfigSources(sources))
+	}
+
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+
+	stagerConfig, err := config.LoadStagerConfig(sources)
 	if err != nil {
 		panic(err.Error())
 	}
-	lifecycles := flags.LifecycleMap{}
-	for _, value := range stagerConfig.Lifecycles {
-		if err := lifecycles.Set(value); err != nil {
-			panic(err.Error())
-		}
-	}
 
 	logger, reconfigurableSink := lagerflags.NewFromConfig("stager", stagerConfig.LagerConfig)
 
+	if ignored := sources.IgnoredVariables(); len(ignored) > 0 {
+		logger.Info("ignored-unknown-environment-variables", lager.Data{"variables": ignored})
+	}
+
+	err = stagerConfig.Validate()
+	if err != nil {
+		logger.Fatal("invalid-config", err)
+	}
+
 	initializeDropsonde(logger, stagerConfig)
 
+	shutdownTracing := initializeTracing(logger, stagerConfig)
+
 	ccClient := cc_client.NewCcClient(stagerConfig.CCBaseUrl, stagerConfig.CCUsername, stagerConfig.CCPassword, stagerConfig.SkipCertVerify)
-	backends := initializeBackends(logger, lifecycles, stagerConfig)
+	clock := clock.NewClock()
 
-	handler := handlers.New(logger, ccClient, initializeBBSClient(logger, stagerConfig), backends, clock.NewClock())
+	sharedConfig, backends := initializeBackends(logger, stagerConfig, clock)
+
+	var completionQueue completion_queue.CompletionQueue
+	if stagerConfig.CompletionQueueDir != "" {
+		completionQueue, err = completion_queue.New(logger, stagerConfig.CompletionQueueDir, ccClient, clock)
+		if err != nil {
+			logger.Fatal("failed-to-initialize-completion-queue", err)
+		}
+	}
+
+	bbsClient := initializeBBSClient(logger, stagerConfig)
+
+	admissionController := admission.New(logger, stagerConfig.StagingLimits)
+	trackInFlight := stagerConfig.StagingLimits.Enabled() || stagerConfig.PrometheusListenAddress != ""
+	if trackInFlight {
+		err = admissionController.Rebuild(logger, bbsClient)
+		if err != nil {
+			logger.Fatal("failed-to-rebuild-staging-limits", err)
+		}
+	}
+
+	apiAuthenticator := api_auth.New(stagerConfig.APIAuthentication)
+
+	var serverCredentials *mutual_tls.Credentials
+	authorizer := handlers.Authorizers{apiAuthenticator}
+	if stagerConfig.ServerTLS.Enabled() {
+		serverCredentials, err = mutual_tls.New(logger, stagerConfig.ServerTLS, clock, mutual_tls.DefaultReloadInterval)
+		if err != nil {
+			logger.Fatal("failed-to-load-server-tls-credentials", err)
+		}
+		authorizer = append(authorizer, serverCredentials)
+	}
+
+	handler := handlers.New(logger, ccClient, completionQueue, admissionController, bbsClient, backends, authorizer, sharedConfig, clock)
 
-	clock := clock.NewClock()
 	consulClient, err := consuladapter.NewClientFromUrl(stagerConfig.ConsulCluster)
 	if err != nil {
 		logger.Fatal("new-client-failed", err)
@@ -80,11 +165,85 @@ func main() {
 
 	registrationRunner := initializeRegistrationRunner(logger, consulClient, portNum, clock)
 
+	server := http_server.New(stagerConfig.ListenAddress, handler)
+	if serverCredentials != nil {
+		server = http_server.NewTLSServer(stagerConfig.ListenAddress, handler, serverCredentials.TLSConfig())
+	}
+
 	members := grouper.Members{
-		{"server", http_server.New(stagerConfig.ListenAddress, handler)},
+		{"server", server},
 		{"registration-runner", registrationRunner},
 	}
 
+	if serverCredentials != nil {
+		members = append(members, grouper.Member{"server-tls-credentials", serverCredentials})
+	}
+
+	if serverCredentials != nil && stagerConfig.ServerTLS.DockerCredentialsListenAddress != "" {
+		credentialsHandler := handlers.NewDockerCredentialsRouter(logger, sharedConfig, clock)
+		members = append(members, grouper.Member{"docker-credentials-server", http_server.NewTLSServer(stagerConfig.ServerTLS.DockerCredentialsListenAddress, credentialsHandler, serverCredentials.DockerCredentialsTLSConfig())})
+	}
+
+	if stagerConfig.PrometheusListenAddress != "" {
+		members = append(members, grouper.Member{"prometheus-server", http_server.New(stagerConfig.PrometheusListenAddress, prometheus_metrics.Handler())})
+	}
+
+	if completionQueue != nil {
+		members = append(members, grouper.Member{"completion-queue", completionQueue})
+	}
+
+	if trackInFlight {
+		members = append(members, grouper.Member{
+			"admission-rebuilder",
+			admission.NewRebuilder(logger, admissionController, bbsClient, clock, stagerConfig.StagingLimits.RebuildInterval()),
+		})
+	}
+
+	if stagerConfig.StagingReconcileInterval > 0 {
+		completionHandler := handlers.NewStagingCompletionHandler(logger, ccClient, completionQueue, admissionController, backends, clock)
+		reconcileInterval := time.Duration(stagerConfig.StagingReconcileInterval) * time.Second
+		gracePeriod := reconciler.GracePeriod(
+			time.Duration(stagerConfig.StagingReconcileGrace)*time.Second,
+			time.Duration(stagerConfig.BBSExpireCompletedTaskTTL)*time.Second,
+			reconcileInterval,
+		)
+		if gracePeriod != time.Duration(stagerConfig.StagingReconcileGrace)*time.Second {
+			logger.Info("shortened-reconcile-grace-period", lager.Data{"grace-period": gracePeriod.String()})
+		}
+		members = append(members, grouper.Member{
+			"reconciler",
+			reconciler.New(logger, bbsClient, completionHandler, clock, reconcileInterval, gracePeriod),
+		})
+	}
+
+	members = append(members, grouper.Member{
+		"config-reloader",
+		config_reloader.New(
+			logger,
+			sources,
+			stagerConfig,
+			reloadConfig(sharedConfig, ccClient, apiAuthenticator, serverCredentials, clock),
+			reloadSignals,
+			clock,
+			time.Duration(stagerConfig.ConfigReloadInterval)*time.Second,
+		),
+	})
+
+	if stagerConfig.StagingProgressEnabled {
+		members = append(members, grouper.Member{
+			"staging-progress",
+			staging_progress.New(
+				logger,
+				bbsClient,
+				ccClient,
+				initializeStagingProgressLock(logger, consulClient, stagerConfig.ListenAddress, clock),
+				clock,
+				staging_progress.DefaultRetryInterval,
+				staging_progress.DefaultQueueSize,
+			),
+		})
+	}
+
 	if dbgAddr := stagerConfig.DebugServerConfig.DebugAddress; dbgAddr != "" {
 		members = append(grouper.Members{
 			{"debug-server", debugserver.Runner(dbgAddr, reconfigurableSink)},
@@ -100,6 +259,7 @@ func main() {
 	logger.Info("Listening for staging requests!")
 
 	err = <-process.Wait()
+	shutdownTracing()
 	if err != nil {
 		logger.Fatal("Stager exited with error", err)
 	}
@@ -115,20 +275,86 @@ func initializeDropsonde(logger lager.Logger, stagerConfig config.StagerConfig)
 	}
 }
 
-func initializeBackends(logger lager.Logger, lifecycles flags.LifecycleMap, stagerConfig config.StagerConfig) map[string]backend.Backend {
-	_, err := url.Parse(stagerConfig.StagingTaskCallbackURL)
+func initializeTracing(logger lager.Logger, stagerConfig config.StagerConfig) func() {
+	if stagerConfig.TracingOTLPEndpoint == "" {
+		return func() {}
+	}
+
+	shutdown, err := tracing.Init(logger, stagerConfig.TracingOTLPEndpoint, stagerConfig.TracingOTLPInsecure)
+	if err != nil {
+		logger.Fatal("failed-to-initialize-tracing", err)
+	}
+
+	return func() {
+		err := shutdown(context.Background())
+		if err != nil {
+			logger.Error("failed-to-shutdown-tracing", err)
+		}
+	}
+}
+
+// validateConfigSources reports every problem with the configuration on
+// stderr and returns the exit status for the -validateConfig mode.
+func validateConfigSources(sources config.Sources) int {
+	err := config.ValidateStagerConfig(sources)
+	if errs, ok := err.(config.ValidationErrors); ok {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 1
+	}
+
 	if err != nil {
-		logger.Fatal("Invalid staging task callback url", err)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
-	if stagerConfig.DockerStagingStack == "" {
-		logger.Fatal("Invalid Docker staging stack", errors.New("dockerStagingStack cannot be blank"))
+
+	fmt.Println("configuration is valid")
+	return 0
+}
+
+// printConfigSources prints the configuration the stager would run with and
+// returns the exit status for the -printConfig mode.
+func printConfigSources(sources config.Sources) int {
+	stagerConfig, err := config.LoadStagerConfig(sources)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
 
-	_, err = url.Parse(stagerConfig.ConsulCluster)
+	payload, err := json.MarshalIndent(stagerConfig.Redacted(), "", "  ")
 	if err != nil {
-		logger.Fatal("Error parsing consul agent URL", err)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
-	config := backend.Config{
+
+	fmt.Println(string(payload))
+	return 0
+}
+
+func initializeBackends(logger lager.Logger, stagerConfig config.StagerConfig, clock clock.Clock) (*backend.SharedConfig, map[string]backend.Backend) {
+	config, err := newBackendConfig(stagerConfig, clock)
+	if err != nil {
+		logger.Fatal("invalid-lifecycles", err)
+	}
+
+	sharedConfig := backend.NewSharedConfig(config)
+
+	backends, err := backend.DefaultRegistry.Build(stagerConfig.EnabledLifecycles, sharedConfig, stagerConfig.LifecycleConfig, logger)
+	if err != nil {
+		logger.Fatal("failed-to-initialize-backends", err)
+	}
+
+	return sharedConfig, backends
+}
+
+func newBackendConfig(stagerConfig config.StagerConfig, clock clock.Clock) (backend.Config, error) {
+	lifecycles, err := stagerConfig.LifecycleMap()
+	if err != nil {
+		return backend.Config{}, err
+	}
+
+	return backend.Config{
 		TaskDomain:               cc_messages.StagingTaskDomain,
 		StagerURL:                stagerConfig.StagingTaskCallbackURL,
 		FileServerURL:            stagerConfig.FileServerUrl,
@@ -140,11 +366,54 @@ func initializeBackends(logger lager.Logger, lifecycles flags.LifecycleMap, stag
 		PrivilegedContainers:     stagerConfig.PrivilegedContainers,
 		Sanitizer:                backend.SanitizeErrorMessage,
 		DockerStagingStack:       stagerConfig.DockerStagingStack,
+		ResourcePolicies:         stagerConfig.StagingResourcePolicies,
+		DockerRegistries:         stagerConfig.DockerRegistries,
+		DockerImagePolicy:        stagerConfig.DockerImagePolicy,
+		PlacementRules:           stagerConfig.PlacementRules,
+		StackRootFSes:            stagerConfig.StackRootFSes,
+		CallbackSigningKey:       stagerConfig.APIAuthentication.SigningKey(),
+		DockerCredentialsBaseURL: dockerCredentialsBaseURL(stagerConfig),
+		DockerCredentialsKeys:    stagerConfig.APIAuthentication.CallbackSigningKeys,
+		Clock:                    clock,
+	}, nil
+}
+
+// dockerCredentialsBaseURL is the URL of the listener that serves docker
+// credentials, when the stager's own listener requires client certificates.
+func dockerCredentialsBaseURL(stagerConfig config.StagerConfig) string {
+	if !stagerConfig.ServerTLS.Enabled() {
+		return ""
 	}
+	return stagerConfig.ServerTLS.DockerCredentialsURL
+}
+
+// reloadConfig swaps the configuration of the running backends, the CC
+// client credentials, the API credentials and the server certificates for
+// those of a reloaded, already validated, stager configuration.
+// serverCredentials is nil when the stager serves plain HTTP.
+func reloadConfig(sharedConfig *backend.SharedConfig, ccClient cc_client.CcClient, apiAuthenticator *api_auth.Authenticator, serverCredentials *mutual_tls.Credentials, clock clock.Clock) config_reloader.ApplyFunc {
+	return func(logger lager.Logger, stagerConfig config.StagerConfig) error {
+		if stagerConfig.ServerTLS.Enabled() != (serverCredentials != nil) {
+			return errors.New("enabling or disabling server_tls requires a restart")
+		}
+
+		backendConfig, err := newBackendConfig(stagerConfig, clock)
+		if err != nil {
+			return err
+		}
+
+		if serverCredentials != nil {
+			err = serverCredentials.Update(stagerConfig.ServerTLS)
+			if err != nil {
+				return err
+			}
+		}
 
-	return map[string]backend.Backend{
-		"buildpack": backend.NewTraditionalBackend(config, logger),
-		"docker":    backend.NewDockerBackend(config, logger),
+		sharedConfig.Store(backendConfig)
+		ccClient.SetCredentials(stagerConfig.CCUsername, stagerConfig.CCPassword)
+		apiAuthenticator.Update(stagerConfig.APIAuthentication)
+
+		return nil
 	}
 }
 
@@ -173,6 +442,20 @@ func initializeBBSClient(logger lager.Logger, stagerConfig config.StagerConfig)
 	return bbsClient
 }
 
+// initializeStagingProgressLock returns the lock that elects the one stager
+// reporting staging progress to CC.
+func initializeStagingProgressLock(logger lager.Logger, consulClient consuladapter.Client, listenAddress string, clock clock.Clock) ifrit.Runner {
+	return locket.NewLock(
+		logger,
+		consulClient,
+		locket.LockSchemaPath("stager_staging_progress_lock"),
+		[]byte(listenAddress),
+		clock,
+		locket.RetryInterval,
+		locket.DefaultSessionTTL,
+	)
+}
+
 func initializeRegistrationRunner(logger lager.Logger, consulClient consuladapter.Client, port int, clock clock.Clock) ifrit.Runner {
 	registration := &api.AgentServiceRegistration{
 		Name: "stager",
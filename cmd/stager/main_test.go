@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"os/exec"
 	"strconv"
 	"strings"
 
@@ -14,6 +16,8 @@ import (
 	"code.cloudfoundry.org/buildpackapplifecycle"
 	"code.cloudfoundry.org/runtimeschema/cc_messages/flags"
 	"code.cloudfoundry.org/stager"
+	"code.cloudfoundry.org/stager/api_auth"
+	"code.cloudfoundry.org/stager/backend"
 	"code.cloudfoundry.org/stager/cmd/stager/testrunner"
 	"code.cloudfoundry.org/stager/config"
 	"code.cloudfoundry.org/stager/diego_errors"
@@ -44,7 +48,7 @@ var _ = Describe("Stager", func() {
 		stagerPort = 8888 + GinkgoParallelNode()
 		listenAddress := fmt.Sprintf("127.0.0.1:%d", stagerPort)
 		stagerURL := fmt.Sprintf("http://%s", listenAddress)
-		callbackURL = stagerURL + "/v1/staging/my-task-guid/completed"
+		callbackURL = stagerURL + "/v1/staging/my-task-guid/completed?signature=" + backend.SignCallback("callback-key", "my-task-guid")
 
 		fakeBBS = ghttp.NewServer()
 		fakeCC = ghttp.NewServer()
@@ -56,6 +60,7 @@ var _ = Describe("Stager", func() {
 			CCBaseUrl:              fakeCC.URL(),
 			DockerStagingStack:     "docker-staging-stack",
 			ConsulCluster:          consulRunner.URL(),
+			APIAuthentication:      api_auth.Config{CallbackSigningKeys: []string{"callback-key"}},
 		}
 
 		runner = testrunner.New(stagerConfig)
@@ -258,6 +263,7 @@ var _ = Describe("Stager", func() {
 			JustBeforeEach(func() {
 				req, err := requestGenerator.CreateRequest(stager.StagingCompletedRoute, rata.Params{"staging_guid": "the-task-guid"}, bytes.NewReader(taskJSON))
 				Expect(err).NotTo(HaveOccurred())
+				req.URL.RawQuery = backend.CallbackSignatureParam + "=" + backend.SignCallback("callback-key", "the-task-guid")
 
 				req.Header.Set("Content-Type", "application/json")
 
@@ -534,7 +540,7 @@ var _ = Describe("Stager", func() {
 
 			It("logs and errors", func() {
 				Eventually(runner.Session().ExitCode()).ShouldNot(Equal(0))
-				Eventually(runner.Session()).Should(gbytes.Say("Error parsing consul agent URL"))
+				Eventually(runner.Session()).Should(gbytes.Say("invalid-config.*consul_cluster"))
 			})
 		})
 	})
@@ -553,6 +559,21 @@ var _ = Describe("Stager", func() {
 		})
 	})
 
+	Describe("enabled_lifecycles config", func() {
+		Context("when started with an unregistered lifecycle enabled", func() {
+			BeforeEach(func() {
+				runner.Config.Lifecycles = []string{"buildpack/linux:lifecycle.zip"}
+				runner.Config.EnabledLifecycles = []string{"buildpack", "unicorn"}
+				runner.Start(stagerPath)
+			})
+
+			It("logs and errors", func() {
+				Eventually(runner.Session().ExitCode()).ShouldNot(Equal(0))
+				Eventually(runner.Session()).Should(gbytes.Say("invalid-config.*unknown lifecycle 'unicorn'"))
+			})
+		})
+	})
+
 	Describe("-stagingTaskCallbackURL arg", func() {
 		Context("when started with an invalid -stagingTaskCallbackURL arg", func() {
 			BeforeEach(func() {
@@ -562,7 +583,7 @@ var _ = Describe("Stager", func() {
 
 			It("logs and errors", func() {
 				Eventually(runner.Session().ExitCode()).ShouldNot(Equal(0))
-				Eventually(runner.Session()).Should(gbytes.Say("Invalid staging task callback url"))
+				Eventually(runner.Session()).Should(gbytes.Say("invalid-config.*staging_task_callback_url"))
 			})
 		})
 	})
@@ -588,11 +609,82 @@ var _ = Describe("Stager", func() {
 
 			It("logs and errors", func() {
 				Eventually(runner.Session().ExitCode()).ShouldNot(Equal(0))
-				Eventually(runner.Session()).Should(gbytes.Say("stager.failed-invalid-listen-port"))
+				Eventually(runner.Session()).Should(gbytes.Say("invalid-config.*stager_listen_addr"))
 			})
 		})
 	})
 
+	Describe("-validateConfig", func() {
+		var configPath string
+
+		validate := func(configJSON []byte) *gexec.Session {
+			configFile, err := ioutil.TempFile("", "stager_config")
+			Expect(err).NotTo(HaveOccurred())
+			configPath = configFile.Name()
+			configFile.Close()
+
+			Expect(ioutil.WriteFile(configPath, configJSON, 0644)).To(Succeed())
+
+			session, err := gexec.Start(exec.Command(stagerPath, "-validateConfig", "-configPath", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			return session
+		}
+
+		AfterEach(func() {
+			os.Remove(configPath)
+		})
+
+		It("exits successfully for a valid config", func() {
+			configJSON, err := json.Marshal(stagerConfig)
+			Expect(err).NotTo(HaveOccurred())
+
+			session := validate(configJSON)
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Out).To(gbytes.Say("configuration is valid"))
+		})
+
+		It("reports every problem and fails for an invalid config", func() {
+			stagerConfig.ListenAddress = "portless"
+			stagerConfig.StagingTaskCallbackURL = "ftp://stager.example.com"
+			configJSON, err := json.Marshal(stagerConfig)
+			Expect(err).NotTo(HaveOccurred())
+			configJSON = bytes.Replace(configJSON, []byte("{"), []byte(`{"docker_registry_address": "registry",`), 1)
+
+			session := validate(configJSON)
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("docker_registry_address: unknown key"))
+			Expect(session.Err).To(gbytes.Say("stager_listen_addr: "))
+			Expect(session.Err).To(gbytes.Say("staging_task_callback_url: unsupported scheme 'ftp'"))
+		})
+	})
+
+	Describe("-printConfig", func() {
+		It("prints the effective config with secrets redacted", func() {
+			configJSON, err := json.Marshal(stagerConfig)
+			Expect(err).NotTo(HaveOccurred())
+
+			configFile, err := ioutil.TempFile("", "stager_config")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(configFile.Name())
+			configFile.Close()
+			Expect(ioutil.WriteFile(configFile.Name(), configJSON, 0644)).To(Succeed())
+
+			command := exec.Command(stagerPath, "-printConfig", "-configPath", configFile.Name())
+			command.Env = append(os.Environ(), "STAGER_CC_BASIC_AUTH_PASSWORD=super-secret", "STAGER_CC_BASIC_AUTH_USERNAME=stager")
+
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session.Out.Contents()).NotTo(ContainSubstring("super-secret"))
+
+			var printed config.StagerConfig
+			Expect(json.Unmarshal(session.Out.Contents(), &printed)).To(Succeed())
+			Expect(printed.CCUsername).To(Equal("stager"))
+			Expect(printed.CCPassword).To(Equal(config.RedactedValue))
+			Expect(printed.ListenAddress).To(Equal(stagerConfig.ListenAddress))
+		})
+	})
 })
 
 func writeResponse(w http.ResponseWriter, message proto.Message) {
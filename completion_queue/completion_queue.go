@@ -0,0 +1,291 @@
+package completion_queue
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/runtimeschema/metric"
+	"code.cloudfoundry.org/stager/cc_client"
+	"code.cloudfoundry.org/stager/prometheus_metrics"
+)
+
+const (
+	DefaultPollInterval = 1 * time.Second
+	DefaultMinBackoff   = 1 * time.Second
+	DefaultMaxBackoff   = 5 * time.Minute
+
+	entryFileSuffix = ".json"
+
+	// Metrics
+	queueDepthMetric = metric.Metric("StagingCompletionQueueDepth")
+)
+
+//go:generate counterfeiter -o fakes/fake_completion_queue.go . CompletionQueue
+type CompletionQueue interface {
+	Enqueue(stagingGuid string, completionCallback string, payload []byte) error
+	Depth() int
+	Run(signals <-chan os.Signal, ready chan<- struct{}) error
+}
+
+type Entry struct {
+	StagingGuid        string          `json:"staging_guid"`
+	CompletionCallback string          `json:"completion_callback"`
+	Payload            json.RawMessage `json:"payload"`
+	Attempts           int             `json:"attempts"`
+	NextAttempt        time.Time       `json:"next_attempt"`
+}
+
+type completionQueue struct {
+	dir          string
+	ccClient     cc_client.CcClient
+	clock        clock.Clock
+	logger       lager.Logger
+	pollInterval time.Duration
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+
+	lock    sync.Mutex
+	entries map[string]*Entry
+	random  *rand.Rand
+}
+
+// New returns a queue persisted in dir. Entries left behind by a previous
+// process are loaded immediately so that they are retried once the queue runs.
+func New(logger lager.Logger, dir string, ccClient cc_client.CcClient, clock clock.Clock) (CompletionQueue, error) {
+	logger = logger.Session("completion-queue", lager.Data{"dir": dir})
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	queue := &completionQueue{
+		dir:          dir,
+		ccClient:     ccClient,
+		clock:        clock,
+		logger:       logger,
+		pollInterval: DefaultPollInterval,
+		minBackoff:   DefaultMinBackoff,
+		maxBackoff:   DefaultMaxBackoff,
+		entries:      map[string]*Entry{},
+		random:       rand.New(rand.NewSource(clock.Now().UnixNano())),
+	}
+
+	err = queue.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return queue, nil
+}
+
+func (q *completionQueue) Enqueue(stagingGuid string, completionCallback string, payload []byte) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	entry := &Entry{
+		StagingGuid:        stagingGuid,
+		CompletionCallback: completionCallback,
+		Payload:            json.RawMessage(payload),
+		NextAttempt:        q.clock.Now().Add(q.backoff(0)),
+	}
+
+	err := q.persist(entry)
+	if err != nil {
+		q.logger.Error("failed-to-persist-entry", err, lager.Data{"staging-guid": stagingGuid})
+		return err
+	}
+
+	q.entries[stagingGuid] = entry
+	q.logger.Info("enqueued", lager.Data{"staging-guid": stagingGuid, "depth": len(q.entries)})
+	q.emitDepth(len(q.entries))
+
+	return nil
+}
+
+func (q *completionQueue) Depth() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.entries)
+}
+
+func (q *completionQueue) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	logger := q.logger.Session("run")
+	logger.Info("starting", lager.Data{"depth": q.Depth()})
+
+	ticker := q.clock.NewTicker(q.pollInterval)
+	defer ticker.Stop()
+
+	close(ready)
+	q.emitDepth(q.Depth())
+
+	for {
+		select {
+		case <-signals:
+			logger.Info("stopped", lager.Data{"depth": q.Depth()})
+			return nil
+		case <-ticker.C():
+			q.deliverDue(logger)
+		}
+	}
+}
+
+func (q *completionQueue) deliverDue(logger lager.Logger) {
+	now := q.clock.Now()
+
+	q.lock.Lock()
+	due := []Entry{}
+	for _, entry := range q.entries {
+		if !entry.NextAttempt.After(now) {
+			due = append(due, *entry)
+		}
+	}
+	q.lock.Unlock()
+
+	for _, entry := range due {
+		q.deliver(logger, entry)
+	}
+}
+
+func (q *completionQueue) deliver(logger lager.Logger, entry Entry) {
+	logger = logger.Session("deliver", lager.Data{"staging-guid": entry.StagingGuid, "attempts": entry.Attempts})
+
+	err := q.ccClient.StagingComplete(entry.StagingGuid, entry.CompletionCallback, entry.Payload, logger)
+	if err != nil && IsRetryable(err) {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+
+		entry.Attempts++
+		entry.NextAttempt = q.clock.Now().Add(q.backoff(entry.Attempts))
+		logger.Error("delivery-failed-will-retry", err, lager.Data{"next-attempt": entry.NextAttempt})
+
+		if _, ok := q.entries[entry.StagingGuid]; !ok {
+			return
+		}
+		q.entries[entry.StagingGuid] = &entry
+		if err := q.persist(&entry); err != nil {
+			logger.Error("failed-to-persist-entry", err)
+		}
+		return
+	}
+
+	if err != nil {
+		logger.Error("delivery-rejected-dropping", err)
+	} else {
+		logger.Info("delivered")
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.entries, entry.StagingGuid)
+	if err := os.Remove(q.entryPath(entry.StagingGuid)); err != nil && !os.IsNotExist(err) {
+		logger.Error("failed-to-remove-entry", err)
+	}
+	q.emitDepth(len(q.entries))
+}
+
+// backoff doubles the wait for every failed attempt, capped at maxBackoff,
+// and picks a random point in the upper half of that window.
+func (q *completionQueue) backoff(attempts int) time.Duration {
+	wait := q.maxBackoff
+	if attempts < 32 {
+		if d := q.minBackoff << uint(attempts); d > 0 && d < q.maxBackoff {
+			wait = d
+		}
+	}
+
+	half := int64(wait / 2)
+	if half == 0 {
+		return wait
+	}
+	return time.Duration(half + q.random.Int63n(half))
+}
+
+func (q *completionQueue) load() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), entryFileSuffix) {
+			continue
+		}
+
+		path := filepath.Join(q.dir, file.Name())
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		entry := &Entry{}
+		err = json.Unmarshal(contents, entry)
+		if err != nil || entry.StagingGuid == "" {
+			q.logger.Error("discarding-corrupt-entry", err, lager.Data{"file": path})
+			os.Remove(path)
+			continue
+		}
+
+		q.entries[entry.StagingGuid] = entry
+	}
+
+	q.logger.Info("loaded", lager.Data{"depth": len(q.entries)})
+	return nil
+}
+
+func (q *completionQueue) persist(entry *Entry) error {
+	contents, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(q.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(contents)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), q.entryPath(entry.StagingGuid))
+}
+
+func (q *completionQueue) entryPath(stagingGuid string) string {
+	return filepath.Join(q.dir, url.PathEscape(stagingGuid)+entryFileSuffix)
+}
+
+func (q *completionQueue) emitDepth(depth int) {
+	prometheus_metrics.StagingCompletionQueueDepth.Set(float64(depth))
+	err := queueDepthMetric.Send(depth)
+	if err != nil {
+		q.logger.Error("failed-to-send-queue-depth-metric", err)
+	}
+}
+
+// IsRetryable reports whether a failed delivery to CC is worth retrying.
+// CC rejecting the payload with a 4xx is final; anything else is not.
+func IsRetryable(err error) bool {
+	if responseErr, ok := err.(*cc_client.BadResponseError); ok {
+		return responseErr.StatusCode >= 500
+	}
+	return true
+}
@@ -0,0 +1,13 @@
+package completion_queue_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestCompletionQueue(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Completion Queue Suite")
+}
@@ -0,0 +1,180 @@
+package completion_queue_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/stager/cc_client"
+	"code.cloudfoundry.org/stager/cc_client/fakes"
+	"code.cloudfoundry.org/stager/completion_queue"
+	"github.com/cloudfoundry/dropsonde/metric_sender/fake"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/tedsuo/ifrit"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CompletionQueue", func() {
+	var (
+		dir          string
+		logger       *lagertest.TestLogger
+		fakeCCClient *fakes.FakeCcClient
+		fakeClock    *fakeclock.FakeClock
+		metricSender *fake.FakeMetricSender
+
+		queue completion_queue.CompletionQueue
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "completion-queue")
+		Expect(err).NotTo(HaveOccurred())
+
+		logger = lagertest.NewTestLogger("test")
+		fakeCCClient = &fakes.FakeCcClient{}
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+
+		metricSender = fake.NewFakeMetricSender()
+		metrics.Initialize(metricSender, nil)
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		queue, err = completion_queue.New(logger, dir, fakeCCClient, fakeClock)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	readEntry := func(stagingGuid string) completion_queue.Entry {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, stagingGuid+".json"))
+		Expect(err).NotTo(HaveOccurred())
+
+		var entry completion_queue.Entry
+		Expect(json.Unmarshal(contents, &entry)).To(Succeed())
+		return entry
+	}
+
+	Describe("Enqueue", func() {
+		JustBeforeEach(func() {
+			err := queue.Enqueue("the-staging-guid", "http://cc/callback", []byte(`{"result":{}}`))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("persists the payload keyed by staging guid", func() {
+			entry := readEntry("the-staging-guid")
+			Expect(entry.StagingGuid).To(Equal("the-staging-guid"))
+			Expect(entry.CompletionCallback).To(Equal("http://cc/callback"))
+			Expect([]byte(entry.Payload)).To(MatchJSON(`{"result":{}}`))
+			Expect(entry.Attempts).To(Equal(0))
+		})
+
+		It("increases the queue depth", func() {
+			Expect(queue.Depth()).To(Equal(1))
+			Expect(metricSender.GetValue("StagingCompletionQueueDepth").Value).To(BeEquivalentTo(1))
+		})
+	})
+
+	Context("when entries were left behind by a previous process", func() {
+		BeforeEach(func() {
+			entry, err := json.Marshal(completion_queue.Entry{
+				StagingGuid: "left-behind",
+				Payload:     json.RawMessage(`{}`),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "left-behind.json"), entry, 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "corrupt.json"), []byte("{"), 0600)).To(Succeed())
+		})
+
+		It("loads them", func() {
+			Expect(queue.Depth()).To(Equal(1))
+		})
+
+		It("discards corrupt entries", func() {
+			Expect(filepath.Join(dir, "corrupt.json")).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Describe("Run", func() {
+		var process ifrit.Process
+
+		JustBeforeEach(func() {
+			err := queue.Enqueue("the-staging-guid", "http://cc/callback", []byte(`{}`))
+			Expect(err).NotTo(HaveOccurred())
+
+			process = ifrit.Invoke(queue)
+		})
+
+		AfterEach(func() {
+			process.Signal(os.Interrupt)
+			Eventually(process.Wait()).Should(Receive(BeNil()))
+		})
+
+		Context("when CC accepts the payload", func() {
+			It("delivers it and removes it from the queue", func() {
+				fakeClock.WaitForWatcherAndIncrement(completion_queue.DefaultPollInterval)
+
+				Eventually(fakeCCClient.StagingCompleteCallCount).Should(Equal(1))
+				guid, payload, _ := fakeCCClient.StagingCompleteArgsForCall(0)
+				Expect(guid).To(Equal("the-staging-guid"))
+				Expect(payload).To(MatchJSON(`{}`))
+
+				Eventually(queue.Depth).Should(Equal(0))
+				Expect(filepath.Join(dir, "the-staging-guid.json")).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("when CC is unavailable", func() {
+			BeforeEach(func() {
+				fakeCCClient.StagingCompleteReturns(errors.New("connection refused"))
+			})
+
+			It("keeps the payload and backs off", func() {
+				fakeClock.WaitForWatcherAndIncrement(completion_queue.DefaultPollInterval)
+				Eventually(fakeCCClient.StagingCompleteCallCount).Should(Equal(1))
+
+				Eventually(func() int { return readEntry("the-staging-guid").Attempts }).Should(Equal(1))
+				Expect(queue.Depth()).To(Equal(1))
+
+				fakeClock.Increment(completion_queue.DefaultPollInterval)
+				Consistently(fakeCCClient.StagingCompleteCallCount).Should(Equal(1))
+
+				fakeClock.Increment(2 * completion_queue.DefaultMinBackoff)
+				Eventually(fakeCCClient.StagingCompleteCallCount).Should(Equal(2))
+			})
+		})
+
+		Context("when CC rejects the payload", func() {
+			BeforeEach(func() {
+				fakeCCClient.StagingCompleteReturns(&cc_client.BadResponseError{StatusCode: 400})
+			})
+
+			It("drops it from the queue", func() {
+				fakeClock.WaitForWatcherAndIncrement(completion_queue.DefaultPollInterval)
+
+				Eventually(queue.Depth).Should(Equal(0))
+				Expect(fakeCCClient.StagingCompleteCallCount()).To(Equal(1))
+			})
+		})
+	})
+
+	Describe("IsRetryable", func() {
+		It("retries transport errors and 5xx responses", func() {
+			Expect(completion_queue.IsRetryable(errors.New("boom"))).To(BeTrue())
+			Expect(completion_queue.IsRetryable(&cc_client.BadResponseError{StatusCode: 503})).To(BeTrue())
+		})
+
+		It("does not retry 4xx responses", func() {
+			Expect(completion_queue.IsRetryable(&cc_client.BadResponseError{StatusCode: 404})).To(BeFalse())
+		})
+	})
+})
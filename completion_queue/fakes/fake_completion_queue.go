@@ -0,0 +1,130 @@
+// This file was generated by counterfeiter
+package fakes
+
+import (
+	"os"
+	"sync"
+
+	"code.cloudfoundry.org/stager/completion_queue"
+)
+
+type FakeCompletionQueue struct {
+	EnqueueStub        func(stagingGuid string, completionCallback string, payload []byte) error
+	enqueueMutex       sync.RWMutex
+	enqueueArgsForCall []struct {
+		stagingGuid        string
+		completionCallback string
+		payload            []byte
+	}
+	enqueueReturns struct {
+		result1 error
+	}
+	DepthStub        func() int
+	depthMutex       sync.RWMutex
+	depthArgsForCall []struct{}
+	depthReturns     struct {
+		result1 int
+	}
+	RunStub        func(signals <-chan os.Signal, ready chan<- struct{}) error
+	runMutex       sync.RWMutex
+	runArgsForCall []struct {
+		signals <-chan os.Signal
+		ready   chan<- struct{}
+	}
+	runReturns struct {
+		result1 error
+	}
+}
+
+func (fake *FakeCompletionQueue) Enqueue(stagingGuid string, completionCallback string, payload []byte) error {
+	fake.enqueueMutex.Lock()
+	fake.enqueueArgsForCall = append(fake.enqueueArgsForCall, struct {
+		stagingGuid        string
+		completionCallback string
+		payload            []byte
+	}{stagingGuid, completionCallback, payload})
+	fake.enqueueMutex.Unlock()
+	if fake.EnqueueStub != nil {
+		return fake.EnqueueStub(stagingGuid, completionCallback, payload)
+	} else {
+		return fake.enqueueReturns.result1
+	}
+}
+
+func (fake *FakeCompletionQueue) EnqueueCallCount() int {
+	fake.enqueueMutex.RLock()
+	defer fake.enqueueMutex.RUnlock()
+	return len(fake.enqueueArgsForCall)
+}
+
+func (fake *FakeCompletionQueue) EnqueueArgsForCall(i int) (string, string, []byte) {
+	fake.enqueueMutex.RLock()
+	defer fake.enqueueMutex.RUnlock()
+	return fake.enqueueArgsForCall[i].stagingGuid, fake.enqueueArgsForCall[i].completionCallback, fake.enqueueArgsForCall[i].payload
+}
+
+func (fake *FakeCompletionQueue) EnqueueReturns(result1 error) {
+	fake.EnqueueStub = nil
+	fake.enqueueReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeCompletionQueue) Depth() int {
+	fake.depthMutex.Lock()
+	fake.depthArgsForCall = append(fake.depthArgsForCall, struct{}{})
+	fake.depthMutex.Unlock()
+	if fake.DepthStub != nil {
+		return fake.DepthStub()
+	} else {
+		return fake.depthReturns.result1
+	}
+}
+
+func (fake *FakeCompletionQueue) DepthCallCount() int {
+	fake.depthMutex.RLock()
+	defer fake.depthMutex.RUnlock()
+	return len(fake.depthArgsForCall)
+}
+
+func (fake *FakeCompletionQueue) DepthReturns(result1 int) {
+	fake.DepthStub = nil
+	fake.depthReturns = struct {
+		result1 int
+	}{result1}
+}
+
+func (fake *FakeCompletionQueue) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	fake.runMutex.Lock()
+	fake.runArgsForCall = append(fake.runArgsForCall, struct {
+		signals <-chan os.Signal
+		ready   chan<- struct{}
+	}{signals, ready})
+	fake.runMutex.Unlock()
+	if fake.RunStub != nil {
+		return fake.RunStub(signals, ready)
+	} else {
+		return fake.runReturns.result1
+	}
+}
+
+func (fake *FakeCompletionQueue) RunCallCount() int {
+	fake.runMutex.RLock()
+	defer fake.runMutex.RUnlock()
+	return len(fake.runArgsForCall)
+}
+
+func (fake *FakeCompletionQueue) RunArgsForCall(i int) (<-chan os.Signal, chan<- struct{}) {
+	fake.runMutex.RLock()
+	defer fake.runMutex.RUnlock()
+	return fake.runArgsForCall[i].signals, fake.runArgsForCall[i].ready
+}
+
+func (fake *FakeCompletionQueue) RunReturns(result1 error) {
+	fake.RunStub = nil
+	fake.runReturns = struct {
+		result1 error
+	}{result1}
+}
+
+var _ completion_queue.CompletionQueue = new(FakeCompletionQueue)
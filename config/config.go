@@ -2,60 +2,174 @@ package config
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
+	"strings"
+	"time"
 
 	"code.cloudfoundry.org/debugserver"
 	"code.cloudfoundry.org/lager/lagerflags"
+	"code.cloudfoundry.org/stager/admission"
+	"code.cloudfoundry.org/stager/api_auth"
+	"code.cloudfoundry.org/stager/backend"
+	"code.cloudfoundry.org/stager/mutual_tls"
+	"code.cloudfoundry.org/stager/reconciler"
 )
 
 type StagerConfig struct {
+	APIAuthentication         api_auth.Config               `json:"api_authentication"`
 	BBSAddress                string                        `json:"bbs_api_url"`
 	BBSCACert                 string                        `json:"bbs_ca_cert"`
 	BBSClientCert             string                        `json:"bbs_client_cert"`
 	BBSClientKey              string                        `json:"bbs_client_key"`
 	BBSClientSessionCacheSize int                           `json:"bbs_client_cache_size"`
+	BBSExpireCompletedTaskTTL int                           `json:"bbs_expire_completed_task_duration_in_seconds"`
 	BBSMaxIdleConnsPerHost    int                           `json:"bbs_max_idle_conns_per_host"`
 	CCBaseUrl                 string                        `json:"cc_base_url"`
 	CCPassword                string                        `json:"cc_basic_auth_password"`
 	CCUploaderURL             string                        `json:"cc_uploader_url"`
 	CCUsername                string                        `json:"cc_basic_auth_username"`
+	CompletionQueueDir        string                        `json:"completion_queue_dir"`
+	ConfigReloadInterval      int                           `json:"config_reload_interval_in_seconds"`
 	ConsulCluster             string                        `json:"consul_cluster"`
 	DebugServerConfig         debugserver.DebugServerConfig `json:"debug_server_config"`
+	DockerImagePolicy         backend.DockerImagePolicy     `json:"docker_image_policy"`
+	DockerRegistries          backend.DockerRegistries      `json:"docker_registries"`
 	DockerStagingStack        string                        `json:"docker_staging_stack"`
 	DropsondePort             int                           `json:"dropsonde_port"`
+	EnabledLifecycles         []string                      `json:"enabled_lifecycles"`
 	InsecureDockerRegistries  []string                      `json:"insecure_docker_registries"`
 	FileServerUrl             string                        `json:"file_server_url"`
 	LagerConfig               lagerflags.LagerConfig        `json:"lager_config"`
+	LifecycleConfig           map[string]json.RawMessage    `json:"lifecycle_config"`
 	Lifecycles                []string                      `json:"lifecycles"`
 	ListenAddress             string                        `json:"stager_listen_addr"`
+	PlacementRules            backend.PlacementRules        `json:"staging_placement_rules"`
 	PrivilegedContainers      bool                          `json:"diego_privileged_containers"`
+	PrometheusListenAddress   string                        `json:"prometheus_listen_addr"`
+	ServerTLS                 mutual_tls.Config             `json:"server_tls"`
 	SkipCertVerify            bool                          `json:"skip_cert_verify"`
+	StackRootFSes             backend.StackRootFSes         `json:"stack_rootfs"`
+	StagingProgressEnabled    bool                          `json:"staging_progress_enabled"`
+	StagingReconcileGrace     int                           `json:"staging_reconcile_grace_period_in_seconds"`
+	StagingReconcileInterval  int                           `json:"staging_reconcile_interval_in_seconds"`
+	StagingLimits             admission.Limits              `json:"staging_limits"`
+	StagingResourcePolicies   backend.ResourcePolicies      `json:"staging_resource_policies"`
 	StagingTaskCallbackURL    string                        `json:"staging_task_callback_url"`
+	TracingOTLPEndpoint       string                        `json:"tracing_otlp_endpoint"`
+	TracingOTLPInsecure       bool                          `json:"tracing_otlp_insecure"`
 }
 
 func DefaultStagerConfig() StagerConfig {
 	return StagerConfig{
 		BBSClientSessionCacheSize: 0,
+		BBSExpireCompletedTaskTTL: 120,
 		BBSMaxIdleConnsPerHost:    0,
 		DropsondePort:             3457,
 		LagerConfig:               lagerflags.DefaultLagerConfig(),
 		PrivilegedContainers:      false,
 		SkipCertVerify:            false,
+		StagingReconcileGrace:     int(reconciler.DefaultGracePeriod / time.Second),
 	}
 }
 
+// NewStagerConfig reads the config at configPath, which may only contain
+// known keys.
 func NewStagerConfig(configPath string) (StagerConfig, error) {
-	configFile, err := ioutil.ReadFile(configPath)
+	return LoadStagerConfig(Sources{ConfigPath: configPath})
+}
+
+// LoadStagerConfig reads the config from sources, which may only contain
+// known keys.
+func LoadStagerConfig(sources Sources) (StagerConfig, error) {
+	stagerConfig, errs, err := readStagerConfig(sources)
 	if err != nil {
 		return StagerConfig{}, err
 	}
 
-	stagerConfig := DefaultStagerConfig()
+	if len(errs) > 0 {
+		return StagerConfig{}, errs
+	}
 
-	err = json.Unmarshal(configFile, &stagerConfig)
+	return stagerConfig, nil
+}
+
+// readStagerConfig merges the sources and decodes the result. Unknown keys,
+// malformed environment overrides and settings of the wrong type are
+// returned as ValidationErrors rather than failing the read, so that they
+// can be reported along with any other problems.
+func readStagerConfig(sources Sources) (StagerConfig, ValidationErrors, error) {
+	fields, errs, err := sources.fields()
 	if err != nil {
-		return StagerConfig{}, err
+		return StagerConfig{}, nil, err
 	}
 
-	return stagerConfig, nil
+	stagerConfig := DefaultStagerConfig()
+
+	// each setting is decoded on its own, as the decoder stops reporting
+	// errors at the first one
+	for _, key := range sortedFieldKeys(fields) {
+		payload, err := json.Marshal(map[string]interface{}{key: fields[key]})
+		if err != nil {
+			return StagerConfig{}, nil, err
+		}
+
+		err = json.Unmarshal(payload, &stagerConfig)
+		if err != nil {
+			errs = append(errs, settingError(key, err))
+		}
+	}
+
+	return stagerConfig, errs, nil
+}
+
+func settingError(key string, err error) error {
+	typeErr, ok := err.(*json.UnmarshalTypeError)
+	if !ok {
+		return fmt.Errorf("%s: %s", key, err)
+	}
+
+	path := key
+	if strings.HasPrefix(typeErr.Field, key+".") {
+		path = typeErr.Field
+	}
+	return fmt.Errorf("%s: cannot be a JSON %s, expected %s", path, typeErr.Value, typeErr.Type)
+}
+
+// Redacted returns a copy of the config with its passwords replaced, which
+// is safe to print or log.
+func (c StagerConfig) Redacted() StagerConfig {
+	if c.CCPassword != "" {
+		c.CCPassword = RedactedValue
+	}
+
+	if c.DockerRegistries != nil {
+		registries := backend.DockerRegistries{}
+		for host, registry := range c.DockerRegistries {
+			if registry.Password != "" {
+				registry.Password = RedactedValue
+			}
+			registries[host] = registry
+		}
+		c.DockerRegistries = registries
+	}
+
+	if c.APIAuthentication.Password != "" {
+		c.APIAuthentication.Password = RedactedValue
+	}
+	c.APIAuthentication.BearerTokens = redactAll(c.APIAuthentication.BearerTokens)
+	c.APIAuthentication.CallbackSigningKeys = redactAll(c.APIAuthentication.CallbackSigningKeys)
+
+	return c
+}
+
+func redactAll(values []string) []string {
+	if values == nil {
+		return nil
+	}
+
+	redacted := make([]string, len(values))
+	for i := range values {
+		redacted[i] = RedactedValue
+	}
+	return redacted
 }
@@ -1,7 +1,11 @@
 package config_test
 
 import (
+	"code.cloudfoundry.org/stager/admission"
+	"code.cloudfoundry.org/stager/api_auth"
+	"code.cloudfoundry.org/stager/backend"
 	. "code.cloudfoundry.org/stager/config"
+	"code.cloudfoundry.org/stager/mutual_tls"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -15,6 +19,8 @@ var _ = Describe("Config", func() {
 
 			Expect(stagerConfig.BBSClientSessionCacheSize).To(Equal(0))
 			Expect(stagerConfig.BBSMaxIdleConnsPerHost).To(Equal(0))
+			Expect(stagerConfig.BBSExpireCompletedTaskTTL).To(Equal(120))
+			Expect(stagerConfig.StagingReconcileGrace).To(Equal(30))
 			Expect(stagerConfig.DropsondePort).To(Equal(3457))
 			Expect(stagerConfig.PrivilegedContainers).NotTo(BeTrue())
 			Expect(stagerConfig.SkipCertVerify).NotTo(BeTrue())
@@ -25,28 +31,137 @@ var _ = Describe("Config", func() {
 		It("reads from the config file and populates the config", func() {
 			stagerConfig, err := NewStagerConfig("../fixtures/stager_config.json")
 			Expect(err).ToNot(HaveOccurred())
+			Expect(stagerConfig.APIAuthentication).To(Equal(api_auth.Config{
+				Username:            "api-username",
+				Password:            "api-password",
+				BearerTokens:        []string{"api-token"},
+				CallbackSigningKeys: []string{"callback-key", "previous-callback-key"},
+			}))
 			Expect(stagerConfig.BBSAddress).To(Equal("http://bbs.example.com"))
 			Expect(stagerConfig.BBSCACert).To(Equal("bbs-ca-cert"))
 			Expect(stagerConfig.BBSClientCert).To(Equal("bbs-client-cert"))
 			Expect(stagerConfig.BBSClientKey).To(Equal("bbs-client-key"))
 			Expect(stagerConfig.BBSClientSessionCacheSize).To(Equal(10))
+			Expect(stagerConfig.BBSExpireCompletedTaskTTL).To(Equal(180))
 			Expect(stagerConfig.BBSMaxIdleConnsPerHost).To(Equal(11))
 			Expect(stagerConfig.CCBaseUrl).To(Equal("cc_base_url"))
 			Expect(stagerConfig.CCPassword).To(Equal("cc_basic_auth_password"))
 			Expect(stagerConfig.CCUploaderURL).To(Equal("cc_uploader_url"))
 			Expect(stagerConfig.CCUsername).To(Equal("cc_basic_auth_username"))
+			Expect(stagerConfig.CompletionQueueDir).To(Equal("completion_queue_dir"))
+			Expect(stagerConfig.ConfigReloadInterval).To(Equal(14))
 			Expect(stagerConfig.ConsulCluster).To(Equal("consul_cluster"))
 			Expect(stagerConfig.DebugServerConfig.DebugAddress).To(Equal("debug_address"))
+			Expect(stagerConfig.DockerImagePolicy).To(Equal(backend.DockerImagePolicy{
+				DockerImageRule: backend.DockerImageRule{
+					DeniedRepositories: []string{"docker.io/library/*"},
+				},
+				IsolationSegments: map[string]backend.DockerImageRule{
+					"production": {
+						AllowedRegistries: []string{"registry.example.com:5000"},
+						RequireDigest:     true,
+					},
+				},
+			}))
+			Expect(stagerConfig.DockerRegistries).To(Equal(backend.DockerRegistries{
+				"registry.example.com:5000": {
+					TLSMode:  backend.RegistryTLSVerify,
+					CABundle: "registry_ca/example.tgz",
+					Mirrors:  []string{"mirror.example.com"},
+					Username: "registry-user",
+					Password: "registry-password",
+				},
+			}))
 			Expect(stagerConfig.DockerStagingStack).To(Equal("docker_staging_stack"))
 			Expect(stagerConfig.DropsondePort).To(Equal(12))
+			Expect(stagerConfig.EnabledLifecycles).To(Equal([]string{"buildpack"}))
 			Expect(stagerConfig.InsecureDockerRegistries).To(Equal([]string{"insecure_docker_registries"}))
 			Expect(stagerConfig.FileServerUrl).To(Equal("file_server_url"))
 			Expect(stagerConfig.LagerConfig.LogLevel).To(Equal("fatal"))
+			Expect(stagerConfig.LifecycleConfig).To(HaveKey("buildpack"))
+			Expect([]byte(stagerConfig.LifecycleConfig["buildpack"])).To(MatchJSON(`{"some": "setting"}`))
 			Expect(stagerConfig.Lifecycles).To(Equal([]string{"lifecycles"}))
 			Expect(stagerConfig.ListenAddress).To(Equal("stager_listen_addr"))
+			Expect(stagerConfig.PlacementRules).To(Equal(backend.PlacementRules{
+				"docker":        {"staging-docker"},
+				"*/windows2016": {"windows"},
+			}))
 			Expect(stagerConfig.PrivilegedContainers).To(BeTrue())
+			Expect(stagerConfig.PrometheusListenAddress).To(Equal("prometheus_listen_addr"))
+			Expect(stagerConfig.ServerTLS).To(Equal(mutual_tls.Config{
+				CACert:              "server-ca-cert",
+				ServerCert:          "server-cert",
+				ServerKey:           "server-key",
+				CCClientIdentities:  []string{"cloud_controller"},
+				BBSClientIdentities: []string{"bbs"},
+
+				DockerCredentialsListenAddress: "docker_credentials_listen_addr",
+				DockerCredentialsURL:           "docker_credentials_url",
+			}))
 			Expect(stagerConfig.SkipCertVerify).NotTo(BeTrue())
+			Expect(stagerConfig.StackRootFSes).To(Equal(backend.StackRootFSes{
+				"cflinuxfs3": "preloaded:cflinuxfs3-v2",
+				"cflinuxfs":  "cflinuxfs3",
+			}))
+			Expect(stagerConfig.StagingProgressEnabled).To(BeTrue())
+			Expect(stagerConfig.StagingReconcileGrace).To(Equal(45))
+			Expect(stagerConfig.StagingReconcileInterval).To(Equal(13))
+			Expect(stagerConfig.StagingLimits).To(Equal(admission.Limits{
+				MaxInFlight:                    100,
+				MaxInFlightPerIsolationSegment: 50,
+				MaxInFlightPerApp:              2,
+				RetryAfterSeconds:              15,
+				RebuildIntervalSeconds:         20,
+			}))
+			Expect(stagerConfig.StagingResourcePolicies).To(Equal(backend.ResourcePolicies{
+				"buildpack/cflinuxfs2": {
+					MemoryMB:  backend.ResourceLimits{Min: 256, Max: 4096, Default: 1024},
+					CpuWeight: 20,
+					Reject:    true,
+				},
+			}))
 			Expect(stagerConfig.StagingTaskCallbackURL).To(Equal("staging_task_callback_url"))
+			Expect(stagerConfig.TracingOTLPEndpoint).To(Equal("tracing_otlp_endpoint"))
+			Expect(stagerConfig.TracingOTLPInsecure).To(BeTrue())
+		})
+	})
+
+	Describe("ChangedFields", func() {
+		var old StagerConfig
+
+		BeforeEach(func() {
+			var err error
+			old, err = NewStagerConfig("../fixtures/stager_config.json")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns nothing for identical configs", func() {
+			Expect(ChangedFields(old, old)).To(BeEmpty())
+		})
+
+		It("returns the JSON names of the changed settings", func() {
+			updated := old
+			updated.CCPassword = "new-password"
+			updated.ListenAddress = "0.0.0.0:9999"
+			updated.StackRootFSes = backend.StackRootFSes{"cflinuxfs3": "cflinuxfs3"}
+
+			Expect(ChangedFields(old, updated)).To(Equal([]string{
+				"cc_basic_auth_password",
+				"stager_listen_addr",
+				"stack_rootfs",
+			}))
+		})
+	})
+
+	Describe("IsReloadable", func() {
+		It("is true for settings used by the backends and the CC client credentials", func() {
+			Expect(IsReloadable("staging_resource_policies")).To(BeTrue())
+			Expect(IsReloadable("cc_basic_auth_password")).To(BeTrue())
+		})
+
+		It("is false for settings only read at startup", func() {
+			Expect(IsReloadable("stager_listen_addr")).To(BeFalse())
+			Expect(IsReloadable("bbs_api_url")).To(BeFalse())
 		})
 	})
 })
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// ReloadableFields lists, by JSON name, the settings that take effect when
+// the configuration is reloaded. Any other setting is only picked up when the
+// stager restarts.
+var ReloadableFields = []string{
+	"api_authentication",
+	"cc_basic_auth_password",
+	"cc_basic_auth_username",
+	"cc_uploader_url",
+	"diego_privileged_containers",
+	"docker_image_policy",
+	"docker_registries",
+	"docker_staging_stack",
+	"file_server_url",
+	"insecure_docker_registries",
+	"lifecycles",
+	"server_tls",
+	"stack_rootfs",
+	"staging_placement_rules",
+	"staging_resource_policies",
+	"staging_task_callback_url",
+}
+
+func IsReloadable(field string) bool {
+	return contains(ReloadableFields, field)
+}
+
+// ChangedFields returns the JSON names of the settings that differ between
+// old and updated, in the order they are declared in StagerConfig.
+func ChangedFields(old, updated StagerConfig) []string {
+	oldValue := reflect.ValueOf(old)
+	newValue := reflect.ValueOf(updated)
+	configType := oldValue.Type()
+
+	changed := []string{}
+	for i := 0; i < configType.NumField(); i++ {
+		if reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			continue
+		}
+
+		name := strings.Split(configType.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = configType.Field(i).Name
+		}
+		changed = append(changed, name)
+	}
+
+	return changed
+}
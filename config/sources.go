@@ -0,0 +1,314 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// EnvironmentPrefix starts the name of every environment variable that
+	// overrides a setting, e.g. STAGER_CC_BASIC_AUTH_PASSWORD.
+	EnvironmentPrefix = "STAGER_"
+
+	RedactedValue = "[REDACTED]"
+)
+
+// Sources lists where the stager configuration is read from, each source
+// overriding the ones before it. The config file comes first, in JSON or,
+// with a .yml or .yaml extension, in YAML. The secrets file, in the same
+// formats, is merged key by key on top of it. Last come environment
+// variables named after the upper-cased keys with the STAGER_ prefix: string
+// settings take the variable's value as is, while any other setting, such as
+// STAGER_ENABLED_LIFECYCLES, takes it as JSON and is replaced as a whole.
+// Prefixed variables that name no setting are ignored. Every source is
+// optional.
+type Sources struct {
+	ConfigPath  string
+	SecretsPath string
+	Environment []string
+}
+
+// Files returns the files the configuration is read from.
+func (s Sources) Files() []string {
+	files := []string{}
+	for _, path := range []string{s.ConfigPath, s.SecretsPath} {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// IgnoredVariables returns the names of the environment variables with the
+// STAGER_ prefix that do not name a setting. They are ignored rather than
+// rejected because the platform may set some of its own, such as the
+// STAGER_SERVICE_HOST and STAGER_PORT Kubernetes sets for a service named
+// stager.
+func (s Sources) IgnoredVariables() []string {
+	types := jsonFields(reflect.TypeOf(StagerConfig{}))
+
+	ignored := []string{}
+	for _, variable := range s.Environment {
+		name, _ := splitVariable(variable)
+		if !strings.HasPrefix(name, EnvironmentPrefix) {
+			continue
+		}
+
+		if _, ok := types[strings.ToLower(strings.TrimPrefix(name, EnvironmentPrefix))]; !ok {
+			ignored = append(ignored, name)
+		}
+	}
+
+	sort.Strings(ignored)
+	return ignored
+}
+
+// fields merges the sources into a single set of top-level settings.
+func (s Sources) fields() (map[string]interface{}, ValidationErrors, error) {
+	fields := map[string]interface{}{}
+	errs := ValidationErrors{}
+	configType := reflect.TypeOf(StagerConfig{})
+	types := jsonFields(configType)
+
+	for _, path := range s.Files() {
+		fileFields, err := readConfigFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, key := range unknownKeys("", fileFields, configType) {
+			errs = append(errs, fmt.Errorf("%s: unknown key", key))
+		}
+
+		merge(fields, fileFields)
+	}
+
+	for _, variable := range s.Environment {
+		name, value := splitVariable(variable)
+		if !strings.HasPrefix(name, EnvironmentPrefix) {
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimPrefix(name, EnvironmentPrefix))
+		settingType, ok := types[key]
+		if !ok {
+			// see IgnoredVariables
+			continue
+		}
+
+		if settingType.Kind() == reflect.String {
+			fields[key] = value
+			continue
+		}
+
+		var override interface{}
+		err := decodeJSON([]byte(value), &override)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid JSON value: %s", name, err))
+			continue
+		}
+
+		unknown := unknownKeys(key, override, settingType)
+		for _, path := range unknown {
+			errs = append(errs, fmt.Errorf("%s: unknown key '%s'", name, path))
+		}
+		if len(unknown) > 0 {
+			continue
+		}
+		fields[key] = override
+	}
+
+	return fields, errs, nil
+}
+
+func readConfigFile(path string) (map[string]interface{}, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]interface{}{}
+
+	switch filepath.Ext(path) {
+	case ".yml", ".yaml":
+		var document interface{}
+		err = yaml.Unmarshal(contents, &document)
+		if err != nil {
+			return nil, fmt.Errorf("invalid YAML in '%s': %s", path, err)
+		}
+
+		if document == nil {
+			return fields, nil
+		}
+
+		converted, ok := fromYAML(document).(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("'%s' does not contain a YAML mapping", path)
+		}
+		return converted, nil
+
+	default:
+		err = decodeJSON(contents, &fields)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON in '%s': %s", path, err)
+		}
+		return fields, nil
+	}
+}
+
+// decodeJSON keeps numbers as written so that large integers survive being
+// encoded again.
+func decodeJSON(payload []byte, value interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+// fromYAML turns the maps produced by the YAML decoder, whose keys may be of
+// any type, into maps that can be encoded as JSON.
+func fromYAML(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		converted := map[string]interface{}{}
+		for key, element := range value {
+			converted[fmt.Sprint(key)] = fromYAML(element)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(value))
+		for i, element := range value {
+			converted[i] = fromYAML(element)
+		}
+		return converted
+	default:
+		return value
+	}
+}
+
+// merge copies overrides into fields, merging nested objects key by key.
+func merge(fields, overrides map[string]interface{}) {
+	for key, override := range overrides {
+		existing, isMap := fields[key].(map[string]interface{})
+		overrideMap, overrideIsMap := override.(map[string]interface{})
+		if isMap && overrideIsMap {
+			merge(existing, overrideMap)
+			continue
+		}
+		fields[key] = override
+	}
+}
+
+// jsonFields maps the JSON name of every field of the struct type t to its
+// type, including the fields of embedded structs.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || (field.PkgPath != "" && !field.Anonymous) {
+			continue
+		}
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			for embeddedName, embeddedType := range jsonFields(field.Type) {
+				fields[embeddedName] = embeddedType
+			}
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// unknownKeys returns the sorted paths, below path, of the keys in value that
+// a setting of type t has no field for. Values of the wrong type are left to
+// the JSON decoder, and settings that decode themselves, such as
+// json.RawMessage, may hold any keys.
+func unknownKeys(path string, value interface{}, t reflect.Type) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return nil
+	}
+
+	unknown := []string{}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		fields := jsonFields(t)
+		for _, key := range sortedFieldKeys(object) {
+			fieldType, ok := fields[key]
+			if !ok {
+				unknown = append(unknown, joinPath(path, key))
+				continue
+			}
+			unknown = append(unknown, unknownKeys(joinPath(path, key), object[key], fieldType)...)
+		}
+
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		for _, key := range sortedFieldKeys(object) {
+			unknown = append(unknown, unknownKeys(joinPath(path, key), object[key], t.Elem())...)
+		}
+
+	case reflect.Slice, reflect.Array:
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+
+		for i, element := range list {
+			unknown = append(unknown, unknownKeys(fmt.Sprintf("%s[%d]", path, i), element, t.Elem())...)
+		}
+	}
+
+	return unknown
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedFieldKeys(object map[string]interface{}) []string {
+	keys := []string{}
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func splitVariable(variable string) (string, string) {
+	parts := strings.SplitN(variable, "=", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
@@ -0,0 +1,224 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/stager/api_auth"
+	"code.cloudfoundry.org/stager/backend"
+	. "code.cloudfoundry.org/stager/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sources", func() {
+	var (
+		dir     string
+		sources Sources
+	)
+
+	writeFile := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+		return path
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "stager-config")
+		Expect(err).NotTo(HaveOccurred())
+
+		sources = Sources{}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("starts from the defaults when there are no sources", func() {
+		stagerConfig, err := LoadStagerConfig(sources)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stagerConfig).To(Equal(DefaultStagerConfig()))
+	})
+
+	It("reads YAML config files", func() {
+		sources.ConfigPath = writeFile("stager.yml", `
+cc_basic_auth_username: stager
+dropsonde_port: 3458
+enabled_lifecycles: [buildpack, docker]
+docker_registries:
+  registry.example.com:5000:
+    tls_mode: insecure
+lifecycle_config:
+  buildpack:
+    some: setting
+`)
+
+		stagerConfig, err := LoadStagerConfig(sources)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stagerConfig.CCUsername).To(Equal("stager"))
+		Expect(stagerConfig.DropsondePort).To(Equal(3458))
+		Expect(stagerConfig.EnabledLifecycles).To(Equal([]string{"buildpack", "docker"}))
+		Expect(stagerConfig.DockerRegistries).To(Equal(backend.DockerRegistries{
+			"registry.example.com:5000": {TLSMode: backend.RegistryTLSInsecure},
+		}))
+		Expect([]byte(stagerConfig.LifecycleConfig["buildpack"])).To(MatchJSON(`{"some": "setting"}`))
+	})
+
+	It("rejects unknown keys in YAML files", func() {
+		sources.ConfigPath = writeFile("stager.yaml", "listen_addr: 0.0.0.0:8888\n")
+
+		_, err := LoadStagerConfig(sources)
+		Expect(err).To(MatchError("listen_addr: unknown key"))
+	})
+
+	It("reports every setting of the wrong type", func() {
+		sources.ConfigPath = writeFile("stager.json", `{
+			"dropsonde_port": "3458",
+			"listen_addr": "0.0.0.0:8888",
+			"skip_cert_verify": "yes",
+			"staging_limits": {"max_in_flight": "ten"}
+		}`)
+
+		_, err := LoadStagerConfig(sources)
+		Expect(err).To(MatchError(
+			"listen_addr: unknown key; " +
+				"dropsonde_port: cannot be a JSON string, expected int; " +
+				"skip_cert_verify: cannot be a JSON string, expected bool; " +
+				"staging_limits.max_in_flight: cannot be a JSON string, expected int",
+		))
+	})
+
+	It("merges the secrets file on top of the config file", func() {
+		sources.ConfigPath = writeFile("stager.json", `{
+			"cc_basic_auth_username": "stager",
+			"docker_registries": {
+				"registry.example.com": {"tls_mode": "verify", "username": "puller"}
+			}
+		}`)
+		sources.SecretsPath = writeFile("secrets.yml", `
+cc_basic_auth_password: secret
+docker_registries:
+  registry.example.com:
+    password: registry-secret
+`)
+
+		stagerConfig, err := LoadStagerConfig(sources)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stagerConfig.CCUsername).To(Equal("stager"))
+		Expect(stagerConfig.CCPassword).To(Equal("secret"))
+		Expect(stagerConfig.DockerRegistries["registry.example.com"]).To(Equal(backend.DockerRegistry{
+			TLSMode:  backend.RegistryTLSVerify,
+			Username: "puller",
+			Password: "registry-secret",
+		}))
+	})
+
+	Describe("environment overrides", func() {
+		BeforeEach(func() {
+			sources.ConfigPath = writeFile("stager.json", `{
+				"cc_basic_auth_password": "from-file",
+				"skip_cert_verify": false,
+				"enabled_lifecycles": ["buildpack"]
+			}`)
+		})
+
+		It("override the files", func() {
+			sources.Environment = []string{
+				"PATH=/usr/bin",
+				"STAGER_CC_BASIC_AUTH_PASSWORD=from-env",
+				"STAGER_SKIP_CERT_VERIFY=true",
+				`STAGER_ENABLED_LIFECYCLES=["docker"]`,
+			}
+
+			stagerConfig, err := LoadStagerConfig(sources)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stagerConfig.CCPassword).To(Equal("from-env"))
+			Expect(stagerConfig.SkipCertVerify).To(BeTrue())
+			Expect(stagerConfig.EnabledLifecycles).To(Equal([]string{"docker"}))
+		})
+
+		It("reports malformed values", func() {
+			sources.Environment = []string{
+				"STAGER_DROPSONDE_PORT=not-a-number",
+				"STAGER_SKIP_CERT_VERIFY=maybe",
+			}
+
+			_, err := LoadStagerConfig(sources)
+			Expect(err).To(HaveOccurred())
+
+			errs := err.(ValidationErrors)
+			Expect(errs).To(HaveLen(2))
+			Expect(errs[0]).To(MatchError(ContainSubstring("STAGER_DROPSONDE_PORT: invalid JSON value")))
+			Expect(errs[1]).To(MatchError(ContainSubstring("STAGER_SKIP_CERT_VERIFY: invalid JSON value")))
+		})
+
+		It("ignores prefixed variables that name no setting", func() {
+			sources.Environment = []string{
+				"STAGER_CC_PASSWORD=typo",
+				"STAGER_SERVICE_HOST=10.0.0.1",
+				"STAGER_PORT=tcp://10.0.0.1:8888",
+				"STAGER_CC_BASIC_AUTH_PASSWORD=from-env",
+				"PATH=/usr/bin",
+			}
+
+			stagerConfig, err := LoadStagerConfig(sources)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stagerConfig.CCPassword).To(Equal("from-env"))
+
+			Expect(sources.IgnoredVariables()).To(Equal([]string{
+				"STAGER_CC_PASSWORD",
+				"STAGER_PORT",
+				"STAGER_SERVICE_HOST",
+			}))
+		})
+
+		It("reports unknown keys within JSON values", func() {
+			sources.Environment = []string{
+				`STAGER_STAGING_LIMITS={"max_in_flight": 10, "max_in_fligth": 20}`,
+			}
+
+			_, err := LoadStagerConfig(sources)
+			Expect(err).To(MatchError("STAGER_STAGING_LIMITS: unknown key 'staging_limits.max_in_fligth'"))
+		})
+	})
+
+	Describe("Redacted", func() {
+		It("replaces passwords", func() {
+			stagerConfig := DefaultStagerConfig()
+			stagerConfig.CCUsername = "stager"
+			stagerConfig.CCPassword = "secret"
+			stagerConfig.DockerRegistries = backend.DockerRegistries{
+				"registry.example.com": {Username: "puller", Password: "registry-secret"},
+			}
+			stagerConfig.APIAuthentication = api_auth.Config{
+				Username:            "cc",
+				Password:            "api-secret",
+				BearerTokens:        []string{"token"},
+				CallbackSigningKeys: []string{"key"},
+			}
+
+			redacted := stagerConfig.Redacted()
+			Expect(redacted.CCUsername).To(Equal("stager"))
+			Expect(redacted.CCPassword).To(Equal(RedactedValue))
+			Expect(redacted.DockerRegistries["registry.example.com"].Username).To(Equal("puller"))
+			Expect(redacted.DockerRegistries["registry.example.com"].Password).To(Equal(RedactedValue))
+
+			Expect(redacted.APIAuthentication).To(Equal(api_auth.Config{
+				Username:            "cc",
+				Password:            RedactedValue,
+				BearerTokens:        []string{RedactedValue},
+				CallbackSigningKeys: []string{RedactedValue},
+			}))
+
+			Expect(stagerConfig.DockerRegistries["registry.example.com"].Password).To(Equal("registry-secret"))
+			Expect(stagerConfig.APIAuthentication.BearerTokens).To(Equal([]string{"token"}))
+		})
+
+		It("leaves unset passwords empty", func() {
+			Expect(DefaultStagerConfig().Redacted().CCPassword).To(BeEmpty())
+		})
+	})
+})
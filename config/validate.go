@@ -0,0 +1,256 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"code.cloudfoundry.org/runtimeschema/cc_messages/flags"
+	"code.cloudfoundry.org/stager/backend"
+)
+
+// ValidationErrors holds every problem found in a configuration.
+type ValidationErrors []error
+
+func (errs ValidationErrors) Error() string {
+	messages := []string{}
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// ValidateStagerConfig reads the config from sources and reports every
+// problem with it, unknown keys included, as ValidationErrors.
+func ValidateStagerConfig(sources Sources) error {
+	stagerConfig, errs, err := readStagerConfig(sources)
+	if err != nil {
+		return err
+	}
+
+	err = stagerConfig.Validate()
+	if err != nil {
+		errs = append(errs, err.(ValidationErrors)...)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Validate checks the settings the stager needs in order to start, returning
+// all of the problems found as ValidationErrors.
+func (c StagerConfig) Validate() error {
+	errs := ValidationErrors{}
+	check := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", field, err))
+		}
+	}
+
+	check("stager_listen_addr", validateListenAddress(c.ListenAddress))
+	if c.PrometheusListenAddress != "" {
+		check("prometheus_listen_addr", validateListenAddress(c.PrometheusListenAddress))
+	}
+	if c.DebugServerConfig.DebugAddress != "" {
+		check("debug_server_config.debug_address", validateListenAddress(c.DebugServerConfig.DebugAddress))
+	}
+
+	check("bbs_api_url", validateURL(c.BBSAddress, true))
+	check("cc_base_url", validateURL(c.CCBaseUrl, true))
+	check("consul_cluster", validateURL(c.ConsulCluster, true))
+	check("staging_task_callback_url", validateURL(c.StagingTaskCallbackURL, true))
+	check("file_server_url", validateURL(c.FileServerUrl, false))
+	check("cc_uploader_url", validateURL(c.CCUploaderURL, false))
+
+	if strings.HasPrefix(c.BBSAddress, "https:") {
+		check("bbs_ca_cert", validateCACert(c.BBSCACert))
+		check("bbs_client_cert", validateKeyPair(c.BBSClientCert, c.BBSClientKey))
+	}
+
+	check("api_authentication", c.APIAuthentication.Validate())
+	if c.ServerTLS.Enabled() {
+		check("server_tls", c.ServerTLS.Validate())
+
+		// the BBS calls back on this URL, and a stager serving TLS does not
+		// answer plain HTTP
+		parsed, err := url.Parse(c.StagingTaskCallbackURL)
+		if c.StagingTaskCallbackURL != "" && err == nil && parsed.Scheme != "https" {
+			check("staging_task_callback_url", errors.New("must be https when server_tls is enabled"))
+		}
+	}
+
+	_, err := c.LifecycleMap()
+	check("lifecycles", err)
+
+	if c.DockerStagingStack == "" {
+		check("docker_staging_stack", errors.New("cannot be blank"))
+	}
+
+	if c.StagingReconcileInterval < 0 {
+		check("staging_reconcile_interval_in_seconds", errors.New("cannot be negative"))
+	}
+	if c.StagingReconcileInterval > 0 {
+		if c.StagingReconcileInterval >= c.BBSExpireCompletedTaskTTL {
+			check("staging_reconcile_interval_in_seconds", fmt.Errorf("must be shorter than bbs_expire_completed_task_duration_in_seconds (%d)", c.BBSExpireCompletedTaskTTL))
+		}
+		if c.StagingReconcileGrace <= 0 {
+			check("staging_reconcile_grace_period_in_seconds", errors.New("must be positive"))
+		} else if c.StagingReconcileGrace >= c.BBSExpireCompletedTaskTTL {
+			// the BBS deletes completed tasks once they expire, so a longer
+			// grace period leaves the reconciler nothing to reconcile
+			check("staging_reconcile_grace_period_in_seconds", fmt.Errorf("must be shorter than bbs_expire_completed_task_duration_in_seconds (%d)", c.BBSExpireCompletedTaskTTL))
+		}
+	}
+	if c.ConfigReloadInterval < 0 {
+		check("config_reload_interval_in_seconds", errors.New("cannot be negative"))
+	}
+
+	enabled := c.EnabledLifecycles
+	if len(enabled) == 0 {
+		enabled = backend.DefaultRegistry.DefaultNames()
+	}
+	registered := backend.DefaultRegistry.Names()
+	for _, lifecycle := range enabled {
+		if !contains(registered, lifecycle) {
+			check("enabled_lifecycles", fmt.Errorf("unknown lifecycle '%s'", lifecycle))
+		}
+	}
+	for _, lifecycle := range sortedKeys(c.LifecycleConfig) {
+		if !contains(registered, lifecycle) {
+			check("lifecycle_config", fmt.Errorf("unknown lifecycle '%s'", lifecycle))
+		}
+	}
+
+	check("staging_resource_policies", c.StagingResourcePolicies.Validate())
+	check("docker_registries", c.DockerRegistries.Validate())
+	check("docker_image_policy", c.DockerImagePolicy.Validate())
+	check("stack_rootfs", c.StackRootFSes.Validate())
+	check("staging_placement_rules", c.PlacementRules.Validate(enabled, c.DockerStagingStack))
+
+	if contains(enabled, backend.DockerLifecycleName) && c.ServerTLS.Enabled() {
+		// cells download docker credentials without a client certificate, so
+		// they are served on a listener of their own
+		check("server_tls.docker_credentials_listen_addr", validateListenAddress(c.ServerTLS.DockerCredentialsListenAddress))
+		check("server_tls.docker_credentials_url", validateURL(c.ServerTLS.DockerCredentialsURL, true))
+		parsed, err := url.Parse(c.ServerTLS.DockerCredentialsURL)
+		if c.ServerTLS.DockerCredentialsURL != "" && err == nil && parsed.Scheme != "https" {
+			check("server_tls.docker_credentials_url", errors.New("must be https"))
+		}
+	}
+
+	if contains(enabled, backend.DockerLifecycleName) && c.APIAuthentication.SigningKey() == "" {
+		// docker registry passwords are sealed with the key, so that the
+		// staging task can download them without storing them in the BBS
+		check("api_authentication.callback_signing_keys", errors.New("cannot be empty when the docker lifecycle is enabled"))
+	}
+
+	if contains(enabled, backend.DockerLifecycleName) && c.DockerStagingStack != "" {
+		_, err := c.StackRootFSes.RootFS(c.DockerStagingStack)
+		check("docker_staging_stack", err)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// LifecycleMap parses the lifecycles setting, which maps lifecycle names,
+// such as "buildpack/cflinuxfs3", to the bundles on the file server.
+func (c StagerConfig) LifecycleMap() (flags.LifecycleMap, error) {
+	lifecycles := flags.LifecycleMap{}
+	for _, value := range c.Lifecycles {
+		err := lifecycles.Set(value)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %s", value, err)
+		}
+	}
+	return lifecycles, nil
+}
+
+func validateListenAddress(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	_, err = net.LookupPort("tcp", port)
+	return err
+}
+
+func validateURL(value string, required bool) error {
+	if value == "" {
+		if required {
+			return errors.New("cannot be blank")
+		}
+		return nil
+	}
+
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme '%s', expected http or https", parsed.Scheme)
+	}
+
+	if parsed.Host == "" {
+		return errors.New("missing host")
+	}
+
+	return nil
+}
+
+func validateCACert(caFile string) error {
+	if caFile == "" {
+		return errors.New("required when bbs_api_url is https")
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+
+	if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no PEM certificates found in '%s'", caFile)
+	}
+
+	return nil
+}
+
+func validateKeyPair(certFile, keyFile string) error {
+	if certFile == "" || keyFile == "" {
+		return errors.New("bbs_client_cert and bbs_client_key are required when bbs_api_url is https")
+	}
+
+	_, err := tls.LoadX509KeyPair(certFile, keyFile)
+	return err
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
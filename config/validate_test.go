@@ -0,0 +1,225 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	"code.cloudfoundry.org/stager/backend"
+	. "code.cloudfoundry.org/stager/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Validation", func() {
+	var stagerConfig StagerConfig
+
+	BeforeEach(func() {
+		stagerConfig = DefaultStagerConfig()
+		stagerConfig.BBSAddress = "http://bbs.example.com"
+		stagerConfig.CCBaseUrl = "https://cc.example.com"
+		stagerConfig.ConsulCluster = "http://127.0.0.1:8500"
+		stagerConfig.DockerStagingStack = "cflinuxfs3"
+		stagerConfig.ListenAddress = "0.0.0.0:8888"
+		stagerConfig.StagingTaskCallbackURL = "http://stager.example.com"
+		stagerConfig.Lifecycles = []string{"buildpack/cflinuxfs3:buildpack_app_lifecycle.tgz"}
+		stagerConfig.APIAuthentication.CallbackSigningKeys = []string{"callback-key"}
+	})
+
+	Describe("Validate", func() {
+		It("accepts a valid config", func() {
+			Expect(stagerConfig.Validate()).To(Succeed())
+		})
+
+		It("reports every problem at once", func() {
+			stagerConfig.ListenAddress = "portless"
+			stagerConfig.CCBaseUrl = ""
+			stagerConfig.FileServerUrl = "ftp://file-server.example.com"
+			stagerConfig.Lifecycles = []string{"invalid form"}
+			stagerConfig.EnabledLifecycles = []string{"unicorn"}
+
+			err := stagerConfig.Validate()
+			Expect(err).To(HaveOccurred())
+
+			errs, ok := err.(ValidationErrors)
+			Expect(ok).To(BeTrue())
+			Expect(errs).To(HaveLen(5))
+			Expect(errs[0]).To(MatchError(ContainSubstring("stager_listen_addr: ")))
+			Expect(errs[1]).To(MatchError("cc_base_url: cannot be blank"))
+			Expect(errs[2]).To(MatchError("file_server_url: unsupported scheme 'ftp', expected http or https"))
+			Expect(errs[3]).To(MatchError(ContainSubstring("lifecycles: 'invalid form'")))
+			Expect(errs[4]).To(MatchError("enabled_lifecycles: unknown lifecycle 'unicorn'"))
+		})
+
+		It("requires an https callback URL when serving TLS", func() {
+			stagerConfig.ServerTLS.ServerCert = "/does/not/exist.crt"
+
+			err := stagerConfig.Validate()
+			Expect(err).To(MatchError(ContainSubstring("staging_task_callback_url: must be https when server_tls is enabled")))
+
+			stagerConfig.StagingTaskCallbackURL = "https://stager.example.com"
+			err = stagerConfig.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).NotTo(ContainSubstring("staging_task_callback_url"))
+		})
+
+		It("requires a listener for docker credentials when serving TLS", func() {
+			stagerConfig.ServerTLS.ServerCert = "/does/not/exist.crt"
+			stagerConfig.StagingTaskCallbackURL = "https://stager.example.com"
+
+			err := stagerConfig.Validate()
+			Expect(err).To(MatchError(ContainSubstring("server_tls.docker_credentials_listen_addr: ")))
+			Expect(err).To(MatchError(ContainSubstring("server_tls.docker_credentials_url: cannot be blank")))
+
+			stagerConfig.ServerTLS.DockerCredentialsListenAddress = "0.0.0.0:8891"
+			stagerConfig.ServerTLS.DockerCredentialsURL = "http://stager.example.com:8891"
+			err = stagerConfig.Validate()
+			Expect(err).NotTo(MatchError(ContainSubstring("server_tls.docker_credentials_listen_addr")))
+			Expect(err).To(MatchError(ContainSubstring("server_tls.docker_credentials_url: must be https")))
+
+			stagerConfig.ServerTLS.DockerCredentialsURL = "https://stager.example.com:8891"
+			err = stagerConfig.Validate()
+			Expect(err).NotTo(MatchError(ContainSubstring("server_tls.docker_credentials")))
+
+			stagerConfig.ServerTLS.DockerCredentialsListenAddress = ""
+			stagerConfig.EnabledLifecycles = []string{backend.TraditionalLifecycleName}
+			err = stagerConfig.Validate()
+			Expect(err).NotTo(MatchError(ContainSubstring("server_tls.docker_credentials")))
+		})
+
+		It("requires a callback signing key to seal docker credentials with", func() {
+			stagerConfig.APIAuthentication.CallbackSigningKeys = nil
+			Expect(stagerConfig.Validate()).To(MatchError(
+				"api_authentication.callback_signing_keys: cannot be empty when the docker lifecycle is enabled",
+			))
+
+			stagerConfig.EnabledLifecycles = []string{backend.TraditionalLifecycleName}
+			Expect(stagerConfig.Validate()).To(Succeed())
+		})
+
+		It("requires the reconcile grace period to end before the BBS expires completed tasks", func() {
+			stagerConfig.StagingReconcileInterval = 60
+			Expect(stagerConfig.Validate()).To(Succeed())
+
+			stagerConfig.StagingReconcileGrace = 120
+			Expect(stagerConfig.Validate()).To(MatchError(
+				"staging_reconcile_grace_period_in_seconds: must be shorter than bbs_expire_completed_task_duration_in_seconds (120)",
+			))
+
+			stagerConfig.BBSExpireCompletedTaskTTL = 300
+			Expect(stagerConfig.Validate()).To(Succeed())
+		})
+
+		It("requires the reconciler to look for tasks before the BBS expires them", func() {
+			stagerConfig.StagingReconcileInterval = 120
+			Expect(stagerConfig.Validate()).To(MatchError(
+				"staging_reconcile_interval_in_seconds: must be shorter than bbs_expire_completed_task_duration_in_seconds (120)",
+			))
+		})
+
+		It("checks the backend settings", func() {
+			stagerConfig.StackRootFSes = backend.StackRootFSes{"cflinuxfs4": "cflinuxfs4"}
+
+			err := stagerConfig.Validate()
+			Expect(err).To(MatchError(ContainSubstring("docker_staging_stack: unknown stack 'cflinuxfs3'")))
+		})
+
+		Context("when the BBS is reached over https", func() {
+			BeforeEach(func() {
+				stagerConfig.BBSAddress = "https://bbs.example.com"
+			})
+
+			It("requires the certificates", func() {
+				err := stagerConfig.Validate()
+				Expect(err).To(MatchError(ContainSubstring("bbs_ca_cert: required when bbs_api_url is https")))
+				Expect(err).To(MatchError(ContainSubstring("bbs_client_cert: bbs_client_cert and bbs_client_key are required")))
+			})
+
+			It("checks that the certificate files can be loaded", func() {
+				notPEM, err := ioutil.TempFile("", "not-pem")
+				Expect(err).NotTo(HaveOccurred())
+				defer os.Remove(notPEM.Name())
+				notPEM.Close()
+
+				stagerConfig.BBSCACert = notPEM.Name()
+				stagerConfig.BBSClientCert = "/does/not/exist.crt"
+				stagerConfig.BBSClientKey = "/does/not/exist.key"
+
+				err = stagerConfig.Validate()
+				Expect(err).To(MatchError(ContainSubstring("bbs_ca_cert: no PEM certificates found")))
+				Expect(err).To(MatchError(ContainSubstring("bbs_client_cert: open /does/not/exist.crt")))
+			})
+		})
+	})
+
+	Describe("NewStagerConfig", func() {
+		It("rejects unknown keys", func() {
+			configFile, err := ioutil.TempFile("", "stager-config")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(configFile.Name())
+
+			_, err = configFile.WriteString(`{"docker_registry_address": "registry", "listen_addr": "0.0.0.0:8888"}`)
+			Expect(err).NotTo(HaveOccurred())
+			configFile.Close()
+
+			_, err = NewStagerConfig(configFile.Name())
+			Expect(err).To(MatchError("docker_registry_address: unknown key; listen_addr: unknown key"))
+		})
+	})
+
+	Describe("unknown nested keys", func() {
+		It("are reported with their path", func() {
+			configFile, err := ioutil.TempFile("", "stager-config")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(configFile.Name())
+
+			_, err = configFile.WriteString(`{
+				"staging_limits": {"max_in_fligth": 10},
+				"docker_registries": {"registry.example.com": {"tls_mode": "verify", "mirors": ["mirror.example.com"]}},
+				"server_tls": {"ca_cert": "ca.crt", "server_crt": "server.crt"},
+				"docker_image_policy": {
+					"denied_repositories": ["docker.io/*"],
+					"isolation_segments": {"production": {"require_digests": true}}
+				},
+				"staging_resource_policies": {"buildpack": {"memory_mb": {"maximum": 1024}}},
+				"lifecycle_config": {"buildpack": {"anything": "goes"}}
+			}`)
+			Expect(err).NotTo(HaveOccurred())
+			configFile.Close()
+
+			_, err = NewStagerConfig(configFile.Name())
+			Expect(err).To(MatchError(
+				"docker_image_policy.isolation_segments.production.require_digests: unknown key; " +
+					"docker_registries.registry.example.com.mirors: unknown key; " +
+					"server_tls.server_crt: unknown key; " +
+					"staging_limits.max_in_fligth: unknown key; " +
+					"staging_resource_policies.buildpack.memory_mb.maximum: unknown key",
+			))
+		})
+	})
+
+	Describe("ValidateStagerConfig", func() {
+		It("reports unknown keys together with invalid settings", func() {
+			configFile, err := ioutil.TempFile("", "stager-config")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(configFile.Name())
+
+			_, err = configFile.WriteString(`{"docker_registry_address": "registry", "stager_listen_addr": "portless"}`)
+			Expect(err).NotTo(HaveOccurred())
+			configFile.Close()
+
+			err = ValidateStagerConfig(Sources{ConfigPath: configFile.Name()})
+			Expect(err).To(HaveOccurred())
+
+			errs := err.(ValidationErrors)
+			Expect(errs[0]).To(MatchError("docker_registry_address: unknown key"))
+			Expect(errs[1]).To(MatchError(ContainSubstring("stager_listen_addr: ")))
+		})
+
+		It("accepts the fixture's keys", func() {
+			err := ValidateStagerConfig(Sources{ConfigPath: "../fixtures/stager_config.json"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).NotTo(ContainSubstring("unknown key"))
+		})
+	})
+})
@@ -0,0 +1,151 @@
+package config_reloader
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/stager/config"
+	"github.com/tedsuo/ifrit"
+)
+
+// ApplyFunc puts the reloadable settings of a reloaded and validated
+// configuration into effect. If it returns an error the running
+// configuration is kept as it is.
+type ApplyFunc func(logger lager.Logger, stagerConfig config.StagerConfig) error
+
+type reloader struct {
+	logger       lager.Logger
+	sources      config.Sources
+	current      config.StagerConfig
+	apply        ApplyFunc
+	reload       <-chan os.Signal
+	clock        clock.Clock
+	pollInterval time.Duration
+}
+
+// New returns a runner that reloads the configuration from sources whenever
+// a signal arrives on reload and, if pollInterval is positive, whenever the
+// modification time of one of its files changes. current is the
+// configuration the stager was started with.
+func New(
+	logger lager.Logger,
+	sources config.Sources,
+	current config.StagerConfig,
+	apply ApplyFunc,
+	reload <-chan os.Signal,
+	clock clock.Clock,
+	pollInterval time.Duration,
+) ifrit.Runner {
+	return &reloader{
+		logger:       logger.Session("config-reloader"),
+		sources:      sources,
+		current:      current,
+		apply:        apply,
+		reload:       reload,
+		clock:        clock,
+		pollInterval: pollInterval,
+	}
+}
+
+func (r *reloader) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	logger := r.logger.Session("run")
+	logger.Info("starting")
+
+	var poll <-chan time.Time
+	if r.pollInterval > 0 {
+		ticker := r.clock.NewTicker(r.pollInterval)
+		defer ticker.Stop()
+		poll = ticker.C()
+	}
+
+	lastModified := r.modTime(logger)
+
+	close(ready)
+
+	for {
+		select {
+		case <-signals:
+			logger.Info("stopped")
+			return nil
+
+		case <-r.reload:
+			r.reloadConfig(logger, "signal")
+
+		case <-poll:
+			modified := r.modTime(logger)
+			if modified.Equal(lastModified) {
+				continue
+			}
+			lastModified = modified
+			r.reloadConfig(logger, "file-changed")
+		}
+	}
+}
+
+func (r *reloader) reloadConfig(logger lager.Logger, trigger string) {
+	logger = logger.Session("reload", lager.Data{"trigger": trigger})
+
+	stagerConfig, err := config.LoadStagerConfig(r.sources)
+	if err != nil {
+		logger.Error("failed-to-read-config", err)
+		return
+	}
+
+	err = stagerConfig.Validate()
+	if err != nil {
+		logger.Error("invalid-config", err)
+		return
+	}
+
+	reloadable := []string{}
+	ignored := []string{}
+	for _, field := range config.ChangedFields(r.current, stagerConfig) {
+		if config.IsReloadable(field) {
+			reloadable = append(reloadable, field)
+		} else {
+			ignored = append(ignored, field)
+		}
+	}
+
+	if len(ignored) > 0 {
+		// these changes are not in effect, which operators need to notice
+		err := fmt.Errorf("changes to %s take effect only after a restart", strings.Join(ignored, ", "))
+		logger.Error("restart-required-for-changes", err, lager.Data{"fields": ignored})
+	}
+
+	if len(reloadable) == 0 {
+		logger.Info("no-reloadable-changes")
+		r.current = stagerConfig
+		return
+	}
+
+	err = r.apply(logger, stagerConfig)
+	if err != nil {
+		logger.Error("failed-to-apply-config", err, lager.Data{"fields": reloadable})
+		return
+	}
+
+	r.current = stagerConfig
+	logger.Info("reloaded", lager.Data{"fields": reloadable})
+}
+
+// modTime returns the latest modification time of the configuration files.
+func (r *reloader) modTime(logger lager.Logger) time.Time {
+	var latest time.Time
+	for _, path := range r.sources.Files() {
+		info, err := os.Stat(path)
+		if err != nil {
+			logger.Error("failed-to-stat-config", err, lager.Data{"path": path})
+			continue
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
@@ -0,0 +1,13 @@
+package config_reloader_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestConfigReloader(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Config Reloader Suite")
+}
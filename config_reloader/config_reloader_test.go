@@ -0,0 +1,209 @@
+package config_reloader_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/stager/config"
+	"code.cloudfoundry.org/stager/config_reloader"
+	"github.com/tedsuo/ifrit"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("ConfigReloader", func() {
+	const pollInterval = 10 * time.Second
+
+	var (
+		logger     *lagertest.TestLogger
+		configPath string
+		current    config.StagerConfig
+		fakeClock  *fakeclock.FakeClock
+		reload     chan os.Signal
+		applyErr   error
+
+		applyLock sync.Mutex
+		applied   []config.StagerConfig
+
+		process ifrit.Process
+	)
+
+	appliedConfigs := func() []config.StagerConfig {
+		applyLock.Lock()
+		defer applyLock.Unlock()
+		return append([]config.StagerConfig{}, applied...)
+	}
+
+	writeConfig := func(stagerConfig config.StagerConfig, modTime time.Time) {
+		payload, err := json.Marshal(stagerConfig)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(configPath, payload, 0644)).To(Succeed())
+		Expect(os.Chtimes(configPath, modTime, modTime)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+		reload = make(chan os.Signal, 1)
+		applyErr = nil
+		applied = nil
+
+		configFile, err := ioutil.TempFile("", "stager-config")
+		Expect(err).NotTo(HaveOccurred())
+		configPath = configFile.Name()
+		configFile.Close()
+
+		current = config.DefaultStagerConfig()
+		current.BBSAddress = "http://bbs.example.com"
+		current.CCBaseUrl = "https://cc.example.com"
+		current.CCUsername = "username"
+		current.CCPassword = "password"
+		current.ConsulCluster = "http://127.0.0.1:8500"
+		current.DockerStagingStack = "cflinuxfs3"
+		current.ListenAddress = "0.0.0.0:8888"
+		current.StagingTaskCallbackURL = "http://stager.example.com"
+		writeConfig(current, time.Unix(1000, 0))
+	})
+
+	JustBeforeEach(func() {
+		apply := func(_ lager.Logger, stagerConfig config.StagerConfig) error {
+			applyLock.Lock()
+			defer applyLock.Unlock()
+			applied = append(applied, stagerConfig)
+			return applyErr
+		}
+
+		runner := config_reloader.New(logger, config.Sources{ConfigPath: configPath}, current, apply, reload, fakeClock, pollInterval)
+		process = ifrit.Invoke(runner)
+	})
+
+	AfterEach(func() {
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive(BeNil()))
+		os.Remove(configPath)
+	})
+
+	Context("when signalled to reload", func() {
+		It("applies a config with reloadable changes", func() {
+			updated := current
+			updated.CCPassword = "new-password"
+			writeConfig(updated, time.Unix(1000, 0))
+
+			reload <- syscall.SIGHUP
+
+			Eventually(appliedConfigs).Should(HaveLen(1))
+			Expect(appliedConfigs()[0].CCPassword).To(Equal("new-password"))
+			Eventually(logger).Should(gbytes.Say(`reloaded.*"fields":\["cc_basic_auth_password"\]`))
+		})
+
+		It("does not log the values of changed settings", func() {
+			updated := current
+			updated.CCPassword = "new-password"
+			writeConfig(updated, time.Unix(1000, 0))
+
+			reload <- syscall.SIGHUP
+
+			Eventually(appliedConfigs).Should(HaveLen(1))
+			Expect(logger.Buffer()).NotTo(gbytes.Say("new-password"))
+		})
+
+		It("warns about changes that need a restart", func() {
+			updated := current
+			updated.CCPassword = "new-password"
+			updated.ListenAddress = "0.0.0.0:9999"
+			writeConfig(updated, time.Unix(1000, 0))
+
+			reload <- syscall.SIGHUP
+
+			Eventually(logger).Should(gbytes.Say(`restart-required-for-changes","log_level":2,.*"error":"changes to stager_listen_addr take effect only after a restart","fields":\["stager_listen_addr"\]`))
+			Eventually(appliedConfigs).Should(HaveLen(1))
+		})
+
+		It("does not apply a config without reloadable changes", func() {
+			updated := current
+			updated.ListenAddress = "0.0.0.0:9999"
+			writeConfig(updated, time.Unix(1000, 0))
+
+			reload <- syscall.SIGHUP
+
+			Eventually(logger).Should(gbytes.Say("no-reloadable-changes"))
+			Expect(appliedConfigs()).To(BeEmpty())
+		})
+
+		Context("when the config cannot be read", func() {
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(configPath, []byte("{not json"), 0644)).To(Succeed())
+			})
+
+			It("keeps the running config", func() {
+				reload <- syscall.SIGHUP
+
+				Eventually(logger).Should(gbytes.Say("failed-to-read-config"))
+				Expect(appliedConfigs()).To(BeEmpty())
+			})
+		})
+
+		Context("when the config is invalid", func() {
+			It("keeps the running config", func() {
+				updated := current
+				updated.CCPassword = "new-password"
+				updated.FileServerUrl = "ftp://file-server.example.com"
+				writeConfig(updated, time.Unix(1000, 0))
+
+				reload <- syscall.SIGHUP
+
+				Eventually(logger).Should(gbytes.Say("invalid-config.*file_server_url"))
+				Expect(appliedConfigs()).To(BeEmpty())
+			})
+		})
+
+		Context("when the config is rejected", func() {
+			BeforeEach(func() {
+				applyErr = errors.New("invalid-placement-rules")
+			})
+
+			It("logs the failure and reports the changes again on the next reload", func() {
+				updated := current
+				updated.CCPassword = "new-password"
+				writeConfig(updated, time.Unix(1000, 0))
+
+				reload <- syscall.SIGHUP
+				Eventually(logger).Should(gbytes.Say("failed-to-apply-config"))
+
+				reload <- syscall.SIGHUP
+				Eventually(appliedConfigs).Should(HaveLen(2))
+			})
+		})
+	})
+
+	Context("when polling the config file", func() {
+		It("reloads the config when its modification time changes", func() {
+			updated := current
+			updated.FileServerUrl = "http://file-server.example.com"
+			writeConfig(updated, time.Unix(2000, 0))
+
+			Eventually(fakeClock.WatcherCount).Should(Equal(1))
+			fakeClock.WaitForWatcherAndIncrement(pollInterval)
+
+			Eventually(appliedConfigs).Should(HaveLen(1))
+			Expect(appliedConfigs()[0].FileServerUrl).To(Equal("http://file-server.example.com"))
+		})
+
+		It("does not reload an unmodified file", func() {
+			fakeClock.WaitForWatcherAndIncrement(pollInterval)
+
+			Consistently(appliedConfigs).Should(BeEmpty())
+			Expect(logger.Buffer()).NotTo(gbytes.Say(`"trigger"`))
+		})
+	})
+})
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+)
+
+//go:generate counterfeiter -o fakes/fake_authorizer.go . Authorizer
+type Authorizer interface {
+	// Authorize returns an error if the request may not use the named route.
+	Authorize(route string, request *http.Request) error
+}
+
+// Authorizers allows a request only if every one of its authorizers does. An
+// empty list allows every request.
+type Authorizers []Authorizer
+
+func (authorizers Authorizers) Authorize(route string, request *http.Request) error {
+	for _, authorizer := range authorizers {
+		err := authorizer.Authorize(route, request)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AuthorizationError lets an Authorizer choose the status a rejected request
+// is answered with, and the WWW-Authenticate challenge sent along with it.
+// Any other error is answered with 403 Forbidden.
+type AuthorizationError struct {
+	StatusCode int
+	Message    string
+	Challenge  string
+}
+
+func (e *AuthorizationError) Error() string {
+	return e.Message
+}
+
+func NewUnauthorizedError(message string) error {
+	return &AuthorizationError{StatusCode: http.StatusUnauthorized, Message: message}
+}
+
+func NewForbiddenError(message string) error {
+	return &AuthorizationError{StatusCode: http.StatusForbidden, Message: message}
+}
+
+func authorize(logger lager.Logger, authorizer Authorizer, route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		err := authorizer.Authorize(route, req)
+		if err != nil {
+			statusCode := http.StatusForbidden
+			if authErr, ok := err.(*AuthorizationError); ok {
+				statusCode = authErr.StatusCode
+				if authErr.Challenge != "" {
+					resp.Header().Set("WWW-Authenticate", authErr.Challenge)
+				}
+			}
+
+			logger.Info("request-not-authorized", lager.Data{
+				"route":       route,
+				"remote-addr": req.RemoteAddr,
+				"reason":      err.Error(),
+			})
+			resp.WriteHeader(statusCode)
+			return
+		}
+
+		handler.ServeHTTP(resp, req)
+	})
+}
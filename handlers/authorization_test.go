@@ -0,0 +1,163 @@
+package handlers_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/bbs/fake_bbs"
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/stager"
+	admission_fakes "code.cloudfoundry.org/stager/admission/fakes"
+	"code.cloudfoundry.org/stager/backend"
+	"code.cloudfoundry.org/stager/cc_client/fakes"
+	"code.cloudfoundry.org/stager/handlers"
+	handler_fakes "code.cloudfoundry.org/stager/handlers/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Authorization", func() {
+	var (
+		logger           *lagertest.TestLogger
+		fakeDiegoClient  *fake_bbs.FakeClient
+		fakeAuthorizer   *handler_fakes.FakeAuthorizer
+		responseRecorder *httptest.ResponseRecorder
+		handler          http.Handler
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		fakeDiegoClient = &fake_bbs.FakeClient{}
+		fakeDiegoClient.TaskByGuidReturns(nil, models.ErrResourceNotFound)
+		fakeAuthorizer = &handler_fakes.FakeAuthorizer{}
+		responseRecorder = httptest.NewRecorder()
+
+		handler = handlers.New(
+			logger,
+			&fakes.FakeCcClient{},
+			nil,
+			&admission_fakes.FakeController{},
+			fakeDiegoClient,
+			map[string]backend.Backend{},
+			fakeAuthorizer,
+			&handler_fakes.FakeDockerCredentialsOpener{},
+			fakeclock.NewFakeClock(time.Now()),
+		)
+	})
+
+	JustBeforeEach(func() {
+		req, err := http.NewRequest("GET", "/v1/staging/a-staging-guid", nil)
+		Expect(err).NotTo(HaveOccurred())
+		handler.ServeHTTP(responseRecorder, req)
+	})
+
+	It("asks the authorizer about the route being called", func() {
+		Expect(fakeAuthorizer.AuthorizeCallCount()).To(Equal(1))
+		route, req := fakeAuthorizer.AuthorizeArgsForCall(0)
+		Expect(route).To(Equal(stager.StagingStatusRoute))
+		Expect(req.URL.Path).To(Equal("/v1/staging/a-staging-guid"))
+	})
+
+	Context("when the request is authorized", func() {
+		It("is handled", func() {
+			Expect(fakeDiegoClient.TaskByGuidCallCount()).To(Equal(1))
+			Expect(responseRecorder.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Context("when the authorizer rejects the request with an AuthorizationError", func() {
+		BeforeEach(func() {
+			fakeAuthorizer.AuthorizeReturns(handlers.NewUnauthorizedError("no client certificate"))
+		})
+
+		It("responds with the error's status without handling the request", func() {
+			Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(responseRecorder.Header().Get("WWW-Authenticate")).To(BeEmpty())
+			Expect(fakeDiegoClient.TaskByGuidCallCount()).To(Equal(0))
+			Expect(logger).To(gbytes.Say("request-not-authorized.*no client certificate"))
+		})
+	})
+
+	Context("when the AuthorizationError carries a challenge", func() {
+		BeforeEach(func() {
+			fakeAuthorizer.AuthorizeReturns(&handlers.AuthorizationError{
+				StatusCode: http.StatusUnauthorized,
+				Message:    "no credentials",
+				Challenge:  `Basic realm="stager"`,
+			})
+		})
+
+		It("sends the challenge", func() {
+			Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(responseRecorder.Header().Get("WWW-Authenticate")).To(Equal(`Basic realm="stager"`))
+		})
+	})
+
+	Context("when the authorizer rejects the request with any other error", func() {
+		BeforeEach(func() {
+			fakeAuthorizer.AuthorizeReturns(errors.New("nope"))
+		})
+
+		It("responds with 403 Forbidden", func() {
+			Expect(responseRecorder.Code).To(Equal(http.StatusForbidden))
+			Expect(fakeDiegoClient.TaskByGuidCallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when a staging task downloads its docker credentials", func() {
+		var (
+			fakeOpener          *handler_fakes.FakeDockerCredentialsOpener
+			credentialsRecorder *httptest.ResponseRecorder
+		)
+
+		BeforeEach(func() {
+			fakeOpener = &handler_fakes.FakeDockerCredentialsOpener{}
+			fakeOpener.OpenDockerCredentialsReturns("secret", nil)
+			fakeAuthorizer.AuthorizeReturns(errors.New("nope"))
+
+			handler = handlers.New(
+				logger,
+				&fakes.FakeCcClient{},
+				nil,
+				&admission_fakes.FakeController{},
+				fakeDiegoClient,
+				map[string]backend.Backend{},
+				fakeAuthorizer,
+				fakeOpener,
+				fakeclock.NewFakeClock(time.Now()),
+			)
+		})
+
+		JustBeforeEach(func() {
+			req, err := http.NewRequest("GET", "/v1/staging/a-staging-guid/docker_credentials?credentials=sealed", nil)
+			Expect(err).NotTo(HaveOccurred())
+			credentialsRecorder = httptest.NewRecorder()
+			handler.ServeHTTP(credentialsRecorder, req)
+		})
+
+		It("leaves the request to the sealed credentials", func() {
+			Expect(credentialsRecorder.Code).To(Equal(http.StatusOK))
+			Expect(fakeOpener.OpenDockerCredentialsCallCount()).To(Equal(1))
+		})
+	})
+
+	Describe("Authorizers", func() {
+		It("allows every request when empty", func() {
+			Expect(handlers.Authorizers{}.Authorize(stager.StageRoute, &http.Request{})).To(Succeed())
+		})
+
+		It("rejects a request any of its authorizers rejects", func() {
+			rejecting := &handler_fakes.FakeAuthorizer{}
+			rejecting.AuthorizeReturns(errors.New("nope"))
+
+			authorizers := handlers.Authorizers{&handler_fakes.FakeAuthorizer{}, rejecting}
+			Expect(authorizers.Authorize(stager.StageRoute, &http.Request{})).To(MatchError("nope"))
+		})
+	})
+})
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/stager/backend"
+)
+
+//go:generate counterfeiter -o fakes/fake_docker_credentials_opener.go . DockerCredentialsOpener
+type DockerCredentialsOpener interface {
+	// OpenDockerCredentials returns the docker registry password sealed for
+	// the staging task, or an error if it cannot be opened or has expired.
+	OpenDockerCredentials(stagingGuid, sealed string, now time.Time) (string, error)
+}
+
+type dockerCredentialsHandler struct {
+	logger lager.Logger
+	opener DockerCredentialsOpener
+	clock  clock.Clock
+}
+
+// NewDockerCredentialsHandler creates a handler that serves staging tasks the
+// docker registry password sealed into their download URL. The sealed
+// credentials are the only authentication the route needs: the cell
+// downloading them has no other credentials for the stager.
+func NewDockerCredentialsHandler(logger lager.Logger, opener DockerCredentialsOpener, clock clock.Clock) http.Handler {
+	return &dockerCredentialsHandler{
+		logger: logger.Session("docker-credentials-handler"),
+		opener: opener,
+		clock:  clock,
+	}
+}
+
+func (handler *dockerCredentialsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	stagingGuid := req.FormValue(":staging_guid")
+	logger := handler.logger.Session("serve", lager.Data{"staging-guid": stagingGuid})
+
+	password, err := handler.opener.OpenDockerCredentials(stagingGuid, req.FormValue(backend.DockerCredentialsParam), handler.clock.Now())
+	if err != nil {
+		logger.Info("rejected-docker-credentials", lager.Data{"reason": err.Error()})
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	archive, err := backend.DockerCredentialsArchive(password)
+	if err != nil {
+		logger.Error("failed-to-archive-docker-credentials", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/gzip")
+	resp.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(archive)
+	logger.Info("served-docker-credentials")
+}
@@ -0,0 +1,124 @@
+package handlers_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/stager/handlers"
+	handler_fakes "code.cloudfoundry.org/stager/handlers/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DockerCredentialsHandler", func() {
+	var (
+		logger           *lagertest.TestLogger
+		fakeOpener       *handler_fakes.FakeDockerCredentialsOpener
+		fakeClock        *fakeclock.FakeClock
+		responseRecorder *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		fakeOpener = &handler_fakes.FakeDockerCredentialsOpener{}
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+		responseRecorder = httptest.NewRecorder()
+	})
+
+	JustBeforeEach(func() {
+		req, err := http.NewRequest("GET", "/v1/staging/a-staging-guid/docker_credentials?credentials=sealed&:staging_guid=a-staging-guid", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		handler := handlers.NewDockerCredentialsHandler(logger, fakeOpener, fakeClock)
+		handler.ServeHTTP(responseRecorder, req)
+	})
+
+	Context("when the credentials open", func() {
+		BeforeEach(func() {
+			fakeOpener.OpenDockerCredentialsReturns("secret", nil)
+		})
+
+		It("opens the credentials sealed for the staging task", func() {
+			Expect(fakeOpener.OpenDockerCredentialsCallCount()).To(Equal(1))
+			stagingGuid, sealed, now := fakeOpener.OpenDockerCredentialsArgsForCall(0)
+			Expect(stagingGuid).To(Equal("a-staging-guid"))
+			Expect(sealed).To(Equal("sealed"))
+			Expect(now).To(Equal(fakeClock.Now()))
+		})
+
+		It("serves the password file as a tgz that is not cached", func() {
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(responseRecorder.Header().Get("Content-Type")).To(Equal("application/gzip"))
+			Expect(responseRecorder.Header().Get("Cache-Control")).To(Equal("no-store"))
+
+			gzipReader, err := gzip.NewReader(responseRecorder.Body)
+			Expect(err).NotTo(HaveOccurred())
+			tarReader := tar.NewReader(gzipReader)
+			_, err = tarReader.Next()
+			Expect(err).NotTo(HaveOccurred())
+
+			contents, err := ioutil.ReadAll(tarReader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("secret"))
+		})
+
+		It("does not log the password", func() {
+			Expect(logger.Buffer().Contents()).NotTo(ContainSubstring("secret"))
+		})
+	})
+
+	Context("when the credentials do not open", func() {
+		BeforeEach(func() {
+			fakeOpener.OpenDockerCredentialsReturns("", errors.New("expired"))
+		})
+
+		It("responds with 403 Forbidden", func() {
+			Expect(responseRecorder.Code).To(Equal(http.StatusForbidden))
+			Expect(responseRecorder.Body.Len()).To(Equal(0))
+		})
+	})
+
+	Describe("NewDockerCredentialsRouter", func() {
+		var router http.Handler
+
+		BeforeEach(func() {
+			fakeOpener.OpenDockerCredentialsReturns("secret", nil)
+			router = handlers.NewDockerCredentialsRouter(logger, fakeOpener, fakeClock)
+		})
+
+		It("serves docker credentials", func() {
+			req, err := http.NewRequest("GET", "/v1/staging/a-staging-guid/docker_credentials?credentials=sealed", nil)
+			Expect(err).NotTo(HaveOccurred())
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			stagingGuid, _, _ := fakeOpener.OpenDockerCredentialsArgsForCall(fakeOpener.OpenDockerCredentialsCallCount() - 1)
+			Expect(stagingGuid).To(Equal("a-staging-guid"))
+		})
+
+		It("serves nothing else", func() {
+			for _, route := range []struct{ method, path string }{
+				{"PUT", "/v1/staging/a-staging-guid"},
+				{"GET", "/v1/staging/a-staging-guid"},
+				{"DELETE", "/v1/staging/a-staging-guid"},
+				{"POST", "/v1/staging/a-staging-guid/completed"},
+			} {
+				req, err := http.NewRequest(route.method, route.path, nil)
+				Expect(err).NotTo(HaveOccurred())
+				recorder := httptest.NewRecorder()
+				router.ServeHTTP(recorder, req)
+
+				Expect(recorder.Code).To(Equal(http.StatusNotFound), route.method+" "+route.path)
+			}
+		})
+	})
+})
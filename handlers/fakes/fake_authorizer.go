@@ -0,0 +1,56 @@
+// This file was generated by counterfeiter
+package fakes
+
+import (
+	"net/http"
+	"sync"
+
+	"code.cloudfoundry.org/stager/handlers"
+)
+
+type FakeAuthorizer struct {
+	AuthorizeStub        func(route string, request *http.Request) error
+	authorizeMutex       sync.RWMutex
+	authorizeArgsForCall []struct {
+		route   string
+		request *http.Request
+	}
+	authorizeReturns struct {
+		result1 error
+	}
+}
+
+func (fake *FakeAuthorizer) Authorize(route string, request *http.Request) error {
+	fake.authorizeMutex.Lock()
+	fake.authorizeArgsForCall = append(fake.authorizeArgsForCall, struct {
+		route   string
+		request *http.Request
+	}{route, request})
+	fake.authorizeMutex.Unlock()
+	if fake.AuthorizeStub != nil {
+		return fake.AuthorizeStub(route, request)
+	} else {
+		return fake.authorizeReturns.result1
+	}
+}
+
+func (fake *FakeAuthorizer) AuthorizeCallCount() int {
+	fake.authorizeMutex.RLock()
+	defer fake.authorizeMutex.RUnlock()
+	return len(fake.authorizeArgsForCall)
+}
+
+func (fake *FakeAuthorizer) AuthorizeArgsForCall(i int) (string, *http.Request) {
+	fake.authorizeMutex.RLock()
+	defer fake.authorizeMutex.RUnlock()
+	return fake.authorizeArgsForCall[i].route, fake.authorizeArgsForCall[i].request
+}
+
+func (fake *FakeAuthorizer) AuthorizeReturns(result1 error) {
+	fake.AuthorizeStub = nil
+	fake.authorizeReturns = struct {
+		result1 error
+	}{result1}
+}
+
+var _ handlers.Authorizer = new(FakeAuthorizer)
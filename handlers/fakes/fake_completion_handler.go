@@ -0,0 +1,88 @@
+// This file was generated by counterfeiter
+package fakes
+
+import (
+	"net/http"
+	"sync"
+
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/stager/handlers"
+)
+
+type FakeCompletionHandler struct {
+	StagingCompleteStub        func(resp http.ResponseWriter, req *http.Request)
+	stagingCompleteMutex       sync.RWMutex
+	stagingCompleteArgsForCall []struct {
+		resp http.ResponseWriter
+		req  *http.Request
+	}
+	CompleteTaskStub        func(logger lager.Logger, task *models.TaskCallbackResponse) int
+	completeTaskMutex       sync.RWMutex
+	completeTaskArgsForCall []struct {
+		logger lager.Logger
+		task   *models.TaskCallbackResponse
+	}
+	completeTaskReturns struct {
+		result1 int
+	}
+}
+
+func (fake *FakeCompletionHandler) StagingComplete(resp http.ResponseWriter, req *http.Request) {
+	fake.stagingCompleteMutex.Lock()
+	fake.stagingCompleteArgsForCall = append(fake.stagingCompleteArgsForCall, struct {
+		resp http.ResponseWriter
+		req  *http.Request
+	}{resp, req})
+	fake.stagingCompleteMutex.Unlock()
+	if fake.StagingCompleteStub != nil {
+		fake.StagingCompleteStub(resp, req)
+	}
+}
+
+func (fake *FakeCompletionHandler) StagingCompleteCallCount() int {
+	fake.stagingCompleteMutex.RLock()
+	defer fake.stagingCompleteMutex.RUnlock()
+	return len(fake.stagingCompleteArgsForCall)
+}
+
+func (fake *FakeCompletionHandler) StagingCompleteArgsForCall(i int) (http.ResponseWriter, *http.Request) {
+	fake.stagingCompleteMutex.RLock()
+	defer fake.stagingCompleteMutex.RUnlock()
+	return fake.stagingCompleteArgsForCall[i].resp, fake.stagingCompleteArgsForCall[i].req
+}
+
+func (fake *FakeCompletionHandler) CompleteTask(logger lager.Logger, task *models.TaskCallbackResponse) int {
+	fake.completeTaskMutex.Lock()
+	fake.completeTaskArgsForCall = append(fake.completeTaskArgsForCall, struct {
+		logger lager.Logger
+		task   *models.TaskCallbackResponse
+	}{logger, task})
+	fake.completeTaskMutex.Unlock()
+	if fake.CompleteTaskStub != nil {
+		return fake.CompleteTaskStub(logger, task)
+	} else {
+		return fake.completeTaskReturns.result1
+	}
+}
+
+func (fake *FakeCompletionHandler) CompleteTaskCallCount() int {
+	fake.completeTaskMutex.RLock()
+	defer fake.completeTaskMutex.RUnlock()
+	return len(fake.completeTaskArgsForCall)
+}
+
+func (fake *FakeCompletionHandler) CompleteTaskArgsForCall(i int) (lager.Logger, *models.TaskCallbackResponse) {
+	fake.completeTaskMutex.RLock()
+	defer fake.completeTaskMutex.RUnlock()
+	return fake.completeTaskArgsForCall[i].logger, fake.completeTaskArgsForCall[i].task
+}
+
+func (fake *FakeCompletionHandler) CompleteTaskReturns(result1 int) {
+	fake.CompleteTaskStub = nil
+	fake.completeTaskReturns = struct {
+		result1 int
+	}{result1}
+}
+
+var _ handlers.CompletionHandler = new(FakeCompletionHandler)
@@ -0,0 +1,60 @@
+// This file was generated by counterfeiter
+package fakes
+
+import (
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/stager/handlers"
+)
+
+type FakeDockerCredentialsOpener struct {
+	OpenDockerCredentialsStub        func(stagingGuid, sealed string, now time.Time) (string, error)
+	openDockerCredentialsMutex       sync.RWMutex
+	openDockerCredentialsArgsForCall []struct {
+		stagingGuid string
+		sealed      string
+		now         time.Time
+	}
+	openDockerCredentialsReturns struct {
+		result1 string
+		result2 error
+	}
+}
+
+func (fake *FakeDockerCredentialsOpener) OpenDockerCredentials(stagingGuid string, sealed string, now time.Time) (string, error) {
+	fake.openDockerCredentialsMutex.Lock()
+	fake.openDockerCredentialsArgsForCall = append(fake.openDockerCredentialsArgsForCall, struct {
+		stagingGuid string
+		sealed      string
+		now         time.Time
+	}{stagingGuid, sealed, now})
+	fake.openDockerCredentialsMutex.Unlock()
+	if fake.OpenDockerCredentialsStub != nil {
+		return fake.OpenDockerCredentialsStub(stagingGuid, sealed, now)
+	} else {
+		return fake.openDockerCredentialsReturns.result1, fake.openDockerCredentialsReturns.result2
+	}
+}
+
+func (fake *FakeDockerCredentialsOpener) OpenDockerCredentialsCallCount() int {
+	fake.openDockerCredentialsMutex.RLock()
+	defer fake.openDockerCredentialsMutex.RUnlock()
+	return len(fake.openDockerCredentialsArgsForCall)
+}
+
+func (fake *FakeDockerCredentialsOpener) OpenDockerCredentialsArgsForCall(i int) (string, string, time.Time) {
+	fake.openDockerCredentialsMutex.RLock()
+	defer fake.openDockerCredentialsMutex.RUnlock()
+	return fake.openDockerCredentialsArgsForCall[i].stagingGuid, fake.openDockerCredentialsArgsForCall[i].sealed, fake.openDockerCredentialsArgsForCall[i].now
+}
+
+func (fake *FakeDockerCredentialsOpener) OpenDockerCredentialsReturns(result1 string, result2 error) {
+	fake.OpenDockerCredentialsStub = nil
+	fake.openDockerCredentialsReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+var _ handlers.DockerCredentialsOpener = new(FakeDockerCredentialsOpener)
@@ -7,20 +7,33 @@ import (
 	"code.cloudfoundry.org/clock"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/stager"
+	"code.cloudfoundry.org/stager/admission"
 	"code.cloudfoundry.org/stager/backend"
 	"code.cloudfoundry.org/stager/cc_client"
+	"code.cloudfoundry.org/stager/completion_queue"
 	"github.com/tedsuo/rata"
 )
 
-func New(logger lager.Logger, ccClient cc_client.CcClient, bbsClient bbs.Client, backends map[string]backend.Backend, clock clock.Clock) http.Handler {
+func New(logger lager.Logger, ccClient cc_client.CcClient, completionQueue completion_queue.CompletionQueue, admissionController admission.Controller, bbsClient bbs.Client, backends map[string]backend.Backend, authorizer Authorizer, credentialsOpener DockerCredentialsOpener, clock clock.Clock) http.Handler {
 
-	stagingHandler := NewStagingHandler(logger, backends, bbsClient)
-	stagingCompletedHandler := NewStagingCompletionHandler(logger, ccClient, backends, clock)
+	stagingHandler := NewStagingHandler(logger, backends, bbsClient, clock, admissionController)
+	stagingCompletedHandler := NewStagingCompletionHandler(logger, ccClient, completionQueue, admissionController, backends, clock)
 
 	actions := rata.Handlers{
-		stager.StageRoute:            http.HandlerFunc(stagingHandler.Stage),
-		stager.StopStagingRoute:      http.HandlerFunc(stagingHandler.StopStaging),
-		stager.StagingCompletedRoute: http.HandlerFunc(stagingCompletedHandler.StagingComplete),
+		stager.StageRoute:             http.HandlerFunc(stagingHandler.Stage),
+		stager.StopStagingRoute:       http.HandlerFunc(stagingHandler.StopStaging),
+		stager.StagingCompletedRoute:  http.HandlerFunc(stagingCompletedHandler.StagingComplete),
+		stager.StagingStatusRoute:     http.HandlerFunc(stagingHandler.StagingStatus),
+		stager.DockerCredentialsRoute: NewDockerCredentialsHandler(logger, credentialsOpener, clock),
+	}
+
+	for route, action := range actions {
+		if route == stager.DockerCredentialsRoute {
+			// cells have no credentials for the stager; the sealed credentials
+			// in the download URL authenticate the request
+			continue
+		}
+		actions[route] = authorize(logger, authorizer, route, action)
 	}
 
 	handler, err := rata.NewRouter(stager.Routes, actions)
@@ -30,3 +43,20 @@ func New(logger lager.Logger, ccClient cc_client.CcClient, bbsClient bbs.Client,
 
 	return handler
 }
+
+// NewDockerCredentialsRouter creates a handler that serves staging tasks
+// their docker credentials and nothing else, for a listener that does not
+// ask clients for certificates.
+func NewDockerCredentialsRouter(logger lager.Logger, credentialsOpener DockerCredentialsOpener, clock clock.Clock) http.Handler {
+	route, _ := stager.Routes.FindRouteByName(stager.DockerCredentialsRoute)
+	actions := rata.Handlers{
+		stager.DockerCredentialsRoute: NewDockerCredentialsHandler(logger, credentialsOpener, clock),
+	}
+
+	handler, err := rata.NewRouter(rata.Routes{route}, actions)
+	if err != nil {
+		panic("unable to create router: " + err.Error())
+	}
+
+	return handler
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"time"
@@ -10,8 +11,13 @@ import (
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
 	"code.cloudfoundry.org/runtimeschema/metric"
+	"code.cloudfoundry.org/stager/admission"
 	"code.cloudfoundry.org/stager/backend"
 	"code.cloudfoundry.org/stager/cc_client"
+	"code.cloudfoundry.org/stager/completion_queue"
+	"code.cloudfoundry.org/stager/prometheus_metrics"
+	"code.cloudfoundry.org/stager/tracing"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -22,23 +28,32 @@ const (
 	stagingFailureDuration = metric.Duration("StagingRequestFailedDuration")
 )
 
+//go:generate counterfeiter -o fakes/fake_completion_handler.go . CompletionHandler
 type CompletionHandler interface {
 	StagingComplete(resp http.ResponseWriter, req *http.Request)
+	CompleteTask(logger lager.Logger, task *models.TaskCallbackResponse) int
 }
 
 type completionHandler struct {
-	ccClient cc_client.CcClient
-	backends map[string]backend.Backend
-	logger   lager.Logger
-	clock    clock.Clock
+	ccClient        cc_client.CcClient
+	completionQueue completion_queue.CompletionQueue
+	admission       admission.Controller
+	backends        map[string]backend.Backend
+	logger          lager.Logger
+	clock           clock.Clock
 }
 
-func NewStagingCompletionHandler(logger lager.Logger, ccClient cc_client.CcClient, backends map[string]backend.Backend, clock clock.Clock) CompletionHandler {
+// NewStagingCompletionHandler creates a handler that forwards staging results
+// to CC. completionQueue may be nil, in which case a failed delivery is
+// reported back to the BBS instead of being retried by the stager.
+func NewStagingCompletionHandler(logger lager.Logger, ccClient cc_client.CcClient, completionQueue completion_queue.CompletionQueue, admissionController admission.Controller, backends map[string]backend.Backend, clock clock.Clock) CompletionHandler {
 	return &completionHandler{
-		ccClient: ccClient,
-		backends: backends,
-		logger:   logger.Session("completion-handler"),
-		clock:    clock,
+		ccClient:        ccClient,
+		completionQueue: completionQueue,
+		admission:       admissionController,
+		backends:        backends,
+		logger:          logger.Session("completion-handler"),
+		clock:           clock,
 	}
 }
 
@@ -62,66 +77,112 @@ func (handler *completionHandler) StagingComplete(res http.ResponseWriter, req *
 		return
 	}
 
-	var annotation cc_messages.StagingTaskAnnotation
-	err = json.Unmarshal([]byte(task.Annotation), &annotation)
+	res.WriteHeader(handler.CompleteTask(logger, task))
+}
+
+// CompleteTask delivers the staging result of a completed task to CC and
+// returns the HTTP status code to report to whoever handed over the task.
+func (handler *completionHandler) CompleteTask(logger lager.Logger, task *models.TaskCallbackResponse) int {
+	taskGuid := task.TaskGuid
+
+	// The task no longer occupies a cell, whether or not CC hears about it.
+	handler.admission.Release(taskGuid)
+
+	var annotation backend.StagingTaskAnnotation
+	err := json.Unmarshal([]byte(task.Annotation), &annotation)
 	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
 		logger.Error("parsing-annotation-failed", err)
-		return
+		return http.StatusBadRequest
 	}
 
+	ctx, span := startCompletionSpan(taskGuid, annotation)
+	defer span.End()
+
 	backend := handler.backends[annotation.Lifecycle]
 	if backend == nil {
-		res.WriteHeader(http.StatusNotFound)
 		logger.Error("get-staging-response-failed-backend-not-found", err)
-		return
+		return http.StatusNotFound
 	}
 
 	response, err := backend.BuildStagingResponse(task)
 	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
 		logger.Error("get-staging-response-failed", err)
-		return
+		return http.StatusBadRequest
 	}
 
 	responseJson, err := json.Marshal(response)
 	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
 		logger.Error("get-staging-response-failed", err)
-		return
-	}
-
-	if responseJson == nil {
-		res.WriteHeader(http.StatusNotFound)
-		res.Write([]byte("Unknown task domain"))
-		return
+		return http.StatusBadRequest
 	}
 
 	logger.Info("posting-staging-complete", lager.Data{
 		"payload": responseJson,
 	})
 
+	_, ccSpan := tracing.Tracer().Start(ctx, "cc.staging-complete")
 	err = handler.ccClient.StagingComplete(taskGuid, annotation.CompletionCallback, responseJson, logger)
+	if err != nil {
+		tracing.RecordError(ccSpan, err)
+	}
+	ccSpan.End()
+
 	if err != nil {
 		logger.Error("cc-staging-complete-failed", err)
+
+		if handler.completionQueue != nil && completion_queue.IsRetryable(err) {
+			enqueueErr := handler.completionQueue.Enqueue(taskGuid, annotation.CompletionCallback, responseJson)
+			if enqueueErr == nil {
+				handler.reportMetrics(task, annotation, response)
+				logger.Info("queued-staging-complete")
+				return http.StatusOK
+			}
+			logger.Error("queue-staging-complete-failed", enqueueErr)
+		}
+
 		if responseErr, ok := err.(*cc_client.BadResponseError); ok {
-			res.WriteHeader(responseErr.StatusCode)
-		} else {
-			res.WriteHeader(http.StatusServiceUnavailable)
+			return responseErr.StatusCode
 		}
-		return
+		return http.StatusServiceUnavailable
 	}
 
-	handler.reportMetrics(task)
+	handler.reportMetrics(task, annotation, response)
 
 	logger.Info("posted-staging-complete")
-	res.WriteHeader(http.StatusOK)
+	return http.StatusOK
+}
+
+// startCompletionSpan starts a new trace for the completion, linked to the
+// trace of the staging request that desired the task.
+func startCompletionSpan(taskGuid string, annotation backend.StagingTaskAnnotation) (context.Context, trace.Span) {
+	options := []trace.SpanStartOption{
+		trace.WithAttributes(
+			tracing.StagingGuidKey.String(taskGuid),
+			tracing.LifecycleKey.String(annotation.Lifecycle),
+		),
+	}
+	if link, ok := tracing.LinkFromCarrier(annotation.TraceContext); ok {
+		options = append(options, trace.WithLinks(link))
+	}
+
+	return tracing.Tracer().Start(context.Background(), "complete-staging", options...)
 }
 
-func (handler *completionHandler) reportMetrics(task *models.TaskCallbackResponse) {
+func (handler *completionHandler) reportMetrics(task *models.TaskCallbackResponse, annotation backend.StagingTaskAnnotation, response cc_messages.StagingResponseForCC) {
 	duration := handler.clock.Now().Sub(time.Unix(0, task.CreatedAt))
+
+	outcome, errorId := prometheus_metrics.OutcomeSucceeded, ""
+	if task.Failed {
+		outcome = prometheus_metrics.OutcomeFailed
+		if response.Error != nil {
+			errorId = response.Error.Id
+		}
+	}
+	prometheus_metrics.ObserveStagingDuration(annotation.Lifecycle, annotation.Stack, outcome, errorId, duration)
+
 	if task.Failed {
 		stagingFailureCounter.Increment()
+		prometheus_metrics.StagingRequestsFailed.Inc()
 		err := stagingFailureDuration.Send(duration)
 		if err != nil {
 			handler.logger.Error("failed-to-send-staging-failed-duration-metric", err)
@@ -132,5 +193,6 @@ func (handler *completionHandler) reportMetrics(task *models.TaskCallbackRespons
 			handler.logger.Error("failed-to-send-staging-success-duration-metric", err)
 		}
 		stagingSuccessCounter.Increment()
+		prometheus_metrics.StagingRequestsSucceeded.Inc()
 	}
 }
@@ -15,10 +15,12 @@ import (
 	"code.cloudfoundry.org/clock/fakeclock"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	admission_fakes "code.cloudfoundry.org/stager/admission/fakes"
 	"code.cloudfoundry.org/stager/backend"
 	"code.cloudfoundry.org/stager/backend/fake_backend"
 	"code.cloudfoundry.org/stager/cc_client"
 	"code.cloudfoundry.org/stager/cc_client/fakes"
+	queue_fakes "code.cloudfoundry.org/stager/completion_queue/fakes"
 	"code.cloudfoundry.org/stager/handlers"
 	"github.com/cloudfoundry/dropsonde/metric_sender/fake"
 	"github.com/cloudfoundry/dropsonde/metrics"
@@ -36,6 +38,7 @@ var _ = Describe("StagingCompletedHandler", func() {
 		backendResponse     cc_messages.StagingResponseForCC
 		backendError        error
 		fakeClock           *fakeclock.FakeClock
+		fakeAdmission       *admission_fakes.FakeController
 		metricSender        *fake.FakeMetricSender
 		stagingDurationNano time.Duration
 
@@ -56,9 +59,10 @@ var _ = Describe("StagingCompletedHandler", func() {
 		backendError = nil
 
 		fakeClock = fakeclock.NewFakeClock(time.Now())
+		fakeAdmission = &admission_fakes.FakeController{}
 
 		responseRecorder = httptest.NewRecorder()
-		handler = handlers.NewStagingCompletionHandler(logger, fakeCCClient, map[string]backend.Backend{"fake": fakeBackend}, fakeClock)
+		handler = handlers.NewStagingCompletionHandler(logger, fakeCCClient, nil, fakeAdmission, map[string]backend.Backend{"fake": fakeBackend}, fakeClock)
 	})
 
 	JustBeforeEach(func() {
@@ -113,6 +117,11 @@ var _ = Describe("StagingCompletedHandler", func() {
 			Expect(fakeBackend.BuildStagingResponseArgsForCall(0)).To(Equal(taskResponse))
 		})
 
+		It("releases the staging task from admission accounting", func() {
+			Expect(fakeAdmission.ReleaseCallCount()).To(Equal(1))
+			Expect(fakeAdmission.ReleaseArgsForCall(0)).To(Equal("the-task-guid"))
+		})
+
 		Context("when the guid in the url does not match the task guid", func() {
 			BeforeEach(func() {
 				taskJSON, err := json.Marshal(taskResponse)
@@ -250,6 +259,58 @@ var _ = Describe("StagingCompletedHandler", func() {
 				It("does not update the staging duration", func() {
 					Expect(metricSender.GetValue("StagingRequestSucceededDuration")).To(Equal(fake.Metric{}))
 				})
+
+				Context("when a completion queue is configured", func() {
+					var fakeQueue *queue_fakes.FakeCompletionQueue
+
+					BeforeEach(func() {
+						fakeQueue = &queue_fakes.FakeCompletionQueue{}
+						handler = handlers.NewStagingCompletionHandler(logger, fakeCCClient, fakeQueue, fakeAdmission, map[string]backend.Backend{"fake": fakeBackend}, fakeClock)
+					})
+
+					It("queues the response for redelivery", func() {
+						Expect(fakeQueue.EnqueueCallCount()).To(Equal(1))
+						guid, _, payload := fakeQueue.EnqueueArgsForCall(0)
+						Expect(guid).To(Equal("the-task-guid"))
+						Expect(payload).To(Equal(backendResponseJson))
+					})
+
+					It("responds with a 200", func() {
+						Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+					})
+
+					It("increments the staging success counter", func() {
+						Expect(metricSender.GetCounter("StagingRequestsSucceeded")).To(BeEquivalentTo(1))
+					})
+
+					Context("when queueing fails", func() {
+						BeforeEach(func() {
+							fakeQueue.EnqueueReturns(errors.New("disk full"))
+						})
+
+						It("responds with a 503 error", func() {
+							Expect(responseRecorder.Code).To(Equal(503))
+						})
+					})
+				})
+			})
+
+			Context("when CC rejects the response and a completion queue is configured", func() {
+				var fakeQueue *queue_fakes.FakeCompletionQueue
+
+				BeforeEach(func() {
+					fakeQueue = &queue_fakes.FakeCompletionQueue{}
+					handler = handlers.NewStagingCompletionHandler(logger, fakeCCClient, fakeQueue, fakeAdmission, map[string]backend.Backend{"fake": fakeBackend}, fakeClock)
+					fakeCCClient.StagingCompleteReturns(&cc_client.BadResponseError{StatusCode: 422})
+				})
+
+				It("does not queue the response", func() {
+					Expect(fakeQueue.EnqueueCallCount()).To(Equal(0))
+				})
+
+				It("responds with the status code that the CC returned", func() {
+					Expect(responseRecorder.Code).To(Equal(422))
+				})
 			})
 		})
 	})
@@ -1,16 +1,26 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"code.cloudfoundry.org/bbs"
 	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/clock"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
 	"code.cloudfoundry.org/runtimeschema/metric"
+	"code.cloudfoundry.org/stager/admission"
 	"code.cloudfoundry.org/stager/backend"
+	"code.cloudfoundry.org/stager/prometheus_metrics"
+	"code.cloudfoundry.org/stager/tracing"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -21,18 +31,32 @@ const (
 type StagingHandler interface {
 	Stage(resp http.ResponseWriter, req *http.Request)
 	StopStaging(resp http.ResponseWriter, req *http.Request)
+	StagingStatus(resp http.ResponseWriter, req *http.Request)
+}
+
+type StagingStatusResponse struct {
+	StagingGuid    string                    `json:"staging_guid"`
+	Lifecycle      string                    `json:"lifecycle"`
+	State          string                    `json:"state"`
+	CellId         string                    `json:"cell_id,omitempty"`
+	FailureReason  *cc_messages.StagingError `json:"failure_reason,omitempty"`
+	ElapsedSeconds float64                   `json:"elapsed_seconds"`
 }
 
 type stagingHandler struct {
 	logger      lager.Logger
 	backends    map[string]backend.Backend
 	diegoClient bbs.Client
+	clock       clock.Clock
+	admission   admission.Controller
 }
 
 func NewStagingHandler(
 	logger lager.Logger,
 	backends map[string]backend.Backend,
 	bbsClient bbs.Client,
+	clock clock.Clock,
+	admissionController admission.Controller,
 ) StagingHandler {
 	logger = logger.Session("staging-handler")
 
@@ -40,6 +64,8 @@ func NewStagingHandler(
 		logger:      logger,
 		backends:    backends,
 		diegoClient: bbsClient,
+		clock:       clock,
+		admission:   admissionController,
 	}
 }
 
@@ -47,6 +73,9 @@ func (handler *stagingHandler) Stage(resp http.ResponseWriter, req *http.Request
 	stagingGuid := req.FormValue(":staging_guid")
 	logger := handler.logger.Session("staging-request", lager.Data{"staging-guid": stagingGuid})
 
+	ctx, span := tracing.Tracer().Start(tracing.FromRequest(req), "stage", trace.WithAttributes(tracing.StagingGuidKey.String(stagingGuid)))
+	defer span.End()
+
 	requestBody, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		logger.Error("read-body-failed", err)
@@ -75,37 +104,122 @@ func (handler *stagingHandler) Stage(resp http.ResponseWriter, req *http.Request
 		return
 	}
 
+	span.SetAttributes(tracing.LifecycleKey.String(stagingRequest.Lifecycle))
+
 	StagingStartRequestsReceivedCounter.Increment()
+	prometheus_metrics.StagingStartRequestsReceived.Inc()
+
+	err = handler.admission.Admit(stagingGuid, stagingRequest.AppId, stagingRequest.IsolationSegment)
+	if err != nil {
+		logger.Error("staging-limit-exceeded", err)
+		handler.doLimitExceededResponse(resp, err)
+		return
+	}
 
+	_, recipeSpan := tracing.Tracer().Start(ctx, "build-recipe")
 	taskDef, guid, domain, err := backend.BuildRecipe(stagingGuid, stagingRequest)
+	recipeSpan.End()
 	if err != nil {
-		logger.Error("recipe-building-failed", err, lager.Data{"staging-request": stagingRequest})
-		handler.doErrorResponse(resp, err.Error())
+		logger.Error("recipe-building-failed", err, lager.Data{"staging-request": redactCredentials(stagingRequest)})
+		tracing.RecordError(span, err)
+		handler.admission.Release(stagingGuid)
+		handler.doErrorResponse(resp, err)
 		return
 	}
 
-	logger.Info("desiring-task", lager.Data{
-		"task_guid":    guid,
-		"callback_url": taskDef.CompletionCallbackUrl,
-	})
+	// the callback URL is not logged: it carries the task's signature
+	logger.Info("desiring-task", lager.Data{"task_guid": guid})
+
+	annotateTraceContext(ctx, taskDef)
 
+	_, desireSpan := tracing.Tracer().Start(ctx, "bbs.desire-task")
 	err = handler.diegoClient.DesireTask(logger, guid, domain, taskDef)
+	desireSpan.End()
 	if models.ErrResourceExists.Equal(err) {
 		err = nil
+
+		conflicts := handler.conflictingFields(logger, guid, taskDef)
+		if len(conflicts) > 0 {
+			logger.Info("conflicting-staging-request", lager.Data{"fields": conflicts})
+			handler.doConflictResponse(resp, conflicts)
+			return
+		}
 	}
 
 	if err != nil {
-		logger.Error("staging-failed", err, lager.Data{"staging-request": stagingRequest})
-		handler.doErrorResponse(resp, err.Error())
+		logger.Error("staging-failed", err, lager.Data{"staging-request": redactCredentials(stagingRequest)})
+		tracing.RecordError(span, err)
+		handler.admission.Release(stagingGuid)
+		handler.doErrorResponse(resp, err)
 		return
 	}
 
 	resp.WriteHeader(http.StatusAccepted)
 }
 
-func (handler *stagingHandler) doErrorResponse(resp http.ResponseWriter, message string) {
+// annotateTraceContext records the trace of the staging request in the task
+// annotation so that its completion can be linked back to it.
+func annotateTraceContext(ctx context.Context, taskDef *models.TaskDefinition) {
+	taskDef.Annotation = backend.WithTraceContext(taskDef.Annotation, tracing.Carrier(ctx))
+}
+
+// redactCredentials keeps registry credentials out of the logs.
+func redactCredentials(request cc_messages.StagingRequestFromCC) cc_messages.StagingRequestFromCC {
+	return backend.RedactCredentials(request)
+}
+
+// conflictingFields compares the request that desired an existing task with
+// the one just received. Tasks that cannot be fetched or carry no fingerprint
+// are assumed to match.
+func (handler *stagingHandler) conflictingFields(logger lager.Logger, taskGuid string, taskDef *models.TaskDefinition) []string {
+	desired := requestFingerprint(taskDef.Annotation)
+	if desired == nil {
+		return nil
+	}
+
+	existingTask, err := handler.diegoClient.TaskByGuid(logger, taskGuid)
+	if err != nil {
+		logger.Error("failed-to-fetch-existing-task", err)
+		return nil
+	}
+
+	if existingTask.TaskDefinition == nil {
+		return nil
+	}
+
+	existing := requestFingerprint(existingTask.Annotation)
+	if existing == nil || existing.Digest == desired.Digest {
+		return nil
+	}
+
+	return existing.Diff(desired)
+}
+
+func requestFingerprint(annotationJson string) *backend.RequestFingerprint {
+	var annotation backend.StagingTaskAnnotation
+	err := json.Unmarshal([]byte(annotationJson), &annotation)
+	if err != nil {
+		return nil
+	}
+	return annotation.RequestFingerprint
+}
+
+func (handler *stagingHandler) doConflictResponse(resp http.ResponseWriter, conflicts []string) {
+	response := cc_messages.StagingResponseForCC{
+		Error: &cc_messages.StagingError{
+			Id:      backend.STAGING_REQUEST_CONFLICT,
+			Message: fmt.Sprintf("staging guid is already in use by a different request; differing fields: %s", strings.Join(conflicts, ", ")),
+		},
+	}
+	responseJson, _ := json.Marshal(response)
+
+	resp.WriteHeader(http.StatusConflict)
+	resp.Write(responseJson)
+}
+
+func (handler *stagingHandler) doErrorResponse(resp http.ResponseWriter, err error) {
 	response := cc_messages.StagingResponseForCC{
-		Error: backend.SanitizeErrorMessage(message),
+		Error: backend.AsStagingError(err).ToCC(),
 	}
 	responseJson, _ := json.Marshal(response)
 
@@ -113,6 +227,20 @@ func (handler *stagingHandler) doErrorResponse(resp http.ResponseWriter, message
 	resp.Write(responseJson)
 }
 
+func (handler *stagingHandler) doLimitExceededResponse(resp http.ResponseWriter, err error) {
+	response := cc_messages.StagingResponseForCC{
+		Error: &cc_messages.StagingError{
+			Id:      admission.STAGING_LIMIT_EXCEEDED,
+			Message: err.Error(),
+		},
+	}
+	responseJson, _ := json.Marshal(response)
+
+	resp.Header().Set("Retry-After", strconv.Itoa(handler.admission.RetryAfterSeconds()))
+	resp.WriteHeader(http.StatusTooManyRequests)
+	resp.Write(responseJson)
+}
+
 func (handler *stagingHandler) StopStaging(resp http.ResponseWriter, req *http.Request) {
 	taskGuid := req.FormValue(":staging_guid")
 	logger := handler.logger.Session("stop-staging-request", lager.Data{"staging-guid": taskGuid})
@@ -139,6 +267,7 @@ func (handler *stagingHandler) StopStaging(resp http.ResponseWriter, req *http.R
 
 	resp.WriteHeader(http.StatusAccepted)
 	StagingStopRequestsReceivedCounter.Increment()
+	prometheus_metrics.StagingStopRequestsReceived.Inc()
 
 	logger.Info("cancelling", lager.Data{"task_guid": taskGuid})
 
@@ -147,3 +276,86 @@ func (handler *stagingHandler) StopStaging(resp http.ResponseWriter, req *http.R
 		logger.Error("stop-staging-failed", err)
 	}
 }
+
+func (handler *stagingHandler) StagingStatus(resp http.ResponseWriter, req *http.Request) {
+	taskGuid := req.FormValue(":staging_guid")
+	logger := handler.logger.Session("staging-status-request", lager.Data{"staging-guid": taskGuid})
+
+	task, err := handler.diegoClient.TaskByGuid(logger, taskGuid)
+	if err != nil {
+		if models.ErrResourceNotFound.Equal(err) {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		logger.Error("failed-to-get-task", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if task.Domain != cc_messages.StagingTaskDomain {
+		logger.Info("not-a-staging-task", lager.Data{"domain": task.Domain})
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var annotation cc_messages.StagingTaskAnnotation
+	err = json.Unmarshal([]byte(task.Annotation), &annotation)
+	if err != nil {
+		logger.Error("failed-to-unmarshal-task-annotation", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	backend, ok := handler.backends[annotation.Lifecycle]
+	if !ok {
+		logger.Error("backend-not-found", nil, lager.Data{"backend": annotation.Lifecycle})
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	status := StagingStatusResponse{
+		StagingGuid:    task.TaskGuid,
+		Lifecycle:      annotation.Lifecycle,
+		State:          task.State.String(),
+		CellId:         task.CellId,
+		ElapsedSeconds: handler.elapsed(task).Seconds(),
+	}
+
+	if task.Failed {
+		stagingResponse, err := backend.BuildStagingResponse(&models.TaskCallbackResponse{
+			TaskGuid:      task.TaskGuid,
+			Failed:        task.Failed,
+			FailureReason: task.FailureReason,
+			Annotation:    task.Annotation,
+			CreatedAt:     task.CreatedAt,
+		})
+		if err != nil {
+			logger.Error("failed-to-sanitize-failure-reason", err)
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		status.FailureReason = stagingResponse.Error
+	}
+
+	responseJson, err := json.Marshal(status)
+	if err != nil {
+		logger.Error("failed-to-marshal-status", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(responseJson)
+}
+
+func (handler *stagingHandler) elapsed(task *models.Task) time.Duration {
+	createdAt := time.Unix(0, task.CreatedAt)
+
+	if task.FirstCompletedAt > 0 {
+		return time.Unix(0, task.FirstCompletedAt).Sub(createdAt)
+	}
+
+	return handler.clock.Now().Sub(createdAt)
+}
@@ -7,12 +7,16 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"time"
 
 	"code.cloudfoundry.org/bbs/fake_bbs"
 	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/clock/fakeclock"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagertest"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/admission"
+	admission_fakes "code.cloudfoundry.org/stager/admission/fakes"
 	"code.cloudfoundry.org/stager/backend"
 	"code.cloudfoundry.org/stager/backend/fake_backend"
 	"code.cloudfoundry.org/stager/handlers"
@@ -32,6 +36,8 @@ var _ = Describe("StagingHandler", func() {
 		logger          lager.Logger
 		fakeDiegoClient *fake_bbs.FakeClient
 		fakeBackend     *fake_backend.FakeBackend
+		fakeClock       *fakeclock.FakeClock
+		fakeAdmission   *admission_fakes.FakeController
 
 		responseRecorder *httptest.ResponseRecorder
 		handler          handlers.StagingHandler
@@ -47,20 +53,31 @@ var _ = Describe("StagingHandler", func() {
 		fakeBackend.BuildRecipeReturns(&models.TaskDefinition{}, "", "", nil)
 
 		fakeDiegoClient = &fake_bbs.FakeClient{}
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+		fakeAdmission = &admission_fakes.FakeController{}
 
 		responseRecorder = httptest.NewRecorder()
-		handler = handlers.NewStagingHandler(logger, map[string]backend.Backend{"fake-backend": fakeBackend}, fakeDiegoClient)
+		handler = handlers.NewStagingHandler(logger, map[string]backend.Backend{"fake-backend": fakeBackend}, fakeDiegoClient, fakeClock, fakeAdmission)
 	})
 
 	Describe("Stage", func() {
 		var (
 			stagingRequestJson []byte
+			traceparent        string
 		)
 
+		BeforeEach(func() {
+			traceparent = ""
+		})
+
 		JustBeforeEach(func() {
 			req, err := http.NewRequest("PUT", "/v1/staging/a-staging-guid", bytes.NewReader(stagingRequestJson))
 			Expect(err).NotTo(HaveOccurred())
 
+			if traceparent != "" {
+				req.Header.Set("traceparent", traceparent)
+			}
+
 			req.Form = url.Values{":staging_guid": {"a-staging-guid"}}
 
 			handler.Stage(responseRecorder, req)
@@ -71,8 +88,9 @@ var _ = Describe("StagingHandler", func() {
 
 			BeforeEach(func() {
 				stagingRequest = cc_messages.StagingRequestFromCC{
-					AppId:     "myapp",
-					Lifecycle: "fake-backend",
+					AppId:            "myapp",
+					Lifecycle:        "fake-backend",
+					IsolationSegment: "my-segment",
 				}
 
 				var err error
@@ -96,6 +114,40 @@ var _ = Describe("StagingHandler", func() {
 				Expect(request).To(Equal(stagingRequest))
 			})
 
+			It("admits the staging task", func() {
+				Expect(fakeAdmission.AdmitCallCount()).To(Equal(1))
+				guid, appId, isolationSegment := fakeAdmission.AdmitArgsForCall(0)
+				Expect(guid).To(Equal("a-staging-guid"))
+				Expect(appId).To(Equal("myapp"))
+				Expect(isolationSegment).To(Equal("my-segment"))
+				Expect(fakeAdmission.ReleaseCallCount()).To(Equal(0))
+			})
+
+			Context("when a staging limit is exceeded", func() {
+				BeforeEach(func() {
+					fakeAdmission.AdmitReturns(&admission.LimitExceededError{Scope: "app", Limit: 1})
+					fakeAdmission.RetryAfterSecondsReturns(42)
+				})
+
+				It("returns Too Many Requests with a Retry-After", func() {
+					Expect(responseRecorder.Code).To(Equal(http.StatusTooManyRequests))
+					Expect(responseRecorder.Header().Get("Retry-After")).To(Equal("42"))
+
+					var response cc_messages.StagingResponseForCC
+					err := json.NewDecoder(responseRecorder.Body).Decode(&response)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(response.Error).To(Equal(&cc_messages.StagingError{
+						Id:      admission.STAGING_LIMIT_EXCEEDED,
+						Message: "too many staging tasks in flight: app limit of 1 reached",
+					}))
+				})
+
+				It("does not desire a task", func() {
+					Expect(fakeBackend.BuildRecipeCallCount()).To(Equal(0))
+					Expect(fakeDiegoClient.DesireTaskCallCount()).To(Equal(0))
+				})
+			})
+
 			Context("when the recipe was built successfully", func() {
 				var fakeTaskDef = &models.TaskDefinition{Annotation: "test annotation"}
 				BeforeEach(func() {
@@ -108,6 +160,25 @@ var _ = Describe("StagingHandler", func() {
 					Expect(resultingTaskDef).To(Equal(fakeTaskDef))
 				})
 
+				Context("when CC sends a W3C trace context", func() {
+					BeforeEach(func() {
+						traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+						fakeBackend.BuildRecipeReturns(&models.TaskDefinition{Annotation: `{"lifecycle":"fake-backend"}`}, "a-guid", "a-domain", nil)
+					})
+
+					It("carries the trace context in the task annotation", func() {
+						Expect(fakeDiegoClient.DesireTaskCallCount()).To(Equal(1))
+						_, _, _, resultingTaskDef := fakeDiegoClient.DesireTaskArgsForCall(0)
+
+						var annotation backend.StagingTaskAnnotation
+						err := json.Unmarshal([]byte(resultingTaskDef.Annotation), &annotation)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(annotation.Lifecycle).To(Equal("fake-backend"))
+						Expect(annotation.TraceContext).To(HaveKey("traceparent"))
+						Expect(annotation.TraceContext["traceparent"]).To(ContainSubstring("4bf92f3577b34da6a3ce929d0e0e4736"))
+					})
+				})
+
 				Context("when the task has already been created", func() {
 					BeforeEach(func() {
 						fakeDiegoClient.DesireTaskReturns(models.NewError(models.Error_ResourceExists, "ok, this task already exists"))
@@ -116,6 +187,63 @@ var _ = Describe("StagingHandler", func() {
 					It("does not log a failure", func() {
 						Expect(logger).NotTo(gbytes.Say("staging-failed"))
 					})
+
+					Context("when both tasks carry a request fingerprint", func() {
+						var existingRequest cc_messages.StagingRequestFromCC
+
+						annotationFor := func(request cc_messages.StagingRequestFromCC) string {
+							fingerprint, err := backend.NewRequestFingerprint(request)
+							Expect(err).NotTo(HaveOccurred())
+
+							annotationJson, err := json.Marshal(backend.StagingTaskAnnotation{RequestFingerprint: fingerprint})
+							Expect(err).NotTo(HaveOccurred())
+							return string(annotationJson)
+						}
+
+						BeforeEach(func() {
+							existingRequest = stagingRequest
+							fakeBackend.BuildRecipeStub = func(string, cc_messages.StagingRequestFromCC) (*models.TaskDefinition, string, string, error) {
+								return &models.TaskDefinition{Annotation: annotationFor(stagingRequest)}, "a-guid", "a-domain", nil
+							}
+							fakeDiegoClient.TaskByGuidStub = func(lager.Logger, string) (*models.Task, error) {
+								return &models.Task{
+									TaskGuid:       "a-guid",
+									TaskDefinition: &models.TaskDefinition{Annotation: annotationFor(existingRequest)},
+								}, nil
+							}
+						})
+
+						Context("when the requests are identical", func() {
+							It("returns an Accepted response", func() {
+								Expect(responseRecorder.Code).To(Equal(http.StatusAccepted))
+							})
+
+							It("compares against the existing task", func() {
+								Expect(fakeDiegoClient.TaskByGuidCallCount()).To(Equal(1))
+								_, taskGuid := fakeDiegoClient.TaskByGuidArgsForCall(0)
+								Expect(taskGuid).To(Equal("a-guid"))
+							})
+						})
+
+						Context("when the requests conflict", func() {
+							BeforeEach(func() {
+								existingRequest.MemoryMB = 4096
+								existingRequest.IsolationSegment = "other-segment"
+							})
+
+							It("returns a Conflict naming the differing fields", func() {
+								Expect(responseRecorder.Code).To(Equal(http.StatusConflict))
+
+								var response cc_messages.StagingResponseForCC
+								err := json.NewDecoder(responseRecorder.Body).Decode(&response)
+								Expect(err).NotTo(HaveOccurred())
+								Expect(response.Error).To(Equal(&cc_messages.StagingError{
+									Id:      backend.STAGING_REQUEST_CONFLICT,
+									Message: "staging guid is already in use by a different request; differing fields: isolation_segment, memory_mb",
+								}))
+							})
+						})
+					})
 				})
 
 				Context("create task fails for any other reason", func() {
@@ -130,6 +258,11 @@ var _ = Describe("StagingHandler", func() {
 						Expect(logger).To(gbytes.Say("staging-failed"))
 					})
 
+					It("releases the staging task", func() {
+						Expect(fakeAdmission.ReleaseCallCount()).To(Equal(1))
+						Expect(fakeAdmission.ReleaseArgsForCall(0)).To(Equal("a-staging-guid"))
+					})
+
 					It("returns an internal service error status code", func() {
 						Expect(responseRecorder.Code).To(Equal(http.StatusInternalServerError))
 					})
@@ -139,7 +272,7 @@ var _ = Describe("StagingHandler", func() {
 
 						BeforeEach(func() {
 							responseForCC = cc_messages.StagingResponseForCC{
-								Error: backend.SanitizeErrorMessage(desireError.Error()),
+								Error: backend.AsStagingError(desireError).ToCC(),
 							}
 						})
 
@@ -167,6 +300,26 @@ var _ = Describe("StagingHandler", func() {
 					Expect(logger).To(gbytes.Say("recipe-building-failed"))
 				})
 
+				Context("when the request carries docker credentials", func() {
+					BeforeEach(func() {
+						lifecycleData := json.RawMessage(`{"docker_image":"busybox","docker_user":"user","docker_password":"docker-secret"}`)
+						stagingRequest.LifecycleData = &lifecycleData
+
+						var err error
+						stagingRequestJson, err = json.Marshal(stagingRequest)
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("does not log the password", func() {
+						Expect(logger).To(gbytes.Say("recipe-building-failed"))
+						Expect(logger.(*lagertest.TestLogger).Buffer().Contents()).NotTo(ContainSubstring("docker-secret"))
+					})
+				})
+
+				It("releases the staging task", func() {
+					Expect(fakeAdmission.ReleaseCallCount()).To(Equal(1))
+				})
+
 				It("returns an internal service error status code", func() {
 					Expect(responseRecorder.Code).To(Equal(http.StatusInternalServerError))
 				})
@@ -176,7 +329,7 @@ var _ = Describe("StagingHandler", func() {
 
 					BeforeEach(func() {
 						responseForCC = cc_messages.StagingResponseForCC{
-							Error: backend.SanitizeErrorMessage(buildRecipeError.Error()),
+							Error: backend.AsStagingError(buildRecipeError).ToCC(),
 						}
 					})
 
@@ -189,6 +342,24 @@ var _ = Describe("StagingHandler", func() {
 						Expect(response).To(Equal(responseForCC))
 					})
 				})
+
+				Context("when the error is a typed staging error", func() {
+					BeforeEach(func() {
+						buildRecipeError = backend.NewStagingError(backend.KindInsufficientResources, errors.New("not enough disk on any cell"))
+						fakeBackend.BuildRecipeReturns(&models.TaskDefinition{}, "", "", buildRecipeError)
+					})
+
+					It("maps the error kind directly", func() {
+						var response cc_messages.StagingResponseForCC
+						err := json.NewDecoder(responseRecorder.Body).Decode(&response)
+						Expect(err).NotTo(HaveOccurred())
+
+						Expect(response.Error).To(Equal(&cc_messages.StagingError{
+							Id:      cc_messages.INSUFFICIENT_RESOURCES,
+							Message: "not enough disk on any cell",
+						}))
+					})
+				})
 			})
 		})
 
@@ -311,4 +482,133 @@ var _ = Describe("StagingHandler", func() {
 			})
 		})
 	})
+
+	Describe("StagingStatus", func() {
+		var stagingTask *models.Task
+
+		BeforeEach(func() {
+			stagingTask = &models.Task{
+				TaskGuid:       "a-staging-guid",
+				Domain:         cc_messages.StagingTaskDomain,
+				CellId:         "cell-1",
+				State:          models.Task_Running,
+				CreatedAt:      fakeClock.Now().UnixNano(),
+				TaskDefinition: &models.TaskDefinition{Annotation: `{"lifecycle": "fake-backend"}`},
+			}
+			fakeClock.Increment(90 * time.Second)
+
+			fakeDiegoClient.TaskByGuidReturns(stagingTask, nil)
+		})
+
+		JustBeforeEach(func() {
+			req, err := http.NewRequest("GET", "/v1/staging/a-staging-guid", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			req.Form = url.Values{":staging_guid": {"a-staging-guid"}}
+
+			handler.StagingStatus(responseRecorder, req)
+		})
+
+		decodeStatus := func() handlers.StagingStatusResponse {
+			var status handlers.StagingStatusResponse
+			err := json.NewDecoder(responseRecorder.Body).Decode(&status)
+			Expect(err).NotTo(HaveOccurred())
+			return status
+		}
+
+		It("retrieves the staging task by guid", func() {
+			Expect(fakeDiegoClient.TaskByGuidCallCount()).To(Equal(1))
+			_, task := fakeDiegoClient.TaskByGuidArgsForCall(0)
+			Expect(task).To(Equal("a-staging-guid"))
+		})
+
+		It("returns the status of the staging task", func() {
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(decodeStatus()).To(Equal(handlers.StagingStatusResponse{
+				StagingGuid:    "a-staging-guid",
+				Lifecycle:      "fake-backend",
+				State:          "Running",
+				CellId:         "cell-1",
+				ElapsedSeconds: 90,
+			}))
+		})
+
+		Context("when the task has failed", func() {
+			var sanitizedError *cc_messages.StagingError
+
+			BeforeEach(func() {
+				stagingTask.State = models.Task_Completed
+				stagingTask.Failed = true
+				stagingTask.FailureReason = "something internal"
+				stagingTask.FirstCompletedAt = stagingTask.CreatedAt + int64(30*time.Second)
+
+				sanitizedError = &cc_messages.StagingError{Id: cc_messages.STAGING_ERROR, Message: "staging failed"}
+				fakeBackend.BuildStagingResponseReturns(cc_messages.StagingResponseForCC{Error: sanitizedError}, nil)
+			})
+
+			It("runs the failure reason through the backend", func() {
+				Expect(fakeBackend.BuildStagingResponseCallCount()).To(Equal(1))
+				taskResponse := fakeBackend.BuildStagingResponseArgsForCall(0)
+				Expect(taskResponse.Failed).To(BeTrue())
+				Expect(taskResponse.FailureReason).To(Equal("something internal"))
+			})
+
+			It("returns the sanitized failure reason and the time it took to complete", func() {
+				status := decodeStatus()
+				Expect(status.State).To(Equal("Completed"))
+				Expect(status.FailureReason).To(Equal(sanitizedError))
+				Expect(status.ElapsedSeconds).To(BeEquivalentTo(30))
+			})
+		})
+
+		Context("when the task is not found", func() {
+			BeforeEach(func() {
+				fakeDiegoClient.TaskByGuidReturns(nil, models.ErrResourceNotFound)
+			})
+
+			It("returns StatusNotFound", func() {
+				Expect(responseRecorder.Code).To(Equal(http.StatusNotFound))
+			})
+		})
+
+		Context("when retrieving the task fails", func() {
+			BeforeEach(func() {
+				fakeDiegoClient.TaskByGuidReturns(nil, errors.New("boom"))
+			})
+
+			It("returns StatusInternalServerError", func() {
+				Expect(responseRecorder.Code).To(Equal(http.StatusInternalServerError))
+			})
+		})
+
+		Context("when the task is not a staging task", func() {
+			BeforeEach(func() {
+				stagingTask.Domain = "some-other-domain"
+			})
+
+			It("returns StatusNotFound", func() {
+				Expect(responseRecorder.Code).To(Equal(http.StatusNotFound))
+			})
+		})
+
+		Context("when the task annotation fails to unmarshal", func() {
+			BeforeEach(func() {
+				stagingTask.Annotation = `"fake-backend"}`
+			})
+
+			It("returns StatusInternalServerError", func() {
+				Expect(responseRecorder.Code).To(Equal(http.StatusInternalServerError))
+			})
+		})
+
+		Context("when the lifecycle has no backend", func() {
+			BeforeEach(func() {
+				stagingTask.Annotation = `{"lifecycle": "unknown"}`
+			})
+
+			It("returns StatusNotFound", func() {
+				Expect(responseRecorder.Code).To(Equal(http.StatusNotFound))
+			})
+		})
+	})
 })
@@ -0,0 +1,295 @@
+package mutual_tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/stager"
+	"code.cloudfoundry.org/stager/handlers"
+)
+
+// DefaultReloadInterval is how often the certificate files are checked for
+// changes.
+const DefaultReloadInterval = time.Minute
+
+// Config enables TLS on the stager's listener when ServerCert is set. Clients
+// must present a certificate signed by CACert. A client's identities are the
+// common name and the DNS and URI subject alternative names of its
+// certificate; CC routes are limited to CCClientIdentities and the completion
+// callback to BBSClientIdentities. An empty list allows any client the CA
+// vouches for.
+//
+// The completion callback is made by the BBS's task callback client, so the
+// BBS must be given a client certificate signed by CACert, and must trust
+// ServerCert, for callbacks to be delivered. The stager's callback URL must
+// then be https.
+//
+// Cells download the docker credentials of staging tasks without a client
+// certificate, so the stager serves them on a listener of its own, at
+// DockerCredentialsListenAddress, which staging tasks reach at
+// DockerCredentialsURL. That listener serves nothing else.
+type Config struct {
+	CACert              string   `json:"ca_cert"`
+	ServerCert          string   `json:"server_cert"`
+	ServerKey           string   `json:"server_key"`
+	CCClientIdentities  []string `json:"cc_client_identities"`
+	BBSClientIdentities []string `json:"bbs_client_identities"`
+
+	DockerCredentialsListenAddress string `json:"docker_credentials_listen_addr"`
+	DockerCredentialsURL           string `json:"docker_credentials_url"`
+}
+
+func (c Config) Enabled() bool {
+	return c.ServerCert != ""
+}
+
+// Validate checks that the certificate files can be loaded.
+func (c Config) Validate() error {
+	_, err := load(c)
+	return err
+}
+
+func (c Config) files() []string {
+	return []string{c.CACert, c.ServerCert, c.ServerKey}
+}
+
+// Credentials holds the TLS configuration of the listener and checks the
+// identity of each client against the route it calls. Certificates can be
+// replaced while the listener is serving: new handshakes use them while
+// existing connections carry on.
+type Credentials struct {
+	logger       lager.Logger
+	clock        clock.Clock
+	pollInterval time.Duration
+
+	updateLock sync.Mutex
+	current    atomic.Value
+}
+
+type credentials struct {
+	config                     Config
+	tlsConfig                  *tls.Config
+	dockerCredentialsTLSConfig *tls.Config
+	modTimes                   []time.Time
+}
+
+var _ handlers.Authorizer = (*Credentials)(nil)
+
+func New(logger lager.Logger, config Config, clock clock.Clock, pollInterval time.Duration) (*Credentials, error) {
+	loaded, err := load(config)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Credentials{
+		logger:       logger.Session("mutual-tls"),
+		clock:        clock,
+		pollInterval: pollInterval,
+	}
+	c.current.Store(loaded)
+
+	return c, nil
+}
+
+// TLSConfig returns the configuration to serve with. It hands out the
+// current certificates on every handshake.
+func (c *Credentials) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return c.load().tlsConfig, nil
+		},
+	}
+}
+
+// DockerCredentialsTLSConfig returns the configuration to serve docker
+// credentials with. It uses the same certificates as TLSConfig but does not
+// ask clients for theirs.
+func (c *Credentials) DockerCredentialsTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return c.load().dockerCredentialsTLSConfig, nil
+		},
+	}
+}
+
+// Update replaces the configuration, reading the certificate files again. If
+// they cannot be loaded the current certificates are kept.
+func (c *Credentials) Update(config Config) error {
+	c.updateLock.Lock()
+	defer c.updateLock.Unlock()
+
+	if config.DockerCredentialsListenAddress != c.load().config.DockerCredentialsListenAddress {
+		return errors.New("changing docker_credentials_listen_addr requires a restart")
+	}
+
+	loaded, err := load(config)
+	if err != nil {
+		return err
+	}
+
+	c.current.Store(loaded)
+	return nil
+}
+
+func (c *Credentials) Authorize(route string, request *http.Request) error {
+	if request.TLS == nil || len(request.TLS.PeerCertificates) == 0 {
+		return handlers.NewUnauthorizedError("no client certificate")
+	}
+
+	config := c.load().config
+	allowed := config.CCClientIdentities
+	if route == stager.StagingCompletedRoute {
+		allowed = config.BBSClientIdentities
+	}
+
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	for _, identity := range identities(request.TLS.PeerCertificates[0]) {
+		for _, allowedIdentity := range allowed {
+			if identity == allowedIdentity {
+				return nil
+			}
+		}
+	}
+
+	return handlers.NewForbiddenError(fmt.Sprintf("client certificate is not allowed to use route '%s'", route))
+}
+
+// Run reloads the certificates whenever one of their files changes.
+func (c *Credentials) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	logger := c.logger.Session("run")
+	logger.Info("starting")
+
+	ticker := c.clock.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+
+	close(ready)
+
+	for {
+		select {
+		case <-signals:
+			logger.Info("stopped")
+			return nil
+
+		case <-ticker.C():
+			reloaded, err := c.reloadIfChanged()
+			if err != nil {
+				logger.Error("failed-to-reload-certificates", err)
+			} else if reloaded {
+				logger.Info("reloaded-certificates")
+			}
+		}
+	}
+}
+
+func (c *Credentials) reloadIfChanged() (bool, error) {
+	c.updateLock.Lock()
+	defer c.updateLock.Unlock()
+
+	current := c.load()
+	if sameTimes(modTimes(current.config), current.modTimes) {
+		return false, nil
+	}
+
+	loaded, err := load(current.config)
+	if err != nil {
+		return false, err
+	}
+
+	c.current.Store(loaded)
+	return true, nil
+}
+
+func (c *Credentials) load() *credentials {
+	return c.current.Load().(*credentials)
+}
+
+func load(config Config) (*credentials, error) {
+	if config.CACert == "" || config.ServerCert == "" || config.ServerKey == "" {
+		return nil, errors.New("ca_cert, server_cert and server_key are all required")
+	}
+
+	// read the modification times first so that a file changing while it is
+	// loaded is loaded again
+	times := modTimes(config)
+
+	certificate, err := tls.LoadX509KeyPair(config.ServerCert, config.ServerKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %s", err)
+	}
+
+	caPEM, err := ioutil.ReadFile(config.CACert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %s", err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no PEM certificates found in '%s'", config.CACert)
+	}
+
+	return &credentials{
+		config: config,
+		tlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientCAs,
+			MinVersion:   tls.VersionTLS12,
+		},
+		dockerCredentialsTLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS12,
+		},
+		modTimes: times,
+	}, nil
+}
+
+func identities(certificate *x509.Certificate) []string {
+	ids := []string{}
+	if certificate.Subject.CommonName != "" {
+		ids = append(ids, certificate.Subject.CommonName)
+	}
+	ids = append(ids, certificate.DNSNames...)
+	for _, uri := range certificate.URIs {
+		ids = append(ids, uri.String())
+	}
+	return ids
+}
+
+func modTimes(config Config) []time.Time {
+	times := []time.Time{}
+	for _, path := range config.files() {
+		var modTime time.Time
+		if info, err := os.Stat(path); err == nil {
+			modTime = info.ModTime()
+		}
+		times = append(times, modTime)
+	}
+	return times
+}
+
+func sameTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,13 @@
+package mutual_tls_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestMutualTLS(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Mutual TLS Suite")
+}
@@ -0,0 +1,441 @@
+package mutual_tls_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/stager"
+	"code.cloudfoundry.org/stager/handlers"
+	"code.cloudfoundry.org/stager/mutual_tls"
+	"github.com/tedsuo/ifrit"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+type certificateAuthority struct {
+	certificate *x509.Certificate
+	key         *rsa.PrivateKey
+	pem         []byte
+	serial      int64
+}
+
+func newCertificateAuthority() *certificateAuthority {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "stager-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	certificate, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+
+	return &certificateAuthority{
+		certificate: certificate,
+		key:         key,
+		pem:         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		serial:      1,
+	}
+}
+
+// sign returns the PEM encoded certificate and key for commonName.
+func (ca *certificateAuthority) sign(commonName string, dnsNames ...string) ([]byte, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).NotTo(HaveOccurred())
+
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	Expect(err).NotTo(HaveOccurred())
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func (ca *certificateAuthority) clientCertificate(commonName string, dnsNames ...string) *x509.Certificate {
+	certPEM, _ := ca.sign(commonName, dnsNames...)
+	block, _ := pem.Decode(certPEM)
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	Expect(err).NotTo(HaveOccurred())
+	return certificate
+}
+
+var _ = Describe("MutualTLS", func() {
+	const pollInterval = 10 * time.Second
+
+	var (
+		logger    *lagertest.TestLogger
+		fakeClock *fakeclock.FakeClock
+		dir       string
+		ca        *certificateAuthority
+		cfg       mutual_tls.Config
+	)
+
+	writeFile := func(name string, contents []byte, modTime time.Time) string {
+		path := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(path, contents, 0600)).To(Succeed())
+		Expect(os.Chtimes(path, modTime, modTime)).To(Succeed())
+		return path
+	}
+
+	writeServerCertificate := func(modTime time.Time) {
+		certPEM, keyPEM := ca.sign("stager.service.cf.internal")
+		cfg.ServerCert = writeFile("server.crt", certPEM, modTime)
+		cfg.ServerKey = writeFile("server.key", keyPEM, modTime)
+	}
+
+	servedSerial := func(credentials *mutual_tls.Credentials) func() int64 {
+		return func() int64 {
+			tlsConfig, err := credentials.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+			Expect(err).NotTo(HaveOccurred())
+			certificate, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+			Expect(err).NotTo(HaveOccurred())
+			return certificate.SerialNumber.Int64()
+		}
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+
+		var err error
+		dir, err = ioutil.TempDir("", "mutual-tls")
+		Expect(err).NotTo(HaveOccurred())
+
+		ca = newCertificateAuthority()
+		cfg = mutual_tls.Config{
+			CACert:              writeFile("ca.crt", ca.pem, time.Unix(1000, 0)),
+			CCClientIdentities:  []string{"cloud_controller"},
+			BBSClientIdentities: []string{"bbs.service.cf.internal"},
+		}
+		writeServerCertificate(time.Unix(1000, 0))
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Describe("Config", func() {
+		It("is enabled by a server certificate", func() {
+			Expect(cfg.Enabled()).To(BeTrue())
+			Expect(mutual_tls.Config{}.Enabled()).To(BeFalse())
+		})
+
+		It("requires all the certificate files", func() {
+			cfg.CACert = ""
+			Expect(cfg.Validate()).To(MatchError("ca_cert, server_cert and server_key are all required"))
+		})
+
+		It("rejects a CA file without certificates", func() {
+			cfg.CACert = writeFile("bogus.crt", []byte("bogus"), time.Unix(1000, 0))
+			Expect(cfg.Validate()).To(MatchError(ContainSubstring("no PEM certificates found")))
+		})
+
+		It("rejects a missing key pair", func() {
+			cfg.ServerKey = filepath.Join(dir, "missing.key")
+			_, err := mutual_tls.New(logger, cfg, fakeClock, pollInterval)
+			Expect(err).To(MatchError(ContainSubstring("failed to load server certificate")))
+		})
+	})
+
+	Describe("serving", func() {
+		var (
+			server *httptest.Server
+			client *http.Client
+		)
+
+		newClient := func(certificates ...tls.Certificate) *http.Client {
+			rootCAs := x509.NewCertPool()
+			rootCAs.AppendCertsFromPEM(ca.pem)
+			return &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{
+						RootCAs:      rootCAs,
+						Certificates: certificates,
+					},
+				},
+			}
+		}
+
+		BeforeEach(func() {
+			credentials, err := mutual_tls.New(logger, cfg, fakeClock, pollInterval)
+			Expect(err).NotTo(HaveOccurred())
+
+			server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			}))
+			server.TLS = credentials.TLSConfig()
+			server.StartTLS()
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("accepts clients with a certificate signed by the CA", func() {
+			certPEM, keyPEM := ca.sign("cloud_controller")
+			certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+			Expect(err).NotTo(HaveOccurred())
+			client = newClient(certificate)
+
+			resp, err := client.Get(server.URL)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusTeapot))
+		})
+
+		It("rejects clients without a certificate", func() {
+			client = newClient()
+
+			_, err := client.Get(server.URL)
+			Expect(err).To(HaveOccurred())
+		})
+
+		Describe("the BBS's completion callback", func() {
+			It("is accepted with a certificate signed by the CA", func() {
+				certPEM, keyPEM := ca.sign("bbs.service.cf.internal")
+				certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+				Expect(err).NotTo(HaveOccurred())
+				client = newClient(certificate)
+
+				resp, err := client.Post(server.URL+"/v1/staging/staging-guid/completed", "application/json", nil)
+				Expect(err).NotTo(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusTeapot))
+			})
+
+			It("is rejected without a certificate", func() {
+				client = newClient()
+
+				_, err := client.Post(server.URL+"/v1/staging/staging-guid/completed", "application/json", nil)
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("is rejected with a certificate from another CA", func() {
+				certPEM, keyPEM := newCertificateAuthority().sign("bbs.service.cf.internal")
+				certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+				Expect(err).NotTo(HaveOccurred())
+				client = newClient(certificate)
+
+				_, err = client.Post(server.URL+"/v1/staging/staging-guid/completed", "application/json", nil)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		It("rejects clients with a certificate from another CA", func() {
+			certPEM, keyPEM := newCertificateAuthority().sign("cloud_controller")
+			certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+			Expect(err).NotTo(HaveOccurred())
+			client = newClient(certificate)
+
+			_, err = client.Get(server.URL)
+			Expect(err).To(HaveOccurred())
+		})
+
+		Describe("docker credentials", func() {
+			var credentialsServer *httptest.Server
+
+			BeforeEach(func() {
+				credentials, err := mutual_tls.New(logger, cfg, fakeClock, pollInterval)
+				Expect(err).NotTo(HaveOccurred())
+
+				credentialsServer = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusTeapot)
+				}))
+				credentialsServer.TLS = credentials.DockerCredentialsTLSConfig()
+				credentialsServer.StartTLS()
+			})
+
+			AfterEach(func() {
+				credentialsServer.Close()
+			})
+
+			It("are served to clients without a certificate on their own listener", func() {
+				client = newClient()
+
+				resp, err := client.Get(credentialsServer.URL)
+				Expect(err).NotTo(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusTeapot))
+
+				_, err = client.Get(server.URL)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("Authorize", func() {
+		var credentials *mutual_tls.Credentials
+
+		requestFrom := func(certificate *x509.Certificate) *http.Request {
+			return &http.Request{
+				TLS: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{certificate}},
+			}
+		}
+
+		statusCode := func(err error) int {
+			authErr, ok := err.(*handlers.AuthorizationError)
+			Expect(ok).To(BeTrue())
+			return authErr.StatusCode
+		}
+
+		JustBeforeEach(func() {
+			var err error
+			credentials, err = mutual_tls.New(logger, cfg, fakeClock, pollInterval)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("rejects requests without a client certificate as unauthorized", func() {
+			err := credentials.Authorize(stager.StageRoute, &http.Request{})
+			Expect(statusCode(err)).To(Equal(http.StatusUnauthorized))
+
+			err = credentials.Authorize(stager.StagingCompletedRoute, &http.Request{TLS: &tls.ConnectionState{}})
+			Expect(statusCode(err)).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("allows CC identities on the CC routes only", func() {
+			request := requestFrom(ca.clientCertificate("cloud_controller"))
+
+			Expect(credentials.Authorize(stager.StageRoute, request)).To(Succeed())
+			Expect(credentials.Authorize(stager.StopStagingRoute, request)).To(Succeed())
+			Expect(credentials.Authorize(stager.StagingStatusRoute, request)).To(Succeed())
+
+			err := credentials.Authorize(stager.StagingCompletedRoute, request)
+			Expect(statusCode(err)).To(Equal(http.StatusForbidden))
+		})
+
+		It("allows BBS identities on the completion route only", func() {
+			request := requestFrom(ca.clientCertificate("bbs", "bbs.service.cf.internal"))
+
+			Expect(credentials.Authorize(stager.StagingCompletedRoute, request)).To(Succeed())
+
+			err := credentials.Authorize(stager.StageRoute, request)
+			Expect(statusCode(err)).To(Equal(http.StatusForbidden))
+		})
+
+		Context("when no identities are configured for a route", func() {
+			BeforeEach(func() {
+				cfg.BBSClientIdentities = nil
+			})
+
+			It("allows any client the CA vouches for", func() {
+				request := requestFrom(ca.clientCertificate("anyone"))
+				Expect(credentials.Authorize(stager.StagingCompletedRoute, request)).To(Succeed())
+			})
+		})
+
+		It("uses the identities of an updated config", func() {
+			request := requestFrom(ca.clientCertificate("cloud_controller_ng"))
+			Expect(credentials.Authorize(stager.StageRoute, request)).NotTo(Succeed())
+
+			cfg.CCClientIdentities = []string{"cloud_controller_ng"}
+			Expect(credentials.Update(cfg)).To(Succeed())
+
+			Expect(credentials.Authorize(stager.StageRoute, request)).To(Succeed())
+		})
+	})
+
+	Describe("Update", func() {
+		It("keeps the current certificates if the new ones cannot be loaded", func() {
+			credentials, err := mutual_tls.New(logger, cfg, fakeClock, pollInterval)
+			Expect(err).NotTo(HaveOccurred())
+			serial := servedSerial(credentials)()
+
+			cfg.ServerCert = filepath.Join(dir, "missing.crt")
+			Expect(credentials.Update(cfg)).NotTo(Succeed())
+
+			Expect(servedSerial(credentials)()).To(Equal(serial))
+		})
+
+		It("does not move the docker credentials listener", func() {
+			cfg.DockerCredentialsListenAddress = "0.0.0.0:8891"
+			credentials, err := mutual_tls.New(logger, cfg, fakeClock, pollInterval)
+			Expect(err).NotTo(HaveOccurred())
+
+			cfg.DockerCredentialsListenAddress = "0.0.0.0:8892"
+			Expect(credentials.Update(cfg)).To(MatchError("changing docker_credentials_listen_addr requires a restart"))
+		})
+	})
+
+	Describe("Run", func() {
+		var (
+			credentials *mutual_tls.Credentials
+			process     ifrit.Process
+		)
+
+		BeforeEach(func() {
+			var err error
+			credentials, err = mutual_tls.New(logger, cfg, fakeClock, pollInterval)
+			Expect(err).NotTo(HaveOccurred())
+
+			process = ifrit.Invoke(credentials)
+		})
+
+		AfterEach(func() {
+			process.Signal(os.Interrupt)
+			Eventually(process.Wait()).Should(Receive(BeNil()))
+		})
+
+		It("reloads the certificates when their files change", func() {
+			serial := servedSerial(credentials)()
+
+			writeServerCertificate(time.Unix(2000, 0))
+			fakeClock.WaitForWatcherAndIncrement(pollInterval)
+
+			Eventually(servedSerial(credentials)).ShouldNot(Equal(serial))
+			Eventually(logger).Should(gbytes.Say("reloaded-certificates"))
+		})
+
+		It("does not reload unchanged files", func() {
+			fakeClock.WaitForWatcherAndIncrement(pollInterval)
+			fakeClock.Increment(pollInterval)
+
+			Consistently(logger).ShouldNot(gbytes.Say("reloaded-certificates"))
+		})
+
+		It("keeps serving the current certificates if the changed files are invalid", func() {
+			serial := servedSerial(credentials)()
+
+			writeFile("server.key", []byte("bogus"), time.Unix(2000, 0))
+			fakeClock.WaitForWatcherAndIncrement(pollInterval)
+
+			Eventually(logger).Should(gbytes.Say("failed-to-reload-certificates"))
+			Expect(servedSerial(credentials)()).To(Equal(serial))
+		})
+	})
+})
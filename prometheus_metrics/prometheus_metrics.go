@@ -0,0 +1,101 @@
+package prometheus_metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "stager"
+
+const (
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+)
+
+// These mirror the dropsonde metrics emitted by the stager. They are always
+// recorded and only exposed when a Prometheus listener is configured.
+var (
+	StagingStartRequestsReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "staging_start_requests_received_total",
+		Help:      "Staging requests received from CC.",
+	})
+
+	StagingStopRequestsReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "staging_stop_requests_received_total",
+		Help:      "Stop staging requests received from CC.",
+	})
+
+	StagingRequestsSucceeded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "staging_requests_succeeded_total",
+		Help:      "Staging tasks that completed successfully.",
+	})
+
+	StagingRequestsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "staging_requests_failed_total",
+		Help:      "Staging tasks that failed.",
+	})
+
+	StagingTasksReconciled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "staging_tasks_reconciled_total",
+		Help:      "Completed staging tasks delivered to CC by the reconciler.",
+	})
+
+	StagingCompletionQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "staging_completion_queue_depth",
+		Help:      "Staging results waiting to be redelivered to CC.",
+	})
+
+	StagingTasksInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "staging_tasks_in_flight",
+		Help:      "Staging tasks desired and not yet completed.",
+	})
+
+	stagingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "staging_duration_seconds",
+		Help:      "Time from desiring a staging task to its completion.",
+		Buckets:   prometheus.ExponentialBuckets(5, 2, 10),
+	}, []string{"lifecycle", "stack", "outcome", "error_id"})
+)
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		StagingStartRequestsReceived,
+		StagingStopRequestsReceived,
+		StagingRequestsSucceeded,
+		StagingRequestsFailed,
+		StagingTasksReconciled,
+		StagingCompletionQueueDepth,
+		StagingTasksInFlight,
+		stagingDuration,
+	)
+}
+
+// ObserveStagingDuration records a completed staging task. errorId is the
+// sanitized error id reported to CC and is empty for successful stagings.
+func ObserveStagingDuration(lifecycle, stack, outcome, errorId string, duration time.Duration) {
+	stagingDuration.WithLabelValues(lifecycle, stack, outcome, errorId).Observe(duration.Seconds())
+}
+
+// MetricsPath is the path the metrics are served at.
+const MetricsPath = "/metrics"
+
+// Handler serves the metrics in the Prometheus exposition format at
+// MetricsPath, and nothing on any other path.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	return mux
+}
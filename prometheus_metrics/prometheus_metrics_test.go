@@ -0,0 +1,57 @@
+package prometheus_metrics_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/stager/prometheus_metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PrometheusMetrics", func() {
+	scrape := func() string {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest("GET", "/metrics", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		prometheus_metrics.Handler().ServeHTTP(recorder, request)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+
+		body, err := ioutil.ReadAll(recorder.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return string(body)
+	}
+
+	It("exposes the staging counters and gauges", func() {
+		prometheus_metrics.StagingStartRequestsReceived.Inc()
+		prometheus_metrics.StagingTasksInFlight.Set(3)
+
+		body := scrape()
+		Expect(body).To(ContainSubstring("stager_staging_start_requests_received_total"))
+		Expect(body).To(ContainSubstring("stager_staging_requests_failed_total"))
+		Expect(body).To(ContainSubstring("stager_staging_tasks_in_flight 3"))
+	})
+
+	It("serves nothing on other paths", func() {
+		for _, path := range []string{"/", "/debug/pprof", "/metrics/extra"} {
+			recorder := httptest.NewRecorder()
+			request, err := http.NewRequest("GET", path, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			prometheus_metrics.Handler().ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusNotFound), path)
+		}
+	})
+
+	It("labels staging durations", func() {
+		prometheus_metrics.ObserveStagingDuration("buildpack", "cflinuxfs2", prometheus_metrics.OutcomeFailed, "BuildpackCompileFailed", 42*time.Second)
+
+		body := scrape()
+		Expect(body).To(ContainSubstring(`stager_staging_duration_seconds_count{error_id="BuildpackCompileFailed",lifecycle="buildpack",outcome="failed",stack="cflinuxfs2"} 1`))
+		Expect(body).To(ContainSubstring(`stager_staging_duration_seconds_sum{error_id="BuildpackCompileFailed",lifecycle="buildpack",outcome="failed",stack="cflinuxfs2"} 42`))
+	})
+})
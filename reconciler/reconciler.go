@@ -0,0 +1,162 @@
+package reconciler
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/bbs"
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/runtimeschema/metric"
+	"code.cloudfoundry.org/stager/handlers"
+	"code.cloudfoundry.org/stager/prometheus_metrics"
+	"github.com/tedsuo/ifrit"
+)
+
+const (
+	// DefaultGracePeriod is how long a completed task is left to the BBS's own
+	// callback before the reconciler takes over. It is shortened as needed by
+	// GracePeriod to end before the BBS deletes the task.
+	DefaultGracePeriod = 30 * time.Second
+
+	// Metrics
+	reconciledTasksCounter = metric.Counter("StagingTasksReconciled")
+)
+
+type reconciler struct {
+	logger            lager.Logger
+	bbsClient         bbs.Client
+	completionHandler handlers.CompletionHandler
+	clock             clock.Clock
+	interval          time.Duration
+	gracePeriod       time.Duration
+}
+
+// New returns a runner that periodically looks for staging tasks the BBS has
+// completed but whose completion callback was never acknowledged, delivers
+// their results to CC and resolves them.
+func New(
+	logger lager.Logger,
+	bbsClient bbs.Client,
+	completionHandler handlers.CompletionHandler,
+	clock clock.Clock,
+	interval time.Duration,
+	gracePeriod time.Duration,
+) ifrit.Runner {
+	return &reconciler{
+		logger:            logger.Session("reconciler"),
+		bbsClient:         bbsClient,
+		completionHandler: completionHandler,
+		clock:             clock,
+		interval:          interval,
+		gracePeriod:       gracePeriod,
+	}
+}
+
+func (r *reconciler) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	logger := r.logger.Session("run", lager.Data{"interval": r.interval.String()})
+	logger.Info("starting")
+
+	ticker := r.clock.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	close(ready)
+
+	for {
+		select {
+		case <-signals:
+			logger.Info("stopped")
+			return nil
+		case <-ticker.C():
+			r.reconcile(logger)
+		}
+	}
+}
+
+func (r *reconciler) reconcile(logger lager.Logger) {
+	logger = logger.Session("reconcile")
+
+	tasks, err := r.bbsClient.TasksByDomain(logger, cc_messages.StagingTaskDomain)
+	if err != nil {
+		logger.Error("failed-to-fetch-tasks", err)
+		return
+	}
+
+	cutoff := r.clock.Now().Add(-r.gracePeriod)
+
+	for _, task := range tasks {
+		if task.State != models.Task_Completed || task.CompletionCallbackUrl == "" {
+			continue
+		}
+
+		if time.Unix(0, task.FirstCompletedAt).After(cutoff) {
+			continue
+		}
+
+		r.reconcileTask(logger, task)
+	}
+}
+
+func (r *reconciler) reconcileTask(logger lager.Logger, task *models.Task) {
+	logger = logger.Session("task", lager.Data{"task-guid": task.TaskGuid})
+
+	err := r.bbsClient.ResolvingTask(logger, task.TaskGuid)
+	if err != nil {
+		logger.Info("failed-to-mark-task-resolving", lager.Data{"error": err.Error()})
+		return
+	}
+
+	status := r.completionHandler.CompleteTask(logger, &models.TaskCallbackResponse{
+		TaskGuid:      task.TaskGuid,
+		Failed:        task.Failed,
+		FailureReason: task.FailureReason,
+		Result:        task.Result,
+		Annotation:    task.Annotation,
+		CreatedAt:     task.CreatedAt,
+	})
+	if status >= http.StatusBadRequest && status < http.StatusInternalServerError {
+		// CC rejected the result, or it cannot be delivered at all, so
+		// retrying will not help: resolve the task as the BBS would
+		logger.Error("staging-result-rejected", nil, lager.Data{"status": status})
+		r.deleteTask(logger, task)
+		return
+	}
+	if status != http.StatusOK {
+		// the BBS returns resolving tasks to completed once they time out,
+		// so the task will be picked up again on a later pass
+		logger.Info("failed-to-deliver-staging-result", lager.Data{"status": status})
+		return
+	}
+
+	if !r.deleteTask(logger, task) {
+		return
+	}
+
+	reconciledTasksCounter.Increment()
+	prometheus_metrics.StagingTasksReconciled.Inc()
+	logger.Info("reconciled")
+}
+
+func (r *reconciler) deleteTask(logger lager.Logger, task *models.Task) bool {
+	err := r.bbsClient.DeleteTask(logger, task.TaskGuid)
+	if err != nil {
+		logger.Error("failed-to-delete-task", err)
+		return false
+	}
+	return true
+}
+
+// GracePeriod returns the grace period to use given the configured one. The
+// BBS deletes completed tasks expireCompletedTaskTTL after they complete and
+// the reconciler only looks for them every interval, so the grace period is
+// shortened when needed for every task to be looked at before it expires.
+func GracePeriod(configured, expireCompletedTaskTTL, interval time.Duration) time.Duration {
+	latest := expireCompletedTaskTTL - interval
+	if configured > latest {
+		return latest
+	}
+	return configured
+}
@@ -0,0 +1,163 @@
+package reconciler_test
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/bbs/fake_bbs"
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/handlers/fakes"
+	"code.cloudfoundry.org/stager/reconciler"
+	"github.com/tedsuo/ifrit"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reconciler", func() {
+	const interval = 30 * time.Second
+
+	var (
+		fakeBBSClient         *fake_bbs.FakeClient
+		fakeCompletionHandler *fakes.FakeCompletionHandler
+		fakeClock             *fakeclock.FakeClock
+
+		completedTask *models.Task
+		process       ifrit.Process
+	)
+
+	BeforeEach(func() {
+		fakeBBSClient = &fake_bbs.FakeClient{}
+		fakeCompletionHandler = &fakes.FakeCompletionHandler{}
+		fakeCompletionHandler.CompleteTaskReturns(http.StatusOK)
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+
+		completedTask = &models.Task{
+			TaskGuid:         "completed-guid",
+			Domain:           cc_messages.StagingTaskDomain,
+			State:            models.Task_Completed,
+			Result:           `{"result":"stuff"}`,
+			CreatedAt:        fakeClock.Now().Add(-time.Hour).UnixNano(),
+			FirstCompletedAt: fakeClock.Now().Add(-time.Hour).UnixNano(),
+			TaskDefinition: &models.TaskDefinition{
+				Annotation:            `{"lifecycle": "buildpack"}`,
+				CompletionCallbackUrl: "http://stager/v1/staging/completed-guid/completed",
+			},
+		}
+
+		runningTask := &models.Task{
+			TaskGuid:       "running-guid",
+			Domain:         cc_messages.StagingTaskDomain,
+			State:          models.Task_Running,
+			TaskDefinition: &models.TaskDefinition{CompletionCallbackUrl: "http://stager"},
+		}
+
+		recentlyCompletedTask := &models.Task{
+			TaskGuid:         "recent-guid",
+			Domain:           cc_messages.StagingTaskDomain,
+			State:            models.Task_Completed,
+			FirstCompletedAt: fakeClock.Now().UnixNano(),
+			TaskDefinition:   &models.TaskDefinition{CompletionCallbackUrl: "http://stager"},
+		}
+
+		fakeBBSClient.TasksByDomainReturns([]*models.Task{completedTask, runningTask, recentlyCompletedTask}, nil)
+	})
+
+	JustBeforeEach(func() {
+		runner := reconciler.New(lagertest.NewTestLogger("test"), fakeBBSClient, fakeCompletionHandler, fakeClock, interval, reconciler.DefaultGracePeriod)
+		process = ifrit.Invoke(runner)
+		fakeClock.WaitForWatcherAndIncrement(interval)
+	})
+
+	AfterEach(func() {
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive(BeNil()))
+	})
+
+	It("lists the tasks in the staging domain", func() {
+		Eventually(fakeBBSClient.TasksByDomainCallCount).Should(Equal(1))
+		_, domain := fakeBBSClient.TasksByDomainArgsForCall(0)
+		Expect(domain).To(Equal(cc_messages.StagingTaskDomain))
+	})
+
+	It("delivers the result of completed tasks past the grace period", func() {
+		Eventually(fakeCompletionHandler.CompleteTaskCallCount).Should(Equal(1))
+		_, taskResponse := fakeCompletionHandler.CompleteTaskArgsForCall(0)
+		Expect(taskResponse).To(Equal(&models.TaskCallbackResponse{
+			TaskGuid:   "completed-guid",
+			Result:     `{"result":"stuff"}`,
+			Annotation: `{"lifecycle": "buildpack"}`,
+			CreatedAt:  completedTask.CreatedAt,
+		}))
+	})
+
+	It("marks the task resolving before delivering, then deletes it", func() {
+		Eventually(fakeBBSClient.DeleteTaskCallCount).Should(Equal(1))
+		Expect(fakeBBSClient.ResolvingTaskCallCount()).To(Equal(1))
+		_, guid := fakeBBSClient.ResolvingTaskArgsForCall(0)
+		Expect(guid).To(Equal("completed-guid"))
+		_, guid = fakeBBSClient.DeleteTaskArgsForCall(0)
+		Expect(guid).To(Equal("completed-guid"))
+	})
+
+	Context("when the task is already being resolved", func() {
+		BeforeEach(func() {
+			fakeBBSClient.ResolvingTaskReturns(models.ErrInvalidStateTransition)
+		})
+
+		It("leaves it alone", func() {
+			Eventually(fakeBBSClient.ResolvingTaskCallCount).Should(Equal(1))
+			Consistently(fakeCompletionHandler.CompleteTaskCallCount).Should(Equal(0))
+		})
+	})
+
+	Context("when delivering the result fails", func() {
+		BeforeEach(func() {
+			fakeCompletionHandler.CompleteTaskReturns(http.StatusServiceUnavailable)
+		})
+
+		It("does not delete the task", func() {
+			Eventually(fakeCompletionHandler.CompleteTaskCallCount).Should(Equal(1))
+			Consistently(fakeBBSClient.DeleteTaskCallCount).Should(Equal(0))
+		})
+	})
+
+	Context("when CC rejects the result", func() {
+		BeforeEach(func() {
+			fakeCompletionHandler.CompleteTaskReturns(http.StatusUnprocessableEntity)
+		})
+
+		It("deletes the task instead of retrying forever", func() {
+			Eventually(fakeBBSClient.DeleteTaskCallCount).Should(Equal(1))
+			_, guid := fakeBBSClient.DeleteTaskArgsForCall(0)
+			Expect(guid).To(Equal("completed-guid"))
+		})
+	})
+
+	Context("when listing tasks fails", func() {
+		BeforeEach(func() {
+			fakeBBSClient.TasksByDomainReturns(nil, errors.New("boom"))
+		})
+
+		It("tries again on the next tick", func() {
+			Eventually(fakeBBSClient.TasksByDomainCallCount).Should(Equal(1))
+			fakeClock.Increment(interval)
+			Eventually(fakeBBSClient.TasksByDomainCallCount).Should(Equal(2))
+		})
+	})
+})
+
+var _ = Describe("GracePeriod", func() {
+	It("keeps a grace period that ends in time", func() {
+		Expect(reconciler.GracePeriod(30*time.Second, 120*time.Second, 30*time.Second)).To(Equal(30 * time.Second))
+	})
+
+	It("shortens the grace period so the task is looked at before the BBS expires it", func() {
+		Expect(reconciler.GracePeriod(100*time.Second, 120*time.Second, 30*time.Second)).To(Equal(90 * time.Second))
+	})
+})
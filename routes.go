@@ -3,13 +3,17 @@ package stager
 import "github.com/tedsuo/rata"
 
 const (
-	StageRoute            = "Stage"
-	StopStagingRoute      = "StopStaging"
-	StagingCompletedRoute = "StagingCompleted"
+	StageRoute             = "Stage"
+	StopStagingRoute       = "StopStaging"
+	StagingCompletedRoute  = "StagingCompleted"
+	StagingStatusRoute     = "StagingStatus"
+	DockerCredentialsRoute = "DockerCredentials"
 )
 
 var Routes = rata.Routes{
 	{Path: "/v1/staging/:staging_guid", Method: "PUT", Name: StageRoute},
 	{Path: "/v1/staging/:staging_guid", Method: "DELETE", Name: StopStagingRoute},
 	{Path: "/v1/staging/:staging_guid/completed", Method: "POST", Name: StagingCompletedRoute},
+	{Path: "/v1/staging/:staging_guid", Method: "GET", Name: StagingStatusRoute},
+	{Path: "/v1/staging/:staging_guid/docker_credentials", Method: "GET", Name: DockerCredentialsRoute},
 }
@@ -0,0 +1,215 @@
+package staging_progress
+
+import (
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/bbs"
+	"code.cloudfoundry.org/bbs/events"
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/cc_client"
+	"github.com/tedsuo/ifrit"
+)
+
+const (
+	// DefaultRetryInterval is how long the reporter waits before trying
+	// again after losing its lock or the BBS event stream.
+	DefaultRetryInterval = 5 * time.Second
+
+	// DefaultQueueSize is how many updates may wait to be sent to CC. Updates
+	// arriving while the queue is full are dropped.
+	DefaultQueueSize = 1000
+)
+
+type update struct {
+	taskGuid string
+	progress cc_client.StagingProgress
+}
+
+type reporter struct {
+	logger        lager.Logger
+	bbsClient     bbs.Client
+	ccClient      cc_client.CcClient
+	lock          ifrit.Runner
+	clock         clock.Clock
+	retryInterval time.Duration
+	queueSize     int
+}
+
+// New returns a runner that watches the BBS task events of the staging domain
+// and forwards the progress of each staging task to CC. Every stager runs it,
+// but only the one holding lock subscribes, so that CC receives each update
+// once. Updates are sent in order from a bounded queue so that a slow CC does
+// not hold up the event stream. Delivery is best effort: the completion
+// callback remains the only authoritative result.
+func New(
+	logger lager.Logger,
+	bbsClient bbs.Client,
+	ccClient cc_client.CcClient,
+	lock ifrit.Runner,
+	clock clock.Clock,
+	retryInterval time.Duration,
+	queueSize int,
+) ifrit.Runner {
+	return &reporter{
+		logger:        logger.Session("staging-progress"),
+		bbsClient:     bbsClient,
+		ccClient:      ccClient,
+		lock:          lock,
+		clock:         clock,
+		retryInterval: retryInterval,
+		queueSize:     queueSize,
+	}
+}
+
+func (r *reporter) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	logger := r.logger.Session("run")
+	logger.Info("starting")
+
+	updates := make(chan update, r.queueSize)
+	done := make(chan struct{})
+	defer close(done)
+	go r.send(logger, updates, done)
+
+	close(ready)
+
+	for {
+		if r.report(logger, signals, updates) {
+			logger.Info("stopped")
+			return nil
+		}
+
+		select {
+		case <-signals:
+			logger.Info("stopped")
+			return nil
+		case <-r.clock.After(r.retryInterval):
+		}
+	}
+}
+
+// report acquires the lock and reports events until the lock is lost, the
+// stream fails or the runner is signalled, returning true in the latter case.
+// The lock is released on return.
+func (r *reporter) report(logger lager.Logger, signals <-chan os.Signal, updates chan<- update) bool {
+	lockProcess := ifrit.Background(r.lock)
+	defer func() {
+		lockProcess.Signal(os.Interrupt)
+		<-lockProcess.Wait()
+	}()
+
+	select {
+	case <-signals:
+		return true
+	case err := <-lockProcess.Wait():
+		logger.Error("failed-to-acquire-lock", err)
+		return false
+	case <-lockProcess.Ready():
+		logger.Info("acquired-lock")
+	}
+
+	return r.subscribe(logger, signals, lockProcess.Wait(), updates)
+}
+
+// subscribe reports events until the stream fails, the lock is lost or the
+// runner is signalled, returning true in the latter case.
+func (r *reporter) subscribe(logger lager.Logger, signals <-chan os.Signal, lockLost <-chan error, updates chan<- update) bool {
+	source, err := r.bbsClient.SubscribeToTaskEvents(logger)
+	if err != nil {
+		logger.Error("failed-to-subscribe-to-task-events", err)
+		return false
+	}
+	defer source.Close()
+
+	eventChan := make(chan models.Event)
+	errChan := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go streamEvents(source, eventChan, errChan, done)
+
+	for {
+		select {
+		case <-signals:
+			return true
+		case err := <-lockLost:
+			logger.Error("lost-lock", err)
+			return false
+		case err := <-errChan:
+			logger.Error("failed-to-read-task-event", err)
+			return false
+		case event := <-eventChan:
+			handleEvent(logger, event, updates)
+		}
+	}
+}
+
+func handleEvent(logger lager.Logger, event models.Event, updates chan<- update) {
+	switch event := event.(type) {
+	case *models.TaskCreatedEvent:
+		if isStagingTask(event.Task) {
+			enqueue(logger, updates, event.Task, cc_client.StagingProgressPending)
+		}
+	case *models.TaskChangedEvent:
+		// cells claim tasks by moving them from pending to running
+		if isStagingTask(event.After) &&
+			event.Before != nil && event.Before.State == models.Task_Pending &&
+			event.After.State == models.Task_Running {
+			enqueue(logger, updates, event.After, cc_client.StagingProgressRunning)
+		}
+	}
+}
+
+func enqueue(logger lager.Logger, updates chan<- update, task *models.Task, state string) {
+	u := update{
+		taskGuid: task.TaskGuid,
+		progress: cc_client.StagingProgress{
+			State:     state,
+			CellId:    task.CellId,
+			UpdatedAt: task.UpdatedAt,
+		},
+	}
+
+	select {
+	case updates <- u:
+	default:
+		logger.Info("dropped-staging-progress", lager.Data{"task-guid": task.TaskGuid, "state": state})
+	}
+}
+
+func (r *reporter) send(logger lager.Logger, updates <-chan update, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case u := <-updates:
+			sendLogger := logger.Session("send", lager.Data{"task-guid": u.taskGuid, "state": u.progress.State})
+			err := r.ccClient.StagingProgress(u.taskGuid, u.progress, sendLogger)
+			if err != nil {
+				sendLogger.Info("failed-to-deliver-staging-progress", lager.Data{"error": err.Error()})
+			}
+		}
+	}
+}
+
+func isStagingTask(task *models.Task) bool {
+	return task != nil && task.Domain == cc_messages.StagingTaskDomain
+}
+
+func streamEvents(source events.EventSource, eventChan chan<- models.Event, errChan chan<- error, done <-chan struct{}) {
+	for {
+		event, err := source.Next()
+		if err != nil {
+			errChan <- err
+			return
+		}
+
+		select {
+		case eventChan <- event:
+		case <-done:
+			return
+		}
+	}
+}
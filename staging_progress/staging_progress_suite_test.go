@@ -0,0 +1,13 @@
+package staging_progress_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestStagingProgress(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Staging Progress Suite")
+}
@@ -0,0 +1,259 @@
+package staging_progress_test
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/bbs/events/eventfakes"
+	"code.cloudfoundry.org/bbs/fake_bbs"
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/cc_client"
+	"code.cloudfoundry.org/stager/cc_client/fakes"
+	"code.cloudfoundry.org/stager/staging_progress"
+	"github.com/tedsuo/ifrit"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("StagingProgress", func() {
+	const retryInterval = 5 * time.Second
+
+	var (
+		logger          *lagertest.TestLogger
+		queueSize       int
+		fakeBBSClient   *fake_bbs.FakeClient
+		fakeEventSource *eventfakes.FakeEventSource
+		fakeCCClient    *fakes.FakeCcClient
+		fakeClock       *fakeclock.FakeClock
+
+		lockAcquired chan struct{}
+		lockErrors   chan error
+		lockRuns     int32
+		fakeLock     ifrit.Runner
+
+		events  chan models.Event
+		process ifrit.Process
+	)
+
+	stagingTask := func(guid string, state models.Task_State) *models.Task {
+		return &models.Task{
+			TaskGuid:  guid,
+			Domain:    cc_messages.StagingTaskDomain,
+			State:     state,
+			CellId:    "cell-id",
+			UpdatedAt: 42,
+		}
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		queueSize = 10
+		events = make(chan models.Event, 10)
+
+		lockAcquired = make(chan struct{})
+		close(lockAcquired)
+		lockErrors = make(chan error, 1)
+		atomic.StoreInt32(&lockRuns, 0)
+		fakeLock = ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+			atomic.AddInt32(&lockRuns, 1)
+			select {
+			case <-signals:
+				return nil
+			case err := <-lockErrors:
+				return err
+			case <-lockAcquired:
+			}
+
+			close(ready)
+
+			select {
+			case <-signals:
+				return nil
+			case err := <-lockErrors:
+				return err
+			}
+		})
+
+		fakeEventSource = &eventfakes.FakeEventSource{}
+		fakeEventSource.NextStub = func() (models.Event, error) {
+			event, ok := <-events
+			if !ok {
+				return nil, errors.New("closed")
+			}
+			return event, nil
+		}
+
+		fakeBBSClient = &fake_bbs.FakeClient{}
+		fakeBBSClient.SubscribeToTaskEventsReturns(fakeEventSource, nil)
+		fakeCCClient = &fakes.FakeCcClient{}
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+	})
+
+	JustBeforeEach(func() {
+		runner := staging_progress.New(logger, fakeBBSClient, fakeCCClient, fakeLock, fakeClock, retryInterval, queueSize)
+		process = ifrit.Invoke(runner)
+	})
+
+	AfterEach(func() {
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive(BeNil()))
+	})
+
+	It("reports created staging tasks as pending", func() {
+		events <- models.NewTaskCreatedEvent(stagingTask("staging-guid", models.Task_Pending))
+
+		Eventually(fakeCCClient.StagingProgressCallCount).Should(Equal(1))
+		guid, progress, _ := fakeCCClient.StagingProgressArgsForCall(0)
+		Expect(guid).To(Equal("staging-guid"))
+		Expect(progress.State).To(Equal(cc_client.StagingProgressPending))
+	})
+
+	It("reports staging tasks claimed by a cell as running", func() {
+		events <- models.NewTaskChangedEvent(
+			stagingTask("staging-guid", models.Task_Pending),
+			stagingTask("staging-guid", models.Task_Running),
+		)
+
+		Eventually(fakeCCClient.StagingProgressCallCount).Should(Equal(1))
+		guid, progress, _ := fakeCCClient.StagingProgressArgsForCall(0)
+		Expect(guid).To(Equal("staging-guid"))
+		Expect(progress).To(Equal(cc_client.StagingProgress{
+			State:     cc_client.StagingProgressRunning,
+			CellId:    "cell-id",
+			UpdatedAt: 42,
+		}))
+	})
+
+	It("ignores other transitions and tasks outside the staging domain", func() {
+		otherTask := stagingTask("other-guid", models.Task_Pending)
+		otherTask.Domain = "other-domain"
+
+		events <- models.NewTaskCreatedEvent(otherTask)
+		events <- models.NewTaskChangedEvent(
+			stagingTask("staging-guid", models.Task_Running),
+			stagingTask("staging-guid", models.Task_Completed),
+		)
+		events <- models.NewTaskCreatedEvent(stagingTask("last-guid", models.Task_Pending))
+
+		Eventually(fakeCCClient.StagingProgressCallCount).Should(Equal(1))
+		Consistently(fakeCCClient.StagingProgressCallCount).Should(Equal(1))
+		guid, _, _ := fakeCCClient.StagingProgressArgsForCall(0)
+		Expect(guid).To(Equal("last-guid"))
+	})
+
+	Context("when CC fails to accept the progress", func() {
+		BeforeEach(func() {
+			fakeCCClient.StagingProgressReturns(errors.New("boom"))
+		})
+
+		It("keeps forwarding events", func() {
+			events <- models.NewTaskCreatedEvent(stagingTask("first-guid", models.Task_Pending))
+			events <- models.NewTaskCreatedEvent(stagingTask("second-guid", models.Task_Pending))
+
+			Eventually(fakeCCClient.StagingProgressCallCount).Should(Equal(2))
+		})
+	})
+
+	Context("when CC is slow", func() {
+		var release chan struct{}
+
+		BeforeEach(func() {
+			queueSize = 1
+			release = make(chan struct{})
+			fakeCCClient.StagingProgressStub = func(string, cc_client.StagingProgress, lager.Logger) error {
+				<-release
+				return nil
+			}
+		})
+
+		AfterEach(func() {
+			close(release)
+		})
+
+		It("keeps reading events and drops the updates that do not fit in the queue", func() {
+			events <- models.NewTaskCreatedEvent(stagingTask("first-guid", models.Task_Pending))
+			Eventually(fakeCCClient.StagingProgressCallCount).Should(Equal(1))
+
+			events <- models.NewTaskCreatedEvent(stagingTask("second-guid", models.Task_Pending))
+			events <- models.NewTaskCreatedEvent(stagingTask("third-guid", models.Task_Pending))
+			Eventually(logger).Should(gbytes.Say("dropped-staging-progress.*third-guid"))
+
+			release <- struct{}{}
+			Eventually(fakeCCClient.StagingProgressCallCount).Should(Equal(2))
+			guid, _, _ := fakeCCClient.StagingProgressArgsForCall(1)
+			Expect(guid).To(Equal("second-guid"))
+		})
+	})
+
+	Context("while another stager holds the lock", func() {
+		BeforeEach(func() {
+			lockAcquired = make(chan struct{})
+		})
+
+		It("does not subscribe until it acquires the lock", func() {
+			Consistently(fakeBBSClient.SubscribeToTaskEventsCallCount).Should(Equal(0))
+
+			close(lockAcquired)
+			Eventually(fakeBBSClient.SubscribeToTaskEventsCallCount).Should(Equal(1))
+		})
+
+		Context("when acquiring the lock fails", func() {
+			It("tries again after the retry interval", func() {
+				lockErrors <- errors.New("boom")
+				Eventually(logger).Should(gbytes.Say("failed-to-acquire-lock"))
+
+				fakeClock.WaitForWatcherAndIncrement(retryInterval)
+				Eventually(func() int32 { return atomic.LoadInt32(&lockRuns) }).Should(Equal(int32(2)))
+			})
+		})
+	})
+
+	Context("when the lock is lost", func() {
+		It("closes the stream and reacquires the lock after the retry interval", func() {
+			Eventually(fakeBBSClient.SubscribeToTaskEventsCallCount).Should(Equal(1))
+			lockErrors <- errors.New("lost")
+
+			Eventually(fakeEventSource.CloseCallCount).Should(Equal(1))
+			Expect(logger).To(gbytes.Say("lost-lock"))
+
+			fakeClock.WaitForWatcherAndIncrement(retryInterval)
+			Eventually(fakeBBSClient.SubscribeToTaskEventsCallCount).Should(Equal(2))
+			Expect(atomic.LoadInt32(&lockRuns)).To(Equal(int32(2)))
+		})
+	})
+
+	Context("when the event stream fails", func() {
+		It("closes the stream and subscribes again after the retry interval", func() {
+			Eventually(fakeBBSClient.SubscribeToTaskEventsCallCount).Should(Equal(1))
+			close(events)
+
+			Eventually(fakeEventSource.CloseCallCount).Should(Equal(1))
+			Consistently(fakeBBSClient.SubscribeToTaskEventsCallCount).Should(Equal(1))
+
+			fakeClock.WaitForWatcherAndIncrement(retryInterval)
+			Eventually(fakeBBSClient.SubscribeToTaskEventsCallCount).Should(Equal(2))
+		})
+	})
+
+	Context("when subscribing fails", func() {
+		BeforeEach(func() {
+			fakeBBSClient.SubscribeToTaskEventsReturns(nil, errors.New("boom"))
+		})
+
+		It("retries after the retry interval", func() {
+			Eventually(fakeBBSClient.SubscribeToTaskEventsCallCount).Should(Equal(1))
+			Consistently(fakeBBSClient.SubscribeToTaskEventsCallCount).Should(Equal(1))
+
+			fakeClock.WaitForWatcherAndIncrement(retryInterval)
+			Eventually(fakeBBSClient.SubscribeToTaskEventsCallCount).Should(Equal(2))
+		})
+	})
+})
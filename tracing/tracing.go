@@ -0,0 +1,91 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "code.cloudfoundry.org/stager"
+	serviceName         = "stager"
+
+	StagingGuidKey = attribute.Key("staging.guid")
+	LifecycleKey   = attribute.Key("staging.lifecycle")
+)
+
+var propagator = propagation.TraceContext{}
+
+func init() {
+	otel.SetTextMapPropagator(propagator)
+}
+
+// Init exports spans over OTLP/HTTP to endpoint, given as host:port. Until it
+// is called spans are not recorded, though incoming trace context is still
+// propagated. The returned function flushes and stops the exporter.
+func Init(logger lager.Logger, endpoint string, insecure bool) (func(context.Context) error, error) {
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	logger.Info("tracing-initialized", lager.Data{"endpoint": endpoint})
+	return provider.Shutdown, nil
+}
+
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// FromRequest returns a context carrying the W3C trace context of an incoming
+// request, if any.
+func FromRequest(req *http.Request) context.Context {
+	return propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+}
+
+// Carrier serializes the trace context of ctx so that it can be stored, for
+// instance in a task annotation. It is nil when ctx carries no trace.
+func Carrier(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// LinkFromCarrier returns a link to the span serialized by Carrier.
+func LinkFromCarrier(carrier map[string]string) (trace.Link, bool) {
+	ctx := propagator.Extract(context.Background(), propagation.MapCarrier(carrier))
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() {
+		return trace.Link{}, false
+	}
+	return trace.Link{SpanContext: spanContext}, true
+}
+
+// RecordError marks span as failed.
+func RecordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
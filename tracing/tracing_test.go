@@ -0,0 +1,46 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+
+	"code.cloudfoundry.org/stager/tracing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tracing", func() {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	Describe("FromRequest", func() {
+		It("honors an incoming W3C traceparent header", func() {
+			req, err := http.NewRequest("PUT", "/v1/staging/some-guid", nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("traceparent", traceparent)
+
+			carrier := tracing.Carrier(tracing.FromRequest(req))
+			Expect(carrier).To(HaveKeyWithValue("traceparent", traceparent))
+		})
+	})
+
+	Describe("Carrier", func() {
+		It("is nil without a trace", func() {
+			Expect(tracing.Carrier(context.Background())).To(BeNil())
+		})
+	})
+
+	Describe("LinkFromCarrier", func() {
+		It("links to the serialized span", func() {
+			link, ok := tracing.LinkFromCarrier(map[string]string{"traceparent": traceparent})
+			Expect(ok).To(BeTrue())
+			Expect(link.SpanContext.TraceID().String()).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+			Expect(link.SpanContext.SpanID().String()).To(Equal("00f067aa0ba902b7"))
+		})
+
+		It("returns false without a trace", func() {
+			_, ok := tracing.LinkFromCarrier(nil)
+			Expect(ok).To(BeFalse())
+		})
+	})
+})